@@ -0,0 +1,225 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"TestProject/apierror"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PeerIDHeader carries the ID of the calling peer on peer-to-peer requests.
+const PeerIDHeader = "X-Peer-ID"
+
+// RunIDHeader carries the ID of the bench or soak run a request is part of.
+const RunIDHeader = "X-Run-ID"
+
+// TokenHeader carries the join token or invite that vouches for the
+// X-Peer-ID of a request.
+const TokenHeader = "X-Join-Token"
+
+// TenantHeader carries the tenant of the calling node, so that the meshes
+// of several tenants sharing a network don't talk to each other.
+const TenantHeader = "X-Tenant"
+
+// tenant is the tenant of this process, empty for none
+var tenant string
+
+// SetTenant sets the tenant this process belongs to. Call it before
+// sending or serving requests.
+func SetTenant(t string) { tenant = t }
+
+// Tenant returns the tenant this process belongs to.
+func Tenant() string { return tenant }
+
+// credential returns what this process presents to vouch for its peer ID
+var credential = func() string { return "" }
+
+// SetCredential sets the join token or invite this process presents with
+// its peer ID. Call it before sending requests.
+func SetCredential(token string) { credential = func() string { return token } }
+
+// SetCredentialFunc is SetCredential for credentials that change, like
+// self-signed invites that expire: f is called for every request.
+func SetCredentialFunc(f func() string) { credential = f }
+
+// Identify marks req to a peer as sent by peerID, of this process' tenant.
+func Identify(req *http.Request, peerID string) {
+	req.Header.Set(PeerIDHeader, peerID)
+	if c := credential(); c != "" {
+		req.Header.Set(TokenHeader, c)
+	}
+	if tenant != "" {
+		req.Header.Set(TenantHeader, tenant)
+	}
+}
+
+// SameTenant reports whether a caller of tenant t may reach this process.
+// Callers that don't name a tenant, like curl or Prometheus, may.
+func SameTenant(t string) bool {
+	return t == "" || t == tenant
+}
+
+var requestsDenied = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "requests_denied_total",
+		Help: "Total number of requests rejected by access control",
+	},
+	[]string{"scope", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(requestsDenied)
+}
+
+// List decides which callers may reach protected endpoints. Deny entries
+// always win; when any allow entry is configured, callers must match one.
+// Peer ID entries only match IDs vouched for by Authenticate, and with
+// deny entries for IDs, callers without one are denied.
+type List struct {
+	// Authenticate, if set, vouches for the peer ID a caller claims with
+	// the token it presents. Without it no ID is vouched for.
+	Authenticate func(peerID, token string) error
+
+	allowIDs  map[string]bool
+	denyIDs   map[string]bool
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+// New builds a list from comma-separated peer IDs and CIDRs. Bare IPs are
+// accepted as single-host networks.
+func New(allowIDs, denyIDs, allowCIDRs, denyCIDRs string) (*List, error) {
+	l := &List{allowIDs: splitSet(allowIDs), denyIDs: splitSet(denyIDs)}
+	var err error
+	if l.allowNets, err = parseNets(allowCIDRs); err != nil {
+		return nil, err
+	}
+	if l.denyNets, err = parseNets(denyCIDRs); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func splitSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+func parseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for v := range splitSet(s) {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesIDs reports whether the list has peer ID entries.
+func (l *List) UsesIDs() bool {
+	return len(l.allowIDs) > 0 || len(l.denyIDs) > 0
+}
+
+// Check reports whether a caller is admitted and, if not, why. peerID is
+// the caller's authenticated ID, empty if it has none.
+func (l *List) Check(peerID string, ip net.IP) (bool, string) {
+	if peerID != "" && l.denyIDs[peerID] {
+		return false, "peer_denied"
+	}
+	if peerID == "" && len(l.denyIDs) > 0 {
+		return false, "unidentified"
+	}
+	if contains(l.denyNets, ip) {
+		return false, "cidr_denied"
+	}
+	if len(l.allowIDs) == 0 && len(l.allowNets) == 0 {
+		return true, ""
+	}
+	if peerID != "" && l.allowIDs[peerID] {
+		return true, ""
+	}
+	if contains(l.allowNets, ip) {
+		return true, ""
+	}
+	return false, "not_allowed"
+}
+
+// Protect wraps next so that denied callers get 403 Forbidden. scope labels
+// the denial metric, e.g. "peer" or "admin".
+func (l *List) Protect(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !SameTenant(r.Header.Get(TenantHeader)) {
+			requestsDenied.WithLabelValues(scope, "tenant").Inc()
+			apierror.Error(w, r, "caller belongs to another tenant", http.StatusForbidden)
+			return
+		}
+		id := l.identify(r)
+		if !l.Admit(scope, id, net.ParseIP(host)) {
+			apierror.Error(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+		if id != "" {
+			r = r.WithContext(context.WithValue(r.Context(), peerKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identify returns the peer ID of r if Authenticate vouches for it
+func (l *List) identify(r *http.Request) string {
+	id := r.Header.Get(PeerIDHeader)
+	if id == "" || l.Authenticate == nil || l.Authenticate(id, r.Header.Get(TokenHeader)) != nil {
+		return ""
+	}
+	return id
+}
+
+type peerKey struct{}
+
+// Peer returns the authenticated peer ID of a request that passed
+// Protect, empty if the caller's ID wasn't vouched for.
+func Peer(r *http.Request) string {
+	id, _ := r.Context().Value(peerKey{}).(string)
+	return id
+}
+
+// Admit is Check for callers outside HTTP, counting denials under scope.
+func (l *List) Admit(scope, peerID string, ip net.IP) bool {
+	ok, reason := l.Check(peerID, ip)
+	if !ok {
+		requestsDenied.WithLabelValues(scope, reason).Inc()
+	}
+	return ok
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/client"
+	"TestProject/clock"
+	"TestProject/delay"
+	"TestProject/dial"
+	"TestProject/features"
+	"TestProject/observability"
+	"TestProject/report"
+	"TestProject/results"
+	"TestProject/rtt"
+	"TestProject/sse"
+	"TestProject/stats"
+	"TestProject/throttle"
+	"TestProject/transfer"
+	"TestProject/wire"
+)
+
+var throttles = throttle.NewTable()
+
+// delays injects latency that grows with load into the traffic endpoints
+var delays = &delay.Injector{}
+
+// LimitRequest sets the bandwidth limits of a peer, in rates ParseRate
+// accepts; an empty rate is unlimited
+type LimitRequest struct {
+	Peer string `json:"peer"`
+	Send string `json:"send"`
+	Recv string `json:"recv"`
+}
+
+// throttleHandler lists (GET), sets (PUT) and removes (DELETE ?peer=) per-peer
+// bandwidth limits, e.g. {"peer":"node-b","send":"1Mbps","recv":"10Mbps"}
+func throttleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(throttles.List())
+	case http.MethodPut, http.MethodPost:
+		var req LimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Peer == "" {
+			apierror.Error(w, r, "expected JSON with peer, send and recv", http.StatusBadRequest)
+			return
+		}
+		send, err := throttle.ParseRate(req.Send)
+		if err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recv, err := throttle.ParseRate(req.Recv)
+		if err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		throttles.Set(throttle.Limit{Peer: req.Peer, Send: send, Recv: recv})
+		faultLog.RecordRun(runOf(r), "throttle", fmt.Sprintf("%s send %s recv %s", req.Peer, rateOrUnlimited(req.Send), rateOrUnlimited(req.Recv)))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		peer := r.URL.Query().Get("peer")
+		if peer == "" {
+			apierror.Error(w, r, "missing peer", http.StatusBadRequest)
+			return
+		}
+		throttles.Set(throttle.Limit{Peer: peer})
+		faultLog.RecordRun(runOf(r), "unthrottle", peer)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// delayHandler shows (GET), sets (PUT) and removes (DELETE) the delay
+// profile of the traffic endpoints, e.g. {"profile":"queue:base=5ms,capacity=50"}
+func delayHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		profile := ""
+		if p := delays.Profile(); p != nil {
+			profile = p.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Profile  string `json:"profile"`
+			InFlight int    `json:"in_flight"`
+		}{profile, delays.InFlight()})
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Profile string `json:"profile"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Profile == "" {
+			apierror.Error(w, r, "expected JSON with a profile", http.StatusBadRequest)
+			return
+		}
+		p, err := delay.Parse(req.Profile)
+		if err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		delays.Set(p)
+		faultLog.RecordRun(runOf(r), "delay", p.String())
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delays.Set(nil)
+		faultLog.RecordRun(runOf(r), "undelay", "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runOf returns the run a request is part of: the run named by the
+// caller, or else the node's own
+func runOf(r *http.Request) string {
+	if id := r.Header.Get(acl.RunIDHeader); id != "" {
+		return id
+	}
+	return *runID
+}
+
+func rateOrUnlimited(rate string) string {
+	if rate == "" {
+		return "unlimited"
+	}
+	return rate
+}
+
+// gossipHandler publishes the request body on ?topic= to the whole mesh
+func gossipHandler(w http.ResponseWriter, r *http.Request) {
+	if pubsub == nil {
+		apierror.Error(w, r, "pubsub is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		apierror.Error(w, r, "missing topic", http.StatusBadRequest)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, wire.MaxFrameSize/2))
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := pubsub.Publish(r.Context(), topic, payload)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+// soakHandler returns the self-reports of the running soak test
+func soakHandler(w http.ResponseWriter, r *http.Request) {
+	if soakRun == nil {
+		apierror.Error(w, r, "soak mode is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(soakRun.Reports())
+}
+
+// peerRTTHandler returns the RTT history to a peer:
+// GET /v1/peers/{id}/rtt?window=1h&step=1m[&transport=http]
+func peerRTTHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, apiVersion), "/peers/")
+	id := strings.TrimSuffix(rest, "/rtt")
+	if id == rest || id == "" || strings.Contains(id, "/") {
+		apierror.Error(w, r, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rttHistory == nil {
+		apierror.Error(w, r, "RTT history is disabled", http.StatusNotFound)
+		return
+	}
+	if _, known := registry.Get(id); !known && !rttHistory.Has(id) {
+		apierror.Error(w, r, "unknown peer "+id, http.StatusNotFound)
+		return
+	}
+	window, step := time.Hour, time.Duration(0)
+	for name, d := range map[string]*time.Duration{"window": &window, "step": &step} {
+		if v := r.URL.Query().Get(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				apierror.Error(w, r, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			*d = parsed
+		}
+	}
+	series, step, err := rttHistory.Query(id, r.URL.Query().Get("transport"), clock.Now(), window, step)
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Peer   string       `json:"peer"`
+		Window string       `json:"window"`
+		Step   string       `json:"step"`
+		Series []rtt.Series `json:"series"`
+	}{id, window.String(), step.String(), series})
+}
+
+// recentStatsHandler returns the request rate, error rate and latencies of
+// the last minutes: GET /stats/recent?window=5m&step=30s[&route=/ping]
+func recentStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if recentStats == nil {
+		apierror.Error(w, r, "recent stats are disabled", http.StatusNotFound)
+		return
+	}
+	var window, step time.Duration
+	for name, d := range map[string]*time.Duration{"window": &window, "step": &step} {
+		if v := r.URL.Query().Get(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				apierror.Error(w, r, fmt.Sprintf("invalid %s %q", name, v), http.StatusBadRequest)
+				return
+			}
+			*d = parsed
+		}
+	}
+	snap, err := recentStats.Query(r.URL.Query().Get("route"), time.Now(), window, step)
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// HandlerCheck is the verdict of /v1/check on a handler's recent requests
+type HandlerCheck struct {
+	Handler  string        `json:"handler,omitempty"`
+	Window   float64       `json:"window_seconds"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Pass     bool          `json:"pass"`
+	Requests int64         `json:"requests"`
+	Checks   []stats.Check `json:"checks"`
+}
+
+// checkHandler holds the recent requests to ?handler=, or to every route,
+// to the thresholds in the query over ?window= (default a minute). It
+// answers 503 when a threshold is exceeded, so that a script can gate on
+// the status alone.
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if recentStats == nil {
+		apierror.Error(w, r, "recent stats are disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	budget, err := stats.ParseBudget(q)
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window := defaultCheckWindow
+	if v := q.Get("window"); v != "" {
+		if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+			apierror.Error(w, r, fmt.Sprintf("invalid window %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if window > recentStats.Window {
+		window = recentStats.Window
+	}
+	handler := q.Get("handler")
+	now := time.Now()
+	snap, err := recentStats.Query(handler, now, window, recentStats.Resolution)
+	if errors.Is(err, stats.ErrNoRoute) {
+		if !knownRoute(handler) {
+			apierror.Error(w, r, fmt.Sprintf("unknown handler %q", handler), http.StatusBadRequest)
+			return
+		}
+		// A handler without requests in the window spends nothing
+		to := now.Truncate(recentStats.Resolution).Add(recentStats.Resolution)
+		snap = stats.Snapshot{From: to.Add(-window).UTC(), To: to.UTC()}
+	}
+	result := HandlerCheck{Handler: handler, Window: snap.To.Sub(snap.From).Seconds(), From: snap.From, To: snap.To, Requests: snap.Summary.Requests}
+	result.Checks, result.Pass = budget.Check(snap.Summary)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Pass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// defaultCheckWindow is how far back /v1/check looks unless told otherwise
+const defaultCheckWindow = time.Minute
+
+// knownRoute reports whether pattern is a route this node serves
+func knownRoute(pattern string) bool {
+	for _, r := range routes {
+		if r == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsInspectHandler lists the metric families of this node and their
+// series, warning about those over --metrics-series-budget or ?budget=
+func metricsInspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	budget := *seriesBudget
+	if v := r.URL.Query().Get("budget"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apierror.Error(w, r, fmt.Sprintf("invalid budget %q", v), http.StatusBadRequest)
+			return
+		}
+		budget = n
+	}
+	in, err := observability.Inspect(budget)
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(in)
+}
+
+// resultsHandler aggregates the results reported to a collector node
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if resultCollector == nil {
+		apierror.Error(w, r, "collector mode is not enabled", http.StatusNotFound)
+		return
+	}
+	resultCollector.ServeHTTP(w, r)
+}
+
+// resultsResetHandler makes a collector forget all results on DELETE, e.g.
+// between scenarios
+func resultsResetHandler(w http.ResponseWriter, r *http.Request) {
+	if resultCollector == nil {
+		apierror.Error(w, r, "collector mode is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resultCollector.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// broadcastHandler sends the request body as an event to every /events
+// subscriber, with ?id= as the event ID (default: a timestamp)
+func broadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, sse.MaxData))
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := events.Publish(sse.Event{ID: id, Data: string(data)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "subscribers": n})
+}
+
+// transferHandler sends a file (?file=) or generated data (?size=) to
+// ?peer= and returns the result. Repeating a failed request with the same
+// ?id= resumes the transfer.
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	peer, ok := registry.Get(q.Get("peer"))
+	if !ok {
+		apierror.Error(w, r, "unknown peer", http.StatusNotFound)
+		return
+	}
+	if !registry.Supports(peer.ID, features.Transfer) {
+		apierror.Error(w, r, "peer doesn't offer transfer", http.StatusConflict)
+		return
+	}
+	if id := q.Get("id"); id != "" && !transfer.ValidID(id) {
+		apierror.Error(w, r, "id must be 1 to 128 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	t := &transfer.Transfer{
+		ID:        q.Get("id"),
+		Self:      *nodeID,
+		Peer:      peer,
+		ChunkSize: 1 << 20,
+		Retries:   5,
+		Client:    &http.Client{Timeout: time.Minute, Transport: dial.Transport},
+		Throttle:  throttles,
+	}
+	if t.ID == "" {
+		t.ID = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	if v := q.Get("chunk"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil || n <= 0 || n > transfer.MaxChunk {
+			apierror.Error(w, r, fmt.Sprintf("chunk must be between 1 byte and %d bytes", transfer.MaxChunk), http.StatusBadRequest)
+			return
+		}
+		t.ChunkSize = n
+	}
+	if v := q.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apierror.Error(w, r, "invalid retries", http.StatusBadRequest)
+			return
+		}
+		t.Retries = n
+	}
+	if v := q.Get("corrupt"); v != "" {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 1 {
+			apierror.Error(w, r, "corrupt must be a probability between 0 and 1", http.StatusBadRequest)
+			return
+		}
+		t.Corrupt = p
+	}
+	switch {
+	case q.Get("file") != "" && *transferSourceDir == "":
+		apierror.Error(w, r, "sending files needs --transfer-source-dir", http.StatusBadRequest)
+		return
+	case q.Get("file") != "":
+		f, err := transfer.File(*transferSourceDir, q.Get("file"))
+		if err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		t.Source = f
+	case q.Get("size") != "":
+		n, err := parseBytes(q.Get("size"))
+		if err != nil || n < 0 {
+			apierror.Error(w, r, "invalid size", http.StatusBadRequest)
+			return
+		}
+		t.Source = transfer.Generated{Seed: t.ID, Length: n}
+	default:
+		apierror.Error(w, r, "expected file or size", http.StatusBadRequest)
+		return
+	}
+
+	res, err := t.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// reportHandler writes an HTML report of the results collected so far, or
+// of the node's own soak run, with the faults injected on the nodes taking
+// part, and returns where it is served. With ?run= only that run's results
+// are reported, under its ID.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var rs []results.Result
+	var kind string
+	switch {
+	case resultCollector != nil:
+		kind, rs = "collector", resultCollector.Results()
+	case soakRun != nil:
+		kind = "soak"
+		for _, rep := range soakRun.Reports() {
+			rs = append(rs, results.New("soak", *nodeID, rep.Traffic))
+		}
+	default:
+		apierror.Error(w, r, "neither collector nor soak mode is enabled", http.StatusNotFound)
+		return
+	}
+	run := r.URL.Query().Get("run")
+	rs = results.ForRun(rs, run)
+	if len(rs) == 0 {
+		apierror.Error(w, r, "no results to report yet", http.StatusConflict)
+		return
+	}
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		title = "p2p_test " + kind + " run"
+	}
+	id := run
+	if id == "" {
+		id = results.NewRunID(kind)
+	}
+	rep := report.New(id, title, rs)
+	rep.AddFaults(meshFaults(r.Context(), rep))
+	if _, err := reportStore.Save(rep); err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/reports/"+rep.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": rep.ID, "url": "/reports/" + rep.ID})
+}
+
+// meshFaults gathers the faults of this node and of the other nodes in rep
+// during its run; nodes that can't be asked are left out
+func meshFaults(ctx context.Context, rep report.Report) []report.Fault {
+	start, end := rep.Summary.Start, rep.Summary.End
+	faults := faultLog.List(start, end)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for _, n := range rep.Summary.Nodes {
+		peer, ok := registry.Get(n.Node)
+		if n.Node == *nodeID || !ok {
+			continue
+		}
+		more, err := client.New(peer.Addr, *nodeID).FaultEvents(ctx, start, end)
+		if err == nil {
+			faults = append(faults, more...)
+		}
+	}
+	return faults
+}
@@ -0,0 +1,296 @@
+package antientropy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"TestProject/clock"
+	"TestProject/discovery"
+	"TestProject/features"
+	"TestProject/mux"
+	"TestProject/wire"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Protocol is the mux protocol name of sync streams.
+const Protocol = "sync"
+
+// Source is the registry source of peers learned through anti-entropy.
+const Source = "antientropy"
+
+// buckets is the fan-out of the digest tree: a root hash over this many
+// bucket hashes, each covering the entries whose ID hashes into it
+const buckets = 64
+
+var (
+	syncDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "antientropy_sync_duration_seconds",
+			Help:    "Histogram of anti-entropy exchange durations",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+	)
+	syncsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "antientropy_syncs_total",
+			Help: "Total number of anti-entropy exchanges by outcome",
+		},
+		[]string{"result"},
+	)
+	entriesRepaired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "antientropy_entries_repaired_total",
+			Help: "Total number of registry entries added by anti-entropy",
+		},
+	)
+	bucketsDiffering = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "antientropy_buckets_differing",
+			Help:    "Histogram of digest buckets that differed per exchange",
+			Buckets: prometheus.LinearBuckets(0, 8, buckets/8+1),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(syncDuration)
+	prometheus.MustRegister(syncsTotal)
+	prometheus.MustRegister(entriesRepaired)
+	prometheus.MustRegister(bucketsDiffering)
+}
+
+// Syncer periodically reconciles the registry with a random peer. Each side
+// holds the set of known nodes including itself; the exchange compares a
+// root digest first, then per-bucket digests, and only ships the entries
+// of buckets that differ.
+//
+// Entries carry their age: zero for this node and the peers a discovery
+// backend reports, which are known first-hand, and for peers learned
+// through anti-entropy the age of the freshest copy merged. Those expire
+// after TTL, so that a peer every backend dropped disappears from the
+// whole mesh instead of being handed back and forth. Digests cover the ID
+// and whether the entry is past half its TTL, so that a stale copy
+// differs from a fresh one and gets refreshed while somebody still knows
+// the peer first-hand.
+//
+// With the registry requiring join tokens, only peers that presented one
+// to this node, and peers learned from nodes that did, are handed on;
+// sync streams themselves only run between admitted nodes.
+type Syncer struct {
+	Self     wire.PeerInfo
+	Registry *discovery.Registry
+	Mux      *mux.Node
+	MuxPort  int
+	Interval time.Duration
+	TTL      time.Duration
+}
+
+// Run syncs with one random peer every Interval until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := clock.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		peers := s.Registry.With(features.Sync)
+		if len(peers) == 0 {
+			continue
+		}
+		peer := peers[rand.Intn(len(peers))]
+		if err := s.SyncWith(ctx, peer); err != nil {
+			syncsTotal.WithLabelValues("failed").Inc()
+			log.Printf("anti-entropy with %s: %v", peer.ID, err)
+		}
+	}
+}
+
+// ttl is TTL in wall-clock time, which entry ages are measured in
+func (s *Syncer) ttl() time.Duration {
+	return clock.Real(s.TTL)
+}
+
+// entries is the local view: every registered peer plus this node, after
+// expiring the peers no node had word of for TTL
+func (s *Syncer) entries() []wire.PeerInfo {
+	now := time.Now()
+	if expired := s.Registry.Expire(Source, now.Add(-s.ttl())); len(expired) > 0 {
+		log.Printf("anti-entropy: expired %s", strings.Join(expired, ", "))
+	}
+	peers := s.Registry.List()
+	out := make([]wire.PeerInfo, 0, len(peers)+1)
+	self := s.Self
+	self.AgeMillis = 0
+	out = append(out, self)
+	for _, p := range peers {
+		if p.Source != Source && !s.Registry.Admitted(p.ID) {
+			continue
+		}
+		e := wire.PeerInfo{ID: p.ID, Addr: p.Addr}
+		if p.Source == Source {
+			e.AgeMillis = uint64(now.Sub(p.Seen) / time.Millisecond)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func bucketOf(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % buckets)
+}
+
+// digests returns the root hash followed by the bucket hashes. Addresses
+// are left out, because nodes may know a peer by different ones.
+func digests(entries []wire.PeerInfo, ttl time.Duration) []uint64 {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	hs := make([]uint64, buckets+1)
+	for _, e := range entries {
+		b := bucketOf(e.ID) + 1
+		h := fnv.New64a()
+		h.Write([]byte(e.ID))
+		if time.Duration(e.AgeMillis)*time.Millisecond >= ttl/2 {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		// Entries are visited in ID order, so chaining is deterministic
+		hs[b] = hs[b]*1099511628211 ^ h.Sum64()
+	}
+	root := fnv.New64a()
+	for _, h := range hs[1:] {
+		var buf [8]byte
+		for i := range buf {
+			buf[i] = byte(h >> (8 * i))
+		}
+		root.Write(buf[:])
+	}
+	hs[0] = root.Sum64()
+	return hs
+}
+
+func inBuckets(entries []wire.PeerInfo, want map[int]bool) []wire.PeerInfo {
+	var out []wire.PeerInfo
+	for _, e := range entries {
+		if want[bucketOf(e.ID)] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (s *Syncer) merge(entries []wire.PeerInfo) int {
+	now := time.Now()
+	peers := make([]discovery.Peer, 0, len(entries))
+	for _, e := range entries {
+		age := time.Duration(e.AgeMillis) * time.Millisecond
+		if age >= s.ttl() {
+			continue
+		}
+		peers = append(peers, discovery.Peer{ID: e.ID, Addr: e.Addr, Seen: now.Add(-age)})
+	}
+	added := s.Registry.Merge(Source, peers)
+	entriesRepaired.Add(float64(added))
+	return added
+}
+
+var errProtocol = errors.New("unexpected message in sync exchange")
+
+// SyncWith runs one exchange with peer as the initiating side.
+func (s *Syncer) SyncWith(ctx context.Context, peer discovery.Peer) error {
+	start := time.Now()
+	stream, err := s.Mux.Open(ctx, mux.Addr(peer, s.MuxPort), Protocol)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
+
+	local := s.entries()
+	mine := digests(local, s.ttl())
+	if err := stream.Send(&wire.Message{Kind: wire.KindSyncDigest, From: s.Self.ID, Digests: mine[:1]}); err != nil {
+		return err
+	}
+
+	var resp wire.Message
+	if err := stream.Recv(&resp); err != nil {
+		return err
+	}
+	if resp.Kind != wire.KindSyncDigest {
+		return errProtocol
+	}
+	if len(resp.Digests) == 0 {
+		syncsTotal.WithLabelValues("in_sync").Inc()
+		syncDuration.Observe(time.Since(start).Seconds())
+		return nil
+	}
+	if len(resp.Digests) != buckets+1 {
+		return errProtocol
+	}
+
+	diff := make(map[int]bool)
+	var idx []uint64
+	for b := 0; b < buckets; b++ {
+		if resp.Digests[b+1] != mine[b+1] {
+			diff[b] = true
+			idx = append(idx, uint64(b))
+		}
+	}
+	bucketsDiffering.Observe(float64(len(idx)))
+
+	out := &wire.Message{Kind: wire.KindSyncEntries, From: s.Self.ID, Digests: idx, Peers: inBuckets(local, diff)}
+	if err := stream.Send(out); err != nil {
+		return err
+	}
+	if err := stream.Recv(&resp); err != nil {
+		return err
+	}
+	if resp.Kind != wire.KindSyncEntries {
+		return errProtocol
+	}
+	s.merge(resp.Peers)
+
+	syncsTotal.WithLabelValues("repaired").Inc()
+	syncDuration.Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// Serve answers exchanges initiated by peers.
+func (s *Syncer) Serve(stream *mux.Stream) {
+	stream.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var req wire.Message
+	if err := stream.Recv(&req); err != nil || req.Kind != wire.KindSyncDigest || len(req.Digests) != 1 {
+		return
+	}
+	local := s.entries()
+	mine := digests(local, s.ttl())
+	if req.Digests[0] == mine[0] {
+		stream.Send(&wire.Message{Kind: wire.KindSyncDigest, From: s.Self.ID})
+		return
+	}
+	if err := stream.Send(&wire.Message{Kind: wire.KindSyncDigest, From: s.Self.ID, Digests: mine}); err != nil {
+		return
+	}
+
+	if err := stream.Recv(&req); err != nil || req.Kind != wire.KindSyncEntries {
+		return
+	}
+	diff := make(map[int]bool)
+	for _, b := range req.Digests {
+		diff[int(b)] = true
+	}
+	// Reply with the state from before merging so the initiator gets ours
+	stream.Send(&wire.Message{Kind: wire.KindSyncEntries, From: s.Self.ID, Peers: inBuckets(local, diff)})
+	s.merge(req.Peers)
+}
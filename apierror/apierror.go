@@ -0,0 +1,99 @@
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader carries the ID of a request in both directions: a
+// caller may pick it, otherwise the node does and echoes it.
+const RequestIDHeader = "X-Request-ID"
+
+// Problem is the body of every error response, wrapped in {"error": ...}.
+// Code is a stable snake_case name for the failure, such as not_found or
+// checksum_mismatch, that tools can match on instead of the message.
+type Problem struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Response is the JSON document written for an error.
+type Response struct {
+	Error Problem `json:"error"`
+}
+
+// codes names statuses whose code isn't derived from the status text
+var codes = map[int]string{
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusInternalServerError:   "internal",
+	460:                              "checksum_mismatch",
+}
+
+// Code returns the default code for an HTTP status.
+func Code(status int) string {
+	if c, ok := codes[status]; ok {
+		return c
+	}
+	if text := http.StatusText(status); text != "" {
+		return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+	}
+	return "error"
+}
+
+// Error replies to r with message and status, like http.Error.
+func Error(w http.ResponseWriter, r *http.Request, message string, status int) {
+	Write(w, r, status, Problem{Message: message})
+}
+
+// Write replies to r with p and status, filling in the code for the status
+// and the request ID if they are empty.
+func Write(w http.ResponseWriter, r *http.Request, status int, p Problem) {
+	if p.Code == "" {
+		p.Code = Code(status)
+	}
+	if p.RequestID == "" {
+		p.RequestID = r.Header.Get(RequestIDHeader)
+	}
+	h := w.Header()
+	// Headers meant for a successful body don't apply to the error
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{Error: p})
+}
+
+// Parse decodes an error response body written by Write.
+func Parse(body []byte) (Problem, bool) {
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error.Code == "" {
+		return Problem{}, false
+	}
+	return resp.Error, true
+}
+
+// RequestIDs gives every request passing through h an ID, keeping one the
+// caller sent, and returns it in the response headers.
+func RequestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/client"
+	"TestProject/discovery"
+	"TestProject/loadgen"
+	"TestProject/report"
+	"TestProject/results"
+	"TestProject/throttle"
+)
+
+// benchMain runs `bench [flags] host:port...`, generating load against the
+// given nodes for a fixed time and reporting the client-side latencies
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := fs.Duration("duration", 30*time.Second, "how long to generate load")
+	concurrency := fs.Int("concurrency", 8, "requests in flight per target in a closed loop")
+	rate := fs.Float64("rate", 0, "open loop: requests per second sent to each target on a fixed schedule, 0 for a closed loop")
+	maxInFlight := fs.Int("max-in-flight", 10000, "open loop: requests in flight per target beyond which arrivals are counted as overload, 0 for no limit")
+	path := fs.String("path", "/ping", "endpoint to request on every target")
+	mix := fs.String("mix", "", "YAML traffic mix profile of weighted endpoints, overrides --path")
+	peerID := fs.String("peer-id", "bench", "peer ID sent to the targets")
+	recvRate := fs.String("recv-rate", "", "read the responses of each target at most at this bit rate, e.g. 1Mbps, as for /v1/admin/throttle")
+	joinToken := fs.String("join-token", "", "join token or invite vouching for --peer-id to nodes with peer ID access lists")
+	warmup := fs.Duration("warmup", 0, "generate load for this long before measuring")
+	steady := fs.Bool("steady-state", false, "after the warmup, also wait until throughput and median latency settle")
+	steadyTimeout := fs.Duration("steady-state-timeout", time.Minute, "measure anyway if no steady state is reached in this time")
+	steadyTolerance := fs.Float64("steady-state-tolerance", 5, "relative standard deviation in percent below which the last 5 one-second samples count as steady")
+	coCorrect := fs.Bool("co-correct", true, "correct latencies for coordinated omission")
+	coInterval := fs.Duration("co-interval", 0, "expected time between requests of a worker for the correction (default: the median latency)")
+	jsonOut := fs.String("json", "", "write the result to this JSON file")
+	csvOut := fs.String("csv", "", "append the result to this CSV file")
+	reportTo := fs.String("report-to", "", "send the result to the collector node at this host:port")
+	reportDir := fs.String("report-dir", "", "write an HTML report of the run to this directory")
+	reportTitle := fs.String("report-title", "p2p_test bench run", "title of the HTML report")
+	runID := fs.String("run-id", "", "ID of the run, sent to the targets and recorded in results (default: generated)")
+	compare := fs.String("compare", "", "baseline JSON result to compare against; exits with status 3 on regression")
+	latencyTol := fs.Float64("tolerance-latency", 10, "allowed latency increase over the baseline in percent")
+	latencyFloor := fs.Float64("tolerance-latency-ms", 0.1, "allowed latency increase in milliseconds on top of the percentage")
+	errorTol := fs.Float64("tolerance-errors", 1, "allowed error rate increase in percentage points")
+	percentiles := fs.String("compare-percentiles", "p50,p90,p99", "latency percentiles to compare: mean, p50, p90, p99, p99.9, p99.99, max")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags] host:port...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	acl.SetCredential(*joinToken)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *maxInFlight < 0 {
+		fmt.Println("Error: --max-in-flight must not be negative")
+		return 2
+	}
+	recv, err := throttle.ParseRate(*recvRate)
+	if err != nil {
+		fmt.Println("Error: invalid --recv-rate:", err)
+		return 2
+	}
+
+	// Load the baseline up front so a typo doesn't waste a whole run
+	var baseline results.Result
+	tol := results.Tolerance{
+		Latency:            *latencyTol / 100,
+		LatencyFloorMillis: *latencyFloor,
+		ErrorRate:          *errorTol / 100,
+		Percentiles:        strings.Split(*percentiles, ","),
+	}
+	if *compare != "" {
+		var err error
+		baseline, err = results.ReadJSON(*compare)
+		if err != nil {
+			fmt.Println("Error loading baseline:", err)
+			return 1
+		}
+		if _, err := results.Compare(baseline, baseline, tol); err != nil {
+			fmt.Println("Error:", err)
+			return 2
+		}
+		if err := results.Comparable(baseline, *coCorrect && *rate == 0); err != nil {
+			fmt.Println("Error:", err)
+			return 2
+		}
+	}
+
+	var targets []discovery.Peer
+	for _, addr := range fs.Args() {
+		targets = append(targets, discovery.Peer{ID: addr, Addr: addr})
+	}
+	gen := loadgen.New(*peerID, func() []discovery.Peer { return targets }, *path, *concurrency)
+	if *mix != "" {
+		endpoints, err := loadgen.LoadMix(*mix)
+		if err != nil {
+			fmt.Println("Error loading traffic mix:", err)
+			return 1
+		}
+		gen.Mix = endpoints
+	}
+	gen.CorrectOmission = *coCorrect
+	gen.ExpectedInterval = *coInterval
+	gen.Rate = *rate
+	gen.MaxInFlight = *maxInFlight
+	if recv > 0 {
+		gen.Throttle = throttle.NewTable()
+		for _, t := range targets {
+			gen.Throttle.Set(throttle.Limit{Peer: t.ID, Recv: recv})
+		}
+	}
+	if *runID == "" {
+		*runID = results.NewRunID("bench")
+	}
+	gen.RunID = *runID
+	fmt.Printf("run %s\n", *runID)
+	if *reportDir != "" {
+		gen.TimelineInterval = time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gen.Run(ctx)
+
+	start := time.Now()
+	if *warmup > 0 {
+		fmt.Printf("warming up for %s\n", *warmup)
+		time.Sleep(*warmup)
+	}
+	if *steady {
+		sctx, scancel := context.WithTimeout(ctx, *steadyTimeout)
+		if gen.WaitSteady(sctx, time.Second, 5, *steadyTolerance/100) {
+			fmt.Printf("steady state after %s\n", time.Since(start).Round(time.Second))
+		} else {
+			fmt.Printf("no steady state within %s, measuring anyway\n", *steadyTimeout)
+		}
+		scancel()
+	}
+	warmedUp := time.Since(start)
+
+	gen.Snapshot()
+	time.Sleep(*duration)
+	res := results.New("bench", *peerID, gen.Snapshot())
+	res.WarmupSeconds = warmedUp.Seconds()
+	cancel()
+	timeline := gen.Timeline(res.Start)
+
+	printResult(res)
+	if *jsonOut != "" {
+		if err := results.WriteJSON(*jsonOut, res); err != nil {
+			fmt.Println("Error writing results:", err)
+			return 1
+		}
+	}
+	if *csvOut != "" {
+		if err := results.AppendCSV(*csvOut, res); err != nil {
+			fmt.Println("Error writing results:", err)
+			return 1
+		}
+	}
+
+	if *reportDir != "" {
+		path, err := writeBenchReport(*reportDir, *reportTitle, *peerID, res, timeline, fs.Args())
+		if err != nil {
+			fmt.Println("Error writing report:", err)
+			return 1
+		}
+		fmt.Println("report written to", path)
+	}
+	if *reportTo != "" {
+		c := client.New(*reportTo, *peerID)
+		c.RunID = res.RunID
+		if err := c.ReportResult(context.Background(), res); err != nil {
+			fmt.Println("Error reporting results:", err)
+			return 1
+		}
+	}
+
+	if *compare != "" {
+		deltas, err := results.Compare(baseline, res, tol)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return 2
+		}
+		regressed := 0
+		fmt.Printf("\ncompared with %s:\n", *compare)
+		for _, d := range deltas {
+			mark := "  ok  "
+			switch {
+			case d.Regression:
+				mark = "REGR  "
+				regressed++
+			case d.Warning:
+				mark = "WARN  "
+			}
+			fmt.Println(mark + d.String())
+		}
+		if regressed > 0 {
+			fmt.Printf("%d regressions\n", regressed)
+			return 3
+		}
+	}
+	return 0
+}
+
+// writeBenchReport saves the report of a run, with the faults the targets
+// logged meanwhile if they let the bench client ask
+func writeBenchReport(dir, title, peerID string, res results.Result, timeline []loadgen.Point, targets []string) (string, error) {
+	store, err := report.NewStore(dir)
+	if err != nil {
+		return "", err
+	}
+	rep := report.New(res.RunID, title, []results.Result{res})
+	rep.Series = map[string][]loadgen.Point{peerID: timeline}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, addr := range targets {
+		c := client.New(addr, peerID)
+		c.RunID = res.RunID
+		faults, err := c.FaultEvents(ctx, rep.Summary.Start, rep.Summary.End)
+		if err == nil {
+			rep.AddFaults(faults)
+		}
+	}
+	return store.Save(rep)
+}
+
+func printResult(r results.Result) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "target\trequests\trps\tmean\tp50\tp90\tp99\tp99.9\tp99.99\tmax\terrors\t")
+	for _, s := range r.Summaries() {
+		var errs []string
+		for result, n := range s.Errors {
+			errs = append(errs, fmt.Sprintf("%s=%d", result, n))
+		}
+		sort.Strings(errs)
+		name := s.Target
+		if s.Endpoint != "" {
+			name += " " + s.Endpoint
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%s\t\n",
+			name, s.Requests, s.RPS, s.MeanMillis, s.P50Millis, s.P90Millis, s.P99Millis,
+			s.P999Millis, s.P9999Millis, s.MaxMillis, strings.Join(errs, " "))
+	}
+	tw.Flush()
+	switch {
+	case r.Total.COIntervalMillis > 0 && len(r.Endpoints) > 0:
+		fmt.Println("latencies in ms, corrected for coordinated omission per endpoint")
+	case r.Total.COIntervalMillis > 0:
+		fmt.Printf("latencies in ms, corrected for coordinated omission at %.3fms intervals\n", r.Total.COIntervalMillis)
+	default:
+		fmt.Println("latencies in ms")
+	}
+}
@@ -0,0 +1,352 @@
+package blobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/features"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SourceHeader tells where a served blob came from: "local" or the ID of
+// the peer it was fetched from.
+const SourceHeader = "X-Blob-Source"
+
+var (
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blob_requests_total",
+			Help: "Total number of blob reads by result: hit, fetched or miss",
+		},
+		[]string{"result"},
+	)
+	fetchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "blob_fetch_duration_seconds",
+			Help:    "Histogram of time taken to find and fetch a missing blob from peers",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	fetchPeers = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "blob_fetch_peers_asked",
+			Help:    "Histogram of how many peers were asked per lookup of a missing blob",
+			Buckets: []float64{1, 2, 3, 4, 6, 8, 12, 16, 32},
+		},
+	)
+	fetchCorrupt = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blob_fetch_corrupt_total",
+			Help: "Total number of blobs fetched from a peer that didn't match their hash",
+		},
+		[]string{"peer"},
+	)
+	storedBlobs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "blob_store_blobs",
+			Help: "Number of blobs in the local store",
+		},
+	)
+	storedBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "blob_store_bytes",
+			Help: "Total size of the blobs in the local store",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(fetchDuration)
+	prometheus.MustRegister(fetchPeers)
+	prometheus.MustRegister(fetchCorrupt)
+	prometheus.MustRegister(storedBlobs)
+	prometheus.MustRegister(storedBytes)
+}
+
+var validHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Info describes a stored blob.
+type Info struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Store keeps blobs in Dir under their hex SHA-256. A blob missing
+// locally is looked up on up to FetchPeers peers, picked by rendezvous
+// hashing so that every node asks the same peers first, as in a DHT, and
+// kept once it is found.
+type Store struct {
+	Dir        string
+	Self       string
+	Registry   *discovery.Registry
+	FetchPeers int
+	MaxSize    int64
+	Client     *http.Client
+
+	mu       sync.Mutex
+	inflight map[string]*call
+}
+
+// call is a fetch in progress that concurrent readers wait for
+type call struct {
+	done   chan struct{}
+	source string
+	err    error
+}
+
+func NewStore(dir, self string, reg *discovery.Registry, fetchPeers int, maxSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		Dir:        dir,
+		Self:       self,
+		Registry:   reg,
+		FetchPeers: fetchPeers,
+		MaxSize:    maxSize,
+		Client:     &http.Client{Timeout: time.Minute, Transport: dial.Transport},
+		inflight:   make(map[string]*call),
+	}
+	s.count()
+	return s, nil
+}
+
+// ServeHTTP stores the body of PUT /blobs, lists the store on GET /blobs
+// and serves GET /blobs/<hash>, fetching it from peers unless ?local=1.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/blobs"), "/")
+	switch {
+	case hash == "" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		info, err := s.Put(r.Body, "")
+		if err != nil {
+			if errors.Is(err, errTooLarge) {
+				apierror.Write(w, r, http.StatusRequestEntityTooLarge, apierror.Problem{
+					Message: err.Error(),
+					Details: map[string]interface{}{"max_size": s.MaxSize},
+				})
+				return
+			}
+			apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/blobs/"+info.Hash)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	case hash == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.List())
+	case hash != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.serveBlob(w, r, hash)
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Store) serveBlob(w http.ResponseWriter, r *http.Request, hash string) {
+	if !validHash.MatchString(hash) {
+		apierror.Error(w, r, "expected a lowercase hex SHA-256", http.StatusBadRequest)
+		return
+	}
+	source := "local"
+	f, err := os.Open(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) && r.URL.Query().Get("local") == "" {
+		source, err = s.fetch(r.Context(), hash)
+		if err == nil {
+			f, err = os.Open(s.path(hash))
+		}
+	}
+	if err != nil {
+		requests.WithLabelValues("miss").Inc()
+		apierror.Error(w, r, "blob not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if source == "local" {
+		requests.WithLabelValues("hit").Inc()
+	} else {
+		requests.WithLabelValues("fetched").Inc()
+	}
+	w.Header().Set(SourceHeader, source)
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	fi, _ := f.Stat()
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+var errTooLarge = errors.New("blob too large")
+
+// errMismatch is returned by Put for content not matching the expected hash
+var errMismatch = errors.New("content doesn't match its hash")
+
+// Put stores the blob read from r and returns its hash. Unless want is
+// empty the blob is only stored if it hashes to want, so a corrupt copy
+// never replaces a good one.
+func (s *Store) Put(r io.Reader, want string) (Info, error) {
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, s.MaxSize+1))
+	if err != nil {
+		return Info{}, err
+	}
+	if n > s.MaxSize {
+		return Info{}, fmt.Errorf("%w, the limit is %d bytes", errTooLarge, s.MaxSize)
+	}
+	if err := tmp.Close(); err != nil {
+		return Info{}, err
+	}
+	info := Info{Hash: hex.EncodeToString(h.Sum(nil)), Size: n}
+	if want != "" && info.Hash != want {
+		return info, fmt.Errorf("%w: it hashes to %s", errMismatch, info.Hash)
+	}
+	if err := os.Rename(tmp.Name(), s.path(info.Hash)); err != nil {
+		return Info{}, err
+	}
+	s.count()
+	return info, nil
+}
+
+// List returns the blobs in the local store.
+func (s *Store) List() []Info {
+	entries, _ := os.ReadDir(s.Dir)
+	out := []Info{}
+	for _, e := range entries {
+		if !validHash.MatchString(e.Name()) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			out = append(out, Info{Hash: e.Name(), Size: fi.Size()})
+		}
+	}
+	return out
+}
+
+func (s *Store) count() {
+	var n, size int64
+	for _, info := range s.List() {
+		n++
+		size += info.Size
+	}
+	storedBlobs.Set(float64(n))
+	storedBytes.Set(float64(size))
+}
+
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.Dir, hash)
+}
+
+// fetch finds hash on a peer, stores it and returns the peer's ID.
+// Concurrent lookups of the same blob share one fetch, which doesn't fail
+// because the caller that started it went away; each of its requests is
+// bounded by the client's timeout.
+func (s *Store) fetch(ctx context.Context, hash string) (string, error) {
+	s.mu.Lock()
+	c, ok := s.inflight[hash]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		s.inflight[hash] = c
+		go func() {
+			c.source, c.err = s.lookup(context.Background(), hash)
+			s.mu.Lock()
+			delete(s.inflight, hash)
+			s.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	s.mu.Unlock()
+	select {
+	case <-c.done:
+		return c.source, c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *Store) lookup(ctx context.Context, hash string) (string, error) {
+	start := time.Now()
+	peers := Closest(hash, s.Registry.With(features.Blobs), s.FetchPeers)
+	for i, peer := range peers {
+		err := s.fetchFrom(ctx, peer, hash)
+		if err == nil {
+			fetchDuration.Observe(time.Since(start).Seconds())
+			fetchPeers.Observe(float64(i + 1))
+			return peer.ID, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("blobs: fetching %s from %s: %v", hash, peer.ID, err)
+		}
+	}
+	fetchPeers.Observe(float64(len(peers)))
+	return "", os.ErrNotExist
+}
+
+func (s *Store) fetchFrom(ctx context.Context, peer discovery.Peer, hash string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer.Addr+"/blobs/"+hash+"?local=1", nil)
+	if err != nil {
+		return err
+	}
+	acl.Identify(req, s.Self)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if _, err := s.Put(resp.Body, hash); err != nil {
+		if errors.Is(err, errMismatch) {
+			fetchCorrupt.WithLabelValues(peer.ID).Inc()
+		}
+		return err
+	}
+	return nil
+}
+
+// Closest orders peers by rendezvous (highest random weight) hashing of
+// hash and their IDs and returns the first n, or all for n <= 0.
+func Closest(hash string, peers []discovery.Peer, n int) []discovery.Peer {
+	weight := func(p discovery.Peer) string {
+		sum := sha256.Sum256([]byte(hash + "/" + p.ID))
+		return string(sum[:])
+	}
+	sort.Slice(peers, func(i, j int) bool { return weight(peers[i]) > weight(peers[j]) })
+	if n > 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
@@ -0,0 +1,66 @@
+package cardinality
+
+import (
+	"sync"
+	"time"
+)
+
+// Other is the label value shared by the values beyond a Limiter's budget.
+const Other = "other"
+
+// maxLen is the longest value kept as is; longer ones count as Other
+const maxLen = 64
+
+// Limiter bounds the distinct values of a metric label that callers
+// control, like run IDs: the first Max values get their own, later ones
+// share Other until a value goes unused for Idle, which frees its place.
+// OnEvict, if set, is told about freed values, e.g. to delete their
+// series.
+type Limiter struct {
+	Max     int
+	Idle    time.Duration
+	OnEvict func(value string)
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Value returns v if it may have its own label value, else Other.
+func (l *Limiter) Value(v string) string {
+	if v == "" || len(v) > maxLen {
+		return Other
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	if _, ok := l.last[v]; ok {
+		l.last[v] = now
+		l.mu.Unlock()
+		return v
+	}
+	var evicted []string
+	if len(l.last) >= l.Max && l.Idle > 0 {
+		for u, t := range l.last {
+			if now.Sub(t) > l.Idle {
+				delete(l.last, u)
+				evicted = append(evicted, u)
+			}
+		}
+	}
+	admitted := len(l.last) < l.Max
+	if admitted {
+		l.last[v] = now
+	}
+	l.mu.Unlock()
+	if l.OnEvict != nil {
+		for _, u := range evicted {
+			l.OnEvict(u)
+		}
+	}
+	if !admitted {
+		return Other
+	}
+	return v
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/chaos"
+	"TestProject/delay"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/mux"
+	"TestProject/throttle"
+)
+
+// chaosRunner carries out the chaos schedule pushed to this node
+var chaosRunner *chaos.Runner
+
+// partitioned holds the peers a chaos partition cut this node off from
+var partitioned chaos.Cut
+
+// defaultChaosLead is the time a coordinator gives itself to push a
+// schedule before it starts
+const defaultChaosLead = 5 * time.Second
+
+// applyChaos carries out a step of a chaos schedule on this node
+func applyChaos(s chaos.Step) error {
+	switch s.Action {
+	case chaos.Delay:
+		p, err := delay.Parse(s.Profile)
+		if err != nil {
+			return err
+		}
+		delays.Set(p)
+	case chaos.Undelay:
+		delays.Set(nil)
+	case chaos.Throttle:
+		send, err := throttle.ParseRate(s.Send)
+		if err != nil {
+			return err
+		}
+		recv, err := throttle.ParseRate(s.Recv)
+		if err != nil {
+			return err
+		}
+		throttles.Set(throttle.Limit{Peer: s.Peer, Send: send, Recv: recv})
+	case chaos.Unthrottle:
+		throttles.Set(throttle.Limit{Peer: s.Peer})
+	case chaos.Partition:
+		cutOff(chaos.Across(s.Groups, *nodeID))
+	case chaos.Heal:
+		cutOff(nil)
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	return nil
+}
+
+// cutOff hides peers and drops their connections, refusing them until a
+// later partition or heal lets them back
+func cutOff(peers []string) {
+	for _, id := range partitioned.Set(peers) {
+		registry.Unsuppress(id)
+	}
+	for _, id := range peers {
+		p, known := registry.Get(id)
+		registry.Suppress(id)
+		messenger.Forget(id)
+		if known {
+			muxNode.Disconnect(mux.Addr(p, *muxPort))
+		}
+	}
+}
+
+// chaosHandler runs chaos schedules. GET shows this node's schedule and
+// timeline. POST coordinates a schedule: the leader, or the node asked
+// with ?coordinator=self, pushes it to every node with the start in the
+// node's own clock; other nodes redirect to the leader. DELETE cancels the
+// steps not carried out yet on every node, partitioned ones included, and
+// undoes the others. ?scope=local limits POST and DELETE to this node.
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	local := r.URL.Query().Get("scope") == "local"
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chaosRunner.Status())
+	case http.MethodPost, http.MethodPut:
+		var s chaos.Schedule
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&s); err != nil {
+			apierror.Error(w, r, "expected a JSON schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Validate(); err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if local {
+			if s.Start.IsZero() {
+				apierror.Error(w, r, "missing start", http.StatusBadRequest)
+				return
+			}
+			chaosRunner.Load(&s)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if leader := currentLeader(); leader != *nodeID && r.URL.Query().Get("coordinator") != "self" {
+			p, ok := registry.Get(leader)
+			if !ok {
+				apierror.Error(w, r, "leader "+leader+" is unknown", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Location", "http://"+p.Addr+r.URL.RequestURI())
+			apierror.Error(w, r, "the leader "+leader+" coordinates chaos", http.StatusTemporaryRedirect)
+			return
+		}
+		if s.ID == "" {
+			s.ID = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+		if s.Run == "" {
+			s.Run = runOf(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(coordinateChaos(r.Context(), s))
+	case http.MethodDelete:
+		chaosRunner.Cancel()
+		if !local {
+			// A partition hides the peers on the other side, which need
+			// healing most
+			forEachPeer(registry.All(), func(c *http.Client, addr string) {
+				chaosRequest(r.Context(), c, http.MethodDelete, addr, nil)
+			})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ChaosPush is what a coordinator did with a schedule
+type ChaosPush struct {
+	ID          string      `json:"id"`
+	Coordinator string      `json:"coordinator"`
+	Start       time.Time   `json:"start"`
+	Nodes       []ChaosNode `json:"nodes"`
+}
+
+// ChaosNode is one node's copy of a schedule: the difference of its clock
+// to the coordinator's, which its start was corrected by
+type ChaosNode struct {
+	Node           string  `json:"node"`
+	Start          string  `json:"start,omitempty"`
+	OffsetMillis   float64 `json:"clock_offset_ms"`
+	ProbeRTTMillis float64 `json:"probe_rtt_ms,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// coordinateChaos pushes s to this node and every peer, starting after
+// its StartIn on the coordinator's clock
+func coordinateChaos(ctx context.Context, s chaos.Schedule) ChaosPush {
+	lead := time.Duration(s.StartIn)
+	if lead <= 0 {
+		lead = defaultChaosLead
+	}
+	s.Coordinator = *nodeID
+	start := time.Now().Add(lead)
+	push := ChaosPush{ID: s.ID, Coordinator: *nodeID, Start: start}
+
+	own := s
+	own.Start = start
+	chaosRunner.Load(&own)
+	push.Nodes = append(push.Nodes, ChaosNode{Node: *nodeID, Start: start.Format(time.RFC3339Nano)})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	client := &http.Client{Timeout: 3 * time.Second, Transport: dial.Transport}
+	for _, p := range registry.List() {
+		wg.Add(1)
+		go func(id, addr string) {
+			defer wg.Done()
+			n := ChaosNode{Node: id}
+			offset, rtt, err := clockOffset(ctx, client, addr)
+			if err == nil {
+				n.OffsetMillis = float64(offset) / float64(time.Millisecond)
+				n.ProbeRTTMillis = float64(rtt) / float64(time.Millisecond)
+				theirs := s
+				theirs.Start = start.Add(offset)
+				n.Start = theirs.Start.Format(time.RFC3339Nano)
+				_, err = chaosRequest(ctx, client, http.MethodPost, addr, &theirs)
+			}
+			if err != nil {
+				n.Error = err.Error()
+			}
+			mu.Lock()
+			push.Nodes = append(push.Nodes, n)
+			mu.Unlock()
+		}(p.ID, p.Addr)
+	}
+	wg.Wait()
+	sort.Slice(push.Nodes, func(i, j int) bool { return push.Nodes[i].Node < push.Nodes[j].Node })
+	return push
+}
+
+// clockProbes is how many times a peer's clock is read; the reading with
+// the shortest round trip wins
+const clockProbes = 3
+
+// clockOffset estimates how far the clock of the node at addr is ahead of
+// this one, assuming it read its clock halfway through the round trip
+func clockOffset(ctx context.Context, c *http.Client, addr string) (offset, rtt time.Duration, err error) {
+	rtt = -1
+	for i := 0; i < clockProbes; i++ {
+		sent := time.Now()
+		body, err := chaosRequest(ctx, c, http.MethodGet, addr, nil)
+		received := time.Now()
+		if err != nil {
+			return 0, 0, err
+		}
+		var status chaos.Status
+		if err := json.Unmarshal(body, &status); err != nil {
+			return 0, 0, fmt.Errorf("reading the clock: %w", err)
+		}
+		if d := received.Sub(sent); rtt < 0 || d < rtt {
+			rtt = d
+			offset = status.Now.Sub(sent.Add(d / 2))
+		}
+	}
+	return offset, rtt, nil
+}
+
+// chaosRequest calls the chaos endpoint of the node at addr for this node
+// alone
+func chaosRequest(ctx context.Context, c *http.Client, method, addr string, s *chaos.Schedule) ([]byte, error) {
+	var body io.Reader
+	if s != nil {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+apiVersion+"/admin/chaos?scope=local", body)
+	if err != nil {
+		return nil, err
+	}
+	acl.Identify(req, *nodeID)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		if p, ok := apierror.Parse(data); ok {
+			return nil, errors.New(p.Message)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return data, nil
+}
+
+// forEachPeer calls f with the address of every one of peers concurrently
+// and waits for all
+func forEachPeer(peers []discovery.Peer, f func(c *http.Client, addr string)) {
+	var wg sync.WaitGroup
+	client := &http.Client{Timeout: 3 * time.Second, Transport: dial.Transport}
+	for _, p := range peers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			f(client, addr)
+		}(p.Addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,417 @@
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/delay"
+	"TestProject/throttle"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stepsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chaos_steps_total",
+			Help: "Total number of chaos schedule steps carried out per action and result",
+		},
+		[]string{"action", "result"},
+	)
+	stepLateness = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "chaos_step_lateness_seconds",
+			Help:    "Histogram of how late chaos steps were carried out after their planned time",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(stepsTotal)
+	prometheus.MustRegister(stepLateness)
+}
+
+// Actions of schedule steps.
+const (
+	// Delay sets the delay profile of the traffic endpoints to Profile
+	Delay = "delay"
+	// Undelay removes the delay profile
+	Undelay = "undelay"
+	// Throttle limits the bandwidth to Peer to Send and Recv
+	Throttle = "throttle"
+	// Unthrottle removes the limits for Peer
+	Unthrottle = "unthrottle"
+	// Partition cuts the nodes of each of Groups off from the other groups
+	Partition = "partition"
+	// Heal ends the partition
+	Heal = "heal"
+)
+
+// Offset is a time after the start of a schedule, written like "60s",
+// "+60s" or "T+60s" in JSON.
+type Offset time.Duration
+
+func (o Offset) MarshalJSON() ([]byte, error) {
+	return json.Marshal("T+" + time.Duration(o).String())
+}
+
+func (o *Offset) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(strings.TrimPrefix(s, "T"), "+"))
+	if err != nil {
+		return err
+	}
+	*o = Offset(d)
+	return nil
+}
+
+// Step is one fault injected at At after the start, on Node or, if empty,
+// on every node.
+type Step struct {
+	At      Offset     `json:"at"`
+	Node    string     `json:"node,omitempty"`
+	Action  string     `json:"action"`
+	Profile string     `json:"profile,omitempty"`
+	Peer    string     `json:"peer,omitempty"`
+	Send    string     `json:"send,omitempty"`
+	Recv    string     `json:"recv,omitempty"`
+	Groups  [][]string `json:"groups,omitempty"`
+}
+
+// String describes what the step does.
+func (s Step) String() string {
+	switch s.Action {
+	case Delay:
+		return "delay " + s.Profile
+	case Throttle:
+		return fmt.Sprintf("throttle %s send %s recv %s", s.Peer, orUnlimited(s.Send), orUnlimited(s.Recv))
+	case Unthrottle:
+		return "unthrottle " + s.Peer
+	case Partition:
+		var gs []string
+		for _, g := range s.Groups {
+			gs = append(gs, strings.Join(g, ","))
+		}
+		return "partition " + strings.Join(gs, " / ")
+	}
+	return s.Action
+}
+
+func orUnlimited(rate string) string {
+	if rate == "" {
+		return "unlimited"
+	}
+	return rate
+}
+
+// Schedule is the chaos a coordinator pushes to the mesh. Start is in the
+// clock of the node holding the schedule; the coordinator translates it
+// for every node.
+type Schedule struct {
+	ID          string    `json:"id"`
+	Run         string    `json:"run,omitempty"`
+	Coordinator string    `json:"coordinator,omitempty"`
+	StartIn     Offset    `json:"start_in,omitempty"`
+	Start       time.Time `json:"start,omitempty"`
+	Steps       []Step    `json:"steps"`
+}
+
+// Validate checks the steps of a schedule.
+func (s *Schedule) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("no steps")
+	}
+	for i, st := range s.Steps {
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	if s.At < 0 {
+		return errors.New("at must not be negative")
+	}
+	switch s.Action {
+	case Delay:
+		_, err := delay.Parse(s.Profile)
+		return err
+	case Throttle, Unthrottle:
+		if s.Peer == "" {
+			return errors.New(s.Action + " needs a peer")
+		}
+		for _, rate := range []string{s.Send, s.Recv} {
+			if _, err := throttle.ParseRate(rate); err != nil {
+				return err
+			}
+		}
+	case Partition:
+		if len(s.Groups) < 2 {
+			return errors.New("partition needs at least two groups")
+		}
+		seen := make(map[string]bool)
+		for _, g := range s.Groups {
+			for _, id := range g {
+				if seen[id] {
+					return fmt.Errorf("node %s is in two groups", id)
+				}
+				seen[id] = true
+			}
+		}
+	case Undelay, Heal:
+	default:
+		return fmt.Errorf("unknown action %q, want delay, undelay, throttle, unthrottle, partition or heal", s.Action)
+	}
+	return nil
+}
+
+// Entry records a step of the schedule on this node.
+type Entry struct {
+	Step       int       `json:"step"`
+	At         Offset    `json:"at"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail"`
+	Planned    time.Time `json:"planned"`
+	Executed   time.Time `json:"executed,omitempty"`
+	LateMillis float64   `json:"late_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status is the schedule a node holds and its timeline so far.
+type Status struct {
+	Now      time.Time `json:"now"`
+	Schedule *Schedule `json:"schedule,omitempty"`
+	Timeline []Entry   `json:"timeline"`
+}
+
+// Runner carries out the steps of a schedule meant for this node at
+// their planned time.
+type Runner struct {
+	Self string
+	// Apply carries out a step on this node
+	Apply func(s Step) error
+	// Event, if set, is told about every step carried out
+	Event func(run, kind, detail string)
+
+	mu       sync.Mutex
+	schedule *Schedule
+	timeline []Entry
+	cancel   context.CancelFunc
+
+	// applying serializes carrying out steps and undoing them
+	applying sync.Mutex
+	applied  []Step
+}
+
+// For reports whether step s applies to node id.
+func (s Step) For(id string) bool {
+	if s.Node == "" || s.Node == "*" {
+		return true
+	}
+	return s.Node == id
+}
+
+// Load replaces the schedule, cancelling the steps of the previous one
+// that haven't been carried out yet.
+func (r *Runner) Load(s *Schedule) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var timeline []Entry
+	for i, st := range s.Steps {
+		if st.For(r.Self) {
+			timeline = append(timeline, Entry{Step: i + 1, At: st.At, Action: st.Action, Detail: st.String(), Planned: s.Start.Add(time.Duration(st.At))})
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].At < timeline[j].At })
+
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.schedule, r.timeline, r.cancel = s, timeline, cancel
+	r.mu.Unlock()
+	go r.run(ctx, s, len(timeline))
+}
+
+// Cancel drops the steps of the schedule that haven't been carried out
+// and undoes those that have, also of earlier schedules: it removes the
+// delay profile and the limits for throttled peers and heals partitions.
+func (r *Runner) Cancel() {
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	s := r.schedule
+	r.mu.Unlock()
+
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	for _, u := range Undo(r.applied) {
+		err := r.Apply(u)
+		result := "ok"
+		if err != nil {
+			result = "failed"
+		}
+		stepsTotal.WithLabelValues(u.Action, result).Inc()
+		if r.Event != nil && s != nil {
+			detail := fmt.Sprintf("chaos %s cancelled: %s", s.ID, u)
+			if err != nil {
+				detail += " failed: " + err.Error()
+			}
+			r.Event(s.Run, u.Action, detail)
+		}
+	}
+	r.applied = nil
+}
+
+// Undo returns the steps reverting the faults steps, carried out in this
+// order, left in place.
+func Undo(steps []Step) []Step {
+	var undo []Step
+	seen := make(map[string]bool)
+	for i := len(steps) - 1; i >= 0; i-- {
+		st := steps[i]
+		var fault string
+		var u Step
+		switch st.Action {
+		case Delay, Undelay:
+			fault, u = Delay, Step{Action: Undelay}
+		case Throttle, Unthrottle:
+			fault, u = Throttle+" "+st.Peer, Step{Action: Unthrottle, Peer: st.Peer}
+		case Partition, Heal:
+			fault, u = Partition, Step{Action: Heal}
+		default:
+			continue
+		}
+		// Only the latest step of a fault counts, and it may have
+		// reverted it already
+		if !seen[fault] && st.Action != u.Action {
+			undo = append(undo, u)
+		}
+		seen[fault] = true
+	}
+	return undo
+}
+
+func (r *Runner) run(ctx context.Context, s *Schedule, steps int) {
+	for i := 0; i < steps; i++ {
+		r.mu.Lock()
+		e := r.timeline[i]
+		r.mu.Unlock()
+		timer := time.NewTimer(time.Until(e.Planned))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		r.applying.Lock()
+		if ctx.Err() != nil {
+			// Cancelled while the timer fired
+			r.applying.Unlock()
+			return
+		}
+		err := r.Apply(s.Steps[e.Step-1])
+		if err == nil {
+			r.applied = append(r.applied, s.Steps[e.Step-1])
+		}
+		r.applying.Unlock()
+		executed := time.Now()
+		late := executed.Sub(e.Planned)
+		stepLateness.Observe(late.Seconds())
+
+		r.mu.Lock()
+		if r.schedule != s {
+			r.mu.Unlock()
+			return
+		}
+		r.timeline[i].Executed = executed
+		r.timeline[i].LateMillis = float64(late) / float64(time.Millisecond)
+		result := "ok"
+		if err != nil {
+			r.timeline[i].Error = err.Error()
+			result = "failed"
+		}
+		r.mu.Unlock()
+		stepsTotal.WithLabelValues(e.Action, result).Inc()
+		if r.Event != nil {
+			detail := fmt.Sprintf("chaos %s step %d at T+%s: %s", s.ID, e.Step, time.Duration(e.At), e.Detail)
+			if err != nil {
+				detail += " failed: " + err.Error()
+			}
+			r.Event(s.Run, e.Action, detail)
+		}
+	}
+}
+
+// Status returns the schedule and its timeline on this node.
+func (r *Runner) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{Now: time.Now(), Schedule: r.schedule, Timeline: append([]Entry{}, r.timeline...)}
+}
+
+// Cut is the set of peers a partition cut this node off from.
+type Cut struct {
+	mu    sync.Mutex
+	peers map[string]bool
+}
+
+// Set cuts this node off from peers, returning the peers cut before that
+// are no longer.
+func (c *Cut) Set(peers []string) (healed []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := make(map[string]bool)
+	for _, id := range peers {
+		next[id] = true
+	}
+	for id := range c.peers {
+		if !next[id] {
+			healed = append(healed, id)
+		}
+	}
+	c.peers = next
+	return healed
+}
+
+// Has reports whether this node is cut off from peer.
+func (c *Cut) Has(peer string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[peer]
+}
+
+// Across returns the nodes a partition into groups cuts self off from:
+// those in the other groups. A node in no group isn't cut off.
+func Across(groups [][]string, self string) []string {
+	mine := -1
+	for i, g := range groups {
+		for _, id := range g {
+			if id == self {
+				mine = i
+			}
+		}
+	}
+	if mine < 0 {
+		return nil
+	}
+	var others []string
+	for i, g := range groups {
+		if i != mine {
+			others = append(others, g...)
+		}
+	}
+	return others
+}
@@ -0,0 +1,195 @@
+package churn
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"TestProject/clock"
+	"TestProject/discovery"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "churn_events_total",
+			Help: "Total number of simulated churn events by action",
+		},
+		[]string{"action"},
+	)
+	peersDown = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "churn_peers_down",
+			Help: "Number of peers currently disconnected by churn simulation",
+		},
+	)
+	recoverySeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "churn_recovery_seconds",
+			Help:    "Histogram of time from the end of a churn event until the peers answer pings again",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+		},
+		[]string{"action"},
+	)
+	recoveryTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "churn_recovery_timeouts_total",
+			Help: "Total number of churn events the mesh did not recover from in time",
+		},
+		[]string{"action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventsTotal)
+	prometheus.MustRegister(peersDown)
+	prometheus.MustRegister(recoverySeconds)
+	prometheus.MustRegister(recoveryTimeouts)
+}
+
+// Modes of churn simulation.
+const (
+	// Disconnect cuts one random peer off for a while
+	Disconnect = "disconnect"
+	// Restart tears down and rebuilds the node's whole peer subsystem
+	Restart = "restart"
+)
+
+// Churner injects churn events at random, exponentially distributed
+// intervals and measures how long the node takes to recover from each.
+type Churner struct {
+	Mode     string
+	Interval time.Duration // mean time between events
+	Down     time.Duration // how long a disconnected peer stays away
+	Timeout  time.Duration // give up waiting for recovery after this long
+	Registry *discovery.Registry
+
+	// Drop closes every connection to peer
+	Drop func(peer discovery.Peer)
+	// Reset stops peer discovery and connections and starts them afresh
+	Reset func()
+	// Alive reports whether peer answered a ping after since
+	Alive func(peer string, since time.Time) bool
+	// Event, if set, is told about every event injected
+	Event func(kind, detail string)
+}
+
+// Validate checks the mode and durations.
+func (c *Churner) Validate() error {
+	if c.Mode != Disconnect && c.Mode != Restart {
+		return fmt.Errorf("unknown churn mode %q, want %s or %s", c.Mode, Disconnect, Restart)
+	}
+	if c.Interval <= 0 || c.Down < 0 || c.Timeout <= 0 {
+		return fmt.Errorf("churn interval and timeout must be positive")
+	}
+	return nil
+}
+
+// Run injects events until ctx is cancelled.
+func (c *Churner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		wait := time.Duration(rand.ExpFloat64() * float64(c.Interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(wait):
+		}
+
+		switch c.Mode {
+		case Disconnect:
+			peers := c.Registry.List()
+			if len(peers) == 0 {
+				continue
+			}
+			peer := peers[rand.Intn(len(peers))]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.disconnect(ctx, peer)
+			}()
+		case Restart:
+			c.restart(ctx)
+		}
+	}
+}
+
+// disconnect hides peer from the registry and closes its connections, then
+// brings it back after Down
+func (c *Churner) disconnect(ctx context.Context, peer discovery.Peer) {
+	log.Printf("churn: disconnecting %s for %s", peer.ID, c.Down)
+	eventsTotal.WithLabelValues("disconnect").Inc()
+	c.event("disconnect", fmt.Sprintf("%s for %s", peer.ID, c.Down))
+	c.Registry.Suppress(peer.ID)
+	peersDown.Inc()
+	c.Drop(peer)
+
+	select {
+	case <-ctx.Done():
+	case <-clock.After(c.Down):
+	}
+	c.Registry.Unsuppress(peer.ID)
+	peersDown.Dec()
+	log.Printf("churn: reconnecting %s", peer.ID)
+	eventsTotal.WithLabelValues("reconnect").Inc()
+	c.event("reconnect", peer.ID)
+
+	c.awaitRecovery(ctx, Disconnect, []string{peer.ID})
+}
+
+// restart resets the peer subsystem and waits for every peer known before
+// to be rediscovered and reachable again
+func (c *Churner) restart(ctx context.Context) {
+	var ids []string
+	for _, p := range c.Registry.List() {
+		ids = append(ids, p.ID)
+	}
+	log.Printf("churn: restarting peer subsystems with %d peers known", len(ids))
+	eventsTotal.WithLabelValues("restart").Inc()
+	c.event("restart", fmt.Sprintf("%d peers known", len(ids)))
+	c.Reset()
+	c.awaitRecovery(ctx, Restart, ids)
+}
+
+func (c *Churner) event(kind, detail string) {
+	if c.Event != nil {
+		c.Event(kind, detail)
+	}
+}
+
+func (c *Churner) awaitRecovery(ctx context.Context, action string, ids []string) {
+	start := clock.Now()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := clock.After(c.Timeout)
+	for {
+		pending := 0
+		for _, id := range ids {
+			if _, ok := c.Registry.Get(id); !ok || !c.Alive(id, start) {
+				pending++
+			}
+		}
+		if pending == 0 {
+			took := clock.Since(start)
+			recoverySeconds.WithLabelValues(action).Observe(took.Seconds())
+			log.Printf("churn: recovered from %s of %d peers in %s", action, len(ids), took.Round(time.Millisecond))
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			recoveryTimeouts.WithLabelValues(action).Inc()
+			log.Printf("churn: %d of %d peers still missing %s after %s", pending, len(ids), c.Timeout, action)
+			return
+		case <-ticker.C:
+		}
+	}
+}
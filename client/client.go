@@ -0,0 +1,364 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/loadgen"
+	"TestProject/report"
+	"TestProject/results"
+	"TestProject/sse"
+	"TestProject/throttle"
+)
+
+// Call describes one HTTP attempt made by a Client, for Hooks.After.
+type Call struct {
+	Method   string
+	Path     string
+	Attempt  int
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// Hooks instrument a Client. Before can add headers to every request, e.g.
+// for tracing; After sees every attempt, retries included.
+type Hooks struct {
+	Before func(*http.Request)
+	After  func(Call)
+}
+
+// StatusError is returned for a response with an unexpected status.
+// Problem holds the node's structured error, if the body was one.
+type StatusError struct {
+	Code    int
+	Body    string
+	Problem apierror.Problem
+}
+
+func (e *StatusError) Error() string {
+	switch {
+	case e.Problem.Code != "":
+		return fmt.Sprintf("status %d: %s: %s", e.Code, e.Problem.Code, e.Problem.Message)
+	case e.Body == "":
+		return fmt.Sprintf("status %d", e.Code)
+	default:
+		return fmt.Sprintf("status %d: %s", e.Code, e.Body)
+	}
+}
+
+// Client talks to the API of one node. Requests failing with a network
+// error or a 502, 503 or 504 are retried up to Retries times, Backoff
+// apart and doubling; POSTs are never retried.
+//
+// RunID, if set, is sent with every request so that the node can tell
+// the run it belongs to, and is used for RunBench.
+type Client struct {
+	Addr    string
+	PeerID  string
+	RunID   string
+	HTTP    *http.Client
+	Retries int
+	Backoff time.Duration
+	Hooks   Hooks
+}
+
+// New returns a client for the node at addr (host:port) that identifies
+// itself as peerID.
+func New(addr, peerID string) *Client {
+	return &Client{
+		Addr:    addr,
+		PeerID:  peerID,
+		HTTP:    &http.Client{Timeout: 30 * time.Second, Transport: dial.Transport},
+		Retries: 2,
+		Backoff: 100 * time.Millisecond,
+	}
+}
+
+// Ping requests /ping and returns the round-trip time.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := c.do(ctx, http.MethodGet, "/ping", nil, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// ListPeers returns the node's peer registry.
+func (c *Client) ListPeers(ctx context.Context) ([]discovery.Peer, error) {
+	var peers []discovery.Peer
+	err := c.do(ctx, http.MethodGet, "/v1/peers", nil, &peers)
+	return peers, err
+}
+
+// Fault limits the bandwidth between the node and Peer. Send and Recv are
+// bit rates such as "1Mbps" or "512kbps", empty for unlimited.
+type Fault struct {
+	Peer string `json:"peer"`
+	Send string `json:"send"`
+	Recv string `json:"recv"`
+}
+
+// InjectFault throttles the node's traffic with a peer.
+func (c *Client) InjectFault(ctx context.Context, f Fault) error {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, "/v1/admin/throttle", body, nil)
+}
+
+// ClearFault removes the limits on the node's traffic with peer.
+func (c *Client) ClearFault(ctx context.Context, peer string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/admin/throttle?peer="+url.QueryEscape(peer), nil, nil)
+}
+
+// Faults returns the limits in effect on the node.
+func (c *Client) Faults(ctx context.Context) ([]throttle.Limit, error) {
+	var limits []throttle.Limit
+	err := c.do(ctx, http.MethodGet, "/v1/admin/throttle", nil, &limits)
+	return limits, err
+}
+
+// ReportResult sends a bench or soak result to a node running as the
+// collector.
+func (c *Client) ReportResult(ctx context.Context, r results.Result) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/results", body, nil)
+}
+
+// Leave tells the node that the caller is shutting down, so it removes the
+// caller from its registry and, as a collector, stops expecting reports.
+func (c *Client) Leave(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/leave", nil, nil)
+}
+
+// FaultEvents returns the faults injected on the node between since and
+// until; zero times leave that end open.
+func (c *Client) FaultEvents(ctx context.Context, since, until time.Time) ([]report.Fault, error) {
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("since", since.Format(time.RFC3339Nano))
+	}
+	if !until.IsZero() {
+		q.Set("until", until.Format(time.RFC3339Nano))
+	}
+	var faults []report.Fault
+	err := c.do(ctx, http.MethodGet, "/v1/faults?"+q.Encode(), nil, &faults)
+	return faults, err
+}
+
+// BenchOptions configure RunBench. Zero values run a closed loop of 8
+// workers requesting /ping for 10s.
+type BenchOptions struct {
+	Duration    time.Duration
+	Warmup      time.Duration
+	Concurrency int
+	Path        string
+	Mix         []loadgen.Endpoint
+	Rate        float64
+}
+
+// RunBench generates load against the node from this process, like
+// p2p_test bench, and returns the client-side results. The run is
+// identified by RunID, or by a new ID if that is empty.
+func (c *Client) RunBench(ctx context.Context, opts BenchOptions) (results.Result, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Second
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	if opts.Path == "" {
+		opts.Path = "/ping"
+	}
+	targets := []discovery.Peer{{ID: c.Addr, Addr: c.Addr}}
+	gen := loadgen.New(c.PeerID, func() []discovery.Peer { return targets }, opts.Path, opts.Concurrency)
+	gen.Mix = opts.Mix
+	gen.Rate = opts.Rate
+	gen.RunID = c.RunID
+	if gen.RunID == "" {
+		gen.RunID = results.NewRunID("bench")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go gen.Run(ctx)
+	if err := sleep(ctx, opts.Warmup); err != nil {
+		return results.Result{}, err
+	}
+	gen.Snapshot()
+	if err := sleep(ctx, opts.Duration); err != nil {
+		return results.Result{}, err
+	}
+	res := results.New("bench", c.PeerID, gen.Snapshot())
+	res.WarmupSeconds = opts.Warmup.Seconds()
+	return res, nil
+}
+
+// StreamEvents subscribes to /events and calls fn for every event until
+// ctx is cancelled or the node closes the stream.
+func (c *Client) StreamEvents(ctx context.Context, fn func(sse.Event)) error {
+	req, err := c.request(ctx, http.MethodGet, "/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	// The stream outlives any client timeout, ctx ends it
+	hc := *c.HTTP
+	hc.Timeout = 0
+	start := time.Now()
+	resp, err := hc.Do(req)
+	c.observe(req, 1, resp, err, start)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	var ev sse.Event
+	var data []string
+	sc := bufio.NewScanner(resp.Body)
+	// A line holds up to the whole data of an event after its field name
+	sc.Buffer(make([]byte, 4096), sse.MaxData+len("data: \n")+1)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != nil {
+				ev.Data = strings.Join(data, "\n")
+				fn(ev)
+			}
+			ev, data = sse.Event{}, nil
+		case strings.HasPrefix(line, "id:"):
+			ev.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// do sends a request, retrying as described on Client, and decodes a JSON
+// response into out unless it is nil
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	backoff := c.Backoff
+	for attempt := 1; ; attempt++ {
+		req, err := c.request(ctx, method, path, body)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		resp, err := c.HTTP.Do(req)
+		c.observe(req, attempt, resp, err, start)
+		if err == nil {
+			if resp.StatusCode < 300 {
+				defer resp.Body.Close()
+				if out == nil {
+					io.Copy(io.Discard, resp.Body)
+					return nil
+				}
+				return json.NewDecoder(resp.Body).Decode(out)
+			}
+			err = statusError(resp)
+			resp.Body.Close()
+		}
+		if attempt > c.Retries || method == http.MethodPost || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+c.Addr+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	acl.Identify(req, c.PeerID)
+	if c.RunID != "" {
+		req.Header.Set(acl.RunIDHeader, c.RunID)
+	}
+	if c.Hooks.Before != nil {
+		c.Hooks.Before(req)
+	}
+	return req, nil
+}
+
+func (c *Client) observe(req *http.Request, attempt int, resp *http.Response, err error, start time.Time) {
+	if c.Hooks.After == nil {
+		return
+	}
+	call := Call{Method: req.Method, Path: req.URL.Path, Attempt: attempt, Duration: time.Since(start), Err: err}
+	if resp != nil {
+		call.Status = resp.StatusCode
+	}
+	c.Hooks.After(call)
+}
+
+func statusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	se := &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	se.Problem, _ = apierror.Parse(body)
+	return se
+}
+
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells and waits for time. It drives the protocol timers: gossip
+// and seen-cache TTLs, keepalives, pings, anti-entropy, discovery
+// refreshes and heartbeats, and churn. Running it scaled makes minute- and
+// hour-long protocol behaviour play out in seconds.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *time.Ticker
+	After(d time.Duration) <-chan time.Time
+	// Real returns the wall-clock time that d takes on this clock
+	Real(d time.Duration) time.Duration
+}
+
+// Wall is the ordinary clock.
+type Wall struct{}
+
+func (Wall) Now() time.Time                         { return time.Now() }
+func (Wall) NewTicker(d time.Duration) *time.Ticker { return time.NewTicker(d) }
+func (Wall) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (Wall) Real(d time.Duration) time.Duration     { return d }
+
+// Scaled runs Factor times faster than the wall clock. Its time starts at
+// the wall-clock time it was created at.
+type Scaled struct {
+	Factor float64
+	epoch  time.Time
+}
+
+func NewScaled(factor float64) *Scaled {
+	return &Scaled{Factor: factor, epoch: time.Now()}
+}
+
+func (s *Scaled) Now() time.Time {
+	return s.epoch.Add(time.Duration(float64(time.Since(s.epoch)) * s.Factor))
+}
+
+func (s *Scaled) NewTicker(d time.Duration) *time.Ticker { return time.NewTicker(s.Real(d)) }
+func (s *Scaled) After(d time.Duration) <-chan time.Time { return time.After(s.Real(d)) }
+
+func (s *Scaled) Real(d time.Duration) time.Duration {
+	r := time.Duration(float64(d) / s.Factor)
+	if r <= 0 && d > 0 {
+		// Tickers panic on non-positive intervals
+		r = 1
+	}
+	return r
+}
+
+var (
+	mu      sync.RWMutex
+	current Clock = Wall{}
+)
+
+// Set replaces the clock used by the package functions. It is meant to be
+// called once at startup, before any timer is started.
+func Set(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = c
+}
+
+// Get returns the clock used by the package functions.
+func Get() Clock {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func Now() time.Time                         { return Get().Now() }
+func Since(t time.Time) time.Duration        { return Get().Now().Sub(t) }
+func NewTicker(d time.Duration) *time.Ticker { return Get().NewTicker(d) }
+func After(d time.Duration) <-chan time.Time { return Get().After(d) }
+func Real(d time.Duration) time.Duration     { return Get().Real(d) }
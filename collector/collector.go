@@ -0,0 +1,171 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"TestProject/apierror"
+	"TestProject/cardinality"
+	"TestProject/report"
+	"TestProject/results"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keep bounds the results held, oldest first out
+const keep = 100000
+
+var reportsReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "collector_results_total",
+		Help: "Total number of results received by the collector per reporting node",
+	},
+	[]string{"node"},
+)
+
+func init() {
+	prometheus.MustRegister(reportsReceived)
+}
+
+// nodeLabels bounds the node label of collector_results_total, which
+// reporters pick
+var nodeLabels = &cardinality.Limiter{
+	Max:     256,
+	Idle:    time.Hour,
+	OnEvict: func(node string) { reportsReceived.DeletePartialMatch(prometheus.Labels{"node": node}) },
+}
+
+// Collector gathers the results of bench runs and soak intervals that the
+// nodes of a scenario report, and summarizes them for the whole mesh.
+type Collector struct {
+	mu      sync.Mutex
+	results []results.Result
+	left    map[string]time.Time
+}
+
+func New() *Collector {
+	return &Collector{left: make(map[string]time.Time)}
+}
+
+// Add records a result.
+func (c *Collector) Add(r results.Result) {
+	reportsReceived.WithLabelValues(nodeLabels.Value(r.Node)).Inc()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.left, r.Node)
+	c.results = append(c.results, r)
+	if len(c.results) > keep {
+		c.results = c.results[len(c.results)-keep:]
+	}
+}
+
+// Reset forgets all results, e.g. between scenarios.
+func (c *Collector) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = nil
+	c.left = make(map[string]time.Time)
+}
+
+// Leave records that node shut down cleanly and won't report anymore.
+func (c *Collector) Leave(node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.left[node] = time.Now()
+}
+
+// Results returns the recorded results in the order they arrived.
+func (c *Collector) Results() []results.Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]results.Result(nil), c.results...)
+}
+
+// Summary aggregates the recorded results.
+func (c *Collector) Summary() results.Aggregate {
+	return c.combine(c.Results())
+}
+
+// combine aggregates rs, marking the nodes that left
+func (c *Collector) combine(rs []results.Result) results.Aggregate {
+	sum := results.Combine(rs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, n := range sum.Nodes {
+		if t, ok := c.left[n.Node]; ok {
+			sum.Nodes[i].Left = &t
+		}
+	}
+	return sum
+}
+
+// ServeHTTP records the results POSTed to /results, one JSON document or
+// several as JSON lines, and returns the summary on GET, as HTML with
+// ?format=html and of a single run with ?run=.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		n, err := c.read(r.Body)
+		if err != nil {
+			apierror.Write(w, r, http.StatusBadRequest, apierror.Problem{
+				Message: err.Error(),
+				Details: map[string]interface{}{"accepted": n},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int{"accepted": n})
+	case http.MethodGet:
+		run := r.URL.Query().Get("run")
+		rs := results.ForRun(c.Results(), run)
+		if r.URL.Query().Get("format") == "html" {
+			// Rendered in full first, so a failure can still be reported
+			var buf bytes.Buffer
+			if err := report.Render(&buf, report.New(run, "p2p_test results", rs)); err != nil {
+				apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(buf.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.combine(rs))
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// read adds every result in body and returns how many it added
+func (c *Collector) read(body io.Reader) (int, error) {
+	dec := json.NewDecoder(body)
+	n := 0
+	for {
+		var res results.Result
+		err := dec.Decode(&res)
+		if errors.Is(err, io.EOF) {
+			if n == 0 {
+				return 0, errors.New("expected a result as JSON")
+			}
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("result %d: %w", n+1, err)
+		}
+		switch {
+		case res.Node == "":
+			return n, fmt.Errorf("result %d: missing node", n+1)
+		case res.Schema > results.Schema:
+			return n, fmt.Errorf("result %d has schema %d, this build reads up to %d", n+1, res.Schema, results.Schema)
+		}
+		c.Add(res)
+		n++
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/churn"
+	"TestProject/delay"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/features"
+	"TestProject/geoip"
+	"TestProject/join"
+	"TestProject/loadgen"
+	"TestProject/rtt"
+	"TestProject/sendq"
+	"TestProject/wire"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config", "", "YAML file of flag settings, e.g. \"listen: :8080\"; flags given on the command line take precedence")
+
+// loadConfig applies the settings in --config to the flags that weren't
+// set on the command line. Keys are flag names; lists are joined with
+// commas, as for --allow-peers.
+func loadConfig() error {
+	if *configFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing %s: %w", *configFile, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected flag settings, like listen: :8080", *configFile, root.Line)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	seen := make(map[string]bool)
+	var errs []string
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		at := fmt.Sprintf("%s:%d", *configFile, key.Line)
+		name := key.Value
+		switch f := flag.Lookup(name); {
+		case f == nil:
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", at, name))
+			continue
+		case name == "config":
+			errs = append(errs, at+": config files can't include others")
+			continue
+		case seen[name]:
+			errs = append(errs, fmt.Sprintf("%s: %s is set twice", at, name))
+			continue
+		}
+		seen[name] = true
+		v, err := settingValue(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %v", at, name, err))
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %v", at, name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// settingValue turns a YAML value into flag syntax
+func settingValue(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value, nil
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("list items must be plain values")
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.New("expected a value or a list")
+	}
+}
+
+// validateConfig checks every setting that can be checked without
+// starting anything: syntax, ranges, the files the node reads and the
+// combinations it rejects. It returns all problems found, not just the
+// first.
+func validateConfig() []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	flagErr := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %w", name, err))
+		}
+	}
+
+	// Negative durations mean nothing anywhere
+	flag.VisitAll(func(f *flag.Flag) {
+		if g, ok := f.Value.(flag.Getter); ok {
+			if d, ok := g.Get().(time.Duration); ok && d < 0 {
+				flagErr(f.Name, errors.New("must not be negative"))
+			}
+		}
+	})
+	if *tenant != "" && !tenantPattern.MatchString(*tenant) {
+		flagErr("tenant", errors.New("may only contain letters, digits, '.', '_' and '-'"))
+	}
+	if *timeScale <= 0 {
+		flagErr("time-scale", errors.New("must be positive"))
+	}
+	if *gogc != "" && *gogc != "off" {
+		if _, err := strconv.Atoi(*gogc); err != nil {
+			flagErr("gogc", fmt.Errorf("want a percentage or off, got %q", *gogc))
+		}
+	}
+	for name, v := range map[string]string{"gomemlimit": *gomemlimit, "blob-max-size": *blobMaxSize, "transfer-max-size": *transferMaxSize, "mtu-max-chunk": *mtuMaxChunk} {
+		if v == "" {
+			continue
+		}
+		if _, err := parseBytes(v); err != nil {
+			flagErr(name, err)
+		}
+	}
+	for name, n := range map[string]int{"send-queue-size": *sendQueueSize, "gossip-hops": *gossipHops, "gossip-seen-size": *gossipSeenSize, "soak-concurrency": *soakWorkers} {
+		if n <= 0 {
+			flagErr(name, errors.New("must be positive"))
+		}
+	}
+	for name, n := range map[string]int{"blob-fetch-peers": *blobFetchPeers, "sse-buffer": *sseBuffer, "gc-ballast-mb": *ballastMB, "soak-leak-window": *soakLeakWindow, "metrics-series-budget": *seriesBudget} {
+		if n < 0 {
+			flagErr(name, errors.New("must not be negative"))
+		}
+	}
+	if *statsWindow > 0 && (*statsResolution <= 0 || *statsResolution > *statsWindow) {
+		flagErr("stats-resolution", errors.New("must be positive and at most --stats-window"))
+	}
+	if *antiEntropyTTL <= 0 || *antiEntropyTTL < 4**antiEntropyEvery {
+		flagErr("anti-entropy-ttl", errors.New("must be positive and at least 4 times --anti-entropy-interval, so that entries are refreshed before they expire"))
+	}
+	if *keepaliveInterval > 0 && *keepaliveMaxMissed < 1 {
+		flagErr("keepalive-max-missed", errors.New("must be at least 1 with keepalives enabled"))
+	}
+
+	// Addresses
+	flagErr("listen", checkListen(*listenAddr))
+	if *muxListen != "" {
+		flagErr("mux-listen", checkListen(*muxListen))
+	}
+	if *proxyURL != "" {
+		_, err := dial.ParseProxy(*proxyURL)
+		flagErr("proxy", err)
+	}
+	if *advertise != "" {
+		flagErr("advertise-addr", discovery.CheckAddr(*advertise))
+	}
+	if *reportTo != "" {
+		flagErr("report-to", discovery.CheckAddr(*reportTo))
+	}
+	for name, port := range map[string]int{"mux-port": *muxPort, "k8s-port": *k8sPort} {
+		if port < 1 || port > 65535 {
+			flagErr(name, errors.New("must be between 1 and 65535"))
+		}
+	}
+	if l, err := acl.New(*allowPeers, *denyPeers, *allowCIDRs, *denyCIDRs); err != nil {
+		add(err)
+	} else if l.UsesIDs() && *joinToken == "" && *joinSecret == "" {
+		add(errors.New("--allow-peers and --deny-peers need --join-token or --join-secret to vouch for peer IDs"))
+	}
+
+	// Discovery
+	switch *discoveryBackend {
+	case "", "kubernetes":
+	case "consul":
+		flagErr("consul-addr", checkURL(*consulAddr))
+		flagErr("registration-ttl", checkRegistrationTTL(*registrationTTL))
+	case "etcd":
+		flagErr("etcd-addr", checkURL(*etcdAddr))
+		flagErr("registration-ttl", checkRegistrationTTL(*registrationTTL))
+	default:
+		flagErr("discovery", fmt.Errorf("unknown backend %q, want kubernetes, consul or etcd", *discoveryBackend))
+	}
+	if *peersFile != "" {
+		_, err := discovery.LoadPeersFile(*peersFile)
+		flagErr("peers-file", err)
+	}
+	if *geoipDB != "" {
+		_, err := geoip.OpenDB(*geoipDB)
+		flagErr("geoip-db", err)
+		if *geoipInterval <= 0 {
+			flagErr("geoip-interval", errors.New("must be positive"))
+		}
+	}
+
+	// Peer protocol
+	_, _, err := peerTLS()
+	add(err)
+	if *inviteToken != "" {
+		if _, expires, err := join.Describe(*inviteToken); err != nil {
+			flagErr("invite", err)
+		} else if time.Now().After(expires) {
+			flagErr("invite", fmt.Errorf("expired at %s", expires.Format(time.RFC3339)))
+		}
+	}
+	for _, name := range strings.Split(*wireCodecs, ",") {
+		if _, ok := wire.Lookup(name); !ok {
+			flagErr("wire-codecs", fmt.Errorf("unknown wire codec %q", name))
+		}
+	}
+	for _, name := range strings.Split(*compressions, ",") {
+		if _, ok := wire.LookupCompression(name); !ok {
+			flagErr("compressions", fmt.Errorf("unknown compression %q", name))
+		}
+	}
+	if enabled, err := features.Enabled(*disableFeatures); err != nil {
+		flagErr("disable-features", err)
+	} else if *antiEntropyEvery > 0 && !features.Has(enabled, features.Sync) {
+		flagErr("anti-entropy-interval", errors.New("anti-entropy needs the sync feature, which --disable-features turns off"))
+	}
+	_, err = sendq.ParsePolicy(*sendQueuePolicy)
+	flagErr("send-queue-policy", err)
+	for _, t := range strings.Split(*pingTransports, ",") {
+		if t != "http" && t != "mux" && t != "icmp" {
+			flagErr("ping-transports", fmt.Errorf("unknown transport %q, want http, mux or icmp", t))
+		}
+	}
+	if *pingInterval > 0 {
+		flagErr("failure-detector", detectorConfig().Validate())
+	}
+	if *rttTiers != "" {
+		_, err := rtt.ParseTiers(*rttTiers)
+		flagErr("rtt-history", err)
+	}
+
+	// Experiments
+	if *churnMode != "" {
+		c := &churn.Churner{Mode: *churnMode, Interval: *churnInterval, Down: *churnDown, Timeout: *churnTimeout}
+		flagErr("churn-mode", c.Validate())
+	}
+	if *delayProfile != "" {
+		_, err := delay.Parse(*delayProfile)
+		flagErr("delay-profile", err)
+	}
+	if *soakMix != "" {
+		_, err := loadgen.LoadMix(*soakMix)
+		flagErr("soak-mix", err)
+	}
+	for name, dir := range map[string]string{"transfer-dir": *transferDir, "transfer-source-dir": *transferSourceDir, "blob-dir": *blobDir, "report-dir": *reportDir, "watchdog-dump-dir": *watchdogDumpDir} {
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			flagErr(name, fmt.Errorf("%s is not a directory", dir))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// tenantPattern keeps tenants usable in headers, label values and paths
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// checkRegistrationTTL checks a consul or etcd TTL: etcd leases count in
+// whole seconds, and the heartbeat every third of it needs to tick
+func checkRegistrationTTL(ttl time.Duration) error {
+	if ttl < time.Second {
+		return fmt.Errorf("%s is shorter than 1s", ttl)
+	}
+	return nil
+}
+
+// checkListen checks an address to listen on, where the host may be empty
+func checkListen(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid address %q: port must be between 0 and 65535", addr)
+	}
+	return nil
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("want an http or https URL, got %q", s)
+	}
+	return nil
+}
+
+// validateMain runs `validate [--config file] [flags]`: it checks the
+// configuration a node would start with and exits without starting it
+func validateMain(args []string) int {
+	flag.CommandLine.Init("validate", flag.ExitOnError)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s validate [--config config.yaml] [node flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(args)
+	if flag.NArg() != 0 {
+		flag.Usage()
+		return 2
+	}
+	if err := loadConfig(); err != nil {
+		fmt.Println("Error loading the configuration:", err)
+		return 1
+	}
+	errs := validateConfig()
+	for _, err := range errs {
+		fmt.Println("Error:", err)
+	}
+	switch len(errs) {
+	case 0:
+	case 1:
+		fmt.Println("1 problem found")
+		return 1
+	default:
+		fmt.Printf("%d problems found\n", len(errs))
+		return 1
+	}
+	fmt.Printf("Configuration of node %s is valid\n", *nodeID)
+	return 0
+}
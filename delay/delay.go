@@ -0,0 +1,277 @@
+package delay
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"TestProject/apierror"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	injectedDelay = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "delay_injected_seconds",
+			Help:    "Histogram of latency injected into requests by the delay profile",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		},
+	)
+	inFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "delay_in_flight_requests",
+			Help: "Number of requests in flight on the routes the delay profile applies to",
+		},
+	)
+	rejectedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "delay_rejected_total",
+			Help: "Total number of requests answered 503 for exceeding the delay profile's limit of requests in flight",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(injectedDelay)
+	prometheus.MustRegister(inFlightGauge)
+	prometheus.MustRegister(rejectedTotal)
+}
+
+// Curves relate the requests in flight to the injected delay.
+const (
+	// Fixed delays every request by Base.
+	Fixed = "fixed"
+	// Linear adds Step per request in flight beyond Knee.
+	Linear = "linear"
+	// Exponential doubles the delay every Doubling requests beyond Knee.
+	Exponential = "exponential"
+	// Queue grows the delay like the response time of a server of
+	// Capacity concurrent requests, Base / (1 - inFlight/Capacity); from
+	// Capacity on, each request in flight adds Base * Capacity as if
+	// waiting in line for a slot.
+	Queue = "queue"
+)
+
+// Profile turns the number of requests in flight, including the one being
+// delayed, into a delay.
+type Profile struct {
+	Curve    string
+	Base     time.Duration
+	Step     time.Duration
+	Knee     int
+	Doubling float64
+	Capacity int
+	// Max caps the delay, 0 for no cap besides a minute
+	Max time.Duration
+	// Jitter varies each delay by up to this fraction either way
+	Jitter float64
+	// Limit, if positive, answers 503 to requests beyond this many in
+	// flight instead of delaying them
+	Limit int
+
+	spec string
+}
+
+// maxDelay caps every delay so that requests don't hang around forever
+const maxDelay = time.Minute
+
+// Parse parses a profile like "linear:base=10ms,step=5ms,knee=8,max=2s".
+// The curve is fixed, linear, exponential or queue; every curve takes
+// base, max, jitter and limit, linear takes step and knee, exponential
+// doubling and knee, and queue capacity.
+func Parse(spec string) (*Profile, error) {
+	curve, params, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	p := &Profile{Curve: curve, Doubling: 1, spec: strings.TrimSpace(spec)}
+	allowed := map[string]bool{"base": true, "max": true, "jitter": true, "limit": true}
+	switch curve {
+	case Fixed:
+	case Linear:
+		allowed["step"], allowed["knee"] = true, true
+	case Exponential:
+		allowed["doubling"], allowed["knee"] = true, true
+	case Queue:
+		allowed["capacity"] = true
+	default:
+		return nil, fmt.Errorf("unknown curve %q, want fixed, linear, exponential or queue", curve)
+	}
+	if params != "" {
+		for _, kv := range strings.Split(params, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+			if !ok || !allowed[k] {
+				return nil, fmt.Errorf("invalid %s parameter %q, want one of %s", curve, kv, strings.Join(keys(allowed), ", "))
+			}
+			if err := p.set(k, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", k, err)
+			}
+		}
+	}
+	switch {
+	case curve == Queue && p.Capacity < 1:
+		return nil, errors.New("queue needs a capacity of at least 1")
+	case curve == Linear && p.Step == 0:
+		return nil, errors.New("linear needs a step")
+	case curve == Exponential && p.Base == 0:
+		return nil, errors.New("exponential needs a base")
+	case p.Max > maxDelay:
+		return nil, fmt.Errorf("max must be at most %s", maxDelay)
+	}
+	return p, nil
+}
+
+func (p *Profile) set(k, v string) error {
+	var err error
+	switch k {
+	case "base", "step", "max":
+		var d time.Duration
+		if d, err = time.ParseDuration(v); err == nil && d < 0 {
+			err = errors.New("must not be negative")
+		}
+		switch k {
+		case "base":
+			p.Base = d
+		case "step":
+			p.Step = d
+		default:
+			p.Max = d
+		}
+	case "knee", "capacity", "limit":
+		var n int
+		if n, err = strconv.Atoi(v); err == nil && n < 0 {
+			err = errors.New("must not be negative")
+		}
+		switch k {
+		case "knee":
+			p.Knee = n
+		case "capacity":
+			p.Capacity = n
+		default:
+			p.Limit = n
+		}
+	case "doubling":
+		if p.Doubling, err = strconv.ParseFloat(v, 64); err == nil && p.Doubling <= 0 {
+			err = errors.New("must be positive")
+		}
+	case "jitter":
+		if p.Jitter, err = strconv.ParseFloat(v, 64); err == nil && (p.Jitter < 0 || p.Jitter > 1) {
+			err = errors.New("must be between 0 and 1")
+		}
+	}
+	return err
+}
+
+func keys(m map[string]bool) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// String returns the spec the profile was parsed from.
+func (p *Profile) String() string {
+	return p.spec
+}
+
+// Delay is the delay of a request arriving with inFlight requests in
+// flight, itself included, before jitter.
+func (p *Profile) Delay(inFlight int) time.Duration {
+	ceiling := p.Max
+	if ceiling == 0 {
+		ceiling = maxDelay
+	}
+	over := float64(inFlight - p.Knee)
+	if over < 0 {
+		over = 0
+	}
+	var d float64
+	switch p.Curve {
+	case Fixed:
+		d = float64(p.Base)
+	case Linear:
+		d = float64(p.Base) + over*float64(p.Step)
+	case Exponential:
+		d = float64(p.Base) * math.Exp2(over/p.Doubling)
+	case Queue:
+		slot := float64(p.Base) * float64(p.Capacity)
+		if inFlight >= p.Capacity {
+			d = slot * float64(inFlight-p.Capacity+1)
+		} else {
+			d = float64(p.Base) / (1 - float64(inFlight)/float64(p.Capacity))
+		}
+	}
+	if d > float64(ceiling) {
+		return ceiling
+	}
+	return time.Duration(d)
+}
+
+// Injector delays the requests passing through it by the current profile.
+type Injector struct {
+	mu       sync.RWMutex
+	profile  *Profile
+	inFlight int64
+}
+
+// Set replaces the profile; nil stops delaying.
+func (in *Injector) Set(p *Profile) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.profile = p
+}
+
+// Profile returns the current profile, nil if none.
+func (in *Injector) Profile() *Profile {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	return in.profile
+}
+
+// InFlight is the number of requests passing through right now.
+func (in *Injector) InFlight() int {
+	return int(atomic.LoadInt64(&in.inFlight))
+}
+
+// Wrap counts the requests to h in flight and delays each by the profile
+// before h answers it.
+func (in *Injector) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt64(&in.inFlight, 1))
+		inFlightGauge.Inc()
+		defer func() {
+			atomic.AddInt64(&in.inFlight, -1)
+			inFlightGauge.Dec()
+		}()
+		p := in.Profile()
+		if p == nil {
+			h(w, r)
+			return
+		}
+		if p.Limit > 0 && n > p.Limit {
+			rejectedTotal.Inc()
+			w.Header().Set("Retry-After", "1")
+			apierror.Error(w, r, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		d := p.Delay(n)
+		if p.Jitter > 0 {
+			d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+		}
+		injectedDelay.Observe(d.Seconds())
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(d):
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,302 @@
+package dial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	attempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dial_attempts_total",
+			Help: "Total number of connection attempts to peers per address family and result: won, lost (connected after another attempt won), failed or canceled",
+		},
+		[]string{"host", "family", "result"},
+	)
+	attemptDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dial_attempt_duration_seconds",
+			Help:    "Histogram of the time connection attempts to peers took until they connected or failed, per address family",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"host", "family"},
+	)
+	dialDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dial_duration_seconds",
+			Help:    "Histogram of the time from resolving a peer to the first connected attempt, per winning address family",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"host", "family"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(attempts)
+	prometheus.MustRegister(attemptDuration)
+	prometheus.MustRegister(dialDuration)
+}
+
+// Attempt is one connection attempt of a dial.
+type Attempt struct {
+	Addr     string
+	Family   string        // ipv4 or ipv6
+	Start    time.Duration // after the dial started
+	Duration time.Duration
+	Err      error
+	Won      bool
+}
+
+// Dialer connects to hosts with several addresses the Happy Eyeballs way
+// (RFC 8305): it looks up IPv6 and IPv4 addresses in parallel, interleaves
+// them starting with IPv6 and starts an attempt every AttemptDelay, or as
+// soon as the previous one fails, until one connects. Meshes where one
+// family is silently broken then still connect after AttemptDelay, and the
+// metrics tell which family won.
+type Dialer struct {
+	// AttemptDelay staggers the attempts, 0 tries them one after another
+	AttemptDelay time.Duration
+	// ResolutionDelay is how long to wait for IPv6 addresses once the IPv4
+	// ones are known
+	ResolutionDelay time.Duration
+	// Timeout limits the whole dial, 0 for none
+	Timeout  time.Duration
+	Resolver *net.Resolver
+	// Proxy, if set, returns the proxy to reach addr through, nil for none
+	Proxy func(addr string) (*url.URL, error)
+	// Trace, if set, sees every attempt when the dial is over
+	Trace func(host string, attempts []Attempt)
+}
+
+// Default is the dialer of the peer clients and connections. Its settings
+// are meant to be changed at startup only.
+var Default = &Dialer{
+	AttemptDelay:    250 * time.Millisecond,
+	ResolutionDelay: 50 * time.Millisecond,
+	Timeout:         10 * time.Second,
+}
+
+// DialContext connects to addr (host:port) over network, which must be tcp.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("dial: unsupported network %q", network)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Proxy != nil {
+		u, err := d.Proxy(addr)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return d.dialProxy(ctx, u, addr)
+		}
+	}
+	start := time.Now()
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return d.race(ctx, host, port, interleave(ips), start)
+}
+
+// resolve looks up both families, giving IPv6 answers ResolutionDelay to
+// arrive after the IPv4 ones
+func (d *Dialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	type answer struct {
+		ips []net.IP
+		err error
+	}
+	v6, v4 := make(chan answer, 1), make(chan answer, 1)
+	lookup := func(network string, out chan<- answer) {
+		ips, err := resolver.LookupIP(ctx, network, host)
+		out <- answer{ips, err}
+	}
+	go lookup("ip6", v6)
+	go lookup("ip4", v4)
+
+	var six, four *answer
+	for six == nil || four == nil {
+		var timeout <-chan time.Time
+		if six == nil && four != nil && len(four.ips) > 0 {
+			timeout = time.After(d.ResolutionDelay)
+		}
+		select {
+		case a := <-v6:
+			six = &a
+		case a := <-v4:
+			four = &a
+		case <-timeout:
+			// Go with IPv4, late IPv6 answers are dropped
+			six = &answer{}
+		}
+	}
+	ips := append(six.ips, four.ips...)
+	if len(ips) == 0 {
+		err := four.err
+		if err == nil {
+			err = six.err
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		return nil, err
+	}
+	return ips, nil
+}
+
+// interleave alternates the families, starting with the first address's
+func interleave(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if len(ips) > 0 && ips[0].To4() != nil {
+		first, second = v4, v6
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+type result struct {
+	i    int
+	conn net.Conn
+	err  error
+	took time.Duration
+}
+
+// race starts the attempts staggered and returns the first connection
+func (d *Dialer) race(ctx context.Context, host, port string, ips []net.IP, start time.Time) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(ips))
+	trace := make([]Attempt, len(ips))
+	next, running := 0, 0
+	launch := func() {
+		i := next
+		next++
+		running++
+		addr := net.JoinHostPort(ips[i].String(), port)
+		trace[i] = Attempt{Addr: addr, Family: family(ips[i]), Start: time.Since(start)}
+		go func() {
+			began := time.Now()
+			var nd net.Dialer
+			conn, err := nd.DialContext(ctx, "tcp", addr)
+			results <- result{i, conn, err, time.Since(began)}
+		}()
+	}
+
+	var won net.Conn
+	var errs []error
+	launch()
+	for running > 0 {
+		var delay <-chan time.Time
+		if won == nil && next < len(ips) && d.AttemptDelay > 0 {
+			delay = time.After(d.AttemptDelay)
+		}
+		select {
+		case <-delay:
+			launch()
+			continue
+		case r := <-results:
+			running--
+			a := &trace[r.i]
+			a.Duration, a.Err = r.took, r.err
+			attemptDuration.WithLabelValues(host, a.Family).Observe(r.took.Seconds())
+			switch {
+			case r.err == nil && won == nil:
+				won, a.Won = r.conn, true
+				attempts.WithLabelValues(host, a.Family, "won").Inc()
+				dialDuration.WithLabelValues(host, a.Family).Observe(time.Since(start).Seconds())
+				// The losers are canceled, but the defer would come too
+				// late for attempts still to be collected
+				cancel()
+			case r.err == nil:
+				r.conn.Close()
+				attempts.WithLabelValues(host, a.Family, "lost").Inc()
+			case won != nil || errors.Is(r.err, context.Canceled):
+				attempts.WithLabelValues(host, a.Family, "canceled").Inc()
+			default:
+				attempts.WithLabelValues(host, a.Family, "failed").Inc()
+				errs = append(errs, r.err)
+			}
+			// A failed attempt makes way for the next one right away
+			if won == nil && r.err != nil && next < len(ips) && ctx.Err() == nil {
+				launch()
+			}
+		}
+	}
+	if d.Trace != nil {
+		d.Trace(host, trace[:next])
+	}
+	if won != nil {
+		return won, nil
+	}
+	if err := ctx.Err(); err != nil && len(errs) == 0 {
+		return nil, err
+	}
+	return nil, joinErrors(errs)
+}
+
+// joinErrors keeps the first error, naming how many more there were
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("%w (and %d more failed attempts)", errs[0], len(errs)-1)
+}
+
+// Transport is the HTTP transport for requests to peers: connections are
+// dialed by Default, through its proxies rather than those of the
+// environment.
+var Transport = NewTransport()
+
+// NewTransport returns a transport dialing with Default, for callers that
+// need their own connection pool.
+func NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = Default.DialContext
+	return t
+}
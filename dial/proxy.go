@@ -0,0 +1,288 @@
+package dial
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	proxyHandshake = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dial_proxy_handshake_duration_seconds",
+			Help:    "Histogram of the time proxies took to open a tunnel to a peer, from connecting to the proxy until the tunnel was ready",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{"proxy", "scheme"},
+	)
+	proxyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dial_proxy_errors_total",
+			Help: "Total number of connections through proxies that failed, connecting to the proxy or in the handshake",
+		},
+		[]string{"proxy", "scheme", "stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(proxyHandshake)
+	prometheus.MustRegister(proxyErrors)
+}
+
+// Direct is the proxy setting of peers reached without a proxy.
+const Direct = "direct"
+
+// ParseProxy parses a proxy URL: socks5://[user:pass@]host:port, with the
+// proxy resolving the peer's host name, or http://[user:pass@]host:port
+// for a proxy supporting CONNECT to the peers' ports. "" and Direct mean
+// no proxy and return nil.
+func ParseProxy(s string) (*url.URL, error) {
+	if s == "" || s == Direct {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" && u.Scheme != "http" {
+		return nil, fmt.Errorf("proxy %q: want a socks5:// or http:// URL", u.Redacted())
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("proxy %q: want host:port, %v", u.Redacted(), err)
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr through the proxy at u
+func (d *Dialer) dialProxy(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	proxyHost, proxyPort, _ := net.SplitHostPort(u.Host)
+	start := time.Now()
+	ips, err := d.resolve(ctx, proxyHost)
+	if err != nil {
+		proxyErrors.WithLabelValues(u.Host, u.Scheme, "connect").Inc()
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	conn, err := d.race(ctx, proxyHost, proxyPort, interleave(ips), start)
+	if err != nil {
+		proxyErrors.WithLabelValues(u.Host, u.Scheme, "connect").Inc()
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+
+	handshakeStart := time.Now()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancellation only reaches the dial by itself; closing the connection
+	// interrupts the handshake too. The watcher is waited for, so it can't
+	// close a connection that was already returned.
+	raw := conn
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	closed := false
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			raw.Close()
+			closed = true
+		case <-stop:
+		}
+	}()
+	if u.Scheme == "http" {
+		conn, err = httpConnect(raw, u, addr)
+	} else {
+		err = socks5Connect(raw, u, addr)
+	}
+	close(stop)
+	<-watched
+	if err == nil && closed {
+		err = ctx.Err()
+	}
+	if err != nil {
+		raw.Close()
+		proxyErrors.WithLabelValues(u.Host, u.Scheme, "handshake").Inc()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	proxyHandshake.WithLabelValues(u.Host, u.Scheme).Observe(time.Since(handshakeStart).Seconds())
+	return conn, nil
+}
+
+// httpConnect opens a tunnel with CONNECT
+func httpConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The peer spoke first; keep what the reader already has
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929)
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksUserPass     = 2
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socks5Connect(conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	methods := []byte{socksNoAuth}
+	if u.User != nil {
+		methods = []byte{socksUserPass}
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if u.User == nil {
+			return errors.New("SOCKS5 proxy wants a username and password")
+		}
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		msg := []byte{1, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	case socksNoAcceptable:
+		return errors.New("SOCKS5 proxy accepts none of the authentication methods offered")
+	default:
+		return fmt.Errorf("SOCKS5 proxy chose unknown authentication method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long for SOCKS5")
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socksIPv4), ip4...)
+	} else {
+		req = append(append(req, socksIPv6), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		msg, ok := socksReplies[head[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", head[1])
+		}
+		return fmt.Errorf("SOCKS5 connect to %s: %s", addr, msg)
+	}
+	// Skip the bound address
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = 4
+	case socksIPv6:
+		skip = 16
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply with unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"TestProject/clock"
+)
+
+// Consul registers this node as a service with a TTL health check in the
+// local Consul agent and discovers the other passing instances of it.
+type Consul struct {
+	Addr    string
+	Service string
+	TTL     time.Duration
+	Self    Peer
+
+	client *http.Client
+}
+
+func NewConsul(addr, service string, ttl time.Duration, self Peer) *Consul {
+	return &Consul{
+		Addr:    addr,
+		Service: service,
+		TTL:     ttl,
+		Self:    self,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *Consul) Name() string { return "consul" }
+
+func (c *Consul) checkID() string { return "service:" + c.Self.ID }
+
+// Run registers the node, then passes the TTL check and refreshes the peer
+// list at a third of the TTL. The node is deregistered when ctx ends.
+func (c *Consul) Run(ctx context.Context, reg *Registry) error {
+	host, portStr, err := net.SplitHostPort(c.Self.Addr)
+	if err != nil {
+		return fmt.Errorf("consul: advertise address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("consul: advertise port: %w", err)
+	}
+
+	registered := false
+	ticker := clock.NewTicker(c.TTL / 3)
+	defer ticker.Stop()
+	defer func() {
+		if registered {
+			c.deregister()
+		}
+	}()
+
+	for {
+		if !registered {
+			if err := c.register(ctx, host, port); err != nil {
+				SyncError(c.Name())
+				log.Printf("consul discovery: register: %v", err)
+			} else {
+				registered = true
+			}
+		}
+		if registered {
+			if err := c.pass(ctx); err != nil {
+				// The agent may have dropped the service, register again
+				SyncError(c.Name())
+				log.Printf("consul discovery: ttl check: %v", err)
+				registered = false
+			}
+		}
+		if peers, err := c.listPeers(ctx); err != nil {
+			SyncError(c.Name())
+			log.Printf("consul discovery: %v", err)
+		} else {
+			reg.Sync(c.Name(), peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Consul) register(ctx context.Context, host string, port int) error {
+	body := map[string]interface{}{
+		"ID":      c.Self.ID,
+		"Name":    c.Service,
+		"Address": host,
+		"Port":    port,
+		"Meta":    c.Self.Meta,
+		"Check": map[string]string{
+			"CheckID":                        c.checkID(),
+			"TTL":                            c.TTL.String(),
+			"DeregisterCriticalServiceAfter": (10 * c.TTL).String(),
+		},
+	}
+	return doJSON(ctx, c.client, http.MethodPut, c.Addr+"/v1/agent/service/register", body, nil)
+}
+
+func (c *Consul) pass(ctx context.Context) error {
+	u := c.Addr + "/v1/agent/check/pass/" + url.PathEscape(c.checkID())
+	return doJSON(ctx, c.client, http.MethodPut, u, nil, nil)
+}
+
+func (c *Consul) deregister() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u := c.Addr + "/v1/agent/service/deregister/" + url.PathEscape(c.Self.ID)
+	if err := doJSON(ctx, c.client, http.MethodPut, u, nil, nil); err != nil {
+		log.Printf("consul discovery: deregister: %v", err)
+	}
+}
+
+func (c *Consul) listPeers(ctx context.Context) ([]Peer, error) {
+	var entries []struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service struct {
+			ID      string            `json:"ID"`
+			Address string            `json:"Address"`
+			Port    int               `json:"Port"`
+			Meta    map[string]string `json:"Meta"`
+		} `json:"Service"`
+	}
+	u := c.Addr + "/v1/health/service/" + url.PathEscape(c.Service) + "?passing=true"
+	if err := doJSON(ctx, c.client, http.MethodGet, u, nil, &entries); err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		peers = append(peers, Peer{
+			ID:   e.Service.ID,
+			Addr: net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			Meta: e.Service.Meta,
+		})
+	}
+	return peers, nil
+}
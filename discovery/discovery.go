@@ -0,0 +1,427 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"TestProject/features"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	discoveredPeers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_peers",
+			Help: "Number of peers currently known per discovery source",
+		},
+		[]string{"source"},
+	)
+	discoverySyncErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_sync_errors_total",
+			Help: "Total number of failed discovery sync attempts",
+		},
+		[]string{"source"},
+	)
+	peerDepartures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_peer_departures_total",
+			Help: "Total number of peers removed from the registry per source and reason: goodbye when the peer said it was leaving, dropped when its source stopped reporting it, expired when no node had word of it any more",
+		},
+		[]string{"source", "reason"},
+	)
+	featureSkips = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_feature_skips_total",
+			Help: "Total number of times a peer was left out of a subsystem for not offering the feature it needs",
+		},
+		[]string{"feature"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(discoveredPeers)
+	prometheus.MustRegister(discoverySyncErrors)
+	prometheus.MustRegister(peerDepartures)
+	prometheus.MustRegister(featureSkips)
+}
+
+// Peer is a single node of the mesh as seen by a discovery backend.
+type Peer struct {
+	ID     string            `json:"id"`
+	Addr   string            `json:"addr"`
+	Source string            `json:"source"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	Seen   time.Time         `json:"last_seen"`
+	// Features are those the peer offered in its last handshake, nil
+	// until it made one
+	Features []string `json:"features,omitempty"`
+}
+
+// Backend finds peers and keeps the registry in sync until ctx is cancelled.
+type Backend interface {
+	Name() string
+	Run(ctx context.Context, reg *Registry) error
+}
+
+// Registry holds the peers reported by all discovery backends. Peers
+// announcing a tenant in their "tenant" meta other than Tenant are left
+// out; set it before the backends run. With RequireJoin, peers only count
+// as Admitted once they presented a join token. OnRemove, if set, is told
+// about every peer that is no longer known, whether a source stopped
+// reporting it, it left, expired or the registry was reset; it is called
+// without the registry locked.
+type Registry struct {
+	Tenant      string
+	RequireJoin bool
+	OnRemove    func(id string)
+
+	self       string
+	mu         sync.RWMutex
+	peers      map[string]Peer
+	suppressed map[string]bool
+	// left holds the peers that said goodbye until they contact us again
+	left map[string]Peer
+	// features holds what each peer offered, kept across backend syncs
+	features map[string][]string
+	// admitted holds the peers that presented a join token
+	admitted map[string]bool
+}
+
+// NewRegistry returns an empty registry that ignores entries for selfID.
+func NewRegistry(selfID string) *Registry {
+	return &Registry{self: selfID, peers: make(map[string]Peer), suppressed: make(map[string]bool), left: make(map[string]Peer), features: make(map[string][]string), admitted: make(map[string]bool)}
+}
+
+// Sync replaces every peer previously reported by source with peers.
+// Peers that left stay out until they Rejoin.
+func (r *Registry) Sync(source string, peers []Peer) {
+	now := time.Now()
+	r.mu.Lock()
+
+	dropped := make(map[string]bool)
+	for id, p := range r.peers {
+		if p.Source == source {
+			delete(r.peers, id)
+			dropped[id] = true
+		}
+	}
+	wasLeft := make(map[string]bool)
+	for id, p := range r.left {
+		if p.Source == source {
+			delete(r.left, id)
+			wasLeft[id] = true
+		}
+	}
+	count := 0
+	for _, p := range peers {
+		if p.ID == "" || p.ID == r.self || !r.sameTenant(p) {
+			continue
+		}
+		p.Source = source
+		p.Seen = now
+		if wasLeft[p.ID] {
+			r.left[p.ID] = p
+			continue
+		}
+		r.peers[p.ID] = p
+		delete(dropped, p.ID)
+		count++
+	}
+	if len(dropped) > 0 {
+		peerDepartures.WithLabelValues(source, "dropped").Add(float64(len(dropped)))
+	}
+	discoveredPeers.WithLabelValues(source).Set(float64(count))
+	r.mu.Unlock()
+	for id := range dropped {
+		r.removed(id)
+	}
+}
+
+// Leave removes a peer that announced it is shutting down, so that nobody
+// waits for it to time out. It returns false for unknown peers.
+func (r *Registry) Leave(id string) bool {
+	r.mu.Lock()
+	p, ok := r.peers[id]
+	if !ok {
+		r.mu.Unlock()
+		return false
+	}
+	delete(r.peers, id)
+	r.left[id] = p
+	peerDepartures.WithLabelValues(p.Source, "goodbye").Inc()
+	r.count(p.Source)
+	r.mu.Unlock()
+	r.removed(id)
+	return true
+}
+
+// Rejoin brings back a peer that left, e.g. on its first request after a
+// restart. Peers that didn't leave are not affected.
+func (r *Registry) Rejoin(id string) {
+	r.mu.RLock()
+	_, ok := r.left[id]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.left[id]
+	if !ok {
+		return
+	}
+	delete(r.left, id)
+	p.Seen = time.Now()
+	r.peers[id] = p
+	r.count(p.Source)
+}
+
+// Suppress hides a peer from Get and List until Unsuppress, while the
+// backends keep tracking it, e.g. to simulate a lost connection.
+func (r *Registry) Suppress(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suppressed[id] = true
+}
+
+// Unsuppress makes a suppressed peer visible again.
+func (r *Registry) Unsuppress(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.suppressed, id)
+}
+
+// Reset forgets every peer, as if the node had just started.
+func (r *Registry) Reset() {
+	r.mu.Lock()
+	var ids []string
+	for id, p := range r.peers {
+		delete(r.peers, id)
+		discoveredPeers.WithLabelValues(p.Source).Set(0)
+		ids = append(ids, id)
+	}
+	r.left = make(map[string]Peer)
+	r.features = make(map[string][]string)
+	r.admitted = make(map[string]bool)
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.removed(id)
+	}
+}
+
+func (r *Registry) removed(id string) {
+	if r.OnRemove != nil {
+		r.OnRemove(id)
+	}
+}
+
+// MarkAdmitted records that peer id presented a valid join token.
+func (r *Registry) MarkAdmitted(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.admitted[id] = true
+}
+
+// Admitted reports whether peer id presented a join token, or needn't.
+func (r *Registry) Admitted(id string) bool {
+	if !r.RequireJoin {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.admitted[id]
+}
+
+// SetFeatures records the features peer id offered in a handshake.
+func (r *Registry) SetFeatures(id string, offered []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.features[id] = append([]string(nil), offered...)
+}
+
+// Supports reports whether peer id offers feature. Peers that haven't
+// told yet, e.g. because they predate feature negotiation or were never
+// connected to, are assumed to.
+func (r *Registry) Supports(id, feature string) bool {
+	r.mu.RLock()
+	offered, ok := r.features[id]
+	r.mu.RUnlock()
+	return !ok || features.Has(offered, feature)
+}
+
+// With returns the peers of List that support feature, counting those
+// skipped for lacking it.
+func (r *Registry) With(feature string) []Peer {
+	var peers []Peer
+	for _, p := range r.List() {
+		if !r.Supports(p.ID, feature) {
+			featureSkips.WithLabelValues(feature).Inc()
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Merge adds the peers whose IDs are not known yet under source and updates
+// the ones source already owns, keeping the later Seen; a zero Seen means
+// now. Peers owned by other sources are left alone. It returns the number
+// of peers added.
+func (r *Registry) Merge(source string, peers []Peer) int {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added := 0
+	for _, p := range peers {
+		if p.ID == "" || p.ID == r.self || !r.sameTenant(p) {
+			continue
+		}
+		if _, gone := r.left[p.ID]; gone {
+			continue
+		}
+		cur, ok := r.peers[p.ID]
+		if ok && cur.Source != source {
+			continue
+		}
+		if !ok {
+			added++
+		}
+		p.Source = source
+		if p.Seen.IsZero() || p.Seen.After(now) {
+			p.Seen = now
+		}
+		if ok && cur.Seen.After(p.Seen) {
+			p.Seen = cur.Seen
+		}
+		r.peers[p.ID] = p
+	}
+	r.count(source)
+	return added
+}
+
+// Expire removes the peers of source not seen since before, returning
+// their IDs. It is for sources, like anti-entropy, that only ever add.
+func (r *Registry) Expire(source string, before time.Time) []string {
+	r.mu.Lock()
+	var expired []string
+	for id, p := range r.peers {
+		if p.Source == source && p.Seen.Before(before) {
+			delete(r.peers, id)
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) > 0 {
+		peerDepartures.WithLabelValues(source, "expired").Add(float64(len(expired)))
+		r.count(source)
+	}
+	r.mu.Unlock()
+	sort.Strings(expired)
+	for _, id := range expired {
+		r.removed(id)
+	}
+	return expired
+}
+
+// count updates the per-source gauge; r.mu must be held
+func (r *Registry) count(source string) {
+	n := 0
+	for _, p := range r.peers {
+		if p.Source == source {
+			n++
+		}
+	}
+	discoveredPeers.WithLabelValues(source).Set(float64(n))
+}
+
+// sameTenant reports whether p may be a peer; peers that don't announce a
+// tenant, e.g. from a peers file, may
+func (r *Registry) sameTenant(p Peer) bool {
+	t, ok := p.Meta["tenant"]
+	return !ok || t == r.Tenant
+}
+
+// Get returns the peer with the given ID.
+func (r *Registry) Get(id string) (Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[id]
+	if r.suppressed[id] {
+		return Peer{}, false
+	}
+	p.Features = r.features[id]
+	return p, ok
+}
+
+// List returns all known peers sorted by ID.
+func (r *Registry) List() []Peer {
+	return r.list(false)
+}
+
+// All returns all known peers sorted by ID, the suppressed ones included.
+func (r *Registry) All() []Peer {
+	return r.list(true)
+}
+
+func (r *Registry) list(suppressed bool) []Peer {
+	r.mu.RLock()
+	peers := make([]Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		if suppressed || !r.suppressed[p.ID] {
+			p.Features = r.features[p.ID]
+			peers = append(peers, p)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// SyncError records a failed sync attempt for source.
+func SyncError(source string) {
+	discoverySyncErrors.WithLabelValues(source).Inc()
+}
+
+// doJSON sends in as a JSON body (if non-nil) and decodes the response into
+// out (if non-nil). Non-2xx responses are returned as errors.
+func doJSON(ctx context.Context, client *http.Client, method, url string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
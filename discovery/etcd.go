@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"TestProject/clock"
+)
+
+var errLeaseExpired = errors.New("lease expired")
+
+// Etcd registers this node under a key prefix bound to a TTL lease, using
+// the etcd v3 JSON gateway, and discovers the nodes registered next to it.
+type Etcd struct {
+	Addr   string
+	Prefix string
+	TTL    time.Duration
+	Self   Peer
+
+	client *http.Client
+}
+
+func NewEtcd(addr, prefix string, ttl time.Duration, self Peer) *Etcd {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Etcd{
+		Addr:   addr,
+		Prefix: prefix,
+		TTL:    ttl,
+		Self:   self,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *Etcd) Name() string { return "etcd" }
+
+// Run keeps the node's key alive at a third of the TTL and refreshes the
+// peer list on each beat. The lease is revoked when ctx ends.
+func (e *Etcd) Run(ctx context.Context, reg *Registry) error {
+	var lease string
+	ticker := clock.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	defer func() {
+		if lease != "" {
+			e.revoke(lease)
+		}
+	}()
+
+	for {
+		if lease != "" {
+			if err := e.keepAlive(ctx, lease); err != nil {
+				SyncError(e.Name())
+				log.Printf("etcd discovery: keepalive: %v", err)
+				lease = ""
+			}
+		}
+		if lease == "" {
+			id, err := e.register(ctx)
+			if err != nil {
+				SyncError(e.Name())
+				log.Printf("etcd discovery: register: %v", err)
+			}
+			lease = id
+		}
+		if peers, err := e.listPeers(ctx); err != nil {
+			SyncError(e.Name())
+			log.Printf("etcd discovery: %v", err)
+		} else {
+			reg.Sync(e.Name(), peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+// register grants a new lease and writes the node's key with it
+func (e *Etcd) register(ctx context.Context) (string, error) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	in := map[string]interface{}{"TTL": int64(e.TTL.Seconds())}
+	if err := doJSON(ctx, e.client, http.MethodPost, e.Addr+"/v3/lease/grant", in, &grant); err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(Peer{ID: e.Self.ID, Addr: e.Self.Addr, Meta: e.Self.Meta})
+	if err != nil {
+		e.revoke(grant.ID)
+		return "", err
+	}
+	put := map[string]string{
+		"key":   b64(e.Prefix + e.Self.ID),
+		"value": b64(string(value)),
+		"lease": grant.ID,
+	}
+	if err := doJSON(ctx, e.client, http.MethodPost, e.Addr+"/v3/kv/put", put, nil); err != nil {
+		// The next attempt grants another lease, don't leave this one
+		// lingering for its TTL
+		e.revoke(grant.ID)
+		return "", err
+	}
+	return grant.ID, nil
+}
+
+// keepAlive fails once the lease has expired, which etcd reports as a zero TTL
+func (e *Etcd) keepAlive(ctx context.Context, lease string) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	in := map[string]string{"ID": lease}
+	if err := doJSON(ctx, e.client, http.MethodPost, e.Addr+"/v3/lease/keepalive", in, &resp); err != nil {
+		return err
+	}
+	if resp.Result.TTL == "" || resp.Result.TTL == "0" {
+		return errLeaseExpired
+	}
+	return nil
+}
+
+func (e *Etcd) revoke(lease string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	in := map[string]string{"ID": lease}
+	if err := doJSON(ctx, e.client, http.MethodPost, e.Addr+"/v3/lease/revoke", in, nil); err != nil {
+		log.Printf("etcd discovery: revoke: %v", err)
+	}
+}
+
+func (e *Etcd) listPeers(ctx context.Context) ([]Peer, error) {
+	// range_end is the prefix with its last byte incremented
+	end := []byte(e.Prefix)
+	end[len(end)-1]++
+	in := map[string]string{"key": b64(e.Prefix), "range_end": b64(string(end))}
+
+	var resp struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := doJSON(ctx, e.client, http.MethodPost, e.Addr+"/v3/kv/range", in, &resp); err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		raw, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			continue
+		}
+		var p Peer
+		if err := json.Unmarshal(raw, &p); err != nil {
+			log.Printf("etcd discovery: skipping malformed entry: %v", err)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
@@ -0,0 +1,38 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A lease whose key couldn't be written is revoked, not left to expire
+func TestEtcdRevokesLeaseOfFailedPut(t *testing.T) {
+	var revoked []string
+	etcd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/lease/grant":
+			w.Write([]byte(`{"ID":"7587"}`))
+		case "/v3/kv/put":
+			http.Error(w, "etcdserver: too many requests", http.StatusServiceUnavailable)
+		case "/v3/lease/revoke":
+			var in struct{ ID string }
+			json.NewDecoder(r.Body).Decode(&in)
+			revoked = append(revoked, in.ID)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer etcd.Close()
+
+	e := NewEtcd(etcd.URL, "/p2p", 15*time.Second, Peer{ID: "node-a", Addr: "10.0.0.1:8080"})
+	if _, err := e.register(context.Background()); err == nil {
+		t.Fatal("registered without the key written")
+	}
+	if len(revoked) != 1 || revoked[0] != "7587" {
+		t.Errorf("revoked %v, want the granted lease 7587", revoked)
+	}
+}
@@ -0,0 +1,143 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"TestProject/dial"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// File discovers peers from a static YAML file and reloads it whenever the
+// file changes on disk.
+type File struct {
+	Path string
+}
+
+// PeersFile is the on-disk format of a static peers file.
+type PeersFile struct {
+	Peers []struct {
+		ID   string            `yaml:"id"`
+		Addr string            `yaml:"addr"`
+		Meta map[string]string `yaml:"meta"`
+	} `yaml:"peers"`
+}
+
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+func (f *File) Name() string { return "file" }
+
+// Run loads the file once and then reloads it on every change. The parent
+// directory is watched so editors that replace the file on save still work.
+func (f *File) Run(ctx context.Context, reg *Registry) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(f.Path)); err != nil {
+		return fmt.Errorf("watching %s: %w", f.Path, err)
+	}
+	f.reload(reg)
+
+	// Editors often emit several events per save, so reloads are debounced
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) == filepath.Clean(f.Path) {
+				debounce = time.After(100 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("file discovery: watch error: %v", err)
+		case <-debounce:
+			debounce = nil
+			f.reload(reg)
+		}
+	}
+}
+
+// reload keeps the previous peer set if the file is missing or invalid
+func (f *File) reload(reg *Registry) {
+	peers, err := LoadPeersFile(f.Path)
+	if err != nil {
+		SyncError(f.Name())
+		log.Printf("file discovery: %v", err)
+		return
+	}
+	reg.Sync(f.Name(), peers)
+	log.Printf("file discovery: loaded %d peers from %s", len(peers), f.Path)
+}
+
+// LoadPeersFile parses and validates a static peers file.
+func LoadPeersFile(path string) ([]Peer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf PeersFile
+	if err := yaml.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	peers := make([]Peer, 0, len(pf.Peers))
+	seen := make(map[string]bool)
+	for i, p := range pf.Peers {
+		if p.ID == "" || p.Addr == "" {
+			return nil, fmt.Errorf("%s: peer #%d needs both id and addr", path, i+1)
+		}
+		if err := CheckAddr(p.Addr); err != nil {
+			return nil, fmt.Errorf("%s: peer %q: %w", path, p.ID, err)
+		}
+		if addr, ok := p.Meta["mux_addr"]; ok {
+			if err := CheckAddr(addr); err != nil {
+				return nil, fmt.Errorf("%s: peer %q: mux_addr: %w", path, p.ID, err)
+			}
+		}
+		if proxy, ok := p.Meta["proxy"]; ok {
+			if _, err := dial.ParseProxy(proxy); err != nil {
+				return nil, fmt.Errorf("%s: peer %q: %w", path, p.ID, err)
+			}
+		}
+		if seen[p.ID] {
+			return nil, fmt.Errorf("%s: duplicate peer id %q", path, p.ID)
+		}
+		seen[p.ID] = true
+		peers = append(peers, Peer{ID: p.ID, Addr: p.Addr, Meta: p.Meta})
+	}
+	return peers, nil
+}
+
+// CheckAddr checks that addr is a host:port peers can be dialed at.
+func CheckAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid address %q: missing host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid address %q: port must be between 1 and 65535", addr)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"TestProject/clock"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes discovers peers by listing pods that match a label selector
+// through the Kubernetes API, using the pod's in-cluster service account.
+type Kubernetes struct {
+	Namespace string
+	Selector  string
+	Port      int
+	Interval  time.Duration
+
+	apiURL string
+	client *http.Client
+	// token is the service account token read from tokenFile, when it
+	// was modified at tokenTime. The kubelet rotates projected tokens, so
+	// it's read again when the file changes or the API refuses it.
+	tokenFile string
+	token     string
+	tokenTime time.Time
+}
+
+// NewKubernetes builds a backend from the in-cluster configuration. An empty
+// namespace means the namespace the pod itself runs in.
+func NewKubernetes(namespace, selector string, port int, interval time.Duration) (*Kubernetes, error) {
+	host, portEnv := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || portEnv == "" {
+		return nil, errors.New("kubernetes: not running in a cluster (KUBERNETES_SERVICE_HOST unset)")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: reading cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes: no certificates found in cluster CA")
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: reading namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	k := &Kubernetes{
+		Namespace: namespace,
+		Selector:  selector,
+		Port:      port,
+		Interval:  interval,
+		apiURL:    "https://" + net.JoinHostPort(host, portEnv),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		tokenFile: serviceAccountDir + "/token",
+	}
+	if err := k.readToken(true); err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	return k, nil
+}
+
+// readToken reads the service account token if its file changed since it
+// was last read, or always when force is set.
+func (k *Kubernetes) readToken(force bool) error {
+	info, err := os.Stat(k.tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	if !force && info.ModTime().Equal(k.tokenTime) {
+		return nil
+	}
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	k.token, k.tokenTime = strings.TrimSpace(string(token)), info.ModTime()
+	return nil
+}
+
+func (k *Kubernetes) Name() string { return "kubernetes" }
+
+// Run polls the pod list every Interval and syncs ready pods into reg.
+func (k *Kubernetes) Run(ctx context.Context, reg *Registry) error {
+	ticker := clock.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	for {
+		peers, err := k.listPeers(ctx)
+		if err != nil {
+			SyncError(k.Name())
+			log.Printf("kubernetes discovery: %v", err)
+		} else {
+			reg.Sync(k.Name(), peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// getPods lists the pods with the current service account token
+func (k *Kubernetes) getPods(ctx context.Context) (*http.Response, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods?labelSelector=%s",
+		k.apiURL, url.PathEscape(k.Namespace), url.QueryEscape(k.Selector))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	return k.client.Do(req)
+}
+
+func (k *Kubernetes) listPeers(ctx context.Context) ([]Peer, error) {
+	if err := k.readToken(false); err != nil {
+		return nil, err
+	}
+	resp, err := k.getPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The token expired before its file was seen to change: read it
+		// again and retry once
+		resp.Body.Close()
+		if err := k.readToken(true); err != nil {
+			return nil, err
+		}
+		if resp, err = k.getPods(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods: unexpected status %s", resp.Status)
+	}
+
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("decoding pod list: %w", err)
+	}
+
+	var peers []Peer
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		ready := false
+		for _, c := range pod.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				ready = true
+			}
+		}
+		if !ready {
+			continue
+		}
+		peers = append(peers, Peer{
+			ID:   pod.Metadata.Name,
+			Addr: net.JoinHostPort(pod.Status.PodIP, fmt.Sprint(k.Port)),
+			Meta: map[string]string{"node": pod.Spec.NodeName},
+		})
+	}
+	return peers, nil
+}
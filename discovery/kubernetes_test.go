@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const onePod = `{"items":[{"metadata":{"name":"pod-a"},"spec":{"nodeName":"n1"},
+	"status":{"phase":"Running","podIP":"10.0.0.1","conditions":[{"type":"Ready","status":"True"}]}}]}`
+
+// The service account token is read again when the kubelet rotates it,
+// and when the API refuses it before the change is seen
+func TestKubernetesTokenRotation(t *testing.T) {
+	valid := "first"
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer "+valid {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, onePod)
+	}))
+	defer api.Close()
+
+	file := filepath.Join(t.TempDir(), "token")
+	write := func(token string, mod time.Time) {
+		if err := os.WriteFile(file, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := time.Now().Add(-time.Hour)
+	write("first", t0)
+	k := &Kubernetes{Namespace: "default", Selector: "app=p2p-test", Port: 8080, apiURL: api.URL, client: api.Client(), tokenFile: file}
+	if err := k.readToken(true); err != nil {
+		t.Fatal(err)
+	}
+	list := func(step string, calls int) {
+		t.Helper()
+		seen = nil
+		peers, err := k.listPeers(context.Background())
+		if err != nil || len(peers) != 1 || peers[0].ID != "pod-a" {
+			t.Fatalf("%s: peers %v, err %v", step, peers, err)
+		}
+		if len(seen) != calls {
+			t.Errorf("%s: %d requests (%v), want %d", step, len(seen), seen, calls)
+		}
+	}
+	list("first token", 1)
+
+	// Rotated: the new file is picked up before the request
+	valid = "second"
+	write("second", t0.Add(time.Minute))
+	list("rotated token", 1)
+
+	// Refused with a file that looks unchanged: read again and retry
+	valid = "third"
+	write("third", t0.Add(time.Minute))
+	list("refused token", 2)
+
+	// Still refused after reading it again: an error, not a loop
+	valid = "fourth"
+	seen = nil
+	if _, err := k.listPeers(context.Background()); err == nil {
+		t.Error("listed pods with a refused token")
+	}
+	if len(seen) != 2 {
+		t.Errorf("%d requests with a refused token, want 2", len(seen))
+	}
+}
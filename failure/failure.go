@@ -0,0 +1,78 @@
+package failure
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of failure detectors.
+const (
+	// Fixed suspects a peer after a fixed number of missed heartbeats
+	Fixed = "fixed"
+	// Phi suspects a peer once the phi-accrual suspicion level, which
+	// adapts to the observed heartbeat intervals, crosses a threshold
+	Phi = "phi"
+)
+
+// Detector judges from the arrival of a peer's heartbeats whether the peer
+// is suspected to have failed. Detectors are not safe for concurrent use.
+type Detector interface {
+	// Heartbeat records a heartbeat that arrived at at
+	Heartbeat(at time.Time)
+	// Suspicion is the level of suspicion at now, comparable with the
+	// detector's threshold; it only grows until the next heartbeat
+	Suspicion(now time.Time) float64
+	// Suspected reports whether the suspicion at now reached the threshold
+	Suspected(now time.Time) bool
+	// Last is the time of the latest heartbeat
+	Last() time.Time
+}
+
+// Config selects and tunes a detector.
+type Config struct {
+	Kind string
+	// Interval is the expected time between heartbeats
+	Interval time.Duration
+	// MaxMissed is the number of missed heartbeats a Fixed detector allows
+	MaxMissed int
+	// Threshold is the phi at which a Phi detector suspects the peer
+	Threshold float64
+	// Window is how many heartbeat intervals a Phi detector remembers
+	Window int
+	// MinStdDev keeps a Phi detector from becoming oversensitive when
+	// heartbeats arrive like clockwork
+	MinStdDev time.Duration
+	// AcceptablePause is added to the mean interval, allowing for pauses
+	// such as garbage collection before a Phi detector's suspicion rises
+	AcceptablePause time.Duration
+}
+
+func (c Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("failure detection needs a positive heartbeat interval")
+	}
+	switch c.Kind {
+	case Fixed:
+		if c.MaxMissed < 1 {
+			return fmt.Errorf("failure detector must allow at least 1 missed heartbeat")
+		}
+	case Phi:
+		if c.Threshold <= 0 || c.Window < 2 {
+			return fmt.Errorf("phi threshold must be positive and its window at least 2")
+		}
+		if c.MinStdDev <= 0 || c.AcceptablePause < 0 {
+			return fmt.Errorf("phi minimum standard deviation must be positive and acceptable pause not negative")
+		}
+	default:
+		return fmt.Errorf("unknown failure detector %q, want %s or %s", c.Kind, Fixed, Phi)
+	}
+	return nil
+}
+
+// New returns a detector for a peer whose first heartbeat arrived at first.
+func (c Config) New(first time.Time) Detector {
+	if c.Kind == Phi {
+		return newPhi(c, first)
+	}
+	return &fixed{interval: c.Interval, maxMissed: c.MaxMissed, last: first}
+}
@@ -0,0 +1,211 @@
+package failure
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func phiConfig() Config {
+	return Config{Kind: Phi, Interval: time.Second, Threshold: 8, Window: 10, MinStdDev: 100 * time.Millisecond}
+}
+
+// beats sends n heartbeats every interval after the last one and returns
+// the time of the last
+func beats(d Detector, n int, interval time.Duration) time.Time {
+	at := d.Last()
+	for i := 0; i < n; i++ {
+		at = at.Add(interval)
+		d.Heartbeat(at)
+	}
+	return at
+}
+
+// suspectedAfter is how long after the last heartbeat d suspects its peer,
+// to a millisecond
+func suspectedAfter(t *testing.T, d Detector) time.Duration {
+	t.Helper()
+	last := d.Last()
+	for e := time.Duration(0); e <= time.Minute; e += time.Millisecond {
+		if d.Suspected(last.Add(e)) {
+			return e
+		}
+	}
+	t.Fatal("never suspected")
+	return 0
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		c    Config
+		want string
+	}{
+		{"fixed", Config{Kind: Fixed, Interval: time.Second, MaxMissed: 3}, ""},
+		{"phi", phiConfig(), ""},
+		{"no interval", Config{Kind: Fixed, MaxMissed: 3}, "positive heartbeat interval"},
+		{"no missed heartbeats", Config{Kind: Fixed, Interval: time.Second}, "at least 1 missed"},
+		{"phi threshold", Config{Kind: Phi, Interval: time.Second, Window: 10, MinStdDev: time.Millisecond}, "phi threshold"},
+		{"phi window", Config{Kind: Phi, Interval: time.Second, Threshold: 8, Window: 1, MinStdDev: time.Millisecond}, "window at least 2"},
+		{"phi standard deviation", Config{Kind: Phi, Interval: time.Second, Threshold: 8, Window: 10}, "standard deviation"},
+		{"negative pause", Config{Kind: Phi, Interval: time.Second, Threshold: 8, Window: 10, MinStdDev: time.Millisecond, AcceptablePause: -1}, "acceptable pause"},
+		{"unknown kind", Config{Kind: "swim", Interval: time.Second}, `unknown failure detector "swim"`},
+	} {
+		err := tc.c.Validate()
+		if tc.want == "" && err != nil || tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestFixed(t *testing.T) {
+	d := Config{Kind: Fixed, Interval: time.Second, MaxMissed: 3}.New(t0)
+	for _, tc := range []struct {
+		elapsed   time.Duration
+		suspicion float64
+		suspected bool
+	}{
+		{0, 0, false},
+		{1500 * time.Millisecond, 1.5, false},
+		{3*time.Second - time.Nanosecond, 3 - 1e-9, false},
+		{3 * time.Second, 3, true},
+		{time.Hour, 3600, true},
+	} {
+		now := t0.Add(tc.elapsed)
+		if got := d.Suspicion(now); math.Abs(got-tc.suspicion) > 1e-9 {
+			t.Errorf("suspicion after %s = %v, want %v", tc.elapsed, got, tc.suspicion)
+		}
+		if got := d.Suspected(now); got != tc.suspected {
+			t.Errorf("suspected after %s = %v, want %v", tc.elapsed, got, tc.suspected)
+		}
+	}
+
+	// A heartbeat clears the suspicion, a late one from before doesn't
+	// bring it back
+	d.Heartbeat(t0.Add(4 * time.Second))
+	d.Heartbeat(t0.Add(2 * time.Second))
+	if got := d.Last(); !got.Equal(t0.Add(4 * time.Second)) {
+		t.Errorf("last heartbeat %v, want %v", got, t0.Add(4*time.Second))
+	}
+	if d.Suspected(t0.Add(6 * time.Second)) {
+		t.Error("suspected 2 intervals after a heartbeat")
+	}
+	if !d.Suspected(t0.Add(7 * time.Second)) {
+		t.Error("not suspected 3 intervals after a heartbeat")
+	}
+}
+
+func TestPhiRegularHeartbeats(t *testing.T) {
+	d := phiConfig().New(t0)
+	last := beats(d, 20, time.Second)
+
+	// Up to the expected interval the peer is fine, soon after it's not
+	if s := d.Suspicion(last.Add(time.Second)); s > 1 {
+		t.Errorf("phi %.2f when the next heartbeat is due", s)
+	}
+	// With intervals like clockwork the spread is the minimum of 100ms:
+	// phi 8 is 5.6 of them past the mean
+	if e := suspectedAfter(t, d); e < 1500*time.Millisecond || e > 1700*time.Millisecond {
+		t.Errorf("suspected %s after the last heartbeat, want about 1.56s", e)
+	}
+
+	// Suspicion only grows until the next heartbeat, which clears it
+	prev := -1.0
+	for e := time.Duration(0); e < 10*time.Second; e += 50 * time.Millisecond {
+		s := d.Suspicion(last.Add(e))
+		if s < prev || math.IsNaN(s) || math.IsInf(s, 0) {
+			t.Fatalf("phi %v after %s, after %v before", s, e, prev)
+		}
+		prev = s
+	}
+	d.Heartbeat(last.Add(3 * time.Second))
+	if d.Suspected(last.Add(3 * time.Second)) {
+		t.Error("suspected right after a heartbeat")
+	}
+}
+
+func TestPhiAdapts(t *testing.T) {
+	fast, slow := phiConfig().New(t0), phiConfig().New(t0)
+	beats(fast, 20, time.Second)
+	beats(slow, 20, 3*time.Second)
+	if !fast.Suspected(fast.Last().Add(2500 * time.Millisecond)) {
+		t.Error("a peer beating every second is not suspected after 2.5s")
+	}
+	if slow.Suspected(slow.Last().Add(2500 * time.Millisecond)) {
+		t.Error("a peer beating every 3s is suspected after 2.5s")
+	}
+
+	// After a window of them, only the new intervals count
+	beats(fast, 10, 3*time.Second)
+	if fast.Suspected(fast.Last().Add(2500 * time.Millisecond)) {
+		t.Error("still judged by intervals that left the window")
+	}
+	if a, b := suspectedAfter(t, fast), suspectedAfter(t, slow); a != b {
+		t.Errorf("suspected after %s and %s with the same intervals in the window", a, b)
+	}
+}
+
+func TestPhiJitter(t *testing.T) {
+	steady, jittery := phiConfig().New(t0), phiConfig().New(t0)
+	beats(steady, 20, time.Second)
+	for i := 0; i < 20; i++ {
+		beats(jittery, 1, time.Second+time.Duration(i%2*2-1)*400*time.Millisecond)
+	}
+	// A spread of 400ms takes longer to be sure of a failure than 100ms
+	if a, b := suspectedAfter(t, steady), suspectedAfter(t, jittery); b <= a+time.Second {
+		t.Errorf("jittery peer suspected after %s, steady one after %s", b, a)
+	}
+}
+
+func TestPhiAcceptablePause(t *testing.T) {
+	c := phiConfig()
+	plain := c.New(t0)
+	c.AcceptablePause = 2 * time.Second
+	paused := c.New(t0)
+	beats(plain, 20, time.Second)
+	beats(paused, 20, time.Second)
+	if a, b := suspectedAfter(t, plain), suspectedAfter(t, paused); b-a != 2*time.Second {
+		t.Errorf("suspected after %s with a pause of 2s, %s without", b, a)
+	}
+}
+
+func TestPhiBeforeHeartbeats(t *testing.T) {
+	// Until heartbeats arrive the detector guesses from the configured
+	// interval, with a quarter of it as spread
+	d := phiConfig().New(t0)
+	if d.Suspected(t0.Add(time.Second)) {
+		t.Error("suspected one interval after the first heartbeat")
+	}
+	if !d.Suspected(t0.Add(3 * time.Second)) {
+		t.Error("not suspected 3 intervals after the first heartbeat")
+	}
+}
+
+func TestPhiIgnoresStaleHeartbeats(t *testing.T) {
+	d := phiConfig().New(t0)
+	last := beats(d, 20, time.Second)
+	before := suspectedAfter(t, d)
+	// A duplicate or reordered heartbeat adds no interval of 0
+	d.Heartbeat(last)
+	d.Heartbeat(last.Add(-time.Second))
+	if !d.Last().Equal(last) {
+		t.Errorf("last heartbeat %v, want %v", d.Last(), last)
+	}
+	if after := suspectedAfter(t, d); after != before {
+		t.Errorf("suspected after %s, %s before the stale heartbeats", after, before)
+	}
+}
+
+func TestPhiExtremes(t *testing.T) {
+	d := phiConfig().New(t0)
+	last := beats(d, 20, time.Second)
+	for _, e := range []time.Duration{-time.Hour, 0, 24 * time.Hour, 1 << 62} {
+		s := d.Suspicion(last.Add(e))
+		if math.IsNaN(s) || math.IsInf(s, 0) || s < 0 {
+			t.Errorf("phi %v after %s", s, e)
+		}
+	}
+}
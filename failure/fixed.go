@@ -0,0 +1,29 @@
+package failure
+
+import "time"
+
+// fixed counts the heartbeats missed since the last one
+type fixed struct {
+	interval  time.Duration
+	maxMissed int
+	last      time.Time
+}
+
+func (d *fixed) Heartbeat(at time.Time) {
+	if at.After(d.last) {
+		d.last = at
+	}
+}
+
+// Suspicion is the number of heartbeat intervals since the last one
+func (d *fixed) Suspicion(now time.Time) float64 {
+	return float64(now.Sub(d.last)) / float64(d.interval)
+}
+
+func (d *fixed) Suspected(now time.Time) bool {
+	return now.Sub(d.last) >= time.Duration(d.maxMissed)*d.interval
+}
+
+func (d *fixed) Last() time.Time {
+	return d.last
+}
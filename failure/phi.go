@@ -0,0 +1,86 @@
+package failure
+
+import (
+	"math"
+	"time"
+)
+
+// phi is the accrual failure detector of Hayashibara et al., "The φ
+// Accrual Failure Detector" (2004). Heartbeat intervals are assumed to be
+// normally distributed with the mean and standard deviation of the recent
+// ones, and phi = -log10(P(the next heartbeat is still to come after the
+// time elapsed)): phi 1 means a 10% chance of being wrong when suspecting
+// the peer, phi 8 a 0.000001% chance.
+type phi struct {
+	threshold float64
+	minStdDev float64
+	pause     float64
+
+	intervals []float64 // seconds, a ring of the most recent
+	next      int
+	sum, sq   float64
+	last      time.Time
+}
+
+func newPhi(c Config, first time.Time) *phi {
+	d := &phi{
+		threshold: c.Threshold,
+		minStdDev: c.MinStdDev.Seconds(),
+		pause:     c.AcceptablePause.Seconds(),
+		intervals: make([]float64, 0, c.Window),
+		last:      first,
+	}
+	// Start from the expected interval with a generous spread, until real
+	// intervals replace the guess
+	mean := c.Interval.Seconds()
+	d.add(mean - mean/4)
+	d.add(mean + mean/4)
+	return d
+}
+
+func (d *phi) add(interval float64) {
+	if len(d.intervals) < cap(d.intervals) {
+		d.intervals = append(d.intervals, interval)
+	} else {
+		old := d.intervals[d.next]
+		d.sum -= old
+		d.sq -= old * old
+		d.intervals[d.next] = interval
+		d.next = (d.next + 1) % len(d.intervals)
+	}
+	d.sum += interval
+	d.sq += interval * interval
+}
+
+func (d *phi) Heartbeat(at time.Time) {
+	if !at.After(d.last) {
+		return
+	}
+	d.add(at.Sub(d.last).Seconds())
+	d.last = at
+}
+
+func (d *phi) Suspicion(now time.Time) float64 {
+	n := float64(len(d.intervals))
+	mean := d.sum / n
+	stdDev := math.Sqrt(math.Max(d.sq/n-mean*mean, 0))
+	if stdDev < d.minStdDev {
+		stdDev = d.minStdDev
+	}
+	y := (now.Sub(d.last).Seconds() - mean - d.pause) / stdDev
+	// The logistic approximation of the normal distribution's tail:
+	// P = 1/(1+e^a), so phi = log10(1+e^a), computed without overflow
+	a := y * (1.5976 + 0.070566*y*y)
+	if a > 0 {
+		return (a + math.Log1p(math.Exp(-a))) / math.Ln10
+	}
+	return math.Log1p(math.Exp(a)) / math.Ln10
+}
+
+func (d *phi) Suspected(now time.Time) bool {
+	return d.Suspicion(now) >= d.threshold
+}
+
+func (d *phi) Last() time.Time {
+	return d.last
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/sse"
+)
+
+// fanoutMain runs `fanout [flags] host:port`: it holds many /events
+// subscriptions open on one node and measures broadcast fan-out latency
+func fanoutMain(args []string) int {
+	fs := flag.NewFlagSet("fanout", flag.ExitOnError)
+	subscribers := fs.Int("subscribers", 1000, "number of concurrent event subscriptions")
+	setupRate := fs.Float64("setup-rate", 0, "subscriptions opened per second, 0 opens them all at once")
+	broadcasts := fs.Int("broadcasts", 20, "number of events to broadcast")
+	interval := fs.Duration("interval", 250*time.Millisecond, "time between broadcasts")
+	peerID := fs.String("peer-id", "fanout", "peer ID sent to the target")
+	joinToken := fs.String("join-token", "", "join token or invite vouching for --peer-id to nodes with peer ID access lists")
+	jsonOut := fs.String("json", "", "write the report to this JSON file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s fanout [flags] host:port\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	acl.SetCredential(*joinToken)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	s := &sse.Stress{
+		Target:      fs.Arg(0),
+		PeerID:      *peerID,
+		Subscribers: *subscribers,
+		Broadcasts:  *broadcasts,
+		Interval:    *interval,
+		SetupRate:   *setupRate,
+	}
+	rep := s.Run(context.Background())
+
+	fmt.Printf("subscriptions: %d of %d connected", rep.Connected, rep.Subscribers)
+	if len(rep.SetupFailures) > 0 {
+		fmt.Printf(", failures %v", rep.SetupFailures)
+	}
+	fmt.Printf("\nsetup:      p50 %.3fms  p99 %.3fms  max %.3fms\n", rep.SetupP50, rep.SetupP99, rep.SetupMax)
+	fmt.Printf("fan-out:    p50 %.3fms  p99 %.3fms  p99.9 %.3fms  max %.3fms\n", rep.FanoutP50, rep.FanoutP99, rep.FanoutP999, rep.FanoutMax)
+	fmt.Printf("completion: p50 %.3fms  max %.3fms (until the last subscriber got a broadcast)\n", rep.CompletionP50, rep.CompletionMax)
+	fmt.Printf("deliveries: %d, missed %d, disconnects %d, failed broadcasts %d\n", rep.Deliveries, rep.Missed, rep.Disconnects, rep.BroadcastFails)
+
+	if *jsonOut != "" {
+		data, _ := json.MarshalIndent(rep, "", "  ")
+		if err := os.WriteFile(*jsonOut, append(data, '\n'), 0o644); err != nil {
+			fmt.Println("Error writing report:", err)
+			return 1
+		}
+	}
+	if rep.Connected < rep.Subscribers || rep.Missed > 0 {
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The features nodes offer their peers. Ping, the mux echo, is always
+// offered; the others can be disabled.
+const (
+	Ping     = "ping"
+	Blobs    = "blobs"
+	PubSub   = "pubsub"
+	Sync     = "sync"
+	Transfer = "transfer"
+)
+
+// Optional lists the features that can be disabled, sorted.
+var Optional = []string{Blobs, PubSub, Sync, Transfer}
+
+// Enabled returns the features offered with the comma-separated disabled
+// ones turned off.
+func Enabled(disabled string) ([]string, error) {
+	off := make(map[string]bool)
+	for _, name := range strings.Split(disabled, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i := sort.SearchStrings(Optional, name)
+		if i == len(Optional) || Optional[i] != name {
+			return nil, fmt.Errorf("unknown feature %q, want %s", name, strings.Join(Optional, ", "))
+		}
+		off[name] = true
+	}
+	enabled := []string{Ping}
+	for _, name := range Optional {
+		if !off[name] {
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled, nil
+}
+
+// Has reports whether list includes feature.
+func Has(list []string, feature string) bool {
+	for _, f := range list {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gogc       = flag.String("gogc", "", "GC target percentage like GOGC, or off (default: the GOGC environment variable)")
+	gomemlimit = flag.String("gomemlimit", "", "soft memory limit like GOMEMLIMIT, e.g. 512MiB (default: the GOMEMLIMIT environment variable)")
+	ballastMB  = flag.Int("gc-ballast-mb", 0, "MiB of never-touched heap to allocate so the GC runs less often")
+)
+
+// ballast is only referenced to keep it alive; being untouched it costs
+// address space but no resident memory
+var ballast []byte
+
+// tuneGC applies the GC flags
+func tuneGC() error {
+	if *gogc != "" {
+		percent := -1
+		if *gogc != "off" {
+			p, err := strconv.Atoi(*gogc)
+			if err != nil {
+				return fmt.Errorf("invalid --gogc %q", *gogc)
+			}
+			percent = p
+		}
+		debug.SetGCPercent(percent)
+	}
+	if *gomemlimit != "" {
+		limit, err := parseBytes(*gomemlimit)
+		if err != nil {
+			return fmt.Errorf("invalid --gomemlimit: %w", err)
+		}
+		debug.SetMemoryLimit(limit)
+	}
+	if *ballastMB > 0 {
+		ballast = make([]byte, *ballastMB<<20)
+	}
+	return nil
+}
+
+// parseBytes parses sizes the way GOMEMLIMIT does: a number with an
+// optional B, KiB, MiB, GiB or TiB suffix. The decimal KB, MB, GB and TB
+// are accepted too.
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+	}
+	num, mult := s, int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			num, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mult, nil
+}
+
+// observeGCPauses feeds every stop-the-world pause into gcPauseDuration.
+// The runtime keeps the last 256 pauses, far more than occur per second.
+func observeGCPauses() {
+	var last uint32
+	var ms runtime.MemStats
+	for range time.Tick(time.Second) {
+		runtime.ReadMemStats(&ms)
+		from := last + 1
+		if ms.NumGC > 256 && from < ms.NumGC-255 {
+			from = ms.NumGC - 255
+		}
+		for i := from; i <= ms.NumGC; i++ {
+			gcPauseDuration.Observe(float64(ms.PauseNs[(i+255)%256]) / 1e9)
+		}
+		last = ms.NumGC
+	}
+}
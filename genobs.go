@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"TestProject/observability"
+)
+
+// genObservabilityMain runs `gen-observability [flags]`: it writes
+// Prometheus rules and a Grafana dashboard for the metrics this binary
+// registers, or with --check tells whether earlier output is still current
+func genObservabilityMain(args []string) int {
+	fs := flag.NewFlagSet("gen-observability", flag.ExitOnError)
+	rulesOut := fs.String("rules", "p2p_test.rules.yml", "write the recording and alerting rules to this file, - for stdout, empty to skip")
+	dashboardOut := fs.String("dashboard", "p2p_test-dashboard.json", "write the Grafana dashboard to this file, - for stdout, empty to skip")
+	check := fs.Bool("check", false, "don't write, exit 1 if the files differ from what would be generated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gen-observability [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	metrics, err := observability.Metrics()
+	if err != nil {
+		fmt.Println("Error listing metrics:", err)
+		return 1
+	}
+	rules, err := observability.Rules(metrics)
+	if err != nil {
+		fmt.Println("Error generating rules:", err)
+		return 1
+	}
+	rulesData, err := rules.Marshal()
+	if err != nil {
+		fmt.Println("Error encoding rules:", err)
+		return 1
+	}
+	dashboardData, err := observability.NewDashboard(metrics).Marshal()
+	if err != nil {
+		fmt.Println("Error encoding dashboard:", err)
+		return 1
+	}
+
+	status := 0
+	for _, out := range []struct {
+		path string
+		data []byte
+	}{{*rulesOut, rulesData}, {*dashboardOut, dashboardData}} {
+		switch {
+		case out.path == "":
+		case *check:
+			if old, err := os.ReadFile(out.path); err != nil || !bytes.Equal(old, out.data) {
+				fmt.Printf("%s is out of date, rerun %s gen-observability\n", out.path, os.Args[0])
+				status = 1
+			}
+		case out.path == "-":
+			os.Stdout.Write(out.data)
+		default:
+			if err := os.WriteFile(out.path, out.data, 0o644); err != nil {
+				fmt.Println("Error writing", out.path+":", err)
+				return 1
+			}
+			fmt.Printf("wrote %s\n", out.path)
+		}
+	}
+	return status
+}
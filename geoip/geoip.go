@@ -0,0 +1,176 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/discovery"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var peerInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "peer_info",
+		Help: "Location of peers looked up in the GeoIP databases, always 1; join on peer to break other peer metrics down by country or AS",
+	},
+	[]string{"peer", "ip", "country", "asn", "as_org"},
+)
+
+func init() {
+	prometheus.MustRegister(peerInfo)
+}
+
+// Info is where a peer's address is, as far as the databases know.
+type Info struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"`
+	ASN     uint64 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// DB combines databases, e.g. a country and an ASN database; for each
+// field the first database that knows it wins.
+type DB []*Reader
+
+// OpenDB opens the comma-separated MMDB files in paths.
+func OpenDB(paths string) (DB, error) {
+	var db DB
+	for _, path := range strings.Split(paths, ",") {
+		r, err := Open(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		db = append(db, r)
+	}
+	return db, nil
+}
+
+// Lookup returns what the databases know about ip.
+func (db DB) Lookup(ip net.IP) (Info, error) {
+	info := Info{IP: ip.String()}
+	for _, r := range db {
+		rec, err := r.Lookup(ip)
+		if err != nil {
+			return info, fmt.Errorf("%s: %w", r.Type, err)
+		}
+		if info.Country == "" {
+			info.Country = country(rec)
+		}
+		if n, ok := rec["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = n
+		}
+		if org, ok := rec["autonomous_system_organization"].(string); ok && info.ASOrg == "" {
+			info.ASOrg = org
+		}
+	}
+	return info, nil
+}
+
+// country is the ISO code of the country of a GeoIP2 record, else of the
+// country the network is registered in. DB-IP and IPinfo lite databases
+// have a top-level country_code.
+func country(rec map[string]interface{}) string {
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	code, _ := rec["country_code"].(string)
+	return code
+}
+
+// Enricher looks up the location of every registered peer, refreshing it
+// every Interval in case addresses change, and exports it as peer_info.
+type Enricher struct {
+	DB       DB
+	Registry *discovery.Registry
+	Interval time.Duration
+
+	mu    sync.Mutex
+	peers map[string]Info
+}
+
+// Run looks up the peers until ctx is cancelled.
+func (e *Enricher) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		e.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Enricher) refresh(ctx context.Context) {
+	found := make(map[string]Info)
+	for _, p := range e.Registry.List() {
+		info, err := e.lookup(ctx, p.Addr)
+		if err != nil {
+			log.Printf("geoip: %s: %v", p.ID, err)
+			continue
+		}
+		found[p.ID] = info
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, old := range e.peers {
+		if cur, ok := found[id]; !ok || cur != old {
+			peerInfo.DeleteLabelValues(labels(id, old)...)
+		}
+	}
+	for id, info := range found {
+		peerInfo.WithLabelValues(labels(id, info)...).Set(1)
+	}
+	e.peers = found
+}
+
+func labels(peer string, info Info) []string {
+	asn := ""
+	if info.ASN != 0 {
+		asn = strconv.FormatUint(info.ASN, 10)
+	}
+	return []string{peer, info.IP, info.Country, asn, info.ASOrg}
+}
+
+// lookup resolves the host of addr and looks up its first address
+func (e *Enricher) lookup(ctx context.Context, addr string) (Info, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return Info{}, err
+		}
+		if len(addrs) == 0 {
+			return Info{}, fmt.Errorf("no addresses for %s", host)
+		}
+		ip = addrs[0].IP
+	}
+	return e.DB.Lookup(ip)
+}
+
+// Get returns the location of a peer, if it was looked up.
+func (e *Enricher) Get(peer string) (Info, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, ok := e.peers[peer]
+	return info, ok
+}
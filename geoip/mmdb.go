@@ -0,0 +1,331 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Reader looks up addresses in a MaxMind DB (MMDB) file, the format of
+// GeoLite2, GeoIP2, DB-IP and IPinfo databases. The file is read into
+// memory once.
+type Reader struct {
+	Type string // database_type of the metadata, e.g. GeoLite2-ASN
+
+	data       []byte // search tree, then the data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+}
+
+// Open reads the MMDB file at path.
+func Open(path string) (*Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+func newReader(data []byte) (*Reader, error) {
+	i := bytes.LastIndex(data, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file, no metadata found")
+	}
+	metaStart := uint(i + len(metadataMarker))
+	d := decoder{data: data[metaStart:]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("reading metadata: not a map")
+	}
+	r := &Reader{data: data[:i]}
+	r.Type, _ = meta["database_type"].(string)
+	r.nodeCount = uintOf(meta["node_count"])
+	r.recordSize = uintOf(meta["record_size"])
+	r.ipVersion = uintOf(meta["ip_version"])
+	if major := uintOf(meta["binary_format_major_version"]); major != 2 {
+		return nil, fmt.Errorf("unsupported format version %d", major)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	r.dataStart = treeSize + 16
+	if r.dataStart > uint(len(r.data)) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	// IPv4 addresses live at ::a.b.c.d of IPv6 trees
+	if r.ipVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+			r.ipv4Start, err = r.record(r.ipv4Start, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func uintOf(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+// Lookup returns the record of the network containing ip, or nil if the
+// database has none.
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node, bits := uint(0), []byte(ip.To16())
+	if ip4 := ip.To4(); ip4 != nil {
+		node, bits = r.ipv4Start, ip4
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	if bits == nil {
+		return nil, fmt.Errorf("invalid IP address %v", ip)
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		var err error
+		if node, err = r.record(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := node - r.nodeCount - 16
+	d := decoder{data: r.data[r.dataStart:]}
+	v, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := v.(map[string]interface{})
+	return rec, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (r *Reader) record(node, bit uint) (uint, error) {
+	off := node * r.recordSize / 4
+	if off+r.recordSize/4 > uint(len(r.data)) {
+		return 0, errors.New("corrupt search tree")
+	}
+	b := r.data[off:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// decoder reads the data section format of MMDB files
+type decoder struct {
+	data []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+var errTruncated = errors.New("corrupt data section: truncated")
+
+// decode returns the value at off and the offset after it
+func (d *decoder) decode(off uint) (interface{}, uint, error) {
+	return d.decodeDepth(off, 0)
+}
+
+func (d *decoder) decodeDepth(off uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("corrupt data section: nested too deep")
+	}
+	if off >= uint(len(d.data)) {
+		return nil, 0, errTruncated
+	}
+	ctrl := d.data[off]
+	off++
+	kind := uint(ctrl >> 5)
+	if kind == typePointer {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeDepth(ptr, depth+1)
+		return v, next, err
+	}
+	if kind == typeExtended {
+		if off >= uint(len(d.data)) {
+			return nil, 0, errTruncated
+		}
+		kind = 7 + uint(d.data[off])
+		off++
+	}
+	size, off, err := d.size(ctrl, off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == typeMap {
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("corrupt data section: map key is not a string")
+			}
+			v, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	}
+	if kind == typeArray {
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	}
+	if kind == typeBool {
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d.data)) {
+		return nil, 0, errTruncated
+	}
+	b := d.data[off : off+size]
+	off += size
+	switch kind {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("corrupt data section: double of wrong size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("corrupt data section: float of wrong size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("corrupt data section: integer too long")
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("corrupt data section: integer too long")
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), off, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), off, nil
+	default:
+		return nil, 0, fmt.Errorf("corrupt data section: unknown type %d", kind)
+	}
+}
+
+func (d *decoder) size(ctrl byte, off uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, off, nil
+	}
+	n := size - 28
+	if off+n > uint(len(d.data)) {
+		return 0, 0, errTruncated
+	}
+	var ext uint
+	for _, c := range d.data[off : off+n] {
+		ext = ext<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		return 29 + ext, off + n, nil
+	case 30:
+		return 285 + ext, off + n, nil
+	default:
+		return 65821 + ext, off + n, nil
+	}
+}
+
+// pointer returns the offset a pointer points to and the offset after it
+func (d *decoder) pointer(ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if off+n > uint(len(d.data)) {
+		return 0, 0, errTruncated
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, c := range d.data[off : off+n] {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, off + n, nil
+}
@@ -0,0 +1,317 @@
+package geoip
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fixtures are built here rather than checked in: a search tree over
+// the given networks, a data section with one record per network and the
+// metadata, as laid out by the MaxMind DB spec.
+
+// ctrl encodes the control byte of a value of kind and size, for sizes
+// below 285
+func ctrl(kind, size int) []byte {
+	var extra []byte
+	if size >= 29 {
+		size, extra = 29, []byte{byte(size - 29)}
+	}
+	b := []byte{byte(kind<<5 | size)}
+	if kind > 7 {
+		b = []byte{byte(size), byte(kind - 7)}
+	}
+	return append(b, extra...)
+}
+
+func str(s string) []byte { return append(ctrl(typeString, len(s)), s...) }
+
+func uintN(kind int, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append(ctrl(kind, len(b)), b...)
+}
+
+// mapOf encodes a map of the keys and encoded values in kv
+func mapOf(kv ...interface{}) []byte {
+	b := ctrl(typeMap, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, str(kv[i].(string))...)
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+func metadata(nodeCount, recordSize, ipVersion, major uint64) []byte {
+	return mapOf(
+		"database_type", str("Test"),
+		"node_count", uintN(typeUint32, nodeCount),
+		"record_size", uintN(typeUint16, recordSize),
+		"ip_version", uintN(typeUint16, ipVersion),
+		"binary_format_major_version", uintN(typeUint16, major),
+	)
+}
+
+// network is a prefix, as a string of bits, and its encoded record
+type network struct {
+	prefix string
+	record []byte
+}
+
+type node struct{ next, data [2]int }
+
+// build returns an MMDB file with the networks, which are IPv4 networks
+// mapped into the IPv6 space if ipVersion is 6
+func build(t *testing.T, ipVersion, recordSize uint64, nets []network) []byte {
+	t.Helper()
+	nodes := []node{{next: [2]int{-1, -1}, data: [2]int{-1, -1}}}
+	for i, n := range nets {
+		bits := n.prefix
+		if ipVersion == 6 {
+			bits = strings.Repeat("0", 96) + bits
+		}
+		cur := 0
+		for j, c := range bits {
+			bit := int(c - '0')
+			if j == len(bits)-1 {
+				nodes[cur].data[bit] = i
+				break
+			}
+			if nodes[cur].next[bit] < 0 {
+				nodes[cur].next[bit] = len(nodes)
+				nodes = append(nodes, node{next: [2]int{-1, -1}, data: [2]int{-1, -1}})
+			}
+			cur = nodes[cur].next[bit]
+		}
+	}
+
+	var data []byte
+	offsets := make([]int, len(nets))
+	for i, n := range nets {
+		offsets[i] = len(data)
+		data = append(data, n.record...)
+	}
+	count := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		var rec [2]uint32
+		for bit := 0; bit < 2; bit++ {
+			switch {
+			case n.next[bit] >= 0:
+				rec[bit] = uint32(n.next[bit])
+			case n.data[bit] >= 0:
+				rec[bit] = uint32(count + 16 + offsets[n.data[bit]])
+			default:
+				rec[bit] = uint32(count)
+			}
+		}
+		l, r := rec[0], rec[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4|r>>24), byte(r>>16), byte(r>>8), byte(r))
+		default:
+			tree = append(tree, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	return assemble(tree, data, metadata(uint64(count), recordSize, ipVersion, 2))
+}
+
+func assemble(tree, data, meta []byte) []byte {
+	var b []byte
+	b = append(b, tree...)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return append(b, meta...)
+}
+
+// testNets: 0.0.0.0/2 is in NL, 64.0.0.0/2 belongs to an AS, 128.0.0.0/1
+// is unknown
+var testNets = []network{
+	{"00", mapOf("country", mapOf("iso_code", str("NL")))},
+	{"01", mapOf("autonomous_system_number", uintN(typeUint32, 64512), "autonomous_system_organization", str("Example"))},
+}
+
+func TestLookup(t *testing.T) {
+	for _, ipVersion := range []uint64{4, 6} {
+		for _, size := range []uint64{24, 28, 32} {
+			r, err := newReader(build(t, ipVersion, size, testNets))
+			if err != nil {
+				t.Fatalf("IPv%d, record size %d: %v", ipVersion, size, err)
+			}
+			for _, tc := range []struct {
+				ip   string
+				want map[string]interface{}
+			}{
+				{"10.1.2.3", map[string]interface{}{"country": map[string]interface{}{"iso_code": "NL"}}},
+				{"64.0.0.1", map[string]interface{}{"autonomous_system_number": uint64(64512), "autonomous_system_organization": "Example"}},
+				{"200.0.0.1", nil},
+				{"2001:db8::1", nil},
+			} {
+				got, err := r.Lookup(net.ParseIP(tc.ip))
+				if err != nil {
+					t.Errorf("IPv%d, record size %d: Lookup(%s): %v", ipVersion, size, tc.ip, err)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("IPv%d, record size %d: Lookup(%s) = %v, want %v", ipVersion, size, tc.ip, got, tc.want)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, build(t, 6, 28, testNets), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]Info{
+		"10.0.0.1": {IP: "10.0.0.1", Country: "NL"},
+		"64.0.0.1": {IP: "64.0.0.1", ASN: 64512, ASOrg: "Example"},
+	} {
+		got, err := db.Lookup(net.ParseIP(ip))
+		if err != nil || got != want {
+			t.Errorf("Lookup(%s) = %+v, %v, want %+v", ip, got, err, want)
+		}
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestNewReaderMalformed(t *testing.T) {
+	valid := build(t, 4, 24, testNets)
+	tree := make([]byte, 6)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "no metadata found"},
+		{"no metadata", []byte("not a database"), "no metadata found"},
+		{"metadata not a map", assemble(tree, nil, str("map")), "not a map"},
+		{"truncated metadata", valid[:len(valid)-3], "truncated"},
+		{"format version", assemble(tree, nil, metadata(1, 24, 4, 1)), "unsupported format version 1"},
+		{"record size", assemble(tree, nil, metadata(1, 20, 4, 2)), "unsupported record size 20"},
+		{"IP version", assemble(tree, nil, metadata(1, 24, 5, 2)), "unsupported IP version 5"},
+		{"tree larger than the file", assemble(tree, nil, metadata(100, 24, 4, 2)), "search tree larger"},
+		{"tree of zero records", assemble(make([]byte, 6*10), nil, metadata(10, 24, 6, 2)), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newReader(tc.data)
+			if tc.want == "" {
+				// A tree of zero records loops at node 0, without data
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rec, err := r.Lookup(net.ParseIP("10.0.0.1")); rec != nil || err != nil {
+					t.Errorf("Lookup = %v, %v, want nothing", rec, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLookupCorruptData(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		record []byte
+		want   string
+	}{
+		{"truncated string", append(ctrl(typeString, 10), "short"...), "truncated"},
+		{"truncated map", ctrl(typeMap, 2), "truncated"},
+		{"pointer loop", []byte{typePointer << 5, 0}, "nested too deep"},
+		{"map key not a string", append(ctrl(typeMap, 1), append(uintN(typeUint16, 1), str("v")...)...), "map key is not a string"},
+		{"double of wrong size", append(ctrl(typeDouble, 4), 0, 0, 0, 0), "double of wrong size"},
+		{"float of wrong size", append(ctrl(typeFloat, 8), make([]byte, 8)...), "float of wrong size"},
+		{"integer too long", append(ctrl(typeUint64, 9), make([]byte, 9)...), "integer too long"},
+		{"unknown type", ctrl(typeEndMarker, 0), "unknown type"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newReader(build(t, 4, 24, []network{{"0", tc.record}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = r.Lookup(net.ParseIP("10.0.0.1"))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want interface{}
+		next uint
+	}{
+		{"uint16", []byte{typeUint16<<5 | 2, 0x01, 0x02}, uint64(0x0102), 3},
+		{"uint32 zero", ctrl(typeUint32, 0), uint64(0), 1},
+		{"uint64", append(ctrl(typeUint64, 8), 0x80, 0, 0, 0, 0, 0, 0, 1), uint64(1<<63 | 1), 10},
+		{"negative int32", append(ctrl(typeInt32, 4), 0xff, 0xff, 0xff, 0xfe), int64(-2), 6},
+		{"uint128", append(ctrl(typeUint128, 2), 0x01, 0x00), big.NewInt(256), 4},
+		{"true", ctrl(typeBool, 1), true, 2},
+		{"false", ctrl(typeBool, 0), false, 2},
+		{"double", append(ctrl(typeDouble, 8), 0x3f, 0xf8, 0, 0, 0, 0, 0, 0), 1.5, 9},
+		{"float", append(ctrl(typeFloat, 4), 0x3f, 0xc0, 0, 0), 1.5, 6},
+		{"bytes", append(ctrl(typeBytes, 2), 0xde, 0xad), []byte{0xde, 0xad}, 3},
+		{"array", append(append(ctrl(typeArray, 2), str("a")...), str("b")...), []interface{}{"a", "b"}, 6},
+		{"size of one extra byte", append([]byte{typeString<<5 | 29, 1}, strings.Repeat("x", 30)...), strings.Repeat("x", 30), 32},
+		{"size of two extra bytes", append([]byte{typeString<<5 | 30, 0, 15}, long...), long, 303},
+		{"pointer", append([]byte{typePointer << 5, 3, 0xff}, str("p")...), "p", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := decoder{data: tc.data}
+			got, next, err := d.decode(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) || next != tc.next {
+				t.Errorf("decode = %#v, %d, want %#v, %d", got, next, tc.want, tc.next)
+			}
+		})
+	}
+}
+
+// Every prefix of a database is either rejected or answers lookups, never
+// panics
+func TestTruncated(t *testing.T) {
+	for _, ipVersion := range []uint64{4, 6} {
+		valid := build(t, ipVersion, 28, testNets)
+		for n := 0; n < len(valid); n++ {
+			data := append([]byte(nil), valid[:n]...)
+			r, err := newReader(data)
+			if err != nil {
+				continue
+			}
+			for _, ip := range []string{"10.0.0.1", "64.0.0.1", "200.0.0.1", "::1"} {
+				r.Lookup(net.ParseIP(ip))
+			}
+		}
+		cut := bytes.Index(valid, metadataMarker)
+		if _, err := newReader(valid[:cut]); err == nil {
+			t.Errorf("IPv%d: read a database without metadata", ipVersion)
+		}
+	}
+}
@@ -2,7 +2,17 @@ module TestProject
 
 go 1.19
 
-require github.com/prometheus/client_golang v1.19.1
+require (
+	github.com/HdrHistogram/hdrhistogram-go v1.1.2
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/fxamacker/cbor/v2 v2.6.0
+	github.com/golang/snappy v0.0.4
+	github.com/hashicorp/yamux v0.1.1
+	github.com/klauspost/compress v1.17.4
+	github.com/prometheus/client_golang v1.19.1
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -10,6 +20,6 @@ require (
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.17.0 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/client"
+	"TestProject/discovery"
+)
+
+// leaveHandler removes the calling peer from the registry when it shuts
+// down cleanly, rather than waiting for its pings and registrations to
+// time out. A collector also marks the peer's results as final. Only a
+// peer itself may leave: with join tokens the one they vouch for, without
+// them a known peer only from its own address.
+func leaveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.Header.Get(acl.PeerIDHeader)
+	if admission.Enabled() {
+		id = acl.Peer(r)
+	}
+	if id == "" {
+		apierror.Error(w, r, "missing "+acl.PeerIDHeader+" header", http.StatusBadRequest)
+		return
+	}
+	// Without join tokens the address of a known peer is the only proof
+	// of its ID, so nobody else can mark it as left here or in the results
+	if !admission.Enabled() {
+		p, known := registry.Get(id)
+		if !known {
+			apierror.Error(w, r, "only peers in the registry can leave without a join token", http.StatusForbidden)
+			return
+		}
+		if !fromAddr(r, p.Addr) {
+			apierror.Error(w, r, "a peer can only leave from its own address", http.StatusForbidden)
+			return
+		}
+	}
+	registry.Leave(id)
+	if resultCollector != nil {
+		resultCollector.Leave(id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fromAddr reports whether r was sent from the host of addr
+func fromAddr(r *http.Request, addr string) bool {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ips, err := net.DefaultResolver.LookupIP(r.Context(), "ip", host)
+	if err != nil {
+		return false
+	}
+	from := net.ParseIP(remote)
+	for _, ip := range ips {
+		if ip.Equal(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// sayGoodbye tells every peer, and the collector if there is one, that
+// this node is leaving, until ctx is done
+func sayGoodbye(ctx context.Context, peers []discovery.Peer, collector string) {
+	addrs := make(map[string]bool)
+	for _, p := range peers {
+		addrs[p.Addr] = true
+	}
+	if collector != "" {
+		addrs[collector] = true
+	}
+	var wg sync.WaitGroup
+	for addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			c := client.New(addr, *nodeID)
+			c.Retries = 0
+			if err := c.Leave(ctx); err != nil {
+				goodbyesSent.WithLabelValues("error").Inc()
+				return
+			}
+			goodbyesSent.WithLabelValues("ok").Inc()
+		}(addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,225 @@
+package gossip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"TestProject/cardinality"
+	"TestProject/discovery"
+	"TestProject/features"
+	"TestProject/messaging"
+	"TestProject/sendq"
+	"TestProject/wire"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	messagesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gossip_messages_received_total",
+			Help: "Total number of gossip messages received, duplicates included",
+		},
+		[]string{"topic"},
+	)
+	duplicatesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gossip_duplicates_total",
+			Help: "Total number of received gossip messages suppressed as already seen",
+		},
+		[]string{"topic"},
+	)
+	duplicateRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gossip_duplicate_ratio",
+			Help: "Share of received gossip messages that were duplicates since start",
+		},
+		[]string{"topic"},
+	)
+	forwardedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gossip_forwarded_total",
+			Help: "Total number of gossip messages forwarded to peers",
+		},
+		[]string{"topic"},
+	)
+	publishedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gossip_published_total",
+			Help: "Total number of gossip messages originated by this node",
+		},
+		[]string{"topic"},
+	)
+	seenSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gossip_seen_cache_entries",
+			Help: "Number of message IDs held in the gossip seen-cache",
+		},
+	)
+	seenEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gossip_seen_cache_evictions_total",
+			Help: "Total number of seen-cache entries evicted by size limit or TTL",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(messagesReceived)
+	prometheus.MustRegister(duplicatesTotal)
+	prometheus.MustRegister(duplicateRatio)
+	prometheus.MustRegister(forwardedTotal)
+	prometheus.MustRegister(publishedTotal)
+	prometheus.MustRegister(seenSize)
+	prometheus.MustRegister(seenEvictions)
+}
+
+// Handler is called once per distinct message delivered on a topic.
+type Handler func(m *wire.Message)
+
+// Gossip floods messages to every known peer. Each message carries a
+// unique ID; a bounded seen-cache stops a node from delivering or
+// forwarding the same message twice, and Seq counts the remaining hops.
+type Gossip struct {
+	self     string
+	registry *discovery.Registry
+	msgs     *messaging.Messenger
+	hops     int
+	seen     *seenCache
+	// topics bounds the topic label, which any peer picks, and with it
+	// counts
+	topics *cardinality.Limiter
+
+	mu       sync.Mutex
+	handlers map[string][]Handler
+	counts   map[string][2]float64 // received, duplicates per topic label
+}
+
+// maxTopics is how many topics get their own series; the others share
+// cardinality.Other until one goes unused for an hour
+const maxTopics = 64
+
+// New attaches gossip to msgs. seenSize and seenTTL bound the seen-cache,
+// hops limits how far a message travels.
+func New(self string, reg *discovery.Registry, msgs *messaging.Messenger, hops, seenSize int, seenTTL time.Duration) *Gossip {
+	g := &Gossip{
+		self:     self,
+		registry: reg,
+		msgs:     msgs,
+		hops:     hops,
+		seen:     newSeenCache(seenSize, seenTTL),
+		handlers: make(map[string][]Handler),
+		counts:   make(map[string][2]float64),
+	}
+	g.topics = &cardinality.Limiter{Max: maxTopics, Idle: time.Hour, OnEvict: g.forget}
+	msgs.Handle(wire.KindGossip, g.receive)
+	return g
+}
+
+// Subscribe registers h for messages on topic, including local publishes.
+func (g *Gossip) Subscribe(topic string, h Handler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.handlers[topic] = append(g.handlers[topic], h)
+}
+
+// Publish originates a message on topic and returns its ID.
+func (g *Gossip) Publish(ctx context.Context, topic string, payload []byte) string {
+	m := &wire.Message{
+		Kind:    wire.KindGossip,
+		ID:      newID(),
+		From:    g.self,
+		Seq:     uint64(g.hops),
+		Sent:    time.Now().UnixNano(),
+		Topic:   topic,
+		Payload: payload,
+	}
+	g.seen.add(m.ID)
+	publishedTotal.WithLabelValues(g.topics.Value(topic)).Inc()
+	g.deliver(m)
+	g.forward(ctx, m, "")
+	return m.ID
+}
+
+func (g *Gossip) receive(from string, m *wire.Message) {
+	dup := g.seen.add(m.ID)
+	g.count(m.Topic, dup)
+	if dup {
+		return
+	}
+	g.deliver(m)
+	if m.Seq > 1 {
+		fwd := *m
+		fwd.Seq--
+		g.forward(context.Background(), &fwd, from)
+	}
+}
+
+func (g *Gossip) count(topic string, dup bool) {
+	topic = g.topics.Value(topic)
+	messagesReceived.WithLabelValues(topic).Inc()
+	if dup {
+		duplicatesTotal.WithLabelValues(topic).Inc()
+	}
+	g.mu.Lock()
+	c := g.counts[topic]
+	c[0]++
+	if dup {
+		c[1]++
+	}
+	g.counts[topic] = c
+	g.mu.Unlock()
+	duplicateRatio.WithLabelValues(topic).Set(c[1] / c[0])
+}
+
+// forget drops the series and counts of a topic label
+func (g *Gossip) forget(topic string) {
+	for _, v := range []*prometheus.MetricVec{messagesReceived.MetricVec, duplicatesTotal.MetricVec, duplicateRatio.MetricVec, forwardedTotal.MetricVec, publishedTotal.MetricVec} {
+		v.DeleteLabelValues(topic)
+	}
+	g.mu.Lock()
+	delete(g.counts, topic)
+	g.mu.Unlock()
+}
+
+func (g *Gossip) deliver(m *wire.Message) {
+	g.mu.Lock()
+	hs := g.handlers[m.Topic]
+	g.mu.Unlock()
+	for _, h := range hs {
+		h(m)
+	}
+}
+
+// forward sends m to every peer with pubsub except the one it came from
+// and its origin. Received messages are forwarded from the read loop of
+// the stream they came in on, so a full queue drops its oldest message
+// rather than blocking: one slow neighbour must not hold up the messages
+// of the others, nor two neighbours forwarding to each other deadlock.
+func (g *Gossip) forward(ctx context.Context, m *wire.Message, from string) {
+	topic := g.topics.Value(m.Topic)
+	for _, p := range g.registry.With(features.PubSub) {
+		if p.ID == from || p.ID == m.From {
+			continue
+		}
+		err := g.msgs.SendWith(ctx, p.ID, m, sendq.DropOldest)
+		if err != nil && err != sendq.ErrDropped {
+			log.Printf("gossip: forwarding to %s: %v", p.ID, err)
+			continue
+		}
+		if err == nil {
+			forwardedTotal.WithLabelValues(topic).Inc()
+		}
+	}
+}
+
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,64 @@
+package gossip
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"TestProject/clock"
+)
+
+// seenCache remembers message IDs for a TTL, bounded to a maximum size by
+// evicting the oldest entries first
+type seenCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	order *list.List // of seenEntry, oldest first
+	ids   map[string]*list.Element
+}
+
+type seenEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newSeenCache(size int, ttl time.Duration) *seenCache {
+	return &seenCache{size: size, ttl: ttl, order: list.New(), ids: make(map[string]*list.Element)}
+}
+
+// add records id and reports whether it was already present
+func (c *seenCache) add(id string) bool {
+	now := clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if _, ok := c.ids[id]; ok {
+		return true
+	}
+	c.ids[id] = c.order.PushBack(seenEntry{id: id, seen: now})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Front())
+		seenEvictions.WithLabelValues("size").Inc()
+	}
+	seenSize.Set(float64(c.order.Len()))
+	return false
+}
+
+// expire drops entries older than the TTL; c.mu must be held
+func (c *seenCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(seenEntry).seen) < c.ttl {
+			break
+		}
+		c.remove(e)
+		seenEvictions.WithLabelValues("ttl").Inc()
+	}
+}
+
+func (c *seenCache) remove(e *list.Element) {
+	delete(c.ids, e.Value.(seenEntry).id)
+	c.order.Remove(e)
+}
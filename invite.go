@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"TestProject/join"
+)
+
+// inviteMain runs `invite [flags]`: it prints an invite that nodes started
+// with the same --join-secret accept from a joining peer
+func inviteMain(args []string) int {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	secret := fs.String("join-secret", os.Getenv("P2P_JOIN_SECRET"), "secret the rendezvous nodes run with (default: $P2P_JOIN_SECRET)")
+	peerID := fs.String("peer-id", "", "node ID the invite is for, empty for any")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the invite is valid")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s invite --join-secret secret [flags]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "The joining node presents the invite with --invite.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *secret == "" {
+		fs.Usage()
+		return 2
+	}
+	if *ttl <= 0 {
+		fmt.Println("Error: --ttl must be positive")
+		return 2
+	}
+	fmt.Println(join.Invite(*secret, *peerID, time.Now().Add(*ttl)))
+	return 0
+}
@@ -0,0 +1,188 @@
+package join
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	admitted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "join_admitted_total",
+			Help: "Total number of peer connections admitted into the mesh per method: token or invite",
+		},
+		[]string{"method"},
+	)
+	rejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "join_rejected_total",
+			Help: "Total number of peer connections refused for a missing, wrong or expired join token or invite",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(admitted)
+	prometheus.MustRegister(rejected)
+}
+
+// Reasons for refusing a peer.
+var (
+	ErrMissing = errors.New("join token required")
+	ErrInvalid = errors.New("invalid join token")
+	ErrExpired = errors.New("invite expired")
+	ErrNotYou  = errors.New("invite is for another peer")
+)
+
+func reason(err error) string {
+	switch err {
+	case ErrMissing:
+		return "missing"
+	case ErrExpired:
+		return "expired"
+	case ErrNotYou:
+		return "wrong_peer"
+	default:
+		return "invalid"
+	}
+}
+
+// invitePrefix marks invites, versioning their format
+const invitePrefix = "inv1."
+
+// Admission decides which peers may join the mesh: those presenting the
+// pre-shared Token, or an invite signed with Secret. With neither set
+// every peer is admitted.
+type Admission struct {
+	Token  string
+	Secret string
+}
+
+// Enabled reports whether peers must present a token.
+func (a *Admission) Enabled() bool {
+	return a.Token != "" || a.Secret != ""
+}
+
+// Check admits or refuses peerID presenting token, counting the outcome.
+func (a *Admission) Check(peerID, token string) error {
+	if !a.Enabled() {
+		return nil
+	}
+	method, err := a.check(peerID, token, time.Now())
+	if err != nil {
+		rejected.WithLabelValues(reason(err)).Inc()
+		return err
+	}
+	admitted.WithLabelValues(method).Inc()
+	return nil
+}
+
+// Verify is Check without counting, for vouching for the peer ID of single
+// requests rather than admitting connections.
+func (a *Admission) Verify(peerID, token string) error {
+	if !a.Enabled() {
+		return nil
+	}
+	_, err := a.check(peerID, token, time.Now())
+	return err
+}
+
+func (a *Admission) check(peerID, token string, now time.Time) (string, error) {
+	switch {
+	case token == "":
+		return "", ErrMissing
+	case a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1:
+		return "token", nil
+	case a.Secret != "" && strings.HasPrefix(token, invitePrefix):
+		return "invite", VerifyInvite(a.Secret, token, peerID, now)
+	default:
+		return "", ErrInvalid
+	}
+}
+
+// Present is what this node presents when joining: invite if set, else the
+// pre-shared token, else an invite for itself signed with the secret, so
+// that nodes sharing the secret admit each other. Self-signed invites are
+// valid for SelfInviteTTL from the call, so call Present for every use.
+func (a *Admission) Present(self, invite string) string {
+	switch {
+	case invite != "":
+		return invite
+	case a.Token != "":
+		return a.Token
+	case a.Secret != "":
+		return Invite(a.Secret, self, time.Now().Add(SelfInviteTTL))
+	}
+	return ""
+}
+
+// SelfInviteTTL is how long the invites a node signs for itself are valid.
+const SelfInviteTTL = 24 * time.Hour
+
+// Invite returns an invite for peerID, or any peer if empty, valid until
+// expires.
+func Invite(secret, peerID string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(peerID)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return invitePrefix + payload + "." + sign(secret, payload)
+}
+
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(invitePrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyInvite checks that invite was signed with secret, is valid at now
+// and lets peerID in.
+func VerifyInvite(secret, invite, peerID string, now time.Time) error {
+	fields := strings.Split(strings.TrimPrefix(invite, invitePrefix), ".")
+	if !strings.HasPrefix(invite, invitePrefix) || len(fields) != 3 {
+		return ErrInvalid
+	}
+	payload := fields[0] + "." + fields[1]
+	if !hmac.Equal([]byte(fields[2]), []byte(sign(secret, payload))) {
+		return ErrInvalid
+	}
+	id, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return ErrInvalid
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	if len(id) > 0 && string(id) != peerID {
+		return ErrNotYou
+	}
+	return nil
+}
+
+// Describe tells who an invite is for and until when, without verifying it.
+func Describe(invite string) (peerID string, expires time.Time, err error) {
+	fields := strings.Split(strings.TrimPrefix(invite, invitePrefix), ".")
+	if !strings.HasPrefix(invite, invitePrefix) || len(fields) != 3 {
+		return "", time.Time{}, fmt.Errorf("not an invite")
+	}
+	id, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("not an invite: %v", err)
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("not an invite: %v", err)
+	}
+	return string(id), time.Unix(unix, 0), nil
+}
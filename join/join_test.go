@@ -0,0 +1,127 @@
+package join
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestVerifyInvite(t *testing.T) {
+	expires := now.Add(time.Hour)
+	inv := Invite("secret", "node-c", expires)
+	anyone := Invite("secret", "", expires)
+
+	// tampered swaps the peer ID of inv for id, keeping the signature
+	tampered := func(id string) string {
+		fields := strings.Split(strings.TrimPrefix(inv, invitePrefix), ".")
+		fields[0] = base64.RawURLEncoding.EncodeToString([]byte(id))
+		return invitePrefix + strings.Join(fields, ".")
+	}
+	extended := func() string {
+		fields := strings.Split(strings.TrimPrefix(inv, invitePrefix), ".")
+		fields[1] = "99999999999"
+		return invitePrefix + strings.Join(fields, ".")
+	}
+
+	for _, tc := range []struct {
+		name, secret, invite, peer string
+		at                         time.Time
+		want                       error
+	}{
+		{"valid", "secret", inv, "node-c", now, nil},
+		{"valid until the second it expires", "secret", inv, "node-c", expires, nil},
+		{"expired", "secret", inv, "node-c", expires.Add(time.Second), ErrExpired},
+		{"for anyone", "secret", anyone, "node-x", now, nil},
+		{"for another peer", "secret", inv, "node-d", now, ErrNotYou},
+		{"wrong secret", "other", inv, "node-c", now, ErrInvalid},
+		{"tampered ID", "secret", tampered("node-d"), "node-d", now, ErrInvalid},
+		{"tampered to anyone", "secret", tampered(""), "node-d", now, ErrInvalid},
+		{"tampered expiry", "secret", extended(), "node-c", now, ErrInvalid},
+		{"no prefix", "secret", strings.TrimPrefix(inv, invitePrefix), "node-c", now, ErrInvalid},
+		{"too few fields", "secret", invitePrefix + "a.b", "node-c", now, ErrInvalid},
+		{"garbage", "secret", invitePrefix + "!.!.!", "node-c", now, ErrInvalid},
+	} {
+		if err := VerifyInvite(tc.secret, tc.invite, tc.peer, tc.at); err != tc.want {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a := &Admission{Token: "token", Secret: "secret"}
+	for _, tc := range []struct {
+		name, peer, token string
+		method            string
+		want              error
+	}{
+		{"token", "node-a", "token", "token", nil},
+		{"invite", "node-a", Invite("secret", "node-a", now.Add(time.Minute)), "invite", nil},
+		{"missing", "node-a", "", "", ErrMissing},
+		{"wrong token", "node-a", "tokem", "", ErrInvalid},
+		{"expired invite", "node-a", Invite("secret", "node-a", now.Add(-time.Minute)), "invite", ErrExpired},
+		{"invite of another secret", "node-a", Invite("other", "node-a", now.Add(time.Minute)), "invite", ErrInvalid},
+	} {
+		method, err := a.check(tc.peer, tc.token, now)
+		if err != tc.want || err == nil && method != tc.method {
+			t.Errorf("%s: check = %q, %v, want %q, %v", tc.name, method, err, tc.method, tc.want)
+		}
+	}
+
+	// Invites aren't accepted without a secret to check them with
+	if _, err := (&Admission{Token: "token"}).check("node-a", Invite("", "node-a", now.Add(time.Minute)), now); err != ErrInvalid {
+		t.Errorf("invite without a secret: err = %v, want %v", err, ErrInvalid)
+	}
+	if err := (&Admission{}).Check("node-a", ""); err != nil {
+		t.Errorf("admission disabled: err = %v", err)
+	}
+}
+
+func TestPresent(t *testing.T) {
+	if got := (&Admission{Token: "token", Secret: "secret"}).Present("node-a", "inv"); got != "inv" {
+		t.Errorf("an invite given is presented as is, got %q", got)
+	}
+	if got := (&Admission{Token: "token", Secret: "secret"}).Present("node-a", ""); got != "token" {
+		t.Errorf("the token is presented over a self-signed invite, got %q", got)
+	}
+	if got := (&Admission{}).Present("node-a", ""); got != "" {
+		t.Errorf("nothing to present, got %q", got)
+	}
+
+	// A node with the secret signs itself an invite from the time of the
+	// call, which its peers admit for SelfInviteTTL
+	a := &Admission{Secret: "secret"}
+	before := time.Now()
+	inv := a.Present("node-a", "")
+	id, expires, err := Describe(inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "node-a" || expires.Before(before.Add(SelfInviteTTL).Truncate(time.Second)) || expires.After(time.Now().Add(SelfInviteTTL)) {
+		t.Errorf("self-signed invite for %q until %v, want node-a until %v", id, expires, before.Add(SelfInviteTTL))
+	}
+	if err := a.Verify("node-a", inv); err != nil {
+		t.Errorf("own invite refused: %v", err)
+	}
+	if err := VerifyInvite("secret", inv, "node-b", time.Now()); err != ErrNotYou {
+		t.Errorf("own invite used by another peer: err = %v, want %v", err, ErrNotYou)
+	}
+	if err := VerifyInvite("secret", inv, "node-a", expires.Add(time.Second)); err != ErrExpired {
+		t.Errorf("own invite after its expiry: err = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	expires := now.Add(time.Hour)
+	id, at, err := Describe(Invite("secret", "node-c", expires))
+	if err != nil || id != "node-c" || !at.Equal(expires) {
+		t.Errorf("Describe = %q, %v, %v, want node-c, %v", id, at, err, expires)
+	}
+	for _, bad := range []string{"", "token", invitePrefix + "a.b", invitePrefix + "!.1.sig", invitePrefix + "YQ.x.sig"} {
+		if _, _, err := Describe(bad); err == nil {
+			t.Errorf("Describe(%q) described a non-invite", bad)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/throttle"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loadgen_requests_total",
+			Help: "Total number of generated requests by run, target, endpoint and result",
+		},
+		[]string{"run_id", "target", "endpoint", "result"},
+	)
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "loadgen_request_duration_seconds",
+			Help:    "Histogram of generated request latencies in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+		},
+		[]string{"run_id", "target", "endpoint"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(requestDuration)
+}
+
+// Generator sends requests for Path, or for a weighted Mix of endpoints, to
+// every target in a closed loop, with Concurrency requests in flight per
+// target.
+//
+// A closed loop waits for each response before sending the next request, so
+// a stalled target is sampled once per stall instead of once per request
+// that would have been sent meanwhile. With CorrectOmission the summaries
+// backfill those missing samples, assuming a request was due every
+// ExpectedInterval, or every median latency when that is 0.
+type Generator struct {
+	Self string
+	// RunID, if set, is sent to the targets and labels the metrics
+	RunID       string
+	Targets     func() []discovery.Peer
+	Path        string
+	Mix         []Endpoint
+	Concurrency int
+	Client      *http.Client
+	// Throttle, if set, limits the responses read from each target
+	Throttle *throttle.Table
+
+	CorrectOmission  bool
+	ExpectedInterval time.Duration
+
+	// Rate switches to an open loop: requests per second are sent to each
+	// target on a fixed schedule whether or not earlier ones completed, up
+	// to MaxInFlight at once, or without a limit if it is 0; arrivals
+	// beyond that count as "overload"
+	Rate        float64
+	MaxInFlight int
+
+	// TimelineInterval, if set, also summarizes all requests per interval
+	// of this length, for charts of a run; see Timeline
+	TimelineInterval time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	cur      map[key]*window
+	slot     time.Time
+	slotWin  *window
+	timeline []Point
+}
+
+// New returns a generator with a default client.
+func New(self string, targets func() []discovery.Peer, path string, concurrency int) *Generator {
+	return &Generator{
+		Self:            self,
+		Targets:         targets,
+		Path:            path,
+		Concurrency:     concurrency,
+		CorrectOmission: true,
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transport(),
+		},
+	}
+}
+
+// transport keeps connections for every worker, or for open-loop bursts,
+// instead of redialing
+func transport() *http.Transport {
+	t := dial.NewTransport()
+	t.MaxIdleConnsPerHost = 1024
+	return t
+}
+
+// Run generates load until ctx is cancelled. The target list is refreshed
+// every second, so peers joining or leaving are picked up.
+func (g *Generator) Run(ctx context.Context) {
+	workers := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range workers {
+			cancel()
+		}
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		seen := make(map[string]bool)
+		for _, p := range g.Targets() {
+			seen[p.ID] = true
+			if _, ok := workers[p.ID]; ok {
+				continue
+			}
+			wctx, cancel := context.WithCancel(ctx)
+			workers[p.ID] = cancel
+			if g.Rate > 0 {
+				go g.schedule(wctx, p)
+				continue
+			}
+			for i := 0; i < g.Concurrency; i++ {
+				go g.loop(wctx, p)
+			}
+		}
+		for id, cancel := range workers {
+			if !seen[id] {
+				cancel()
+				delete(workers, id)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *Generator) loop(ctx context.Context, target discovery.Peer) {
+	for ctx.Err() == nil {
+		start := time.Now()
+		path := g.pick()
+		result := g.do(ctx, target, path)
+		if ctx.Err() != nil {
+			return
+		}
+		g.record(target.ID, path, result, time.Since(start))
+		if result != "ok" {
+			// Don't spin on a peer that is down
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// schedule sends requests to target at Rate. Latency counts from the
+// scheduled time, so waiting on a backed-up scheduler or connection pool
+// shows up in it and there is no coordinated omission to correct.
+func (g *Generator) schedule(ctx context.Context, target discovery.Peer) {
+	interval := time.Duration(float64(time.Second) / g.Rate)
+	var slots chan struct{}
+	if g.MaxInFlight > 0 {
+		slots = make(chan struct{}, g.MaxInFlight)
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	next := time.Now()
+	for {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		// Behind schedule the loop doesn't sleep, catching up in a burst
+		due := next
+		next = next.Add(interval)
+		path := g.pick()
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				g.record(target.ID, path, "overload", 0)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			result := g.do(ctx, target, path)
+			if ctx.Err() == nil {
+				g.record(target.ID, path, result, time.Since(due))
+			}
+		}()
+	}
+}
+
+// do issues one request and returns "ok", the HTTP status code or "error"
+func (g *Generator) do(ctx context.Context, target discovery.Peer, path string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+target.Addr+path, nil)
+	if err != nil {
+		return "error"
+	}
+	if g.Self != "" {
+		acl.Identify(req, g.Self)
+	}
+	if g.RunID != "" {
+		req.Header.Set(acl.RunIDHeader, g.RunID)
+	}
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return "error"
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if g.Throttle != nil {
+		body = throttle.Reader(body, g.Throttle.Recv(target.ID))
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return "error"
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Sprint(resp.StatusCode)
+	}
+	return "ok"
+}
+
+// key identifies the requests of one endpoint on one target. Their
+// latencies are recorded and corrected separately, since mixing a fast
+// and a slow endpoint would skew the expected interval.
+type key struct{ target, endpoint string }
+
+// window accumulates requests since the last Snapshot
+type window struct {
+	latencies  *hdrhistogram.Histogram // microseconds
+	results    map[string]int
+	coInterval int64 // microseconds, set once corrected
+}
+
+// maxLatency bounds the histograms, slower requests are clamped to it
+const maxLatency = time.Minute
+
+func newHistogram() *hdrhistogram.Histogram {
+	return hdrhistogram.New(1, int64(maxLatency/time.Microsecond), 3)
+}
+
+func (g *Generator) record(target, endpoint, result string, d time.Duration) {
+	requestsTotal.WithLabelValues(g.RunID, target, endpoint, result).Inc()
+	if result == "ok" {
+		requestDuration.WithLabelValues(g.RunID, target, endpoint).Observe(d.Seconds())
+	}
+	if d > maxLatency {
+		d = maxLatency
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cur == nil {
+		g.cur = make(map[key]*window)
+	}
+	k := key{target, endpoint}
+	w := g.cur[k]
+	if w == nil {
+		w = newWindow()
+		g.cur[k] = w
+	}
+	w.results[result]++
+	if result == "ok" {
+		w.latencies.RecordValue(d.Microseconds())
+	}
+	if g.TimelineInterval > 0 {
+		g.recordTimeline(result, d)
+	}
+}
+
+// Point summarizes all requests completed in one timeline interval
+// starting at Time. Its latencies are never corrected for coordinated
+// omission.
+type Point struct {
+	Time time.Time `json:"time"`
+	Summary
+}
+
+// recordTimeline adds a request to the current timeline interval; g.mu is
+// held
+func (g *Generator) recordTimeline(result string, d time.Duration) {
+	slot := time.Now().Truncate(g.TimelineInterval)
+	if !slot.Equal(g.slot) {
+		g.closeSlot()
+		g.slot, g.slotWin = slot, newWindow()
+	}
+	g.slotWin.results[result]++
+	if result == "ok" {
+		g.slotWin.latencies.RecordValue(d.Microseconds())
+	}
+}
+
+func (g *Generator) closeSlot() {
+	if g.slotWin == nil {
+		return
+	}
+	g.timeline = append(g.timeline, Point{Time: g.slot, Summary: summarize("*", g.slotWin, g.TimelineInterval.Seconds())})
+	g.slotWin = nil
+}
+
+// Timeline returns the points of the intervals completed since since,
+// oldest first.
+func (g *Generator) Timeline(since time.Time) []Point {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.slotWin != nil && time.Since(g.slot) >= g.TimelineInterval {
+		g.closeSlot()
+	}
+	var out []Point
+	for _, p := range g.timeline {
+		if !p.Time.Before(since) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func newWindow() *window {
+	return &window{latencies: newHistogram(), results: make(map[string]int)}
+}
+
+// merge adds the requests of o to w
+func (w *window) merge(o *window) {
+	for result, n := range o.results {
+		w.results[result] += n
+	}
+	w.latencies.Merge(o.latencies)
+	if o.coInterval > w.coInterval {
+		w.coInterval = o.coInterval
+	}
+}
+
+// Summary describes the requests to one target, to one endpoint on all
+// targets, or to all of them, in a measurement window. Latencies cover
+// successful requests only.
+type Summary struct {
+	Target      string         `json:"target"`
+	Endpoint    string         `json:"endpoint,omitempty"`
+	Requests    int            `json:"requests"`
+	Errors      map[string]int `json:"errors,omitempty"`
+	RPS         float64        `json:"rps"`
+	MeanMillis  float64        `json:"mean_ms"`
+	P50Millis   float64        `json:"p50_ms"`
+	P90Millis   float64        `json:"p90_ms"`
+	P99Millis   float64        `json:"p99_ms"`
+	P999Millis  float64        `json:"p99_9_ms"`
+	P9999Millis float64        `json:"p99_99_ms"`
+	MaxMillis   float64        `json:"max_ms"`
+	// COIntervalMillis is the expected request interval used to correct
+	// for coordinated omission (the largest one when several endpoints
+	// are merged), 0 if the latencies are uncorrected
+	COIntervalMillis float64 `json:"co_interval_ms"`
+}
+
+// Window is the traffic since the previous Snapshot.
+type Window struct {
+	RunID    string    `json:"run_id,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Total    Summary   `json:"total"`
+	Targets  []Summary `json:"targets"`
+	// Endpoints breaks the total down by endpoint of the mix
+	Endpoints []Summary `json:"endpoints,omitempty"`
+}
+
+// Snapshot summarizes the requests since the previous Snapshot, in total
+// and per target, and starts a new window.
+func (g *Generator) Snapshot() Window {
+	now := time.Now()
+	g.mu.Lock()
+	cur, start := g.cur, g.start
+	g.cur, g.start = nil, now
+	g.mu.Unlock()
+	if start.IsZero() {
+		start = now
+	}
+
+	win := Window{RunID: g.RunID, Start: start, Duration: now.Sub(start).Seconds()}
+	all := newWindow()
+	targets := make(map[string]*window)
+	endpoints := make(map[string]*window)
+	for k, w := range cur {
+		if g.CorrectOmission && g.Rate == 0 {
+			w.correct(g.ExpectedInterval)
+		}
+		mergeInto(targets, k.target, w)
+		mergeInto(endpoints, k.endpoint, w)
+		all.merge(w)
+	}
+
+	for target, w := range targets {
+		win.Targets = append(win.Targets, summarize(target, w, win.Duration))
+	}
+	sort.Slice(win.Targets, func(i, j int) bool { return win.Targets[i].Target < win.Targets[j].Target })
+	win.Total = summarize("*", all, win.Duration)
+	if len(g.Mix) > 0 {
+		for endpoint, w := range endpoints {
+			s := summarize("*", w, win.Duration)
+			s.Endpoint = endpoint
+			win.Endpoints = append(win.Endpoints, s)
+		}
+		sort.Slice(win.Endpoints, func(i, j int) bool { return win.Endpoints[i].Endpoint < win.Endpoints[j].Endpoint })
+	}
+	return win
+}
+
+func mergeInto(views map[string]*window, name string, w *window) {
+	if views[name] == nil {
+		views[name] = newWindow()
+	}
+	views[name].merge(w)
+}
+
+func summarize(target string, w *window, seconds float64) Summary {
+	s := Summary{Target: target}
+	for result, n := range w.results {
+		s.Requests += n
+		if result != "ok" {
+			if s.Errors == nil {
+				s.Errors = make(map[string]int)
+			}
+			s.Errors[result] = n
+		}
+	}
+	if seconds > 0 {
+		s.RPS = float64(s.Requests) / seconds
+	}
+	h := w.latencies
+	if h.TotalCount() == 0 {
+		return s
+	}
+	s.MeanMillis = h.Mean() / 1000
+	s.P50Millis = float64(h.ValueAtQuantile(50)) / 1000
+	s.P90Millis = float64(h.ValueAtQuantile(90)) / 1000
+	s.P99Millis = float64(h.ValueAtQuantile(99)) / 1000
+	s.P999Millis = float64(h.ValueAtQuantile(99.9)) / 1000
+	s.P9999Millis = float64(h.ValueAtQuantile(99.99)) / 1000
+	s.MaxMillis = float64(h.Max()) / 1000
+	s.COIntervalMillis = float64(w.coInterval) / 1000
+	return s
+}
+
+// correct backfills the samples a closed loop omitted while waiting on slow
+// responses: a request taking n expected intervals stands for n-1 more
+// requests that would have waited 1 to n-1 intervals less
+func (w *window) correct(expected time.Duration) {
+	interval := expected.Microseconds()
+	if interval <= 0 {
+		interval = w.latencies.ValueAtQuantile(50)
+	}
+	if interval <= 0 {
+		return
+	}
+	out := newHistogram()
+	for _, b := range w.latencies.Distribution() {
+		if b.Count == 0 {
+			continue
+		}
+		out.RecordValues(b.To, b.Count)
+		for missing := b.To - interval; missing >= interval; missing -= interval {
+			out.RecordValues(missing, b.Count)
+		}
+	}
+	w.latencies = out
+	w.coInterval = interval
+}
+
+// WaitSteady samples the traffic every interval until the throughput and
+// the median latency of the last n samples each have a relative standard
+// deviation below tolerance, and reports whether that happened before ctx
+// was done. The samples are not part of any later Snapshot.
+func (g *Generator) WaitSteady(ctx context.Context, interval time.Duration, n int, tolerance float64) bool {
+	g.Snapshot()
+	var rps, p50 []float64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+		w := g.Snapshot()
+		rps = append(rps, w.Total.RPS)
+		p50 = append(p50, w.Total.P50Millis)
+		if len(rps) > n {
+			rps, p50 = rps[1:], p50[1:]
+		}
+		if len(rps) == n && w.Total.Requests > 0 && relStdDev(rps) < tolerance && relStdDev(p50) < tolerance {
+			return true
+		}
+	}
+}
+
+func relStdDev(xs []float64) float64 {
+	var mean float64
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	if mean == 0 {
+		return 0
+	}
+	var v float64
+	for _, x := range xs {
+		v += (x - mean) * (x - mean)
+	}
+	return math.Sqrt(v/float64(len(xs))) / mean
+}
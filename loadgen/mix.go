@@ -0,0 +1,70 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Endpoint is one entry of a traffic mix, requested with a probability
+// proportional to its weight.
+type Endpoint struct {
+	Path   string `yaml:"path"`
+	Weight int    `yaml:"weight"`
+}
+
+// MixFile is the on-disk format of a traffic mix profile.
+type MixFile struct {
+	Endpoints []Endpoint `yaml:"endpoints"`
+}
+
+// LoadMix parses and validates a traffic mix profile.
+func LoadMix(path string) ([]Endpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mf MixFile
+	if err := yaml.Unmarshal(data, &mf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(mf.Endpoints) == 0 {
+		return nil, fmt.Errorf("%s: no endpoints", path)
+	}
+	seen := make(map[string]bool)
+	for i, e := range mf.Endpoints {
+		if !strings.HasPrefix(e.Path, "/") {
+			return nil, fmt.Errorf("%s: endpoint #%d needs a path starting with /", path, i+1)
+		}
+		if e.Weight <= 0 {
+			return nil, fmt.Errorf("%s: endpoint %s needs a positive weight", path, e.Path)
+		}
+		if seen[e.Path] {
+			return nil, fmt.Errorf("%s: duplicate endpoint %s", path, e.Path)
+		}
+		seen[e.Path] = true
+	}
+	return mf.Endpoints, nil
+}
+
+// pick returns the path of the next request
+func (g *Generator) pick() string {
+	if len(g.Mix) == 0 {
+		return g.Path
+	}
+	total := 0
+	for _, e := range g.Mix {
+		total += e.Weight
+	}
+	n := rand.Intn(total)
+	for _, e := range g.Mix {
+		if n < e.Weight {
+			return e.Path
+		}
+		n -= e.Weight
+	}
+	return g.Mix[len(g.Mix)-1].Path
+}
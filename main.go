@@ -1,11 +1,59 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"TestProject/acl"
+	"TestProject/antientropy"
+	"TestProject/apierror"
+	"TestProject/blobs"
+	"TestProject/cardinality"
+	"TestProject/chaos"
+	"TestProject/churn"
+	"TestProject/clock"
+	"TestProject/collector"
+	"TestProject/delay"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/failure"
+	"TestProject/features"
+	"TestProject/geoip"
+	"TestProject/gossip"
+	"TestProject/join"
+	"TestProject/loadgen"
+	"TestProject/messaging"
+	"TestProject/mux"
+	"TestProject/openapi"
+	"TestProject/pinger"
+	"TestProject/probe"
+	"TestProject/report"
+	"TestProject/results"
+	"TestProject/rtt"
+	"TestProject/sendq"
+	"TestProject/soak"
+	"TestProject/sse"
+	"TestProject/stats"
+	"TestProject/transfer"
+	"TestProject/watchdog"
+	"TestProject/wire"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -24,11 +72,180 @@ var (
 		},
 		[]string{"handler", "method"},
 	)
+	runRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "run_requests_total",
+			Help: "Total number of peer requests received as part of a bench or soak run, per run and registered peer; runs beyond 32 active within the hour count as other",
+		},
+		[]string{"run_id", "peer"},
+	)
+	legacyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_legacy_path_requests_total",
+			Help: "Total number of requests to deprecated unversioned management paths",
+		},
+		[]string{"path"},
+	)
+	goodbyesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goodbyes_sent_total",
+			Help: "Total number of leaving messages sent to peers and the collector on shutdown per result",
+		},
+		[]string{"result"},
+	)
+	// Next to the request durations so latency spikes can be matched
+	// against collector pauses
+	gcPauseDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gc_pause_duration_seconds",
+			Help:    "Histogram of garbage collector stop-the-world pauses in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 2, 16),
+		},
+	)
+)
+
+var (
+	listenAddr = flag.String("listen", ":8080", "address the HTTP server listens on")
+	nodeID     = flag.String("node-id", defaultNodeID(), "unique ID of this node in the mesh")
+	advertise  = flag.String("advertise-addr", "", "host:port other nodes use to reach this one (default: hostname and listen port)")
+	tenant     = flag.String("tenant", "", "tenant or namespace of this node's mesh: added as a tenant label to all metrics, and nodes of other tenants are refused")
+
+	discoveryBackend  = flag.String("discovery", "", "peer discovery backend: kubernetes, consul or etcd")
+	discoveryInterval = flag.Duration("discovery-interval", 10*time.Second, "how often discovery backends refresh the peer list")
+	k8sNamespace      = flag.String("k8s-namespace", "", "namespace to search for peer pods (default: the pod's own namespace)")
+	k8sSelector       = flag.String("k8s-selector", "app=p2p-test", "label selector matching peer pods")
+	k8sPort           = flag.Int("k8s-port", 8080, "port peers listen on inside their pods")
+	peersFile         = flag.String("peers-file", "", "YAML file listing static peers, reloaded on change")
+	registrationTTL   = flag.Duration("registration-ttl", 15*time.Second, "TTL of this node's registration in consul or etcd")
+	consulAddr        = flag.String("consul-addr", "http://127.0.0.1:8500", "address of the local Consul agent")
+	consulService     = flag.String("consul-service", "p2p-test", "Consul service name nodes register under")
+	etcdAddr          = flag.String("etcd-addr", "http://127.0.0.1:2379", "address of an etcd endpoint")
+	etcdPrefix        = flag.String("etcd-prefix", "/p2p-test/nodes/", "etcd key prefix nodes register under")
+
+	allowPeers = flag.String("allow-peers", "", "comma-separated peer IDs allowed to call this node")
+	denyPeers  = flag.String("deny-peers", "", "comma-separated peer IDs refused by this node")
+	allowCIDRs = flag.String("allow-cidrs", "", "comma-separated networks allowed to call this node")
+	denyCIDRs  = flag.String("deny-cidrs", "", "comma-separated networks refused by this node")
+
+	muxListen          = flag.String("mux-listen", "", "address for multiplexed peer connections, e.g. :7946 (default: disabled)")
+	muxPort            = flag.Int("mux-port", 7946, "port of peers' multiplexed listeners unless they announce mux_addr")
+	joinToken          = flag.String("join-token", "", "pre-shared token peers must present to connect to this node before it gossips them to the mesh; also presented when connecting to peers")
+	joinSecret         = flag.String("join-secret", "", "secret signing invites: peers presenting an invite made with the invite subcommand are admitted, and nodes sharing it admit each other")
+	inviteToken        = flag.String("invite", "", "invite to present to the peers this node connects to instead of --join-token")
+	disableFeatures    = flag.String("disable-features", "", "comma-separated features this node doesn't offer its peers: blobs, pubsub, sync, transfer; peers learn it in the mux handshake and leave the node out")
+	proxyURL           = flag.String("proxy", "", "proxy for all connections to peers, socks5://[user:pass@]host:port or http://[user:pass@]host:port (CONNECT); a peer's proxy meta overrides it, direct for none")
+	dialAttemptDelay   = flag.Duration("dial-attempt-delay", 250*time.Millisecond, "head start of each connection attempt to a dual-stack peer over the next (Happy Eyeballs), 0 tries its addresses one after another")
+	keepaliveInterval  = flag.Duration("keepalive-interval", 10*time.Second, "keepalive ping interval on persistent peer connections, 0 disables")
+	keepaliveTimeout   = flag.Duration("keepalive-timeout", 5*time.Second, "time to wait for a keepalive pong")
+	keepaliveMaxMissed = flag.Int("keepalive-max-missed", 3, "consecutive missed pongs before a connection is closed")
+	wireCodecs         = flag.String("wire-codecs", strings.Join(wire.Names(), ","), "wire formats for peer messages in order of preference: json, protobuf, cbor")
+	compressions       = flag.String("compressions", "none", "peer message compressions in order of preference: zstd, snappy, none")
+	sendQueueSize      = flag.Int("send-queue-size", 256, "outbound messages buffered per peer")
+	sendQueuePolicy    = flag.String("send-queue-policy", "block", "what to do when a peer's queue is full: block, drop-newest, drop-oldest")
+	antiEntropyEvery   = flag.Duration("anti-entropy-interval", 0, "how often to reconcile the peer registry with a random peer, 0 disables")
+	antiEntropyTTL     = flag.Duration("anti-entropy-ttl", 5*time.Minute, "how long peers learned through anti-entropy are kept after the last node that knew them first-hand stopped")
+	gossipHops         = flag.Int("gossip-hops", 6, "maximum number of hops a gossip message travels")
+	gossipSeenSize     = flag.Int("gossip-seen-size", 10000, "maximum number of message IDs kept to suppress gossip duplicates")
+	gossipSeenTTL      = flag.Duration("gossip-seen-ttl", 5*time.Minute, "how long gossip message IDs are remembered")
+	pingInterval       = flag.Duration("ping-interval", 5*time.Second, "how often to ping every peer, 0 disables pinging")
+	pingTransports     = flag.String("ping-transports", "http", "comma-separated transports to ping peers over: http, mux, icmp")
+	failureDetector    = flag.String("failure-detector", "fixed", "how peers are judged from their answers to pings: fixed (after --failure-max-missed pings) or phi (phi-accrual)")
+	failureMaxMissed   = flag.Int("failure-max-missed", 3, "unanswered pings after which the fixed failure detector suspects a peer")
+	phiThreshold       = flag.Float64("phi-threshold", 8, "phi at which the phi-accrual failure detector suspects a peer, lower detects sooner with more false positives")
+	phiWindow          = flag.Int("phi-window", 100, "ping intervals the phi-accrual failure detector bases its estimate on")
+	phiMinStdDev       = flag.Duration("phi-min-stddev", 500*time.Millisecond, "lower bound of the standard deviation of ping intervals assumed by the phi-accrual failure detector")
+	phiPause           = flag.Duration("phi-acceptable-pause", 0, "pause allowed on top of the mean ping interval before the phi-accrual suspicion rises")
+	statsWindow        = flag.Duration("stats-window", 15*time.Minute, "how much request history /stats/recent keeps in memory, 0 disables")
+	statsResolution    = flag.Duration("stats-resolution", 5*time.Second, "resolution of the request history of /stats/recent")
+	seriesBudget       = flag.Int("metrics-series-budget", 1000, "series a metric family may have before /v1/admin/metrics/inspect warns about it, 0 never warns")
+	rttTiers           = flag.String("rtt-history", "10s:1h,1m:24h,10m:168h", "resolution:retention of the RTT history kept per peer and transport for /v1/peers/{id}/rtt, empty disables")
+	timeScale          = flag.Float64("time-scale", 1, "run protocol timers (gossip, keepalives, pings, anti-entropy, discovery, churn) this many times faster than real time")
+	probeInterval      = flag.Duration("probe-interval", 15*time.Second, "how often to probe TCP connect and TLS handshake times of every peer, 0 disables")
+	geoipDB            = flag.String("geoip-db", "", "comma-separated MMDB files, e.g. GeoLite2-Country.mmdb,GeoLite2-ASN.mmdb, to look up the country and AS of peers in")
+	geoipInterval      = flag.Duration("geoip-interval", 10*time.Minute, "how often to look up the addresses of peers again with --geoip-db")
+	transferDir        = flag.String("transfer-dir", "", "directory for partially received transfers (default: p2p_test-transfers-<node id> in the temp directory)")
+	transferSourceDir  = flag.String("transfer-source-dir", "", "directory the files sent with /v1/admin/transfer?file= are taken from (default: none, only generated data is sent)")
+	transferMaxSize    = flag.String("transfer-max-size", "16GiB", "largest transfer the receiver accepts")
+	blobDir            = flag.String("blob-dir", "", "directory of the content-addressed blob store (default: p2p_test-blobs-<node id> in the temp directory)")
+	reportDir          = flag.String("report-dir", "", "directory HTML run reports are written to and served from (default: p2p_test-reports-<node id> in the temp directory)")
+	blobFetchPeers     = flag.Int("blob-fetch-peers", 3, "how many peers to ask for a missing blob, 0 asks all")
+	blobMaxSize        = flag.String("blob-max-size", "256MiB", "largest blob the store accepts")
+	mtuEcho            = flag.Bool("mtu-echo", true, "answer MTU probe datagrams on the UDP port matching --listen")
+	mtuInterval        = flag.Duration("mtu-interval", 5*time.Minute, "how often to search the path MTU and largest HTTP chunk to every peer, 0 disables")
+	mtuMaxChunk        = flag.String("mtu-max-chunk", "16MiB", "largest HTTP body the chunk search tries, 0 skips it")
+	mtuChunkTimeout    = flag.Duration("mtu-chunk-timeout", 5*time.Second, "time an HTTP chunk may take to arrive during the chunk search")
+	sseBuffer          = flag.Int("sse-buffer", 16, "events buffered per /events subscriber before it misses some")
+
+	churnMode     = flag.String("churn-mode", "", "simulate churn: disconnect (random peers) or restart (own peer subsystems), default disabled")
+	churnInterval = flag.Duration("churn-interval", time.Minute, "mean time between churn events")
+	churnDown     = flag.Duration("churn-down", 10*time.Second, "how long a peer stays disconnected in disconnect mode")
+	churnTimeout  = flag.Duration("churn-timeout", 5*time.Minute, "how long to wait for recovery from a churn event")
+
+	delayProfile = flag.String("delay-profile", "", "latency injected into /, /payload and /slow as a function of the requests in flight, e.g. queue:base=5ms,capacity=50 or linear:base=10ms,step=5ms,knee=8; curves fixed, linear, exponential, queue")
+
+	soakMode       = flag.Bool("soak", false, "generate traffic to all peers indefinitely and write periodic self-reports")
+	soakPath       = flag.String("soak-path", "/ping", "endpoint requested on peers in soak mode")
+	soakWorkers    = flag.Int("soak-concurrency", 4, "requests in flight per peer in soak mode")
+	soakEvery      = flag.Duration("soak-report-interval", 10*time.Minute, "how often to write a soak self-report")
+	soakFile       = flag.String("soak-report-file", "soak-report.jsonl", "file soak reports are appended to as JSON lines, empty to disable")
+	soakLeakWindow = flag.Int("soak-leak-window", 6, "consecutive growing reports after which goroutines or heap are flagged as leaking")
+	soakMix        = flag.String("soak-mix", "", "YAML traffic mix profile for soak mode, overrides --soak-path")
+	soakCSV        = flag.String("soak-results-csv", "", "CSV file each interval's traffic results are appended to")
+	soakJSON       = flag.String("soak-results-json", "", "JSON lines file each interval's traffic results are appended to")
+	runID          = flag.String("run-id", "", "ID of the soak run, sent to peers and recorded in results, metrics and faults (default: generated in soak mode)")
+
+	collectorMode = flag.Bool("collector", false, "accept bench and soak results from the mesh at /results and aggregate them")
+	reportTo      = flag.String("report-to", "", "collector node (host:port) soak results are sent to")
+
+	goodbyeTimeout = flag.Duration("goodbye-timeout", 3*time.Second, "time to tell peers and the collector that the node is leaving on SIGINT or SIGTERM, 0 leaves silently")
+
+	watchdogInterval   = flag.Duration("watchdog-interval", 15*time.Second, "how often to sample goroutines, open files and heap, 0 disables")
+	watchdogGoroutines = flag.Int("watchdog-max-goroutines", 0, "warn when more goroutines are running, 0 disables")
+	watchdogFDs        = flag.Int("watchdog-max-fds", 0, "warn when more file descriptors are open, 0 disables")
+	watchdogHeapMB     = flag.Int("watchdog-max-heap-mb", 0, "warn when the heap grows beyond this many MiB, 0 disables")
+	watchdogDumpDir    = flag.String("watchdog-dump-dir", "", "directory to write a goroutine profile to when a threshold is exceeded")
+)
+
+var (
+	registry   *discovery.Registry
+	accessList *acl.List
+	admission  *join.Admission
+	messenger  *messaging.Messenger
+	muxNode    *mux.Node
+	pubsub     *gossip.Gossip
+	peerPinger *pinger.Pinger
+	geoEnrich  *geoip.Enricher
+	rttHistory *rtt.History
+	soakRun    *soak.Soak
+	events     *sse.Broker
+	transfers  *transfer.Receiver
+	blobStore  *blobs.Store
+
+	// nodeFeatures are the features this node offers its peers
+	nodeFeatures []string
+
+	resultCollector *collector.Collector
+	reportStore     *report.Store
+	recentStats     *stats.Recent
+	faultLog        *report.Log
 )
 
 func init() {
 	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(legacyRequests)
+	prometheus.MustRegister(runRequests)
 	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(gcPauseDuration)
+	prometheus.MustRegister(goodbyesSent)
+}
+
+// defaultNodeID uses the hostname, which is the pod name under Kubernetes
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "node"
+	}
+	return host
 }
 
 // handler function that writes a simple response with a smiley
@@ -44,17 +261,701 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	httpRequestsTotal.WithLabelValues(fmt.Sprintf("%d", http.StatusOK), r.Method).Inc()
 }
 
+// advertiseAddr is the address this node registers itself with
+func advertiseAddr() string {
+	if *advertise != "" {
+		return *advertise
+	}
+	_, port, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		port = "8080"
+	}
+	return net.JoinHostPort(defaultNodeID(), port)
+}
+
+// pingHandler answers peer pings as cheaply as possible
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "pong")
+}
+
+// maxPayload bounds /payload responses
+const maxPayload = 1 << 30
+
+// payloadHandler streams ?size= bytes (e.g. 1MB, 64KiB, default 1KiB)
+func payloadHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(httpRequestDuration.WithLabelValues("/payload", r.Method))
+	defer timer.ObserveDuration()
+
+	size := int64(1 << 10)
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil || n < 0 || n > maxPayload {
+			apierror.Error(w, r, "size must be a byte count up to 1GiB", http.StatusBadRequest)
+			httpRequestsTotal.WithLabelValues(fmt.Sprintf("%d", http.StatusBadRequest), r.Method).Inc()
+			return
+		}
+		size = n
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	chunk := bytes.Repeat([]byte("p2p-test"), 4096)
+	for size > 0 {
+		n := int64(len(chunk))
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+	httpRequestsTotal.WithLabelValues(fmt.Sprintf("%d", http.StatusOK), r.Method).Inc()
+}
+
+// slowHandler answers after ?delay= (default 1s, at most 5m)
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	timer := prometheus.NewTimer(httpRequestDuration.WithLabelValues("/slow", r.Method))
+	defer timer.ObserveDuration()
+
+	delay := time.Second
+	if v := r.URL.Query().Get("delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > 5*time.Minute {
+			apierror.Error(w, r, "delay must be a duration up to 5m", http.StatusBadRequest)
+			httpRequestsTotal.WithLabelValues(fmt.Sprintf("%d", http.StatusBadRequest), r.Method).Inc()
+			return
+		}
+		delay = d
+	}
+	select {
+	case <-r.Context().Done():
+		return
+	case <-time.After(delay):
+	}
+	fmt.Fprint(w, "done")
+	httpRequestsTotal.WithLabelValues(fmt.Sprintf("%d", http.StatusOK), r.Method).Inc()
+}
+
+// peersHandler lists the peers currently known to the registry
+// LocatedPeer is a peer of /peers with the location of its address
+type LocatedPeer struct {
+	discovery.Peer
+	Geo *geoip.Info `json:"geo,omitempty"`
+}
+
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if geoEnrich == nil {
+		json.NewEncoder(w).Encode(registry.List())
+		return
+	}
+	peers := []LocatedPeer{}
+	for _, p := range registry.List() {
+		l := LocatedPeer{Peer: p}
+		if info, ok := geoEnrich.Get(p.ID); ok {
+			l.Geo = &info
+		}
+		peers = append(peers, l)
+	}
+	json.NewEncoder(w).Encode(peers)
+}
+
+// detectorConfig is the failure detector set up by the flags
+func detectorConfig() failure.Config {
+	return failure.Config{
+		Kind:            *failureDetector,
+		Interval:        *pingInterval,
+		MaxMissed:       *failureMaxMissed,
+		Threshold:       *phiThreshold,
+		Window:          *phiWindow,
+		MinStdDev:       *phiMinStdDev,
+		AcceptablePause: *phiPause,
+	}
+}
+
+// peerProxy picks the proxy to dial addr through: the proxy meta of the
+// peer at addr, else --proxy
+func peerProxy(addr string) (*url.URL, error) {
+	if registry != nil {
+		for _, p := range registry.List() {
+			if p.Addr != addr && mux.Addr(p, *muxPort) != addr {
+				continue
+			}
+			if proxy, ok := p.Meta["proxy"]; ok {
+				return dial.ParseProxy(proxy)
+			}
+			break
+		}
+	}
+	return dial.ParseProxy(*proxyURL)
+}
+
+// routes are the registered patterns, checked against the API definition
+var routes []string
+
+// handlePeer registers an endpoint of the peer protocol behind access control
+// and the per-peer bandwidth limits
+func handlePeer(pattern string, h http.HandlerFunc) {
+	routes = append(routes, pattern)
+	http.Handle(pattern, accessList.Protect("peer", throttles.Middleware(throttledPeer, countRuns(h))))
+}
+
+// throttledPeer is the peer whose limits apply to r: with join tokens
+// required, only an admitted ID, so callers can't pick another peer's
+// limits or dodge their own
+func throttledPeer(r *http.Request) string {
+	if admission.Enabled() {
+		return acl.Peer(r)
+	}
+	return r.Header.Get(acl.PeerIDHeader)
+}
+
+// runLabels bounds the run IDs of run_requests_total, which callers pick
+var runLabels = &cardinality.Limiter{
+	Max:     32,
+	Idle:    time.Hour,
+	OnEvict: func(id string) { runRequests.DeletePartialMatch(prometheus.Labels{"run_id": id}) },
+}
+
+// countRuns counts the requests that are part of a run. With join tokens
+// required, callers must present one for their ID, which admits them. Any
+// request also brings back a peer that said goodbye before restarting,
+// unless a chaos partition cut it off.
+func countRuns(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if admission.Enabled() {
+			id := acl.Peer(r)
+			if id == "" {
+				apierror.Error(w, r, "a join token for "+acl.PeerIDHeader+" is required", http.StatusForbidden)
+				return
+			}
+			registry.MarkAdmitted(id)
+		}
+		if partitioned.Has(r.Header.Get(acl.PeerIDHeader)) {
+			apierror.Error(w, r, "partitioned", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/leave" {
+			registry.Rejoin(r.Header.Get(acl.PeerIDHeader))
+		}
+		if id := r.Header.Get(acl.RunIDHeader); id != "" {
+			peer := r.Header.Get(acl.PeerIDHeader)
+			if _, known := registry.Get(peer); !known {
+				peer = "unknown"
+			}
+			runRequests.WithLabelValues(runLabels.Value(id), peer).Inc()
+		}
+		h(w, r)
+	}
+}
+
+// apiVersion prefixes the paths of the management API
+const apiVersion = "/v1"
+
+// handleAdmin registers a management endpoint under apiVersion behind
+// access control. The unversioned path keeps working for old scripts,
+// with headers pointing to the new one.
+func handleAdmin(pattern string, h http.HandlerFunc) {
+	routes = append(routes, apiVersion+pattern)
+	http.Handle(apiVersion+pattern, accessList.Protect("admin", h))
+	http.Handle(pattern, accessList.Protect("admin", deprecated(pattern, h)))
+}
+
+// deprecated serves h at a legacy path, counting its use
+func deprecated(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	successor := apiVersion + pattern
+	return func(w http.ResponseWriter, r *http.Request) {
+		legacyRequests.WithLabelValues(pattern).Inc()
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		w.Header().Set("Warning", `299 - "deprecated path, use `+successor+`"`)
+		h(w, r)
+	}
+}
+
+// handlePublic registers an endpoint anybody may call
+func handlePublic(pattern string, h http.Handler) {
+	routes = append(routes, pattern)
+	http.Handle(pattern, h)
+}
+
+// metricsHandler exposes the metrics of all packages, labelled with the
+// tenant if there is one so that tenants can share a Prometheus
+func metricsHandler() http.Handler {
+	if *tenant == "" {
+		return promhttp.Handler()
+	}
+	reg := prometheus.NewRegistry()
+	labelled := prometheus.WrapRegistererWith(prometheus.Labels{"tenant": *tenant}, reg)
+	labelled.MustRegister(prometheus.DefaultRegisterer.(prometheus.Collector))
+	return promhttp.InstrumentMetricHandler(labelled, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+}
+
+// newBackend builds the discovery backend selected on the command line
+func newBackend(name string) (discovery.Backend, error) {
+	switch name {
+	case "kubernetes":
+		return discovery.NewKubernetes(*k8sNamespace, *k8sSelector, *k8sPort, *discoveryInterval)
+	case "consul":
+		return discovery.NewConsul(*consulAddr, *consulService, *registrationTTL, selfPeer()), nil
+	case "etcd":
+		return discovery.NewEtcd(*etcdAddr, *etcdPrefix, *registrationTTL, selfPeer()), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q", name)
+	}
+}
+
+// selfPeer is the registration of this node with consul or etcd
+func selfPeer() discovery.Peer {
+	self := discovery.Peer{ID: *nodeID, Addr: advertiseAddr()}
+	if *tenant != "" {
+		self.Meta = map[string]string{"tenant": *tenant}
+	}
+	return self
+}
+
+// startDiscovery runs the backends until the returned function is called,
+// which waits for them to finish so that they deregister before a restart
+func startDiscovery(backends []discovery.Backend) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(b discovery.Backend) {
+			defer wg.Done()
+			if err := b.Run(ctx, registry); err != nil && ctx.Err() == nil {
+				fmt.Printf("Discovery backend %s stopped: %v\n", b.Name(), err)
+			}
+		}(backend)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
 func main() {
-	// Set up the HTTP server and define the route
-	http.HandleFunc("/", handler)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(benchMain(os.Args[2:]))
+		case "fanout":
+			os.Exit(fanoutMain(os.Args[2:]))
+		case "invite":
+			os.Exit(inviteMain(os.Args[2:]))
+		case "gen-observability":
+			os.Exit(genObservabilityMain(os.Args[2:]))
+		case "selftest":
+			os.Exit(selftestMain(os.Args[2:]))
+		case "validate":
+			os.Exit(validateMain(os.Args[2:]))
+		}
+	}
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Println("Error loading the configuration:", err)
+		os.Exit(1)
+	}
+	if errs := validateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Println("Error:", err)
+		}
+		os.Exit(1)
+	}
+	dial.Default.AttemptDelay = *dialAttemptDelay
+	dial.Default.Proxy = peerProxy
 
-	// Expose the Prometheus metrics endpoint
-	http.Handle("/metrics", promhttp.Handler())
+	if *timeScale != 1 {
+		clock.Set(clock.NewScaled(*timeScale))
+		fmt.Printf("Protocol timers run %gx faster than real time\n", *timeScale)
+	}
+	if err := tuneGC(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	go observeGCPauses()
 
-	// Start the server on port 8080
-	fmt.Println("Server is running on port 8080")
-	err := http.ListenAndServe(":8080", nil)
+	acl.SetTenant(*tenant)
+	var err error
+	accessList, err = acl.New(*allowPeers, *denyPeers, *allowCIDRs, *denyCIDRs)
 	if err != nil {
+		fmt.Println("Error setting up access control:", err)
+		os.Exit(1)
+	}
+
+	registry = discovery.NewRegistry(*nodeID)
+	registry.Tenant = *tenant
+	faultLog = report.NewLog(*nodeID)
+	var backends []discovery.Backend
+	if *discoveryBackend != "" {
+		backend, err := newBackend(*discoveryBackend)
+		if err != nil {
+			fmt.Println("Error setting up discovery:", err)
+			os.Exit(1)
+		}
+		backends = append(backends, backend)
+	}
+	if *peersFile != "" {
+		backends = append(backends, discovery.NewFile(*peersFile))
+	}
+
+	serverTLS, clientTLS, err := peerTLS()
+	if err != nil {
+		fmt.Println("Error setting up TLS:", err)
+		os.Exit(1)
+	}
+	muxNode = mux.New(*nodeID, serverTLS, clientTLS)
+	muxNode.Tenant = *tenant
+	muxNode.Codecs = strings.Split(*wireCodecs, ",")
+	muxNode.Compressions = strings.Split(*compressions, ",")
+	admission = &join.Admission{Token: *joinToken, Secret: *joinSecret}
+	// Self-signed invites expire, so each handshake and request gets a
+	// fresh one
+	muxNode.JoinToken = func() string { return admission.Present(*nodeID, *inviteToken) }
+	acl.SetCredentialFunc(muxNode.JoinToken)
+	if admission.Enabled() {
+		muxNode.Join = admission.Check
+		muxNode.OnJoin = registry.MarkAdmitted
+		accessList.Authenticate = admission.Verify
+		registry.RequireJoin = true
+	}
+	muxNode.Admit = func(peerID string, ip net.IP) bool {
+		// The hello's ID is only vouched for by a join token or invite
+		id := ""
+		if admission.Enabled() {
+			id = peerID
+		}
+		if partitioned.Has(peerID) || !accessList.Admit("peer", id, ip) {
+			return false
+		}
+		registry.Rejoin(peerID)
+		return true
+	}
+	nodeFeatures, err = features.Enabled(*disableFeatures)
+	if err != nil {
+		fmt.Println("Error: invalid --disable-features:", err)
+		os.Exit(1)
+	}
+	muxNode.Features = nodeFeatures
+	muxNode.OnFeatures = registry.SetFeatures
+	muxNode.Keepalive = mux.Keepalive{
+		Interval:  *keepaliveInterval,
+		Timeout:   *keepaliveTimeout,
+		MaxMissed: *keepaliveMaxMissed,
+	}
+	muxNode.Handle(pinger.Protocol, pinger.Echo)
+
+	policy, err := sendq.ParsePolicy(*sendQueuePolicy)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	messenger = messaging.New(muxNode, func(id string) (string, bool) {
+		p, ok := registry.Get(id)
+		return mux.Addr(p, *muxPort), ok
+	}, *sendQueueSize, policy)
+	// Messages queued for a peer that is gone would never be delivered
+	registry.OnRemove = messenger.Forget
+	stopDiscovery := startDiscovery(backends)
+	if *muxListen != "" {
+		l, err := net.Listen("tcp", *muxListen)
+		if err != nil {
+			fmt.Println("Error starting the multiplexed listener:", err)
+			os.Exit(1)
+		}
+		go muxNode.Serve(l)
+	}
+
+	if features.Has(nodeFeatures, features.PubSub) {
+		pubsub = gossip.New(*nodeID, registry, messenger, *gossipHops, *gossipSeenSize, *gossipSeenTTL)
+	}
+
+	syncer := &antientropy.Syncer{
+		Self:     wire.PeerInfo{ID: *nodeID, Addr: advertiseAddr()},
+		Registry: registry,
+		Mux:      muxNode,
+		MuxPort:  *muxPort,
+		Interval: *antiEntropyEvery,
+		TTL:      *antiEntropyTTL,
+	}
+	if features.Has(nodeFeatures, features.Sync) {
+		muxNode.Handle(antientropy.Protocol, syncer.Serve)
+		if *antiEntropyEvery > 0 {
+			go syncer.Run(context.Background())
+		}
+	}
+
+	transports := strings.Split(*pingTransports, ",")
+	peerPinger = pinger.New(*nodeID, registry, *pingInterval, transports, muxNode, *muxPort)
+	peerPinger.Detector = detectorConfig()
+	// Nor would those for a peer that stopped answering; queueing starts
+	// again with the next message
+	peerPinger.OnSuspect = messenger.Forget
+	if *rttTiers != "" {
+		tiers, err := rtt.ParseTiers(*rttTiers)
+		if err != nil {
+			fmt.Println("Error: invalid --rtt-history:", err)
+			os.Exit(1)
+		}
+		rttHistory = rtt.New(tiers)
+		peerPinger.History = rttHistory
+	}
+	if *pingInterval > 0 {
+		go peerPinger.Run(context.Background())
+	}
+
+	chaosRunner = &chaos.Runner{Self: *nodeID, Apply: applyChaos, Event: faultLog.RecordRun}
+
+	if *delayProfile != "" {
+		p, err := delay.Parse(*delayProfile)
+		if err != nil {
+			fmt.Println("Error: invalid --delay-profile:", err)
+			os.Exit(1)
+		}
+		delays.Set(p)
+	}
+
+	if *churnMode != "" {
+		churner := &churn.Churner{
+			Mode:     *churnMode,
+			Interval: *churnInterval,
+			Down:     *churnDown,
+			Timeout:  *churnTimeout,
+			Registry: registry,
+			Drop: func(p discovery.Peer) {
+				messenger.Forget(p.ID)
+				muxNode.Disconnect(mux.Addr(p, *muxPort))
+			},
+			Reset: func() {
+				stopDiscovery()
+				muxNode.Close()
+				registry.Reset()
+				stopDiscovery = startDiscovery(backends)
+			},
+			Alive: func(id string, since time.Time) bool {
+				if *pingInterval <= 0 {
+					return true
+				}
+				for transport, s := range peerPinger.Last()[id] {
+					if transport != "icmp" && s.At.After(since) {
+						return true
+					}
+				}
+				return false
+			},
+			Event: faultLog.Record,
+		}
+		if err := churner.Validate(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		go churner.Run(context.Background())
+	}
+
+	if *collectorMode {
+		resultCollector = collector.New()
+	}
+
+	if *soakMode {
+		gen := loadgen.New(*nodeID, registry.List, *soakPath, *soakWorkers)
+		gen.Throttle = throttles
+		if *runID == "" {
+			*runID = results.NewRunID("soak")
+		}
+		gen.RunID = *runID
+		faultLog.RunID = *runID
+		if *soakMix != "" {
+			gen.Mix, err = loadgen.LoadMix(*soakMix)
+			if err != nil {
+				fmt.Println("Error loading traffic mix:", err)
+				os.Exit(1)
+			}
+		}
+		soakRun = &soak.Soak{
+			Gen:         gen,
+			Node:        *nodeID,
+			Interval:    *soakEvery,
+			File:        *soakFile,
+			LeakWindow:  *soakLeakWindow,
+			ResultsCSV:  *soakCSV,
+			ResultsJSON: *soakJSON,
+			Collector:   *reportTo,
+		}
+		go soakRun.Run(context.Background())
+	}
+
+	if *watchdogInterval > 0 {
+		wd := &watchdog.Watchdog{
+			Interval:      *watchdogInterval,
+			MaxGoroutines: *watchdogGoroutines,
+			MaxFDs:        *watchdogFDs,
+			MaxHeap:       uint64(*watchdogHeapMB) << 20,
+			DumpDir:       *watchdogDumpDir,
+		}
+		go wd.Run(context.Background())
+	}
+
+	if *geoipDB != "" {
+		db, err := geoip.OpenDB(*geoipDB)
+		if err != nil {
+			fmt.Println("Error opening the GeoIP database:", err)
+			os.Exit(1)
+		}
+		geoEnrich = &geoip.Enricher{DB: db, Registry: registry, Interval: *geoipInterval}
+		go geoEnrich.Run(context.Background())
+	}
+
+	if *probeInterval > 0 {
+		prober := &probe.Prober{Registry: registry, Interval: *probeInterval, TLS: clientTLS, MuxPort: *muxPort}
+		go prober.Run(context.Background())
+	}
+
+	if *mtuEcho {
+		conn, err := net.ListenPacket("udp", *listenAddr)
+		if err != nil {
+			fmt.Println("Error starting the MTU probe responder:", err)
+			os.Exit(1)
+		}
+		go probe.ServeUDPEcho(conn)
+	}
+	if *mtuInterval > 0 {
+		maxChunk, err := parseBytes(*mtuMaxChunk)
+		if err != nil {
+			fmt.Println("Error: invalid --mtu-max-chunk:", err)
+			os.Exit(1)
+		}
+		mtuProber := &probe.MTUProber{
+			Self:         *nodeID,
+			Registry:     registry,
+			Interval:     *mtuInterval,
+			MaxChunk:     maxChunk,
+			ChunkTimeout: *mtuChunkTimeout,
+		}
+		go mtuProber.Run(context.Background())
+	}
+
+	events = sse.NewBroker(*sseBuffer)
+	if *transferDir == "" {
+		*transferDir = filepath.Join(os.TempDir(), "p2p_test-transfers-"+*nodeID)
+	}
+	maxTransfer, err := parseBytes(*transferMaxSize)
+	if err != nil {
+		fmt.Println("Error: invalid --transfer-max-size:", err)
+		os.Exit(1)
+	}
+	transfers, err = transfer.NewReceiver(*transferDir, maxTransfer)
+	if err != nil {
+		fmt.Println("Error creating the transfer directory:", err)
+		os.Exit(1)
+	}
+	if *blobDir == "" {
+		*blobDir = filepath.Join(os.TempDir(), "p2p_test-blobs-"+*nodeID)
+	}
+	maxBlob, err := parseBytes(*blobMaxSize)
+	if err != nil {
+		fmt.Println("Error: invalid --blob-max-size:", err)
+		os.Exit(1)
+	}
+	blobStore, err = blobs.NewStore(*blobDir, *nodeID, registry, *blobFetchPeers, maxBlob)
+	if err != nil {
+		fmt.Println("Error creating the blob store:", err)
+		os.Exit(1)
+	}
+	if *reportDir == "" {
+		*reportDir = filepath.Join(os.TempDir(), "p2p_test-reports-"+*nodeID)
+	}
+	reportStore, err = report.NewStore(*reportDir)
+	if err != nil {
+		fmt.Println("Error creating the report directory:", err)
+		os.Exit(1)
+	}
+
+	// Set up the HTTP server and define the route
+	handlePeer("/", delays.Wrap(handler))
+	handlePeer("/ping", pingHandler)
+	handlePeer("/payload", delays.Wrap(payloadHandler))
+	handlePeer("/slow", delays.Wrap(slowHandler))
+	handlePeer("/events", events.ServeHTTP)
+	var disabledRoutes []string
+	if features.Has(nodeFeatures, features.Transfer) {
+		handlePeer("/transfer/", transfers.ServeHTTP)
+	} else {
+		disabledRoutes = append(disabledRoutes, "/transfer/")
+	}
+	if features.Has(nodeFeatures, features.Blobs) {
+		handlePeer("/blobs", blobStore.ServeHTTP)
+		handlePeer("/blobs/", blobStore.ServeHTTP)
+	} else {
+		disabledRoutes = append(disabledRoutes, "/blobs", "/blobs/")
+	}
+	handlePeer("/results", resultsHandler)
+	handlePeer("/leave", leaveHandler)
+	handleAdmin("/peers", peersHandler)
+	handleAdmin("/peers/", peerRTTHandler)
+	handleAdmin("/faults", faultLog.ServeHTTP)
+	handleAdmin("/topology", topologyHandler)
+	handleAdmin("/admin/throttle", throttleHandler)
+	handleAdmin("/admin/delay", delayHandler)
+	handleAdmin("/admin/chaos", chaosHandler)
+	handleAdmin("/admin/gossip", gossipHandler)
+	handleAdmin("/soak", soakHandler)
+	handleAdmin("/admin/broadcast", broadcastHandler)
+	handleAdmin("/admin/transfer", transferHandler)
+	handleAdmin("/admin/report", reportHandler)
+	handleAdmin("/admin/results", resultsResetHandler)
+	handleAdmin("/admin/metrics/inspect", metricsInspectHandler)
+
+	// Expose the Prometheus metrics endpoint and the API definition
+	handlePublic("/metrics", metricsHandler())
+	handlePublic("/openapi.json", http.HandlerFunc(openapi.Spec))
+	handlePublic("/docs", http.HandlerFunc(openapi.Docs))
+	handlePublic("/reports/", reportStore)
+	handlePublic("/stats/recent", http.HandlerFunc(recentStatsHandler))
+	handlePublic(apiVersion+"/check", http.HandlerFunc(checkHandler))
+	for _, problem := range openapi.Check(routes, disabledRoutes) {
+		fmt.Println("Warning: API definition out of date:", problem)
+	}
+
+	// Start the server
+	var handler http.Handler = http.DefaultServeMux
+	if *statsWindow > 0 {
+		recentStats, err = stats.NewRecent(*statsResolution, *statsWindow)
+		if err != nil {
+			fmt.Println("Error: invalid --stats-window:", err)
+			os.Exit(1)
+		}
+		handler = recentStats.Middleware(func(r *http.Request) string {
+			_, pattern := http.DefaultServeMux.Handler(r)
+			return pattern
+		}, handler)
+	}
+	srv := &http.Server{Addr: *listenAddr, Handler: apierror.RequestIDs(handler)}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	fmt.Printf("Server %s is running on %s\n", *nodeID, *listenAddr)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
 		fmt.Println("Error starting the server:", err)
+		os.Exit(1)
+	case <-stop:
+	}
+	signal.Stop(stop)
+
+	// Leave cleanly: tell everyone first so they stop sending, then drop
+	// the registration and stop serving
+	if *goodbyeTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *goodbyeTimeout)
+		sayGoodbye(ctx, registry.List(), *reportTo)
+		cancel()
 	}
+	stopDiscovery()
+	// Streams such as /events never finish, so don't wait for them long
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	srv.Shutdown(ctx)
+	cancel()
+	muxNode.Close()
+	fmt.Printf("Server %s stopped\n", *nodeID)
 }
@@ -0,0 +1,132 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"TestProject/mux"
+	"TestProject/sendq"
+	"TestProject/wire"
+)
+
+// Protocol is the mux protocol name of message streams.
+const Protocol = "msg"
+
+// Handler processes one message received from peer.
+type Handler func(from string, m *wire.Message)
+
+// AddrFunc resolves a peer ID to its multiplexed listener address.
+type AddrFunc func(peer string) (string, bool)
+
+// Messenger sends wire messages to peers through bounded per-peer queues,
+// each peer getting one long-lived stream encoded with the codec negotiated
+// for its connection.
+type Messenger struct {
+	node   *mux.Node
+	addr   AddrFunc
+	queues *sendq.Queues
+
+	mu       sync.Mutex
+	handlers map[wire.Kind]Handler
+	streams  map[string]*mux.Stream
+}
+
+// New registers the message protocol on node. Outbound queues hold up to
+// queueSize messages per peer and apply policy when full.
+func New(node *mux.Node, addr AddrFunc, queueSize int, policy sendq.Policy) *Messenger {
+	m := &Messenger{
+		node:     node,
+		addr:     addr,
+		handlers: make(map[wire.Kind]Handler),
+		streams:  make(map[string]*mux.Stream),
+	}
+	m.queues = sendq.New(queueSize, policy, m.deliver)
+	node.Handle(Protocol, m.serve)
+	return m
+}
+
+// Handle registers the handler for messages of kind.
+func (m *Messenger) Handle(kind wire.Kind, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[kind] = h
+}
+
+// Send queues msg for peer.
+func (m *Messenger) Send(ctx context.Context, peer string, msg *wire.Message) error {
+	return m.queues.Enqueue(ctx, peer, msg)
+}
+
+// SendWith queues msg for peer, applying policy if its queue is full.
+func (m *Messenger) SendWith(ctx context.Context, peer string, msg *wire.Message, policy sendq.Policy) error {
+	return m.queues.EnqueueWith(ctx, peer, msg, policy)
+}
+
+// Forget drops the queue and stream of a peer that left.
+func (m *Messenger) Forget(peer string) {
+	m.queues.Remove(peer)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.streams[peer]; ok {
+		s.Close()
+		delete(m.streams, peer)
+	}
+}
+
+func (m *Messenger) deliver(ctx context.Context, peer string, msg sendq.Message) error {
+	s, err := m.stream(ctx, peer)
+	if err != nil {
+		return err
+	}
+	if err := s.Send(msg.(*wire.Message)); err != nil {
+		m.mu.Lock()
+		if m.streams[peer] == s {
+			delete(m.streams, peer)
+		}
+		m.mu.Unlock()
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+func (m *Messenger) stream(ctx context.Context, peer string) (*mux.Stream, error) {
+	m.mu.Lock()
+	s, ok := m.streams[peer]
+	m.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	addr, ok := m.addr(peer)
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %q", peer)
+	}
+	s, err := m.node.Open(ctx, addr, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.streams[peer] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+func (m *Messenger) serve(s *mux.Stream) {
+	for {
+		var msg wire.Message
+		if err := s.Recv(&msg); err != nil {
+			return
+		}
+		m.mu.Lock()
+		h, ok := m.handlers[msg.Kind]
+		m.mu.Unlock()
+		if !ok {
+			log.Printf("messaging: no handler for %s from %s", msg.Kind, s.Peer)
+			continue
+		}
+		h(s.Peer, &msg)
+	}
+}
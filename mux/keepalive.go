@@ -0,0 +1,126 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"TestProject/clock"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const keepaliveProtocol = "keepalive"
+
+var (
+	keepaliveRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mux_keepalive_rtt_seconds",
+			Help:    "Histogram of keepalive ping/pong round trips on multiplexed connections",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{"peer"},
+	)
+	keepaliveMissed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mux_keepalive_missed_pongs_total",
+			Help: "Total number of keepalive pings not answered within the timeout",
+		},
+		[]string{"peer"},
+	)
+	keepaliveClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mux_keepalive_closed_total",
+			Help: "Total number of connections closed as dead by keepalives",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(keepaliveRTT)
+	prometheus.MustRegister(keepaliveMissed)
+	prometheus.MustRegister(keepaliveClosed)
+}
+
+// Keepalive configures application-level pings on persistent connections.
+type Keepalive struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	MaxMissed int
+}
+
+// keepalive pings over a dedicated stream of s until the connection closes
+// or is declared dead
+func (n *Node) keepalive(addr string, s *session) {
+	stream, err := n.openOn(addr, s, keepaliveProtocol)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	ticker := clock.NewTicker(n.Keepalive.Interval)
+	defer ticker.Stop()
+	var seq uint64
+	missed := 0
+	for {
+		select {
+		case <-s.ys.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		seq++
+		rtt, err := pingPong(stream, seq, clock.Real(n.Keepalive.Timeout))
+		if err == nil {
+			missed = 0
+			keepaliveRTT.WithLabelValues(s.peer).Observe(rtt.Seconds())
+			continue
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) && !isTimeout(err) {
+			return
+		}
+		missed++
+		keepaliveMissed.WithLabelValues(s.peer).Inc()
+		if n.Keepalive.MaxMissed > 0 && missed >= n.Keepalive.MaxMissed {
+			log.Printf("mux: %s (%s) missed %d pongs, closing connection", s.peer, addr, missed)
+			keepaliveClosed.WithLabelValues(s.peer).Inc()
+			n.drop(addr, s)
+			return
+		}
+	}
+}
+
+// pingPong sends seq and waits for its echo, skipping late pongs of
+// earlier pings
+func pingPong(stream net.Conn, seq uint64, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	stream.SetDeadline(start.Add(timeout))
+	if _, err := stream.Write(buf[:]); err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := io.ReadFull(stream, buf[:]); err != nil {
+			return 0, err
+		}
+		if binary.BigEndian.Uint64(buf[:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// echoPongs answers keepalive pings on the accepting side
+func echoPongs(s *Stream) {
+	io.Copy(s, s)
+}
@@ -0,0 +1,148 @@
+package mux
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"TestProject/wire"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sessionsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mux_sessions",
+			Help: "Number of open multiplexed peer connections",
+		},
+		[]string{"direction"},
+	)
+	streamsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mux_streams_total",
+			Help: "Total number of streams opened over multiplexed peer connections",
+		},
+		[]string{"protocol", "direction"},
+	)
+	streamsActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mux_streams_active",
+			Help: "Number of currently open streams",
+		},
+		[]string{"protocol", "direction"},
+	)
+	streamBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mux_stream_bytes_total",
+			Help: "Total bytes carried by streams",
+		},
+		[]string{"protocol", "direction"},
+	)
+	streamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mux_stream_duration_seconds",
+			Help:    "Histogram of stream lifetimes in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"protocol"},
+	)
+	compressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_message_compressed_bytes_total",
+			Help: "Total bytes of peer messages as sent on the wire, after compression",
+		},
+		[]string{"peer", "direction"},
+	)
+	uncompressedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_message_uncompressed_bytes_total",
+			Help: "Total bytes of encoded peer messages before compression",
+		},
+		[]string{"peer", "direction"},
+	)
+	streamOpenDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mux_stream_open_seconds",
+			Help:    "Histogram of time to open an outbound stream, including dialing a new connection",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"protocol"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessionsActive)
+	prometheus.MustRegister(streamsTotal)
+	prometheus.MustRegister(streamsActive)
+	prometheus.MustRegister(streamBytes)
+	prometheus.MustRegister(streamDuration)
+	prometheus.MustRegister(streamOpenDuration)
+	prometheus.MustRegister(compressedBytes)
+	prometheus.MustRegister(uncompressedBytes)
+}
+
+// Stream is one multiplexed stream to or from Peer. Streams count their
+// bytes and lifetime in the per-protocol metrics.
+type Stream struct {
+	net.Conn
+	Peer   string
+	Format wire.Format
+
+	proto, direction string
+	start            time.Time
+	once             sync.Once
+	r                *bufio.Reader
+}
+
+func newStream(c net.Conn, sess *session, proto, direction string) *Stream {
+	streamsTotal.WithLabelValues(proto, direction).Inc()
+	streamsActive.WithLabelValues(proto, direction).Inc()
+	return &Stream{Conn: c, Peer: sess.peer, Format: sess.format, proto: proto, direction: direction, start: time.Now()}
+}
+
+// Send writes m in the connection's negotiated format.
+func (s *Stream) Send(m *wire.Message) error {
+	raw, sent, err := wire.WriteFrame(s, s.Format, m)
+	if err != nil {
+		return err
+	}
+	uncompressedBytes.WithLabelValues(s.Peer, "sent").Add(float64(raw))
+	compressedBytes.WithLabelValues(s.Peer, "sent").Add(float64(sent))
+	return nil
+}
+
+// Recv reads the next message in the connection's negotiated format.
+func (s *Stream) Recv(m *wire.Message) error {
+	if s.r == nil {
+		s.r = bufio.NewReader(s)
+	}
+	raw, received, err := wire.ReadFrame(s.r, s.Format, m)
+	if err != nil {
+		return err
+	}
+	uncompressedBytes.WithLabelValues(s.Peer, "received").Add(float64(raw))
+	compressedBytes.WithLabelValues(s.Peer, "received").Add(float64(received))
+	return nil
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	streamBytes.WithLabelValues(s.proto, "received").Add(float64(n))
+	return n, err
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	n, err := s.Conn.Write(p)
+	streamBytes.WithLabelValues(s.proto, "sent").Add(float64(n))
+	return n, err
+}
+
+func (s *Stream) Close() error {
+	s.once.Do(func() {
+		streamsActive.WithLabelValues(s.proto, s.direction).Dec()
+		streamDuration.WithLabelValues(s.proto).Observe(time.Since(s.start).Seconds())
+	})
+	return s.Conn.Close()
+}
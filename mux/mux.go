@@ -0,0 +1,514 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/wire"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Handler serves one inbound stream of a protocol.
+type Handler func(s *Stream)
+
+// HandshakeTimeout bounds the TLS handshake and the exchange of hellos of
+// a connection, and reading the protocol of a stream.
+const HandshakeTimeout = 10 * time.Second
+
+const (
+	// maxHello bounds a hello line, which carries a join token or invite
+	maxHello = 64 << 10
+	// maxProtocol bounds the protocol line of a stream
+	maxProtocol = 1 << 10
+)
+
+var errLineTooLong = errors.New("header line too long")
+
+// Hello is exchanged once per connection, before yamux takes over. The
+// dialing side offers Codecs and Compressions in order of preference and
+// the accepting side answers with the chosen Codec and Compression. Both
+// sides name their Tenant, and nodes of different tenants don't connect.
+// The dialing side presents its join Token; an accepting side that refuses
+// it answers with the reason in Refused and hangs up. Both sides list the
+// Features they offer.
+type Hello struct {
+	ID           string   `json:"id"`
+	Tenant       string   `json:"tenant,omitempty"`
+	Token        string   `json:"token,omitempty"`
+	Refused      string   `json:"refused,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+	Codec        string   `json:"codec,omitempty"`
+	Compressions []string `json:"compressions,omitempty"`
+	Compression  string   `json:"compression,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+// Node keeps one long-lived multiplexed connection per peer address and
+// dispatches inbound streams to protocol handlers.
+type Node struct {
+	ID        string
+	Tenant    string
+	ServerTLS *tls.Config // nil serves plain TCP
+	ClientTLS *tls.Config // nil dials plain TCP
+
+	// Codecs are the wire formats this node speaks, preferred first.
+	Codecs []string
+	// Compressions are the message compressions this node accepts,
+	// preferred first.
+	Compressions []string
+
+	// Admit, if set, decides whether an inbound connection is accepted.
+	Admit func(peerID string, ip net.IP) bool
+
+	// JoinToken, if set, returns what is presented to every peer in the
+	// handshake; it is called for each, so invites can be re-signed. Join, if
+	// set, checks the token peers present, both those dialing in, which it
+	// refuses with the error, and those dialed. OnJoin, if set, is told
+	// about every peer Join admitted.
+	JoinToken func() string
+	Join      func(peerID, token string) error
+	OnJoin    func(peerID string)
+
+	// Features are offered to every peer in the handshake. OnFeatures, if
+	// set, is told what each peer offers; peers that predate feature
+	// negotiation don't say.
+	Features   []string
+	OnFeatures func(peerID string, features []string)
+
+	// Keepalive sends application-level pings on every outbound connection
+	// and closes it after MaxMissed consecutive pongs fail to arrive within
+	// Timeout. A zero Interval disables keepalives.
+	Keepalive Keepalive
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	sessions map[string]*session
+}
+
+type session struct {
+	peer   string
+	format wire.Format
+	ys     *yamux.Session
+}
+
+func New(id string, serverTLS, clientTLS *tls.Config) *Node {
+	n := &Node{
+		ID:           id,
+		ServerTLS:    serverTLS,
+		ClientTLS:    clientTLS,
+		Codecs:       wire.Names(),
+		Compressions: []string{"none"},
+		handlers:     make(map[string]Handler),
+		sessions:     make(map[string]*session),
+	}
+	n.handlers[keepaliveProtocol] = echoPongs
+	return n
+}
+
+// Handle registers the handler for streams of protocol proto.
+func (n *Node) Handle(proto string, h Handler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[proto] = h
+}
+
+// Serve accepts peer connections on l until it fails.
+func (n *Node) Serve(l net.Listener) error {
+	if n.ServerTLS != nil {
+		l = tls.NewListener(l, n.ServerTLS)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go n.serveConn(conn)
+	}
+}
+
+func (n *Node) serveConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	r := newLineReader(conn, maxHello)
+	var hello Hello
+	if err := readHello(r, &hello); err != nil {
+		// Connect and handshake probes hang up without a hello
+		if err != io.EOF {
+			log.Printf("mux: handshake from %s: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	if hello.Tenant != n.Tenant {
+		log.Printf("mux: refused %s of tenant %q", hello.ID, hello.Tenant)
+		conn.Close()
+		return
+	}
+	if n.Join != nil {
+		if err := n.Join(hello.ID, hello.Token); err != nil {
+			log.Printf("mux: refused %s: %v", hello.ID, err)
+			writeHello(conn, Hello{ID: n.ID, Tenant: n.Tenant, Refused: err.Error()})
+			conn.Close()
+			return
+		}
+		if n.OnJoin != nil {
+			n.OnJoin(hello.ID)
+		}
+	}
+	if n.Admit != nil {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !n.Admit(hello.ID, net.ParseIP(host)) {
+			conn.Close()
+			return
+		}
+	}
+	codecName, err := wire.Negotiate(hello.Codecs, n.Codecs)
+	if err != nil {
+		log.Printf("mux: codec handshake from %s: %v", hello.ID, err)
+		conn.Close()
+		return
+	}
+	// Peers that predate compression negotiation offer nothing
+	offered := hello.Compressions
+	if len(offered) == 0 {
+		offered = []string{"none"}
+	}
+	compName, err := wire.Negotiate(offered, n.Compressions)
+	if err != nil {
+		log.Printf("mux: compression handshake from %s: %v", hello.ID, err)
+		conn.Close()
+		return
+	}
+	codec, _ := wire.Lookup(codecName)
+	comp, _ := wire.LookupCompression(compName)
+	if err := writeHello(conn, Hello{ID: n.ID, Tenant: n.Tenant, Token: n.joinToken(), Codec: codecName, Compression: compName, Features: n.Features}); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	n.offered(hello)
+	sess := &session{peer: hello.ID, format: wire.Format{Codec: codec, Compression: comp}}
+
+	ys, err := yamux.Server(&bufferedConn{Conn: conn, r: r.Reader}, yamuxConfig())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	sess.ys = ys
+	sessionsActive.WithLabelValues("inbound").Inc()
+	defer sessionsActive.WithLabelValues("inbound").Dec()
+	defer ys.Close()
+
+	for {
+		stream, err := ys.Accept()
+		if err != nil {
+			return
+		}
+		go n.serveStream(sess, stream)
+	}
+}
+
+func (n *Node) joinToken() string {
+	if n.JoinToken == nil {
+		return ""
+	}
+	return n.JoinToken()
+}
+
+func (n *Node) serveStream(sess *session, stream net.Conn) {
+	stream.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	r := newLineReader(stream, maxProtocol)
+	line, err := r.readLine()
+	if err != nil {
+		stream.Close()
+		return
+	}
+	proto := strings.TrimSpace(string(line))
+	stream.SetReadDeadline(time.Time{})
+
+	n.mu.Lock()
+	h, ok := n.handlers[proto]
+	n.mu.Unlock()
+	if !ok {
+		log.Printf("mux: %s opened stream for unknown protocol %q", sess.peer, proto)
+		stream.Close()
+		return
+	}
+
+	s := newStream(&bufferedConn{Conn: stream, r: r.Reader}, sess, proto, "inbound")
+	defer s.Close()
+	h(s)
+}
+
+// Open returns a new stream for proto to the peer at addr, dialing a
+// connection first if there is none yet.
+func (n *Node) Open(ctx context.Context, addr, proto string) (*Stream, error) {
+	start := time.Now()
+	sess, err := n.session(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := n.openOn(addr, sess, proto)
+	if err != nil {
+		return nil, err
+	}
+	streamOpenDuration.WithLabelValues(proto).Observe(time.Since(start).Seconds())
+	return s, nil
+}
+
+func (n *Node) openOn(addr string, sess *session, proto string) (*Stream, error) {
+	stream, err := sess.ys.OpenStream()
+	if err != nil {
+		n.drop(addr, sess)
+		return nil, err
+	}
+	if _, err := io.WriteString(stream, proto+"\n"); err != nil {
+		stream.Close()
+		n.drop(addr, sess)
+		return nil, err
+	}
+	return newStream(stream, sess, proto, "outbound"), nil
+}
+
+// Addr is the address of peer's multiplexed listener: the "mux_addr"
+// metadata if the peer announces one, else its host with port.
+func Addr(peer discovery.Peer, port int) string {
+	if addr := peer.Meta["mux_addr"]; addr != "" {
+		return addr
+	}
+	host, _, err := net.SplitHostPort(peer.Addr)
+	if err != nil {
+		host = peer.Addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Peer returns the ID the peer at addr announced, if connected.
+func (n *Node) Peer(addr string) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.sessions[addr]
+	if !ok || s.ys.IsClosed() {
+		return "", false
+	}
+	return s.peer, true
+}
+
+func (n *Node) session(ctx context.Context, addr string) (*session, error) {
+	n.mu.Lock()
+	s, ok := n.sessions[addr]
+	n.mu.Unlock()
+	if ok && !s.ys.IsClosed() {
+		return s, nil
+	}
+
+	s, err := n.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Another caller may have raced us to the same peer, keep theirs
+	if cur, ok := n.sessions[addr]; ok && !cur.ys.IsClosed() {
+		s.ys.Close()
+		return cur, nil
+	}
+	n.sessions[addr] = s
+	if n.Keepalive.Interval > 0 {
+		go n.keepalive(addr, s)
+	}
+	return s, nil
+}
+
+func (n *Node) dial(ctx context.Context, addr string) (*session, error) {
+	conn, err := dial.Default.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if n.ClientTLS != nil {
+		cfg := n.ClientTLS
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn = tls.Client(conn, cfg)
+	}
+
+	// The deadline covers the TLS handshake and the hellos, also with a
+	// ctx without one
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := writeHello(conn, Hello{ID: n.ID, Tenant: n.Tenant, Token: n.joinToken(), Codecs: n.Codecs, Compressions: n.Compressions, Features: n.Features}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := newLineReader(conn, maxHello)
+	var hello Hello
+	if err := readHello(r, &hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: %w", addr, err)
+	}
+	if hello.Tenant != n.Tenant {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: peer belongs to tenant %q", addr, hello.Tenant)
+	}
+	if hello.Refused != "" {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: refused: %s", addr, hello.Refused)
+	}
+	if n.Join != nil {
+		if err := n.Join(hello.ID, hello.Token); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("handshake with %s: %s not admitted: %w", addr, hello.ID, err)
+		}
+		if n.OnJoin != nil {
+			n.OnJoin(hello.ID)
+		}
+	}
+	codec, ok := wire.Lookup(hello.Codec)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: peer chose unknown codec %q", addr, hello.Codec)
+	}
+	if hello.Compression == "" {
+		hello.Compression = "none"
+	}
+	comp, ok := wire.LookupCompression(hello.Compression)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s: peer chose unknown compression %q", addr, hello.Compression)
+	}
+	conn.SetDeadline(time.Time{})
+	n.offered(hello)
+
+	ys, err := yamux.Client(&bufferedConn{Conn: conn, r: r.Reader}, yamuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sessionsActive.WithLabelValues("outbound").Inc()
+	go func() {
+		<-ys.CloseChan()
+		sessionsActive.WithLabelValues("outbound").Dec()
+	}()
+	return &session{peer: hello.ID, format: wire.Format{Codec: codec, Compression: comp}, ys: ys}, nil
+}
+
+func (n *Node) drop(addr string, s *session) {
+	s.ys.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sessions[addr] == s {
+		delete(n.sessions, addr)
+	}
+}
+
+// Disconnect tears down the outbound connection to addr, if any.
+func (n *Node) Disconnect(addr string) {
+	n.mu.Lock()
+	s, ok := n.sessions[addr]
+	delete(n.sessions, addr)
+	n.mu.Unlock()
+	if ok {
+		s.ys.Close()
+	}
+}
+
+// Close tears down all outbound connections.
+func (n *Node) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for addr, s := range n.sessions {
+		s.ys.Close()
+		delete(n.sessions, addr)
+	}
+}
+
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	return cfg
+}
+
+// offered passes on the features a peer listed in its hello
+func (n *Node) offered(hello Hello) {
+	if n.OnFeatures != nil && hello.Features != nil {
+		n.OnFeatures(hello.ID, hello.Features)
+	}
+}
+
+func writeHello(w io.Writer, h Hello) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func readHello(r *lineReader, h *Hello) error {
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, h); err != nil {
+		return err
+	}
+	if h.ID == "" {
+		return errors.New("peer did not announce an ID")
+	}
+	return nil
+}
+
+// lineReader reads the header line of a connection or stream, a hello or
+// a protocol name, through a limit, so a peer can't make it buffer
+// without end. The limit is lifted for what follows the line.
+type lineReader struct {
+	*bufio.Reader
+	limit *io.LimitedReader
+}
+
+func newLineReader(r io.Reader, max int64) *lineReader {
+	limit := &io.LimitedReader{R: r, N: max}
+	return &lineReader{Reader: bufio.NewReader(limit), limit: limit}
+}
+
+func (r *lineReader) readLine() ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && r.limit.N == 0 {
+		return nil, errLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.limit.N = math.MaxInt64
+	return line, nil
+}
+
+// bufferedConn keeps bytes already buffered while reading a header line
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
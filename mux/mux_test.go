@@ -0,0 +1,40 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadHello(t *testing.T) {
+	// What follows the hello is read on without the limit
+	session := strings.Repeat("s", 2*maxHello)
+	r := newLineReader(strings.NewReader(`{"id":"node-a","codecs":["json"]}`+"\n"+session), maxHello)
+	var h Hello
+	if err := readHello(r, &h); err != nil || h.ID != "node-a" {
+		t.Fatalf("readHello = %+v, %v", h, err)
+	}
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != session {
+		t.Errorf("read %d bytes after the hello, want %d: %v", len(rest), len(session), err)
+	}
+
+	for name, tc := range map[string]struct {
+		data string
+		want error
+	}{
+		"endless":  {strings.Repeat("x", 10*maxHello), errLineTooLong},
+		"too long": {`{"id":"` + strings.Repeat("x", maxHello) + `"}` + "\n", errLineTooLong},
+		"hang up":  {"", io.EOF},
+		"cut off":  {`{"id":"node-a"`, io.EOF},
+	} {
+		var h Hello
+		err := readHello(newLineReader(strings.NewReader(tc.data), maxHello), &h)
+		if err != tc.want {
+			t.Errorf("%s: err = %v, want %v", name, err, tc.want)
+		}
+	}
+	if err := readHello(newLineReader(bytes.NewReader([]byte("{}\n")), maxHello), &Hello{}); err == nil {
+		t.Error("a hello without an ID was accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package observability
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Dashboard is a Grafana dashboard, in the JSON model of Grafana 9 and later.
+type Dashboard struct {
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	Tags          []string   `json:"tags"`
+	Editable      bool       `json:"editable"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Refresh       string     `json:"refresh"`
+	Time          TimeRange  `json:"time"`
+	Templating    Templating `json:"templating"`
+	Panels        []Panel    `json:"panels"`
+}
+
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+type Variable struct {
+	Name       string      `json:"name"`
+	Label      string      `json:"label"`
+	Type       string      `json:"type"`
+	Query      string      `json:"query"`
+	Datasource *Datasource `json:"datasource,omitempty"`
+	Multi      bool        `json:"multi,omitempty"`
+	IncludeAll bool        `json:"includeAll,omitempty"`
+	AllValue   string      `json:"allValue,omitempty"`
+	Refresh    int         `json:"refresh,omitempty"`
+}
+
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// Panel is a row (Type "row") or a time series panel.
+type Panel struct {
+	ID          int          `json:"id"`
+	Type        string       `json:"type"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	GridPos     GridPos      `json:"gridPos"`
+	Collapsed   *bool        `json:"collapsed,omitempty"`
+	Datasource  *Datasource  `json:"datasource,omitempty"`
+	FieldConfig *FieldConfig `json:"fieldConfig,omitempty"`
+	Targets     []Target     `json:"targets,omitempty"`
+}
+
+type GridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type FieldConfig struct {
+	Defaults  FieldDefaults `json:"defaults"`
+	Overrides []interface{} `json:"overrides"`
+}
+
+type FieldDefaults struct {
+	Unit string `json:"unit"`
+}
+
+type Target struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+const (
+	panelWidth  = 12
+	panelHeight = 8
+)
+
+var prometheusDatasource = &Datasource{Type: "prometheus", UID: "${datasource}"}
+
+// instanceSelector limits every query to the tenants and instances picked
+// on the dashboard
+const instanceSelector = `{tenant=~"$tenant", instance=~"$instance"}`
+
+// NewDashboard generates a dashboard with a row per subsystem of metrics
+// and a panel per metric: the rate of counters, the p50 and p99 of
+// histograms and the value of gauges.
+func NewDashboard(metrics []Metric) Dashboard {
+	d := Dashboard{
+		UID:           "p2p-test",
+		Title:         "p2p_test",
+		Description:   "Generated by p2p_test gen-observability from the metrics the binary registers.",
+		Tags:          []string{"p2p_test"},
+		Editable:      true,
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          TimeRange{From: "now-1h", To: "now"},
+		Templating: Templating{List: []Variable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				// Nodes started without --tenant have none, which All matches
+				Name:       "tenant",
+				Label:      "Tenant",
+				Type:       "query",
+				Query:      "label_values(http_requests_total, tenant)",
+				Datasource: prometheusDatasource,
+				Multi:      true,
+				IncludeAll: true,
+				AllValue:   ".*",
+				Refresh:    2,
+			},
+			{
+				Name:       "instance",
+				Label:      "Instance",
+				Type:       "query",
+				Query:      `label_values(http_requests_total{tenant=~"$tenant"}, instance)`,
+				Datasource: prometheusDatasource,
+				Multi:      true,
+				IncludeAll: true,
+				Refresh:    2,
+			},
+		}},
+	}
+
+	id, y := 0, 0
+	subsystem := ""
+	col := 0
+	for _, m := range metrics {
+		if m.Subsystem() != subsystem {
+			subsystem = m.Subsystem()
+			if col > 0 {
+				y += panelHeight
+			}
+			id++
+			collapsed := false
+			d.Panels = append(d.Panels, Panel{ID: id, Type: "row", Title: subsystem, GridPos: GridPos{Y: y, W: 24, H: 1}, Collapsed: &collapsed})
+			y++
+			col = 0
+		}
+		id++
+		d.Panels = append(d.Panels, Panel{
+			ID:          id,
+			Type:        "timeseries",
+			Title:       m.Name,
+			Description: m.Help,
+			GridPos:     GridPos{X: col * panelWidth, Y: y, W: panelWidth, H: panelHeight},
+			Datasource:  prometheusDatasource,
+			FieldConfig: &FieldConfig{Defaults: FieldDefaults{Unit: unit(m)}, Overrides: []interface{}{}},
+			Targets:     targets(m),
+		})
+		if col++; col == 24/panelWidth {
+			col = 0
+			y += panelHeight
+		}
+	}
+	return d
+}
+
+// Marshal encodes d as indented JSON, ready to import into Grafana.
+func (d Dashboard) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(d, "", "  ")
+	return append(data, '\n'), err
+}
+
+func targets(m Metric) []Target {
+	legend := "{{instance}}"
+	for _, l := range m.Labels {
+		legend += " {{" + l + "}}"
+	}
+	switch m.Type {
+	case Counter:
+		return []Target{{
+			RefID:        "A",
+			Expr:         fmt.Sprintf("sum by (%s) (rate(%s%s[$__rate_interval]))", by(m, "tenant", "instance"), m.Name, instanceSelector),
+			LegendFormat: legend,
+		}}
+	case Histogram:
+		var ts []Target
+		for i, q := range quantiles {
+			ts = append(ts, Target{
+				RefID:        string(rune('A' + i)),
+				Expr:         fmt.Sprintf("histogram_quantile(%s, sum by (%s) (rate(%s_bucket%s[$__rate_interval])))", q.value, by(m, "tenant", "instance", "le"), m.Name, instanceSelector),
+				LegendFormat: q.name + " " + legend,
+			})
+		}
+		return ts
+	}
+	if strings.HasSuffix(m.Name, "_timestamp_seconds") {
+		// How far off, rather than a date
+		return []Target{{RefID: "A", Expr: m.Name + instanceSelector + " - time()", LegendFormat: legend}}
+	}
+	return []Target{{RefID: "A", Expr: m.Name + instanceSelector, LegendFormat: legend}}
+}
+
+// unit picks the Grafana unit from the metric name suffix
+func unit(m Metric) string {
+	name := m.Name
+	if m.Type == Counter {
+		switch {
+		case strings.HasSuffix(name, "_bytes_total"):
+			return "Bps"
+		case strings.HasSuffix(name, "_seconds_total"):
+			// seconds spent per second
+			return "percentunit"
+		default:
+			return "cps"
+		}
+	}
+	switch {
+	case strings.HasSuffix(name, "_bytes_per_second"):
+		return "Bps"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "bytes"
+	case strings.HasSuffix(name, "_ratio"):
+		return "percentunit"
+	default:
+		return "short"
+	}
+}
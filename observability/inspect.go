@@ -0,0 +1,125 @@
+package observability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Family is a registered metric family and the series it holds right now.
+type Family struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Help   string   `json:"help"`
+	Labels []string `json:"labels"`
+	// Children is the number of label combinations with a value
+	Children int `json:"children"`
+	// Series is the number of time series scraped: one per child, or for
+	// histograms and summaries one per bucket or quantile plus _sum and
+	// _count
+	Series int `json:"series"`
+	// LabelValues is the number of distinct values of each label
+	LabelValues map[string]int `json:"label_values,omitempty"`
+	OverBudget  bool           `json:"over_budget,omitempty"`
+}
+
+// Inspection is the metric surface of the binary.
+type Inspection struct {
+	Families []Family `json:"families"`
+	Series   int      `json:"series"`
+	Budget   int      `json:"series_budget"`
+	Warnings []string `json:"warnings"`
+}
+
+// Inspect lists every metric family registered with the default registry,
+// the Go runtime and process metrics included, heaviest first, and warns
+// about families of more than budget series, naming the label most of
+// them come from. A budget of 0 warns about none.
+func Inspect(budget int) (Inspection, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return Inspection{}, err
+	}
+	byName := make(map[string]*Family)
+	for _, f := range families {
+		fam := &Family{Name: f.GetName(), Type: strings.ToLower(f.GetType().String()), Help: f.GetHelp(), LabelValues: make(map[string]int)}
+		values := make(map[string]map[string]bool)
+		for _, m := range f.GetMetric() {
+			fam.Children++
+			switch {
+			case m.GetHistogram() != nil:
+				// The +Inf bucket isn't among the buckets of the family
+				fam.Series += len(m.GetHistogram().GetBucket()) + 3
+			case m.GetSummary() != nil:
+				fam.Series += len(m.GetSummary().GetQuantile()) + 2
+			default:
+				fam.Series++
+			}
+			for _, l := range m.GetLabel() {
+				if values[l.GetName()] == nil {
+					values[l.GetName()] = make(map[string]bool)
+				}
+				values[l.GetName()][l.GetValue()] = true
+			}
+		}
+		for l, vs := range values {
+			fam.Labels = append(fam.Labels, l)
+			fam.LabelValues[l] = len(vs)
+		}
+		sort.Strings(fam.Labels)
+		byName[fam.Name] = fam
+	}
+
+	// Vectors without children yet aren't gathered, but are registered
+	registered, err := Metrics()
+	if err != nil {
+		return Inspection{}, err
+	}
+	for _, m := range registered {
+		if _, ok := byName[m.Name]; ok {
+			continue
+		}
+		byName[m.Name] = &Family{Name: m.Name, Type: m.Type, Help: m.Help, Labels: m.Labels}
+	}
+
+	in := Inspection{Budget: budget, Families: []Family{}, Warnings: []string{}}
+	for _, fam := range byName {
+		if fam.Labels == nil {
+			fam.Labels = []string{}
+		}
+		if len(fam.LabelValues) == 0 {
+			fam.LabelValues = nil
+		}
+		if budget > 0 && fam.Series > budget {
+			fam.OverBudget = true
+			in.Warnings = append(in.Warnings, overBudget(fam, budget))
+		}
+		in.Series += fam.Series
+		in.Families = append(in.Families, *fam)
+	}
+	sort.Slice(in.Families, func(i, j int) bool {
+		a, b := in.Families[i], in.Families[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		return a.Name < b.Name
+	})
+	sort.Strings(in.Warnings)
+	return in, nil
+}
+
+func overBudget(f *Family, budget int) string {
+	w := fmt.Sprintf("%s has %d series, over the budget of %d", f.Name, f.Series, budget)
+	var worst string
+	for _, l := range f.Labels {
+		if worst == "" || f.LabelValues[l] > f.LabelValues[worst] {
+			worst = l
+		}
+	}
+	if worst != "" {
+		w += fmt.Sprintf("; label %s has %d values", worst, f.LabelValues[worst])
+	}
+	return w
+}
@@ -0,0 +1,147 @@
+package observability
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric types, as named by Prometheus.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Metric is one metric family the binary exposes.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+}
+
+// Subsystem is the first part of the name, e.g. mux for mux_sessions.
+func (m Metric) Subsystem() string {
+	if i := strings.Index(m.Name, "_"); i > 0 {
+		return m.Name[:i]
+	}
+	return m.Name
+}
+
+// HasLabels reports whether m carries all of labels.
+func (m Metric) HasLabels(labels ...string) bool {
+	have := make(map[string]bool)
+	for _, l := range m.Labels {
+		have[l] = true
+	}
+	for _, l := range labels {
+		if !have[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// runtime metrics come with client_golang and have their own dashboards
+var runtimePrefixes = []string{"go_", "process_", "promhttp_"}
+
+// descPattern matches prometheus.Desc.String, the only way to read a
+// descriptor's name, help and labels
+var descPattern = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{.*\}, variableLabels: \{(.*)\}\}$`)
+
+// Metrics lists the metrics registered with the default registry, which
+// every package registers its metrics with in init, leaving out the Go
+// runtime and process metrics.
+//
+// Descriptors don't tell the type. It is taken from the gathered families
+// where a metric has values already, and otherwise from the naming
+// conventions of the code: counters end in _total and histograms have help
+// starting with "Histogram of".
+func Metrics() ([]Metric, error) {
+	describer, ok := prometheus.DefaultRegisterer.(interface {
+		Describe(chan<- *prometheus.Desc)
+	})
+	if !ok {
+		return nil, fmt.Errorf("the default registerer can't describe its metrics")
+	}
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		describer.Describe(descs)
+		close(descs)
+	}()
+
+	byName := make(map[string]Metric)
+	for d := range descs {
+		m, err := parseDesc(d.String())
+		if err != nil {
+			return nil, err
+		}
+		if runtimeMetric(m.Name) {
+			continue
+		}
+		byName[m.Name] = m
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	gathered := make(map[string]string)
+	for _, f := range families {
+		gathered[f.GetName()] = strings.ToLower(f.GetType().String())
+	}
+
+	var out []Metric
+	for _, m := range byName {
+		switch t := gathered[m.Name]; {
+		case t != "":
+			m.Type = t
+		case strings.HasSuffix(m.Name, "_total"):
+			m.Type = Counter
+		case strings.HasPrefix(m.Help, "Histogram of"):
+			m.Type = Histogram
+		default:
+			m.Type = Gauge
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func parseDesc(s string) (Metric, error) {
+	match := descPattern.FindStringSubmatch(s)
+	if match == nil {
+		return Metric{}, fmt.Errorf("unexpected metric descriptor %s", s)
+	}
+	name, err := strconv.Unquote(match[1])
+	if err != nil {
+		return Metric{}, err
+	}
+	help, err := strconv.Unquote(match[2])
+	if err != nil {
+		return Metric{}, err
+	}
+	m := Metric{Name: name, Help: help}
+	for _, l := range strings.Split(match[3], ",") {
+		l = strings.TrimSuffix(strings.TrimPrefix(l, "c("), ")")
+		if l != "" {
+			m.Labels = append(m.Labels, l)
+		}
+	}
+	return m, nil
+}
+
+func runtimeMetric(name string) bool {
+	for _, p := range runtimePrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package observability
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleFile is a Prometheus rule file.
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a recording rule (Record set) or an alerting rule (Alert set).
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// alert is a recommended alert and the metrics, with their labels, its
+// expression and annotations use
+type alert struct {
+	name     string
+	expr     string
+	wait     string
+	severity string
+	summary  string
+	uses     map[string][]string
+}
+
+var alerts = []alert{
+	{
+		name:     "PeerPingFailing",
+		expr:     `sum by (tenant, instance, peer) (rate(peer_ping_failures_total[5m])) > 0.1`,
+		wait:     "5m",
+		severity: "warning",
+		summary:  "Pings from {{ $labels.instance }} to {{ $labels.peer }} are failing",
+		uses:     map[string][]string{"peer_ping_failures_total": {"peer"}},
+	},
+	{
+		name:     "PeerPingRTTHigh",
+		expr:     `histogram_quantile(0.99, sum by (tenant, instance, peer, le) (rate(peer_ping_rtt_seconds_bucket[5m]))) > 0.5`,
+		wait:     "10m",
+		severity: "warning",
+		summary:  "p99 ping RTT from {{ $labels.instance }} to {{ $labels.peer }} is {{ $value | humanizeDuration }}",
+		uses:     map[string][]string{"peer_ping_rtt_seconds": {"peer"}},
+	},
+	{
+		name:     "MuxSessionsTimingOut",
+		expr:     `sum by (tenant, instance, peer) (increase(mux_keepalive_closed_total[10m])) > 0`,
+		severity: "warning",
+		summary:  "Mux sessions from {{ $labels.instance }} to {{ $labels.peer }} are closed for missed keepalives",
+		uses:     map[string][]string{"mux_keepalive_closed_total": {"peer"}},
+	},
+	{
+		name:     "SendQueueDropping",
+		expr:     `sum by (tenant, instance, peer, policy) (rate(peer_send_queue_dropped_total[5m])) > 0`,
+		wait:     "5m",
+		severity: "warning",
+		summary:  "{{ $labels.instance }} drops messages to {{ $labels.peer }} ({{ $labels.policy }} queue)",
+		uses:     map[string][]string{"peer_send_queue_dropped_total": {"peer", "policy"}},
+	},
+	{
+		name:     "ProbeFailing",
+		expr:     `probe_success == 0`,
+		wait:     "5m",
+		severity: "critical",
+		summary:  "{{ $labels.probe_type }} probe from {{ $labels.instance }} to {{ $labels.peer }} is failing",
+		uses:     map[string][]string{"probe_success": {"peer", "probe_type"}},
+	},
+	{
+		name:     "TLSCertificateExpiringSoon",
+		expr:     `probe_tls_cert_expiry_timestamp_seconds - time() < 7 * 86400`,
+		wait:     "1h",
+		severity: "warning",
+		summary:  "The TLS certificate of {{ $labels.peer }} expires in {{ $value | humanizeDuration }}",
+		uses:     map[string][]string{"probe_tls_cert_expiry_timestamp_seconds": {"peer"}},
+	},
+	{
+		name:     "SoakLeakSuspected",
+		expr:     `soak_leak_suspected == 1`,
+		wait:     "1m",
+		severity: "critical",
+		summary:  "Soak run on {{ $labels.instance }} suspects a {{ $labels.resource }} leak",
+		uses:     map[string][]string{"soak_leak_suspected": {"resource"}},
+	},
+	{
+		name:     "WatchdogThresholdExceeded",
+		expr:     `sum by (tenant, instance, resource) (increase(watchdog_threshold_exceeded_total[10m])) > 0`,
+		severity: "warning",
+		summary:  "{{ $labels.instance }} exceeded its {{ $labels.resource }} threshold",
+		uses:     map[string][]string{"watchdog_threshold_exceeded_total": {"resource"}},
+	},
+	{
+		name:     "HTTPErrorRateHigh",
+		expr:     `sum by (tenant, instance) (rate(http_requests_total{code=~"5.."}[5m])) / sum by (tenant, instance) (rate(http_requests_total[5m])) > 0.05`,
+		wait:     "5m",
+		severity: "critical",
+		summary:  "{{ $value | humanizePercentage }} of the requests to {{ $labels.instance }} fail with 5xx",
+		uses:     map[string][]string{"http_requests_total": {"code"}},
+	},
+	{
+		name:     "ChurnRecoveryTimeouts",
+		expr:     `sum by (tenant, instance, action) (increase(churn_recovery_timeouts_total[15m])) > 0`,
+		severity: "warning",
+		summary:  "The mesh did not recover from {{ $labels.action }} churn on {{ $labels.instance }} in time",
+		uses:     map[string][]string{"churn_recovery_timeouts_total": {"action"}},
+	},
+	{
+		name:     "TransferCorruption",
+		expr:     `sum by (tenant, instance, peer, scope) (increase(transfer_corrupt_total[10m])) > 0`,
+		severity: "critical",
+		summary:  "Transfers from {{ $labels.peer }} to {{ $labels.instance }} fail {{ $labels.scope }} checksums",
+		uses:     map[string][]string{"transfer_corrupt_total": {"peer", "scope"}},
+	},
+	{
+		name:     "BlobCorruption",
+		expr:     `sum by (tenant, instance, peer) (increase(blob_fetch_corrupt_total[10m])) > 0`,
+		severity: "critical",
+		summary:  "Blobs fetched by {{ $labels.instance }} from {{ $labels.peer }} fail verification",
+		uses:     map[string][]string{"blob_fetch_corrupt_total": {"peer"}},
+	},
+	{
+		name:     "DiscoverySyncFailing",
+		expr:     `sum by (tenant, instance, source) (rate(discovery_sync_errors_total[5m])) > 0`,
+		wait:     "10m",
+		severity: "warning",
+		summary:  "{{ $labels.instance }} can't sync peers from {{ $labels.source }}",
+		uses:     map[string][]string{"discovery_sync_errors_total": {"source"}},
+	},
+	{
+		name:     "LegacyAPIPathsInUse",
+		expr:     `sum by (tenant, instance, path) (increase(http_legacy_path_requests_total[1h])) > 0`,
+		severity: "info",
+		summary:  "Clients of {{ $labels.instance }} still call the deprecated path {{ $labels.path }}",
+		uses:     map[string][]string{"http_legacy_path_requests_total": {"path"}},
+	},
+}
+
+// quantiles are the ones recorded and charted for every histogram
+var quantiles = []struct {
+	name  string
+	value string
+}{{"p50", "0.5"}, {"p99", "0.99"}}
+
+// Rules generates recording rules for the rates of every counter and the
+// quantiles of every histogram in metrics, and the recommended alerts. It
+// fails if an alert uses a metric or label metrics don't have, so renaming
+// a metric can't leave a rule silently matching nothing.
+func Rules(metrics []Metric) (RuleFile, error) {
+	byName := make(map[string]Metric)
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+
+	recording := RuleGroup{Name: "p2p_test.recording"}
+	for _, m := range metrics {
+		switch m.Type {
+		case Counter:
+			recording.Rules = append(recording.Rules, Rule{
+				Record: "instance:" + strings.TrimSuffix(m.Name, "_total") + ":rate5m",
+				Expr:   fmt.Sprintf("sum by (%s) (rate(%s[5m]))", by(m, "tenant", "instance"), m.Name),
+			})
+		case Histogram:
+			for _, q := range quantiles {
+				recording.Rules = append(recording.Rules, Rule{
+					Record: "instance:" + m.Name + ":" + q.name + "_5m",
+					Expr:   fmt.Sprintf("histogram_quantile(%s, sum by (%s) (rate(%s_bucket[5m])))", q.value, by(m, "tenant", "instance", "le"), m.Name),
+				})
+			}
+		}
+	}
+
+	alerting := RuleGroup{Name: "p2p_test.alerts"}
+	for _, a := range alerts {
+		if err := a.check(byName); err != nil {
+			return RuleFile{}, err
+		}
+		alerting.Rules = append(alerting.Rules, Rule{
+			Alert:       a.name,
+			Expr:        a.expr,
+			For:         a.wait,
+			Labels:      map[string]string{"severity": a.severity},
+			Annotations: map[string]string{"summary": a.summary},
+		})
+	}
+	return RuleFile{Groups: []RuleGroup{recording, alerting}}, nil
+}
+
+// Marshal encodes f as YAML.
+func (f RuleFile) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+func (a alert) check(byName map[string]Metric) error {
+	var names []string
+	for name := range a.uses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("alert %s uses %s, which is not registered", a.name, name)
+		}
+		if !m.HasLabels(a.uses[name]...) {
+			return fmt.Errorf("alert %s uses labels %v of %s, which has %v", a.name, a.uses[name], name, m.Labels)
+		}
+	}
+	return nil
+}
+
+// by lists the labels to aggregate m by: the extra ones, e.g. instance,
+// then m's own
+func by(m Metric, extra ...string) string {
+	return strings.Join(append(extra, m.Labels...), ", ")
+}
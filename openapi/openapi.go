@@ -0,0 +1,95 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// source is the API definition; edit it along with the handlers
+//
+//go:embed openapi.yaml
+var source []byte
+
+var (
+	document map[string]interface{}
+	spec     []byte
+)
+
+func init() {
+	if err := yaml.Unmarshal(source, &document); err != nil {
+		panic(fmt.Sprintf("openapi: parsing openapi.yaml: %v", err))
+	}
+	var err error
+	spec, err = json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("openapi: encoding openapi.yaml as JSON: %v", err))
+	}
+}
+
+// Spec serves the API definition as JSON.
+func Spec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+// docsPage renders /openapi.json in the browser. It carries its script and
+// styles, so the docs work without internet access.
+//
+//go:embed docs.html
+var docsPage []byte
+
+// Docs serves a browsable, self-contained page of the API definition.
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+// Patterns returns the ServeMux patterns of the documented paths: a path
+// with a parameter such as /blobs/{hash} is served by the subtree pattern
+// /blobs/.
+func Patterns() []string {
+	paths, _ := document["paths"].(map[string]interface{})
+	var out []string
+	for p := range paths {
+		if i := strings.Index(p, "{"); i >= 0 {
+			p = p[:i]
+		}
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Check compares the registered ServeMux patterns with the documented
+// paths and describes every difference. The patterns of disabled features
+// may be documented without being served.
+func Check(registered, disabled []string) []string {
+	documented := make(map[string]bool)
+	for _, p := range Patterns() {
+		documented[p] = true
+	}
+	var problems []string
+	seen := make(map[string]bool)
+	for _, p := range disabled {
+		seen[p] = true
+	}
+	for _, p := range registered {
+		seen[p] = true
+		if !documented[p] {
+			problems = append(problems, fmt.Sprintf("%s is served but not documented", p))
+		}
+	}
+	for _, p := range Patterns() {
+		if !seen[p] {
+			problems = append(problems, fmt.Sprintf("%s is documented but not served", p))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
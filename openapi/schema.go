@@ -0,0 +1,200 @@
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const schemaRefPrefix = "#/components/schemas/"
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	jsonMarshaler  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler  = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	emptyInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+	integerKinds   = []reflect.Kind{reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64}
+	floatKinds     = []reflect.Kind{reflect.Float32, reflect.Float64}
+)
+
+// CheckSchema compares the JSON encoding of v with the component schema
+// name and describes every difference: fields the schema doesn't
+// document, properties v doesn't have and values of another type. Types
+// with their own MarshalJSON are only checked where they encode as
+// strings, time.Time as a date-time.
+func CheckSchema(name string, v interface{}) []string {
+	schema, ok := component(name)
+	if !ok {
+		return []string{fmt.Sprintf("no schema %s in components", name)}
+	}
+	var problems []string
+	compare(name, schema, reflect.TypeOf(v), &problems)
+	sort.Strings(problems)
+	return problems
+}
+
+// SchemaNames returns the names of the component schemas.
+func SchemaNames() []string {
+	components, _ := document["components"].(map[string]interface{})
+	schemas, _ := components["schemas"].(map[string]interface{})
+	var names []string
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// component returns the schema of components/schemas/name
+func component(name string) (map[string]interface{}, bool) {
+	components, _ := document["components"].(map[string]interface{})
+	schemas, _ := components["schemas"].(map[string]interface{})
+	schema, ok := schemas[name].(map[string]interface{})
+	return schema, ok
+}
+
+// resolve follows $ref and merges the properties of allOf into one schema
+func resolve(schema map[string]interface{}) map[string]interface{} {
+	if ref, ok := schema["$ref"].(string); ok && strings.HasPrefix(ref, schemaRefPrefix) {
+		if target, ok := component(strings.TrimPrefix(ref, schemaRefPrefix)); ok {
+			return resolve(target)
+		}
+		return schema
+	}
+	all, ok := schema["allOf"].([]interface{})
+	if !ok {
+		return schema
+	}
+	merged := map[string]interface{}{"type": "object"}
+	properties := map[string]interface{}{}
+	for _, part := range all {
+		p, _ := part.(map[string]interface{})
+		props, _ := resolve(p)["properties"].(map[string]interface{})
+		for k, v := range props {
+			properties[k] = v
+		}
+	}
+	merged["properties"] = properties
+	return merged
+}
+
+func compare(path string, schema map[string]interface{}, t reflect.Type, problems *[]string) {
+	schema = resolve(schema)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	want, _ := schema["type"].(string)
+	mismatch := func(got string) {
+		if want != "" && want != got {
+			*problems = append(*problems, fmt.Sprintf("%s: documented as %s, encoded as %s", path, want, got))
+		}
+	}
+
+	switch {
+	case t == timeType:
+		mismatch("string")
+		if format, _ := schema["format"].(string); format != "date-time" {
+			*problems = append(*problems, fmt.Sprintf("%s: a time, documented without format date-time", path))
+		}
+		return
+	case t == emptyInterface:
+		return
+	case t.Implements(jsonMarshaler) || reflect.PointerTo(t).Implements(jsonMarshaler):
+		return
+	case t.Implements(textMarshaler) || reflect.PointerTo(t).Implements(textMarshaler):
+		mismatch("string")
+		return
+	}
+
+	switch k := t.Kind(); {
+	case k == reflect.String:
+		mismatch("string")
+	case k == reflect.Bool:
+		mismatch("boolean")
+	case kindIn(k, integerKinds):
+		mismatch("integer")
+	case kindIn(k, floatKinds):
+		mismatch("number")
+	case (k == reflect.Slice || k == reflect.Array) && t.Elem().Kind() == reflect.Uint8:
+		mismatch("string")
+	case k == reflect.Slice || k == reflect.Array:
+		mismatch("array")
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			compare(path+"[]", items, t.Elem(), problems)
+		}
+	case k == reflect.Map:
+		mismatch("object")
+		if values, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+			compare(path+"{}", values, t.Elem(), problems)
+		} else if _, ok := schema["additionalProperties"]; !ok {
+			*problems = append(*problems, fmt.Sprintf("%s: a map, documented without additionalProperties", path))
+		}
+	case k == reflect.Struct:
+		mismatch("object")
+		compareFields(path, schema, t, problems)
+	default:
+		*problems = append(*problems, fmt.Sprintf("%s: %s has no JSON schema to compare", path, t))
+	}
+}
+
+func compareFields(path string, schema map[string]interface{}, t reflect.Type, problems *[]string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	fields := make(map[string]reflect.Type)
+	jsonFields(t, fields)
+	for name, ft := range fields {
+		prop, ok := properties[name].(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("%s.%s is encoded but not documented", path, name))
+			continue
+		}
+		compare(path+"."+name, prop, ft, problems)
+	}
+	for name := range properties {
+		if _, ok := fields[name]; !ok {
+			*problems = append(*problems, fmt.Sprintf("%s.%s is documented but not encoded", path, name))
+		}
+	}
+}
+
+// jsonFields adds the names and types of the fields encoding/json writes
+// for the struct type t, including those of embedded structs.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				jsonFields(ft, fields)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+}
+
+func kindIn(k reflect.Kind, kinds []reflect.Kind) bool {
+	for _, c := range kinds {
+		if k == c {
+			return true
+		}
+	}
+	return false
+}
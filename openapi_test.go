@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"TestProject/apierror"
+	"TestProject/blobs"
+	"TestProject/chaos"
+	"TestProject/loadgen"
+	"TestProject/openapi"
+	"TestProject/report"
+	"TestProject/results"
+	"TestProject/soak"
+	"TestProject/stats"
+	"TestProject/throttle"
+	"TestProject/transfer"
+)
+
+// The component schemas of openapi.yaml describe the types the handlers
+// encode, field for field
+func TestSchemas(t *testing.T) {
+	types := map[string]interface{}{
+		"Error":            apierror.Response{},
+		"Peer":             LocatedPeer{},
+		"RequestStats":     stats.Point{},
+		"HandlerCheck":     HandlerCheck{},
+		"Topology":         Topology{},
+		"Limit":            throttle.Limit{},
+		"LimitRequest":     LimitRequest{},
+		"Blob":             blobs.Info{},
+		"TransferResult":   transfer.Result{},
+		"Summary":          loadgen.Summary{},
+		"CollectorSummary": results.Aggregate{},
+		"Fault":            report.Fault{},
+		"Report":           report.Report{},
+		"ChaosStep":        chaos.Step{},
+		"ChaosSchedule":    chaos.Schedule{},
+		"ChaosStatus":      chaos.Status{},
+		"ChaosPush":        ChaosPush{},
+		"TrafficWindow":    loadgen.Window{},
+		"SoakReport":       soak.Report{},
+		"BenchResult":      results.Result{},
+	}
+	for _, name := range openapi.SchemaNames() {
+		v, ok := types[name]
+		if !ok {
+			t.Errorf("schema %s has no Go type to check it against", name)
+			continue
+		}
+		for _, p := range openapi.CheckSchema(name, v) {
+			t.Errorf("%T: %s", v, p)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pinger
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"TestProject/discovery"
+)
+
+// ICMP message types of echo requests and replies
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+var (
+	icmpID  = uint16(os.Getpid())
+	icmpSeq uint32
+)
+
+// ICMPAvailable reports whether this process may open raw ICMP sockets,
+// which takes root or CAP_NET_RAW.
+func ICMPAvailable() error {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func (p *Pinger) pingICMP(ctx context.Context, peer discovery.Peer) (time.Duration, error) {
+	host, _, err := net.SplitHostPort(peer.Addr)
+	if err != nil {
+		return 0, err
+	}
+	ip, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return 0, err
+	}
+	if len(ip) == 0 {
+		return 0, fmt.Errorf("no address for %s", host)
+	}
+	return icmpEcho(ctx, ip[0].IP)
+}
+
+// icmpEcho sends one echo request to ip and waits for the matching reply.
+// The RTT covers only the network and the peer's kernel, so comparing it
+// with the http and mux transports shows how much the stacks above add.
+func icmpEcho(ctx context.Context, ip net.IP) (time.Duration, error) {
+	network, addr, request, reply := "ip4:icmp", "0.0.0.0", byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if ip.To4() == nil {
+		network, addr, request, reply = "ip6:ipv6-icmp", "::", icmpv6EchoRequest, icmpv6EchoReply
+	}
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	seq := uint16(atomic.AddUint32(&icmpSeq, 1))
+	msg := make([]byte, 16)
+	msg[0] = request
+	binary.BigEndian.PutUint16(msg[4:], icmpID)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "p2p_test")
+	if request == icmpv4EchoRequest {
+		// The kernel fills in the ICMPv6 checksum itself
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	// A raw socket sees every ICMP message the host receives, so skip
+	// everything but our own reply
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return 0, fmt.Errorf("no echo reply from %s", ip)
+			}
+			return 0, err
+		}
+		if n < 8 || buf[0] != reply || !from.(*net.IPAddr).IP.Equal(ip) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[4:]) == icmpID && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// checksum is the Internet checksum of RFC 1071
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,345 @@
+package pinger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/clock"
+	"TestProject/dial"
+	"TestProject/discovery"
+	"TestProject/failure"
+	"TestProject/mux"
+	"TestProject/rtt"
+	"TestProject/wire"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Protocol is the mux protocol name of ping streams.
+const Protocol = "ping"
+
+var (
+	pingRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "peer_ping_rtt_seconds",
+			Help:    "Histogram of round-trip times of pings to peers in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{"peer", "probe_type"},
+	)
+	pingFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_ping_failures_total",
+			Help: "Total number of failed pings to peers",
+		},
+		[]string{"peer", "probe_type"},
+	)
+	suspicionLevel = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "peer_suspicion_level",
+			Help: "Suspicion level of the failure detector per peer: missed pings for the fixed detector, phi for phi-accrual",
+		},
+		[]string{"peer"},
+	)
+	suspicions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_suspicions_total",
+			Help: "Total number of times the failure detector started suspecting a peer",
+		},
+		[]string{"peer"},
+	)
+	detectionSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "peer_failure_detection_seconds",
+			Help:    "Histogram of time from the last answered ping until the failure detector suspected the peer",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pingRTT)
+	prometheus.MustRegister(pingFailures)
+	prometheus.MustRegister(suspicionLevel)
+	prometheus.MustRegister(suspicions)
+	prometheus.MustRegister(detectionSeconds)
+}
+
+// Pinger periodically pings every registered peer over each transport:
+// "http" opens a new connection per ping, "mux" opens a stream on the
+// long-lived multiplexed connection and "icmp" sends an ICMP echo request
+// to the peer's host.
+type Pinger struct {
+	Self       string
+	Registry   *discovery.Registry
+	Interval   time.Duration
+	Transports []string
+	Mux        *mux.Node
+	MuxPort    int
+	// Detector judges the peers from their answers to pings over any
+	// transport but ICMP, see Suspected
+	Detector failure.Config
+	// History, if set, keeps every ping's RTT
+	History *rtt.History
+	// OnSuspect, if set, is told about every peer the detector starts
+	// suspecting
+	OnSuspect func(peer string)
+
+	client *http.Client
+
+	mu        sync.Mutex
+	last      map[string]map[string]Sample // peer -> transport -> sample
+	detectors map[string]failure.Detector
+	suspected map[string]bool
+}
+
+// Sample is the latest successful ping of a peer over one transport.
+type Sample struct {
+	RTT time.Duration
+	At  time.Time
+}
+
+func New(self string, reg *discovery.Registry, interval time.Duration, transports []string, node *mux.Node, muxPort int) *Pinger {
+	var usable []string
+	for _, t := range transports {
+		if t == "icmp" {
+			if err := ICMPAvailable(); err != nil {
+				log.Printf("pinger: ICMP pings disabled, raw sockets need root or CAP_NET_RAW: %v", err)
+				continue
+			}
+		}
+		usable = append(usable, t)
+	}
+	transports = usable
+	return &Pinger{
+		Self:       self,
+		Registry:   reg,
+		Interval:   interval,
+		Transports: transports,
+		Mux:        node,
+		MuxPort:    muxPort,
+		client: &http.Client{
+			Timeout:   interval,
+			Transport: &http.Transport{DisableKeepAlives: true, DialContext: dial.Default.DialContext},
+		},
+		last:      make(map[string]map[string]Sample),
+		Detector:  failure.Config{Kind: failure.Fixed, Interval: interval, MaxMissed: 3},
+		detectors: make(map[string]failure.Detector),
+		suspected: make(map[string]bool),
+	}
+}
+
+// Run pings all peers every Interval until ctx is cancelled.
+func (p *Pinger) Run(ctx context.Context) {
+	ticker := clock.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		peers := p.Registry.List()
+		for _, peer := range peers {
+			for _, transport := range p.Transports {
+				wg.Add(1)
+				go func(peer discovery.Peer, transport string) {
+					defer wg.Done()
+					p.pingOnce(ctx, peer, transport)
+				}(peer, transport)
+			}
+		}
+		wg.Wait()
+		p.judge(peers)
+	}
+}
+
+func (p *Pinger) pingOnce(ctx context.Context, peer discovery.Peer, transport string) {
+	ctx, cancel := context.WithTimeout(ctx, clock.Real(p.Interval))
+	defer cancel()
+
+	rtt, err := p.Ping(ctx, peer, transport)
+	if err != nil {
+		pingFailures.WithLabelValues(peer.ID, transport).Inc()
+		log.Printf("ping %s over %s: %v", peer.ID, transport, err)
+		return
+	}
+	pingRTT.WithLabelValues(peer.ID, transport).Observe(rtt.Seconds())
+
+	now := clock.Now()
+	if p.History != nil {
+		p.History.Record(peer.ID, transport, now, rtt)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last[peer.ID] == nil {
+		p.last[peer.ID] = make(map[string]Sample)
+	}
+	p.last[peer.ID][transport] = Sample{RTT: rtt, At: now}
+	// ICMP echoes are answered by the peer's kernel even when the node is
+	// down, so they are no heartbeats. Pings over several transports in one
+	// round count once.
+	if transport == "icmp" {
+		return
+	}
+	if d, ok := p.detectors[peer.ID]; !ok {
+		p.detectors[peer.ID] = p.Detector.New(now)
+	} else if now.Sub(d.Last()) > p.Interval/2 {
+		d.Heartbeat(now)
+	}
+}
+
+// judge updates the suspicion of every peer after a round of pings and
+// forgets the peers that are gone
+func (p *Pinger) judge(peers []discovery.Peer) {
+	now := clock.Now()
+	current := make(map[string]bool, len(peers))
+	var newly []string
+	p.mu.Lock()
+	for _, peer := range peers {
+		current[peer.ID] = true
+		d, ok := p.detectors[peer.ID]
+		if !ok {
+			continue
+		}
+		suspicionLevel.WithLabelValues(peer.ID).Set(d.Suspicion(now))
+		suspected := d.Suspected(now)
+		if suspected && !p.suspected[peer.ID] {
+			suspicions.WithLabelValues(peer.ID).Inc()
+			detectionSeconds.WithLabelValues(peer.ID).Observe(now.Sub(d.Last()).Seconds())
+			log.Printf("pinger: suspecting %s, last answered %s ago", peer.ID, now.Sub(d.Last()).Round(time.Millisecond))
+			newly = append(newly, peer.ID)
+		}
+		p.suspected[peer.ID] = suspected
+	}
+	for id := range p.detectors {
+		if !current[id] {
+			delete(p.detectors, id)
+			delete(p.suspected, id)
+			suspicionLevel.DeleteLabelValues(id)
+		}
+	}
+	for id := range p.last {
+		if !current[id] {
+			delete(p.last, id)
+		}
+	}
+	p.mu.Unlock()
+	if p.OnSuspect != nil {
+		for _, id := range newly {
+			p.OnSuspect(id)
+		}
+	}
+}
+
+// Suspected reports whether the failure detector suspects peer to have
+// failed. Peers that never answered a ping are suspected.
+func (p *Pinger) Suspected(peer string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.detectors[peer]
+	return !ok || d.Suspected(clock.Now())
+}
+
+// Last returns the latest successful ping per peer and transport.
+func (p *Pinger) Last() map[string]map[string]Sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]map[string]Sample, len(p.last))
+	for peer, byTransport := range p.last {
+		out[peer] = make(map[string]Sample, len(byTransport))
+		for t, s := range byTransport {
+			out[peer][t] = s
+		}
+	}
+	return out
+}
+
+// Ping measures one round trip to peer over transport.
+func (p *Pinger) Ping(ctx context.Context, peer discovery.Peer, transport string) (time.Duration, error) {
+	switch transport {
+	case "http":
+		return p.pingHTTP(ctx, peer)
+	case "mux":
+		return p.pingMux(ctx, peer)
+	case "icmp":
+		return p.pingICMP(ctx, peer)
+	default:
+		return 0, fmt.Errorf("unknown transport %q", transport)
+	}
+}
+
+func (p *Pinger) pingHTTP(ctx context.Context, peer discovery.Peer) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer.Addr+"/ping", nil)
+	if err != nil {
+		return 0, err
+	}
+	acl.Identify(req, p.Self)
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+func (p *Pinger) pingMux(ctx context.Context, peer discovery.Peer) (time.Duration, error) {
+	if p.Mux == nil {
+		return 0, fmt.Errorf("multiplexing is disabled")
+	}
+	start := time.Now()
+	stream, err := p.Mux.Open(ctx, mux.Addr(peer, p.MuxPort), Protocol)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// Pings go through the negotiated codec so its cost shows in the RTT
+	ping := &wire.Message{Kind: wire.KindPing, From: p.Self, Sent: start.UnixNano()}
+	if err := stream.Send(ping); err != nil {
+		return 0, err
+	}
+	var pong wire.Message
+	if err := stream.Recv(&pong); err != nil {
+		return 0, err
+	}
+	if pong.Kind != wire.KindPong {
+		return 0, fmt.Errorf("expected pong, got %s", pong.Kind)
+	}
+	return time.Since(start), nil
+}
+
+// Echo answers the pings of a ping stream with pongs.
+func Echo(s *mux.Stream) {
+	for {
+		var m wire.Message
+		if err := s.Recv(&m); err != nil {
+			return
+		}
+		if m.Kind != wire.KindPing {
+			return
+		}
+		pong := &wire.Message{Kind: wire.KindPong, Seq: m.Seq, Sent: m.Sent}
+		if err := s.Send(pong); err != nil {
+			return
+		}
+	}
+}
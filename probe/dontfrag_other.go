@@ -0,0 +1,12 @@
+//go:build !linux
+
+package probe
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(conn *net.UDPConn, v6 bool) error {
+	return errors.New("not supported on this platform")
+}
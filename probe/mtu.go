@@ -0,0 +1,238 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/discovery"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pathMTU = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "peer_path_mtu_bytes",
+			Help: "Largest IP packet carrying a UDP datagram that reached a peer unfragmented",
+		},
+		[]string{"peer"},
+	)
+	httpChunk = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "peer_http_max_chunk_bytes",
+			Help: "Largest HTTP response body fetched from a peer within the chunk timeout",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pathMTU)
+	prometheus.MustRegister(httpChunk)
+}
+
+// mtuMagic starts every MTU probe datagram and its acknowledgement
+var mtuMagic = []byte("MTU1")
+
+const (
+	mtuMinPayload = 64
+	mtuTries      = 3
+)
+
+// ServeUDPEcho acknowledges MTU probe datagrams arriving on conn until it
+// is closed. Only the header is sent back, so the probe measures the path
+// towards this node only.
+func ServeUDPEcho(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 8 || !bytes.Equal(buf[:4], mtuMagic) {
+			continue
+		}
+		conn.WriteTo(buf[:8], from)
+	}
+}
+
+// MTUProber binary-searches, for every peer, the largest UDP datagram that
+// gets through with fragmentation forbidden, and the largest HTTP body
+// that can be fetched from /payload within ChunkTimeout. Peers answer the
+// datagrams on the UDP port matching their HTTP address.
+type MTUProber struct {
+	Self         string
+	Registry     *discovery.Registry
+	Interval     time.Duration
+	MaxChunk     int64
+	ChunkTimeout time.Duration
+}
+
+// Run probes all peers one after another every Interval until ctx is
+// cancelled, so probes don't compete with each other for the path.
+func (m *MTUProber) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	var probed map[string]bool
+	for {
+		peers := m.Registry.List()
+		for _, peer := range peers {
+			if mtu, err := PathMTU(ctx, peer.Addr); err != nil {
+				log.Printf("probe path MTU of %s: %v", peer.ID, err)
+			} else {
+				pathMTU.WithLabelValues(peer.ID).Set(float64(mtu))
+			}
+			if m.MaxChunk > 0 {
+				chunk := m.maxChunk(ctx, peer)
+				httpChunk.WithLabelValues(peer.ID).Set(float64(chunk))
+			}
+		}
+		probed = forget(probed, peers, pathMTU.MetricVec, httpChunk.MetricVec)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PathMTU returns the largest IP packet size towards the UDP endpoint addr
+// that arrives without fragmentation.
+func PathMTU(ctx context.Context, addr string) (int, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	v6 := raddr.IP.To4() == nil
+	if err := setDontFragment(conn, v6); err != nil {
+		return 0, fmt.Errorf("forbidding fragmentation: %w", err)
+	}
+
+	// IPv4 and UDP headers take 28 bytes, IPv6 and UDP 48
+	overhead, hi := 28, 65507
+	if v6 {
+		overhead, hi = 48, 65527
+	}
+	var seq uint32
+	fits := func(size int) (bool, error) {
+		for i := 0; i < mtuTries; i++ {
+			seq++
+			ok, err := sendProbe(ctx, conn, size, seq)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	ok, err := fits(mtuMinPayload)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no answer to %d byte datagrams, is UDP blocked?", mtuMinPayload)
+	}
+	lo := mtuMinPayload
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo + overhead, nil
+}
+
+// sendProbe sends one datagram of size bytes and reports whether it was
+// acknowledged. Datagrams larger than the local interface's MTU are
+// refused by the kernel with EMSGSIZE, which counts as not fitting.
+func sendProbe(ctx context.Context, conn *net.UDPConn, size int, seq uint32) (bool, error) {
+	msg := make([]byte, size)
+	copy(msg, mtuMagic)
+	binary.BigEndian.PutUint32(msg[4:], seq)
+	if _, err := conn.Write(msg); err != nil {
+		if errors.Is(err, syscall.EMSGSIZE) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	ack := make([]byte, 8)
+	for {
+		n, err := conn.Read(ack)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return false, ctx.Err()
+			}
+			// A refused port shows up as an error on the next read
+			return false, err
+		}
+		// Late acknowledgements of earlier probes are skipped
+		if n == 8 && bytes.Equal(ack[:4], mtuMagic) && binary.BigEndian.Uint32(ack[4:]) == seq {
+			return true, nil
+		}
+	}
+}
+
+// maxChunk binary-searches the largest /payload body up to MaxChunk that
+// the peer delivers within ChunkTimeout. A path that drops large packets
+// without telling anybody stalls TCP as soon as full-sized segments are
+// needed, which shows up here rather than in the UDP search.
+func (m *MTUProber) maxChunk(ctx context.Context, peer discovery.Peer) int64 {
+	client := &http.Client{Timeout: m.ChunkTimeout}
+	fetch := func(size int64) bool {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+peer.Addr+"/payload?size="+strconv.FormatInt(size, 10), nil)
+		if err != nil {
+			return false
+		}
+		acl.Identify(req, m.Self)
+		resp, err := client.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		return err == nil && resp.StatusCode == http.StatusOK && n == size
+	}
+
+	var lo, hi int64 = 0, m.MaxChunk
+	if fetch(hi) {
+		return hi
+	}
+	for lo < hi-1 {
+		mid := lo + (hi-lo)/2
+		if fetch(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
@@ -0,0 +1,173 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"TestProject/discovery"
+	"TestProject/mux"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "probe_duration_seconds",
+			Help:    "Histogram of successful probe durations by peer and probe type",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		},
+		[]string{"peer", "probe_type"},
+	)
+	probeSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "1 if the latest probe of a peer succeeded, 0 if it failed",
+		},
+		[]string{"peer", "probe_type"},
+	)
+	certExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "probe_tls_cert_expiry_timestamp_seconds",
+			Help: "Unix time at which the earliest-expiring certificate a peer presented expires",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(probeDuration)
+	prometheus.MustRegister(probeSuccess)
+	prometheus.MustRegister(certExpiry)
+}
+
+// Prober measures connection setup to every peer below HTTP: a raw TCP
+// connect to the peer's HTTP address and, when peer connections use TLS, a
+// TLS handshake with the multiplexed listener, recording the expiry of
+// the certificates it presents.
+type Prober struct {
+	Registry *discovery.Registry
+	Interval time.Duration
+	TLS      *tls.Config // client config of peer connections, nil without TLS
+	MuxPort  int
+}
+
+// Run probes all peers every Interval until ctx is cancelled.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	var probed map[string]bool
+	for {
+		var wg sync.WaitGroup
+		peers := p.Registry.List()
+		for _, peer := range peers {
+			wg.Add(1)
+			go func(peer discovery.Peer) {
+				defer wg.Done()
+				p.probe(ctx, peer)
+			}(peer)
+		}
+		wg.Wait()
+		probed = forget(probed, peers, probeDuration.MetricVec, probeSuccess.MetricVec, certExpiry.MetricVec)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Prober) probe(ctx context.Context, peer discovery.Peer) {
+	ctx, cancel := context.WithTimeout(ctx, p.Interval)
+	defer cancel()
+
+	d, err := TCPConnect(ctx, peer.Addr)
+	p.observe(peer.ID, "tcp_connect", d, err)
+
+	if p.TLS == nil {
+		return
+	}
+	d, notAfter, err := TLSHandshake(ctx, mux.Addr(peer, p.MuxPort), p.TLS)
+	p.observe(peer.ID, "tls_handshake", d, err)
+	if !notAfter.IsZero() {
+		certExpiry.WithLabelValues(peer.ID).Set(float64(notAfter.Unix()))
+	}
+}
+
+// forget deletes the series of the peers probed before that are no longer
+// among peers, so a peer that left doesn't fail its last probe forever,
+// and returns the peers probed now
+func forget(before map[string]bool, peers []discovery.Peer, vecs ...*prometheus.MetricVec) map[string]bool {
+	now := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		now[peer.ID] = true
+	}
+	for id := range before {
+		if !now[id] {
+			for _, v := range vecs {
+				v.DeletePartialMatch(prometheus.Labels{"peer": id})
+			}
+		}
+	}
+	return now
+}
+
+func (p *Prober) observe(peer, probeType string, d time.Duration, err error) {
+	if err != nil {
+		probeSuccess.WithLabelValues(peer, probeType).Set(0)
+		log.Printf("probe %s of %s: %v", probeType, peer, err)
+		return
+	}
+	probeSuccess.WithLabelValues(peer, probeType).Set(1)
+	probeDuration.WithLabelValues(peer, probeType).Observe(d.Seconds())
+}
+
+// TCPConnect measures the time to establish a TCP connection to addr.
+func TCPConnect(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return elapsed, nil
+}
+
+// TLSHandshake measures the TLS handshake with addr, excluding the TCP
+// connect, and returns when the earliest presented certificate expires.
+func TLSHandshake(ctx context.Context, addr string, cfg *tls.Config) (time.Duration, time.Time, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer raw.Close()
+
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		cfg.ServerName = host
+	}
+	conn := tls.Client(raw, cfg)
+	start := time.Now()
+	err = conn.HandshakeContext(ctx)
+	elapsed := time.Since(start)
+
+	var notAfter time.Time
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if err != nil {
+		return 0, notAfter, err
+	}
+	return elapsed, notAfter, nil
+}
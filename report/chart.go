@@ -0,0 +1,124 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"TestProject/loadgen"
+)
+
+type metric struct {
+	title string
+	value func(loadgen.Point) float64
+}
+
+var metrics = map[string]metric{
+	"p50": {"median latency (ms)", func(p loadgen.Point) float64 { return p.P50Millis }},
+	"p99": {"p99 latency (ms)", func(p loadgen.Point) float64 { return p.P99Millis }},
+	"rps": {"throughput (requests/s)", func(p loadgen.Point) float64 { return p.RPS }},
+}
+
+// palette colours the series in name order
+var palette = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+const (
+	chartWidth  = 800
+	chartHeight = 220
+	marginLeft  = 60
+	marginRight = 20
+	marginTop   = 24
+	marginBot   = 24
+)
+
+// chart draws m of every series of r over time as an SVG line chart, with
+// the faults as vertical markers
+func chart(r Report, m metric) template.HTML {
+	var names []string
+	start, end := r.Summary.Start, r.Summary.End
+	top := 0.0
+	for name, points := range r.Series {
+		names = append(names, name)
+		for _, p := range points {
+			if start.IsZero() || p.Time.Before(start) {
+				start = p.Time
+			}
+			if p.Time.After(end) {
+				end = p.Time
+			}
+			if v := m.value(p); v > top {
+				top = v
+			}
+		}
+	}
+	sort.Strings(names)
+	if !end.After(start) {
+		end = start.Add(time.Second)
+	}
+	if top == 0 {
+		top = 1
+	}
+	top *= 1.1
+
+	plotW := float64(chartWidth - marginLeft - marginRight)
+	plotH := float64(chartHeight - marginTop - marginBot)
+	x := func(t time.Time) float64 {
+		return marginLeft + plotW*float64(t.Sub(start))/float64(end.Sub(start))
+	}
+	y := func(v float64) float64 { return marginTop + plotH*(1-v/top) }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight+16*((len(names)+3)/4), chartWidth, chartHeight+16*((len(names)+3)/4))
+	fmt.Fprintf(&b, `<text x="%d" y="14" style="font-weight:bold">%s</text>`, marginLeft, template.HTMLEscapeString(m.title))
+	for i := 0; i <= 4; i++ {
+		v := top * float64(i) / 4
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#eee"/>`, marginLeft, chartWidth-marginRight, y(v), y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, marginLeft-6, y(v)+4, short(v))
+	}
+	for i := 0; i <= 4; i++ {
+		t := start.Add(end.Sub(start) * time.Duration(i) / 4)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x(t), chartHeight-6, t.UTC().Format("15:04:05"))
+	}
+	for _, f := range r.Faults {
+		fx := x(f.Time)
+		fmt.Fprintf(&b, `<line x1="%.1f" x2="%.1f" y1="%d" y2="%.1f" stroke="#d62728" stroke-dasharray="4 3"><title>%s</title></line>`,
+			fx, fx, marginTop, marginTop+plotH, template.HTMLEscapeString(f.Time.UTC().Format("15:04:05")+" "+f.Node+" "+f.Kind+": "+f.Detail))
+	}
+	for i, name := range names {
+		color := palette[i%len(palette)]
+		var pts []string
+		for _, p := range r.Series[name] {
+			pts = append(pts, fmt.Sprintf("%.1f,%.1f", x(p.Time), y(m.value(p))))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/>`, color, strings.Join(pts, " "))
+		if len(pts) <= 100 {
+			// Dots keep sparse series, like one result per soak interval, visible
+			for _, p := range r.Series[name] {
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/>`, x(p.Time), y(m.value(p)), color)
+			}
+		}
+		lx, ly := marginLeft+(i%4)*180, chartHeight+10+16*(i/4)
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/><text x="%d" y="%d">%s</text>`,
+			lx, ly-9, color, lx+14, ly, template.HTMLEscapeString(name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// short formats an axis value compactly
+func short(v float64) string {
+	switch {
+	case v >= 1e6:
+		return fmt.Sprintf("%.1fM", v/1e6)
+	case v >= 1e4:
+		return fmt.Sprintf("%.0fk", v/1e3)
+	case v >= 100:
+		return fmt.Sprintf("%.0f", v)
+	case v >= 1:
+		return fmt.Sprintf("%.1f", v)
+	default:
+		return fmt.Sprintf("%.2f", v)
+	}
+}
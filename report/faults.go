@@ -0,0 +1,90 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"TestProject/apierror"
+)
+
+// keepFaults bounds the faults a Log holds, oldest first out
+const keepFaults = 10000
+
+// Fault is one injected fault, such as a bandwidth limit or a churn event,
+// shown on the timeline of reports.
+type Fault struct {
+	Time   time.Time `json:"time"`
+	RunID  string    `json:"run_id,omitempty"`
+	Node   string    `json:"node"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+// Log records the faults injected on a node. RunID is the run the node
+// itself takes part in, if any.
+type Log struct {
+	Node  string
+	RunID string
+
+	mu     sync.Mutex
+	faults []Fault
+}
+
+func NewLog(node string) *Log {
+	return &Log{Node: node}
+}
+
+// Record adds a fault of kind, e.g. throttle or disconnect, happening now
+// as part of the node's run.
+func (l *Log) Record(kind, detail string) {
+	l.RecordRun(l.RunID, kind, detail)
+}
+
+// RecordRun adds a fault injected for run runID, e.g. by a bench client.
+func (l *Log) RecordRun(runID, kind, detail string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.faults = append(l.faults, Fault{Time: time.Now(), RunID: runID, Node: l.Node, Kind: kind, Detail: detail})
+	if len(l.faults) > keepFaults {
+		l.faults = l.faults[len(l.faults)-keepFaults:]
+	}
+}
+
+// List returns the faults between since and until, oldest first; zero
+// times leave that end open.
+func (l *Log) List(since, until time.Time) []Fault {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []Fault{}
+	for _, f := range l.faults {
+		if f.Time.Before(since) || (!until.IsZero() && f.Time.After(until)) {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// ServeHTTP lists the faults, optionally from ?since= to ?until= (RFC 3339).
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			apierror.Error(w, r, name+" must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.List(since, until))
+}
@@ -0,0 +1,130 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"TestProject/loadgen"
+	"TestProject/results"
+)
+
+// Report is everything shown on the HTML report of a run: the aggregated
+// results, latency and throughput over time per series (a node, or the
+// bench client) and the faults injected meanwhile.
+type Report struct {
+	ID      string                     `json:"id"`
+	Title   string                     `json:"title"`
+	Created time.Time                  `json:"created"`
+	Summary results.Aggregate          `json:"summary"`
+	Series  map[string][]loadgen.Point `json:"series"`
+	Faults  []Fault                    `json:"faults"`
+}
+
+// New builds a report of rs with one series per node, a point per result.
+func New(id, title string, rs []results.Result) Report {
+	r := Report{
+		ID:      id,
+		Title:   title,
+		Created: time.Now(),
+		Summary: results.Combine(rs),
+		Series:  make(map[string][]loadgen.Point),
+		Faults:  []Fault{},
+	}
+	for _, res := range rs {
+		r.Series[res.Node] = append(r.Series[res.Node], loadgen.Point{Time: res.Start, Summary: res.Total})
+	}
+	for _, points := range r.Series {
+		sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	}
+	return r
+}
+
+// AddFaults adds the faults that happened during the run to the timeline,
+// leaving out those injected for other runs.
+func (r *Report) AddFaults(faults []Fault) {
+	runs := make(map[string]bool)
+	for _, id := range r.Summary.Runs {
+		runs[id] = true
+	}
+	for _, f := range faults {
+		if f.Time.Before(r.Summary.Start) || f.Time.After(r.Summary.End) {
+			continue
+		}
+		if f.RunID != "" && len(runs) > 0 && !runs[f.RunID] {
+			continue
+		}
+		r.Faults = append(r.Faults, f)
+	}
+	sort.Slice(r.Faults, func(i, j int) bool { return r.Faults[i].Time.Before(r.Faults[j].Time) })
+}
+
+// Render writes r as a self-contained HTML page: charts are inline SVG and
+// nothing is loaded from elsewhere.
+func Render(w io.Writer, r Report) error {
+	return page.Execute(w, r)
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms":    func(f float64) string { return fmt.Sprintf("%.3f", f) },
+	"rps":   func(f float64) string { return fmt.Sprintf("%.1f", f) },
+	"errs":  results.Failed,
+	"time":  func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"clock": func(t time.Time) string { return t.UTC().Format("15:04:05") },
+	"chart": func(r Report, metric string) template.HTML { return chart(r, metrics[metric]) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg { display: block; margin-bottom: 1.5em; }
+svg text { font-size: 11px; fill: #555; }
+.note { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{with .ID}}Report {{.}}, created{{else}}Created{{end}} {{time .Created}}.
+{{with .Summary}}{{.Reports}} results from {{len .Nodes}} nodes{{if .Reports}}, {{time .Start}} to {{time .End}}{{end}}.
+{{if .Runs}}Runs: {{range $i, $id := .Runs}}{{if $i}}, {{end}}<code>{{$id}}</code>{{end}}.{{end}}{{end}}</p>
+
+<h2>Over time</h2>
+{{if .Series}}{{chart . "p50"}}{{chart . "p99"}}{{chart . "rps"}}
+<p class="note">Dashed red lines mark injected faults.</p>
+{{else}}<p>No results over time.</p>{{end}}
+
+{{define "head"}}<tr><th>{{.}}</th><th>requests</th><th>errors</th><th>rps</th><th>mean</th><th>p50</th><th>p90</th><th>p99</th><th>p99.9</th><th>max</th></tr>{{end}}
+{{define "row"}}<td>{{.Requests}}</td><td>{{errs .}}</td><td>{{rps .RPS}}</td><td>{{ms .MeanMillis}}</td><td>{{ms .P50Millis}}</td><td>{{ms .P90Millis}}</td><td>{{ms .P99Millis}}</td><td>{{ms .P999Millis}}</td><td>{{ms .MaxMillis}}</td>{{end}}
+<h2>Total</h2>
+<table>
+{{template "head" "total"}}
+<tr><td>*</td>{{template "row" .Summary.Total}}</tr>
+</table>
+<h2>Nodes</h2>
+<table>
+{{template "head" "node"}}
+{{range .Summary.Nodes}}<tr><td>{{.Node}} ({{.Kind}}, {{.Reports}} results)</td>{{template "row" .Total}}</tr>
+{{end}}</table>
+<h2>Peers</h2>
+<table>
+{{template "head" "peer"}}
+{{range .Summary.Targets}}<tr><td>{{.Target}}</td>{{template "row" .}}</tr>
+{{end}}</table>
+<p class="note">Latencies in ms. Percentiles over several results are the highest any of them reported.</p>
+
+<h2>Faults</h2>
+{{if .Faults}}<table>
+<tr><th>time</th><th>node</th><th>fault</th><th>detail</th><th>run</th></tr>
+{{range .Faults}}<tr><td>{{clock .Time}}</td><td>{{.Node}}</td><td>{{.Kind}}</td><td>{{.Detail}}</td><td>{{.RunID}}</td></tr>
+{{end}}</table>
+{{else}}<p>No faults were recorded during the run.</p>{{end}}
+</body>
+</html>
+`))
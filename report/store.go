@@ -0,0 +1,110 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"TestProject/apierror"
+)
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Store keeps reports in Dir, each as <id>.html and its data as <id>.json.
+type Store struct {
+	Dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// Save writes r and returns the path of its HTML page.
+func (s *Store) Save(r Report) (string, error) {
+	if !validID.MatchString(r.ID) {
+		return "", errors.New("invalid report ID " + r.ID)
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	var page bytes.Buffer
+	if err := Render(&page, r); err != nil {
+		return "", err
+	}
+	base := filepath.Join(s.Dir, r.ID)
+	if err := os.WriteFile(base+".json", append(data, '\n'), 0o644); err != nil {
+		return "", err
+	}
+	return base + ".html", os.WriteFile(base+".html", page.Bytes(), 0o644)
+}
+
+// Entry describes a stored report.
+type Entry struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Created time.Time `json:"created"`
+}
+
+// List returns the stored reports, newest first.
+func (s *Store) List() []Entry {
+	files, _ := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	out := []Entry{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var e Entry
+		if json.Unmarshal(data, &e) == nil && validID.MatchString(e.ID) {
+			out = append(out, e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// ServeHTTP lists the reports on GET /reports/ and serves the page of one
+// on GET /reports/<id>, or its data on GET /reports/<id>.json.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/reports/")
+	if name == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.List())
+		return
+	}
+	ext := ".html"
+	if strings.HasSuffix(name, ".json") {
+		name, ext = strings.TrimSuffix(name, ".json"), ".json"
+	}
+	if !validID.MatchString(name) {
+		apierror.Error(w, r, "invalid report ID", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.Dir, name+ext))
+	if err != nil {
+		apierror.Error(w, r, "report not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name+ext, fi.ModTime(), f)
+}
@@ -0,0 +1,167 @@
+package results
+
+import (
+	"sort"
+	"time"
+
+	"TestProject/loadgen"
+)
+
+// Node summarizes the results of one node.
+type Node struct {
+	Node    string          `json:"node"`
+	Kind    string          `json:"kind"`
+	Reports int             `json:"reports"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Seconds float64         `json:"duration_seconds"`
+	Total   loadgen.Summary `json:"total"`
+	// Left is when the node said goodbye, as recorded by a collector
+	Left *time.Time `json:"left,omitempty"`
+
+	targets map[string]loadgen.Summary
+}
+
+// Aggregate is the consolidated view of several results, e.g. of all the
+// nodes in a distributed test. Request and error counts
+// and rates add up; the mean is weighted by successful requests; the
+// percentiles are the highest reported by any node in any interval, since
+// summarized percentiles can't be merged exactly, and so are upper bounds.
+type Aggregate struct {
+	Reports int               `json:"reports"`
+	Runs    []string          `json:"runs"`
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	Total   loadgen.Summary   `json:"total"`
+	Nodes   []Node            `json:"nodes"`
+	Targets []loadgen.Summary `json:"targets"`
+}
+
+// Combine aggregates all.
+func Combine(all []Result) Aggregate {
+	nodes := make(map[string]*Node)
+	runs := make(map[string]bool)
+	for _, r := range all {
+		if r.RunID != "" {
+			runs[r.RunID] = true
+		}
+		n, ok := nodes[r.Node]
+		if !ok {
+			n = &Node{Node: r.Node, Kind: r.Kind, Start: r.Start, targets: make(map[string]loadgen.Summary)}
+			nodes[r.Node] = n
+		}
+		n.Reports++
+		n.Seconds += r.Duration
+		if r.Start.Before(n.Start) {
+			n.Start = r.Start
+		}
+		if end := r.Start.Add(time.Duration(r.Duration * float64(time.Second))); end.After(n.End) {
+			n.End = end
+		}
+		n.Total = combine(n.Total, r.Total)
+		for _, t := range r.Targets {
+			n.targets[t.Target] = combine(n.targets[t.Target], t)
+		}
+	}
+
+	s := Aggregate{Reports: len(all), Runs: []string{}, Nodes: []Node{}, Targets: []loadgen.Summary{}}
+	for id := range runs {
+		s.Runs = append(s.Runs, id)
+	}
+	sort.Strings(s.Runs)
+	s.Total.Target = "*"
+	targets := make(map[string]loadgen.Summary)
+	for _, n := range nodes {
+		// Rates over a node's intervals, which add up across nodes
+		n.Total.RPS = rate(n.Total.Requests, n.Seconds)
+		n.Total.Target = "*"
+		s.Total = combine(s.Total, n.Total)
+		s.Total.RPS += n.Total.RPS
+		for name, t := range n.targets {
+			t.RPS = rate(t.Requests, n.Seconds)
+			merged := combine(targets[name], t)
+			merged.Target = name
+			merged.RPS = targets[name].RPS + t.RPS
+			targets[name] = merged
+		}
+		if s.Start.IsZero() || n.Start.Before(s.Start) {
+			s.Start = n.Start
+		}
+		if n.End.After(s.End) {
+			s.End = n.End
+		}
+		s.Nodes = append(s.Nodes, *n)
+	}
+	for _, t := range targets {
+		s.Targets = append(s.Targets, t)
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Node < s.Nodes[j].Node })
+	sort.Slice(s.Targets, func(i, j int) bool { return s.Targets[i].Target < s.Targets[j].Target })
+	return s
+}
+
+// combine adds b to a as described on Summary, leaving RPS to the caller
+func combine(a, b loadgen.Summary) loadgen.Summary {
+	if a.Target == "" {
+		a.Target = b.Target
+	}
+	okA, okB := succeeded(a), succeeded(b)
+	if okA+okB > 0 {
+		a.MeanMillis = (a.MeanMillis*float64(okA) + b.MeanMillis*float64(okB)) / float64(okA+okB)
+	}
+	a.Requests += b.Requests
+	for result, n := range b.Errors {
+		if a.Errors == nil {
+			a.Errors = make(map[string]int)
+		}
+		a.Errors[result] += n
+	}
+	for _, p := range []struct{ dst, src *float64 }{
+		{&a.P50Millis, &b.P50Millis},
+		{&a.P90Millis, &b.P90Millis},
+		{&a.P99Millis, &b.P99Millis},
+		{&a.P999Millis, &b.P999Millis},
+		{&a.P9999Millis, &b.P9999Millis},
+		{&a.MaxMillis, &b.MaxMillis},
+		{&a.COIntervalMillis, &b.COIntervalMillis},
+	} {
+		if *p.src > *p.dst {
+			*p.dst = *p.src
+		}
+	}
+	return a
+}
+
+// Failed returns the number of failed requests in s.
+func Failed(s loadgen.Summary) int {
+	return s.Requests - succeeded(s)
+}
+
+func succeeded(s loadgen.Summary) int {
+	n := s.Requests
+	for _, e := range s.Errors {
+		n -= e
+	}
+	return n
+}
+
+func rate(n int, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(n) / seconds
+}
+
+// ForRun returns the results of run runID, or all for an empty ID.
+func ForRun(all []Result, runID string) []Result {
+	if runID == "" {
+		return all
+	}
+	var out []Result
+	for _, r := range all {
+		if r.RunID == runID {
+			out = append(out, r)
+		}
+	}
+	return out
+}
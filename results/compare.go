@@ -0,0 +1,137 @@
+package results
+
+import (
+	"fmt"
+
+	"TestProject/loadgen"
+)
+
+// Tolerance bounds how much worse a result may be than its baseline.
+type Tolerance struct {
+	// Latency is the allowed relative increase of each percentile, 0.1
+	// meaning 10%
+	Latency float64
+	// LatencyFloorMillis is an absolute slack on top, so sub-millisecond
+	// jitter doesn't count as a regression
+	LatencyFloorMillis float64
+	// ErrorRate is the allowed absolute increase of the error share,
+	// 0.01 meaning one percentage point
+	ErrorRate float64
+	// Percentiles lists the compared percentiles by name, e.g. "p99"
+	Percentiles []string
+}
+
+// Percentiles maps the names accepted in Tolerance.Percentiles to their
+// values in a summary.
+var Percentiles = map[string]func(loadgen.Summary) float64{
+	"mean":   func(s loadgen.Summary) float64 { return s.MeanMillis },
+	"p50":    func(s loadgen.Summary) float64 { return s.P50Millis },
+	"p90":    func(s loadgen.Summary) float64 { return s.P90Millis },
+	"p99":    func(s loadgen.Summary) float64 { return s.P99Millis },
+	"p99.9":  func(s loadgen.Summary) float64 { return s.P999Millis },
+	"p99.99": func(s loadgen.Summary) float64 { return s.P9999Millis },
+	"max":    func(s loadgen.Summary) float64 { return s.MaxMillis },
+}
+
+// Delta is the comparison of one value of one target.
+type Delta struct {
+	Target     string
+	Metric     string
+	Baseline   float64
+	Current    float64
+	Regression bool
+	// Warning marks a difference in how the values were measured, which
+	// makes the comparison less meaningful without being a regression
+	Warning bool
+}
+
+func (d Delta) String() string {
+	change := "n/a"
+	if d.Baseline != 0 {
+		change = fmt.Sprintf("%+.1f%%", 100*(d.Current-d.Baseline)/d.Baseline)
+	}
+	return fmt.Sprintf("%s %s: %.3f -> %.3f (%s)", d.Target, d.Metric, d.Baseline, d.Current, change)
+}
+
+// Compare checks every target and endpoint present in both results, and
+// the totals, against tol. Results of which only one is corrected for
+// coordinated omission can't be compared; a different interval of the
+// correction is reported as a warning.
+func Compare(base, cur Result, tol Tolerance) ([]Delta, error) {
+	for _, p := range tol.Percentiles {
+		if Percentiles[p] == nil {
+			return nil, fmt.Errorf("unknown percentile %q", p)
+		}
+	}
+	if err := Comparable(base, cur.Corrected()); err != nil {
+		return nil, err
+	}
+	baseline := make(map[string]loadgen.Summary)
+	for _, s := range base.Summaries() {
+		baseline[name(s)] = s
+	}
+
+	var deltas []Delta
+	for _, s := range cur.Summaries() {
+		b, ok := baseline[name(s)]
+		if !ok {
+			continue
+		}
+		if b.COIntervalMillis != s.COIntervalMillis && !within(b.COIntervalMillis, s.COIntervalMillis, tol.Latency) {
+			deltas = append(deltas, Delta{Target: name(s), Metric: "co_interval_ms", Baseline: b.COIntervalMillis, Current: s.COIntervalMillis, Warning: true})
+		}
+		for _, p := range tol.Percentiles {
+			value := Percentiles[p]
+			d := Delta{Target: name(s), Metric: p, Baseline: value(b), Current: value(s)}
+			d.Regression = d.Current > d.Baseline*(1+tol.Latency)+tol.LatencyFloorMillis
+			deltas = append(deltas, d)
+		}
+		d := Delta{Target: name(s), Metric: "error_rate", Baseline: errorRate(b), Current: errorRate(s)}
+		d.Regression = d.Current > d.Baseline+tol.ErrorRate
+		deltas = append(deltas, d)
+	}
+	return deltas, nil
+}
+
+// Comparable checks that a run whose latencies are corrected for
+// coordinated omission, or not, can be compared with base.
+func Comparable(base Result, corrected bool) error {
+	describe := func(corrected bool) string {
+		if corrected {
+			return "corrected"
+		}
+		return "uncorrected"
+	}
+	if base.Corrected() != corrected {
+		return fmt.Errorf("the baseline latencies are %s for coordinated omission, these are %s; run both with the same --co-correct and --rate", describe(base.Corrected()), describe(corrected))
+	}
+	return nil
+}
+
+// within reports whether a and b differ by at most the fraction tol of a
+func within(a, b, tol float64) bool {
+	d := b - a
+	if d < 0 {
+		d = -d
+	}
+	return d <= a*tol
+}
+
+// name identifies a summary across results
+func name(s loadgen.Summary) string {
+	if s.Endpoint != "" {
+		return s.Target + " " + s.Endpoint
+	}
+	return s.Target
+}
+
+func errorRate(s loadgen.Summary) float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	errors := 0
+	for _, n := range s.Errors {
+		errors += n
+	}
+	return float64(errors) / float64(s.Requests)
+}
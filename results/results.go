@@ -0,0 +1,163 @@
+package results
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"TestProject/loadgen"
+)
+
+// Schema is the version of the artifact layout. Columns and fields are
+// only ever added; a removal or change of meaning bumps it. Since schema 2
+// closed-loop latencies are corrected for coordinated omission unless
+// co_interval_ms is 0; those of schema 1 never were.
+const Schema = 2
+
+// Result is the artifact of one bench run or one soak report interval.
+type Result struct {
+	Schema   int       `json:"schema"`
+	Kind     string    `json:"kind"`
+	RunID    string    `json:"run_id,omitempty"`
+	Node     string    `json:"node"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	// WarmupSeconds of load preceded Start and were left out
+	WarmupSeconds float64           `json:"warmup_seconds,omitempty"`
+	Total         loadgen.Summary   `json:"total"`
+	Targets       []loadgen.Summary `json:"targets"`
+	Endpoints     []loadgen.Summary `json:"endpoints,omitempty"`
+}
+
+// NewRunID returns a unique ID for a run of kind, such as bench or soak,
+// starting with the time so that IDs sort by age.
+func NewRunID(kind string) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s-%s", kind, time.Now().UTC().Format("20060102-150405"), hex.EncodeToString(b))
+}
+
+// New wraps a generator window.
+func New(kind, node string, w loadgen.Window) Result {
+	return Result{
+		Schema:    Schema,
+		Kind:      kind,
+		RunID:     w.RunID,
+		Node:      node,
+		Start:     w.Start,
+		Duration:  w.Duration,
+		Total:     w.Total,
+		Targets:   w.Targets,
+		Endpoints: w.Endpoints,
+	}
+}
+
+// WriteJSON writes r as an indented JSON document to path.
+func WriteJSON(path string, r Result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// AppendJSONLine appends r as one line to path, for runs producing a
+// result per interval.
+func AppendJSONLine(path string, r Result) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadJSON loads an artifact written by WriteJSON.
+func ReadJSON(path string) (Result, error) {
+	var r Result
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if r.Schema > Schema {
+		return r, fmt.Errorf("%s has schema %d, this build reads up to %d", path, r.Schema, Schema)
+	}
+	return r, nil
+}
+
+var csvHeader = []string{
+	"schema", "kind", "node", "start", "duration_seconds", "target",
+	"requests", "errors", "rps", "mean_ms", "p50_ms", "p90_ms", "p99_ms",
+	"p99_9_ms", "p99_99_ms", "max_ms", "error_breakdown", "co_interval_ms",
+	"endpoint", "run_id",
+}
+
+// AppendCSV appends one row per target, a total row with target "*" and
+// one row per endpoint of a traffic mix to path, writing the header first
+// if the file is new.
+func AppendCSV(path string, r Result) error {
+	_, err := os.Stat(path)
+	fresh := os.IsNotExist(err)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	if fresh {
+		w.Write(csvHeader)
+	}
+	for _, s := range r.Summaries() {
+		w.Write(row(r, s))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func row(r Result, s loadgen.Summary) []string {
+	errors := 0
+	var breakdown []string
+	for result, n := range s.Errors {
+		errors += n
+		breakdown = append(breakdown, result+"="+strconv.Itoa(n))
+	}
+	sort.Strings(breakdown)
+	return []string{
+		strconv.Itoa(r.Schema), r.Kind, r.Node, r.Start.UTC().Format(time.RFC3339Nano), num(r.Duration), s.Target,
+		strconv.Itoa(s.Requests), strconv.Itoa(errors), num(s.RPS), num(s.MeanMillis), num(s.P50Millis),
+		num(s.P90Millis), num(s.P99Millis), num(s.P999Millis), num(s.P9999Millis), num(s.MaxMillis),
+		strings.Join(breakdown, ";"), num(s.COIntervalMillis), s.Endpoint, r.RunID,
+	}
+}
+
+// Corrected reports whether the latencies of r are corrected for
+// coordinated omission.
+func (r Result) Corrected() bool {
+	return r.Total.COIntervalMillis > 0
+}
+
+// Summaries lists the per-target summaries, the total and the per-endpoint
+// summaries.
+func (r Result) Summaries() []loadgen.Summary {
+	out := append([]loadgen.Summary(nil), r.Targets...)
+	out = append(out, r.Total)
+	return append(out, r.Endpoints...)
+}
+
+func num(f float64) string { return strconv.FormatFloat(f, 'f', 3, 64) }
@@ -0,0 +1,255 @@
+package rtt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tier keeps the samples of Retention aggregated into buckets of
+// Resolution.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// DefaultTiers keep an hour at 10s, a day at 1m and a week at 10m
+// (10s:1h,1m:24h,10m:168h), about 2800 buckets per peer and transport.
+var DefaultTiers = []Tier{
+	{10 * time.Second, time.Hour},
+	{time.Minute, 24 * time.Hour},
+	{10 * time.Minute, 7 * 24 * time.Hour},
+}
+
+// ParseTiers parses tiers like "10s:1h,1m:24h", finest first.
+func ParseTiers(s string) ([]Tier, error) {
+	var tiers []Tier
+	for _, part := range strings.Split(s, ",") {
+		res, ret, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier %q, want resolution:retention like 1m:24h", part)
+		}
+		t := Tier{}
+		var err error
+		if t.Resolution, err = time.ParseDuration(res); err != nil {
+			return nil, fmt.Errorf("invalid tier %q: %w", part, err)
+		}
+		if t.Retention, err = time.ParseDuration(ret); err != nil {
+			return nil, fmt.Errorf("invalid tier %q: %w", part, err)
+		}
+		if t.Resolution <= 0 || t.Retention < t.Resolution {
+			return nil, fmt.Errorf("invalid tier %q: the resolution must be positive and at most the retention", part)
+		}
+		if n := len(tiers); n > 0 && (t.Resolution <= tiers[n-1].Resolution || t.Retention <= tiers[n-1].Retention) {
+			return nil, fmt.Errorf("invalid tier %q: tiers must get coarser and longer", part)
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, nil
+}
+
+// Point aggregates the samples from Time until the next point.
+type Point struct {
+	Time       time.Time `json:"time"`
+	Count      int       `json:"count"`
+	MeanMillis float64   `json:"mean_ms"`
+	MinMillis  float64   `json:"min_ms"`
+	MaxMillis  float64   `json:"max_ms"`
+}
+
+// Series is the RTT history to a peer over one transport.
+type Series struct {
+	Transport string  `json:"transport"`
+	Points    []Point `json:"points"`
+}
+
+type bucket struct {
+	start    int64 // Unix nanoseconds, 0 for empty buckets
+	count    int
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func (b *bucket) add(rtt time.Duration) {
+	if b.count == 0 || rtt < b.min {
+		b.min = rtt
+	}
+	if rtt > b.max {
+		b.max = rtt
+	}
+	b.count++
+	b.sum += rtt
+}
+
+// ring is one tier of one series
+type ring struct {
+	res     int64
+	buckets []bucket
+}
+
+func (r *ring) record(at int64, rtt time.Duration) {
+	start := at - at%r.res
+	b := &r.buckets[(start/r.res)%int64(len(r.buckets))]
+	if b.start != start {
+		*b = bucket{start: start}
+	}
+	b.add(rtt)
+}
+
+// History keeps the RTT samples of every peer and transport in fixed-size
+// rings, one per tier, so memory doesn't grow with the age of the mesh.
+// Peers that left are kept, their history being what's left of them,
+// until their last sample is older than the longest retention. It is safe
+// for concurrent use.
+type History struct {
+	tiers []Tier
+
+	mu     sync.Mutex
+	series map[string]map[string][]ring // peer -> transport -> tiers
+	last   map[string]time.Time         // peer -> latest sample
+	pruned time.Time
+}
+
+func New(tiers []Tier) *History {
+	return &History{tiers: tiers, series: make(map[string]map[string][]ring), last: make(map[string]time.Time)}
+}
+
+// Record adds a sample taken at at.
+func (h *History) Record(peer, transport string, at time.Time, rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	byTransport := h.series[peer]
+	if byTransport == nil {
+		byTransport = make(map[string][]ring)
+		h.series[peer] = byTransport
+	}
+	rings := byTransport[transport]
+	if rings == nil {
+		for _, t := range h.tiers {
+			n := int((t.Retention + t.Resolution - 1) / t.Resolution)
+			// One more bucket so the oldest isn't overwritten while current
+			rings = append(rings, ring{res: int64(t.Resolution), buckets: make([]bucket, n+1)})
+		}
+		byTransport[transport] = rings
+	}
+	for i := range rings {
+		rings[i].record(at.UnixNano(), rtt)
+	}
+	if at.After(h.last[peer]) {
+		h.last[peer] = at
+	}
+	if at.Sub(h.pruned) >= h.tiers[0].Resolution {
+		h.prune(at)
+	}
+}
+
+// prune forgets the peers without samples in any tier any more; h.mu must
+// be held
+func (h *History) prune(now time.Time) {
+	h.pruned = now
+	retention := h.tiers[len(h.tiers)-1].Retention
+	for peer, last := range h.last {
+		if now.Sub(last) > retention {
+			delete(h.series, peer)
+			delete(h.last, peer)
+		}
+	}
+}
+
+// Has reports whether there are samples of peer.
+func (h *History) Has(peer string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.series[peer] != nil
+}
+
+// MaxPoints limits the points of a series returned by Query.
+const MaxPoints = 10000
+
+// Query returns the history of peer over the window before now, one point
+// per step, with empty steps left out. Step is rounded up to a multiple of
+// the resolution of the finest tier that keeps the whole window; zero
+// picks a step giving about 60 points. Query returns the step used.
+func (h *History) Query(peer, transport string, now time.Time, window, step time.Duration) ([]Series, time.Duration, error) {
+	if window <= 0 || step < 0 {
+		return nil, 0, errors.New("window must be positive and step not negative")
+	}
+	tier := -1
+	for i, t := range h.tiers {
+		if t.Retention >= window {
+			tier = i
+			break
+		}
+	}
+	if tier < 0 {
+		return nil, 0, fmt.Errorf("window %s is longer than the %s of history kept", window, h.tiers[len(h.tiers)-1].Retention)
+	}
+	if step == 0 {
+		step = window / 60
+	}
+	// Prefer the coarsest tier that is still fine enough for step, it has
+	// the fewest buckets to merge
+	for tier+1 < len(h.tiers) && h.tiers[tier+1].Resolution <= step {
+		tier++
+	}
+	res := h.tiers[tier].Resolution
+	if step < res {
+		step = res
+	}
+	step = (step + res - 1) / res * res
+	if window/step > MaxPoints {
+		return nil, 0, fmt.Errorf("window %s in steps of %s has more than %d points", window, step, MaxPoints)
+	}
+
+	to := now.UnixNano()
+	from := to - int64(window)
+	from -= from % int64(step)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []Series{}
+	for t, rings := range h.series[peer] {
+		if transport != "" && t != transport {
+			continue
+		}
+		s := Series{Transport: t, Points: []Point{}}
+		r := rings[tier]
+		for p := from; p <= to; p += int64(step) {
+			var agg bucket
+			for b := p; b < p+int64(step); b += r.res {
+				bk := r.buckets[(b/r.res)%int64(len(r.buckets))]
+				if bk.start != b || bk.count == 0 {
+					continue
+				}
+				if agg.count == 0 || bk.min < agg.min {
+					agg.min = bk.min
+				}
+				if bk.max > agg.max {
+					agg.max = bk.max
+				}
+				agg.count += bk.count
+				agg.sum += bk.sum
+			}
+			if agg.count == 0 {
+				continue
+			}
+			s.Points = append(s.Points, Point{
+				Time:       time.Unix(0, p).UTC(),
+				Count:      agg.count,
+				MeanMillis: millis(agg.sum) / float64(agg.count),
+				MinMillis:  millis(agg.min),
+				MaxMillis:  millis(agg.max),
+			})
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Transport < out[j].Transport })
+	return out, step, nil
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
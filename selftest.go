@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/client"
+	"TestProject/selftest"
+)
+
+// selftestMain runs `selftest [flags] [-- node flags]`: it starts a node
+// with the given flags on an ephemeral port, exercises its endpoints and
+// the connectivity to the peers it discovers, and prints a pass/fail report
+func selftestMain(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	peerID := fs.String("peer-id", "selftest", "peer ID sent to the node, must pass its access lists")
+	joinToken := fs.String("join-token", "", "join token or invite vouching for --peer-id to nodes with peer ID access lists")
+	timeout := fs.Duration("timeout", 30*time.Second, "time each check may take")
+	startTimeout := fs.Duration("start-timeout", 10*time.Second, "time the node may take to start")
+	peerWait := fs.Duration("peer-wait", 5*time.Second, "time to wait for the node to discover its bootstrap peers")
+	jsonOut := fs.String("json", "", "write the report to this JSON file")
+	verbose := fs.Bool("v", false, "print the node's output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s selftest [flags] [-- node flags]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Node flags, e.g. --peers-file or --discovery, configure the node under test.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	acl.SetCredential(*joinToken)
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Println("Error finding the executable:", err)
+		return 1
+	}
+	port, err := freePort()
+	if err != nil {
+		fmt.Println("Error finding a free port:", err)
+		return 1
+	}
+	dir, err := os.MkdirTemp("", "p2p_test-selftest-")
+	if err != nil {
+		fmt.Println("Error creating a temporary directory:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	node := "selftest-" + strconv.Itoa(os.Getpid())
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	// The node's own directories and collector mode come first so that the
+	// node flags can change them; the address and ID must be these
+	nodeArgs := []string{
+		"--collector",
+		"--transfer-dir", dir + "/transfers",
+		"--blob-dir", dir + "/blobs",
+		"--report-dir", dir + "/reports",
+		"--soak-report-file", "",
+	}
+	nodeArgs = append(nodeArgs, fs.Args()...)
+	nodeArgs = append(nodeArgs, "--listen", addr, "--node-id", node, "--advertise-addr", addr)
+
+	var output lockedBuffer
+	cmd := exec.Command(exe, nodeArgs...)
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Error starting the node:", err)
+		return 1
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	fmt.Printf("node %s started on %s\n", node, addr)
+	if err := waitReady(addr, *peerID, *startTimeout, exited); err != nil {
+		fmt.Println("Error: the node did not start:", err)
+		os.Stdout.Write(output.Bytes())
+		return 1
+	}
+
+	t := &selftest.Test{Addr: addr, Node: node, PeerID: *peerID, PeerWait: *peerWait}
+	rep := t.Run(context.Background(), *timeout)
+	for _, c := range rep.Checks {
+		line := fmt.Sprintf("%-4s  %-52s %8.1fms", map[string]string{selftest.Pass: "PASS", selftest.Fail: "FAIL", selftest.Skip: "SKIP"}[c.Status], c.Name, c.Millis)
+		if c.Detail != "" {
+			line += "  " + c.Detail
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d passed, %d failed, %d skipped\n", rep.Passed, rep.Failed, rep.Skipped)
+	if *verbose || !rep.OK() {
+		fmt.Println("node output:")
+		os.Stdout.Write(output.Bytes())
+	}
+
+	if *jsonOut != "" {
+		data, _ := json.MarshalIndent(rep, "", "  ")
+		if err := os.WriteFile(*jsonOut, append(data, '\n'), 0o644); err != nil {
+			fmt.Println("Error writing report:", err)
+			return 1
+		}
+	}
+	if !rep.OK() {
+		return 3
+	}
+	return 0
+}
+
+// freePort asks the kernel for a port nothing listens on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitReady pings the node until it answers, it exits or timeout passes
+func waitReady(addr, peerID string, timeout time.Duration, exited <-chan error) error {
+	c := client.New(addr, peerID)
+	c.Retries = 0
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := c.Ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("exited: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// lockedBuffer collects the output of the node while it runs
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
@@ -0,0 +1,669 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/chaos"
+	"TestProject/client"
+	"TestProject/delay"
+	"TestProject/discovery"
+	"TestProject/loadgen"
+	"TestProject/observability"
+	"TestProject/results"
+	"TestProject/sse"
+	"TestProject/stats"
+	"TestProject/transfer"
+)
+
+// Check outcomes.
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Skip = "skip"
+)
+
+// Metrics must be on /metrics once every endpoint was exercised: each is
+// updated by at least one of the checks.
+var Metrics = []string{
+	"http_requests_total",
+	"http_request_duration_seconds",
+	"http_legacy_path_requests_total",
+	"run_requests_total",
+	"gc_pause_duration_seconds",
+	"sse_subscribers",
+	"sse_events_sent_total",
+	"transfer_bytes_total",
+	"blob_requests_total",
+	"blob_store_blobs",
+	"blob_store_bytes",
+	"collector_results_total",
+	"gossip_published_total",
+	"go_goroutines",
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name   string  `json:"name"`
+	Status string  `json:"status"`
+	Detail string  `json:"detail,omitempty"`
+	Millis float64 `json:"duration_ms"`
+}
+
+// Report lists the results of a self-test in the order the checks ran.
+type Report struct {
+	Node    string   `json:"node"`
+	Checks  []Result `json:"checks"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped"`
+}
+
+// OK reports whether no check failed.
+func (r Report) OK() bool { return r.Failed == 0 }
+
+// Test exercises every endpoint of the node at Addr, which must run in
+// collector mode, then checks that the node can reach the peers it
+// discovered within PeerWait.
+type Test struct {
+	Addr     string // host:port
+	Node     string
+	PeerID   string
+	PeerWait time.Duration
+
+	c    *client.Client
+	http *http.Client
+	// faultPeer is throttled and unthrottled, so the fault log has entries
+	faultPeer string
+}
+
+// skipped is returned by a check that doesn't apply
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+type check struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// Run performs the checks, each within timeout.
+func (t *Test) Run(ctx context.Context, timeout time.Duration) Report {
+	t.c = client.New(t.Addr, t.PeerID)
+	t.c.RunID = results.NewRunID("selftest")
+	t.http = &http.Client{Timeout: timeout}
+	t.faultPeer = t.PeerID + "-fault"
+
+	checks := []check{
+		{"GET /ping", t.ping},
+		{"GET /", t.root},
+		{"GET /payload", t.payload},
+		{"GET /slow", t.slow},
+		{"GET /events, POST /v1/admin/broadcast", t.events},
+		{"PATCH /transfer/{id}", t.transfer},
+		{"POST /v1/admin/transfer", t.adminTransfer},
+		{"PUT /blobs, GET /blobs/{hash}", t.blobs},
+		{"POST /results, GET /results", t.results},
+		{"POST /v1/admin/report, GET /reports/{id}", t.report},
+		{"GET /v1/peers", t.peers},
+		{"GET /v1/topology", t.topology},
+		{"PUT /v1/admin/throttle, DELETE /v1/admin/throttle", t.throttle},
+		{"GET /v1/faults", t.faults},
+		{"POST /v1/admin/gossip", t.gossip},
+		{"GET /v1/soak", t.soak},
+		{"GET /stats/recent", t.recent},
+		{"GET /v1/check", t.check},
+		{"PUT /v1/admin/delay, DELETE /v1/admin/delay", t.delay},
+		{"POST /v1/admin/chaos, DELETE /v1/admin/chaos", t.chaos},
+		{"GET /v1/admin/metrics/inspect", t.inspect},
+		{"GET /peers (deprecated)", t.legacy},
+		{"GET /openapi.json, GET /docs", t.openapi},
+		{"structured errors", t.errors},
+		{"GET /metrics", t.metrics},
+	}
+	rep := Report{Node: t.Node}
+	for _, c := range checks {
+		rep.add(c.name, func() (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return c.run(ctx)
+		})
+	}
+
+	peers, err := t.bootstrapPeers(ctx)
+	if err != nil {
+		rep.add("bootstrap peers", func() (string, error) { return "", err })
+	}
+	if err == nil && len(peers) == 0 {
+		rep.add("bootstrap peers", func() (string, error) { return "", skipped("no peers discovered") })
+	}
+	for _, p := range peers {
+		p := p
+		rep.add(fmt.Sprintf("peer %s (%s)", p.ID, p.Addr), func() (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return t.reach(ctx, p)
+		})
+	}
+	return rep
+}
+
+func (r *Report) add(name string, run func() (string, error)) {
+	start := time.Now()
+	detail, err := run()
+	res := Result{Name: name, Status: Pass, Detail: detail, Millis: float64(time.Since(start)) / float64(time.Millisecond)}
+	var skip skipped
+	switch {
+	case errors.As(err, &skip):
+		res.Status, res.Detail = Skip, err.Error()
+		r.Skipped++
+	case err != nil:
+		res.Status, res.Detail = Fail, err.Error()
+		r.Failed++
+	default:
+		r.Passed++
+	}
+	r.Checks = append(r.Checks, res)
+}
+
+// do sends a request to the node and returns the response with its body
+// read; an unexpected status is an error
+func (t *Test) do(ctx context.Context, method, path string, body []byte, header http.Header, want int) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+t.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	acl.Identify(req, t.PeerID)
+	req.Header.Set(acl.RunIDHeader, t.c.RunID)
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	if resp.StatusCode != want {
+		if p, ok := apierror.Parse(data); ok {
+			return resp, data, fmt.Errorf("status %d, want %d: %s", resp.StatusCode, want, p.Message)
+		}
+		return resp, data, fmt.Errorf("status %d, want %d", resp.StatusCode, want)
+	}
+	return resp, data, nil
+}
+
+func (t *Test) ping(ctx context.Context) (string, error) {
+	rtt, err := t.c.Ping(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rtt %s", rtt.Round(time.Microsecond)), nil
+}
+
+func (t *Test) root(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/", nil, nil, http.StatusOK)
+	if err == nil && len(body) == 0 {
+		err = errors.New("empty response")
+	}
+	return "", err
+}
+
+func (t *Test) payload(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/payload?size=64KiB", nil, nil, http.StatusOK)
+	if err == nil && len(body) != 64<<10 {
+		err = fmt.Errorf("got %d bytes, want %d", len(body), 64<<10)
+	}
+	return "", err
+}
+
+func (t *Test) slow(ctx context.Context) (string, error) {
+	start := time.Now()
+	if _, _, err := t.do(ctx, http.MethodGet, "/slow?delay=50ms", nil, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		return "", fmt.Errorf("answered after %s, before the delay", d)
+	}
+	return "", nil
+}
+
+// events subscribes to /events and broadcasts until the event arrives
+func (t *Test) events(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := t.c.RunID
+	got := make(chan struct{}, 1)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- t.c.StreamEvents(ctx, func(ev sse.Event) {
+			if ev.ID == id {
+				select {
+				case got <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if _, _, err := t.do(ctx, http.MethodPost, "/v1/admin/broadcast?id="+id, []byte("selftest"), nil, http.StatusOK); err != nil {
+			return "", err
+		}
+		select {
+		case <-got:
+			return "", nil
+		case err := <-streamErr:
+			return "", fmt.Errorf("event stream: %w", err)
+		case <-ctx.Done():
+			return "", errors.New("broadcast event never arrived")
+		case <-tick.C:
+		}
+	}
+}
+
+func (t *Test) transfer(ctx context.Context) (string, error) {
+	tr := &transfer.Transfer{
+		ID:        t.c.RunID,
+		Self:      t.PeerID,
+		Peer:      discovery.Peer{ID: t.Node, Addr: t.Addr},
+		Source:    transfer.Generated{Seed: t.c.RunID, Length: 256 << 10},
+		ChunkSize: 64 << 10,
+		Client:    t.http,
+	}
+	res, err := tr.Run(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !res.Complete {
+		return "", errors.New("transfer did not complete")
+	}
+	return fmt.Sprintf("%d bytes in %d chunks", res.Size, res.Chunks), nil
+}
+
+// adminTransfer only checks the endpoint answers, as the node has no peer
+// to send to that is known to accept data
+func (t *Test) adminTransfer(ctx context.Context) (string, error) {
+	_, _, err := t.do(ctx, http.MethodPost, "/v1/admin/transfer?peer="+t.faultPeer+"&size=1KiB", nil, nil, http.StatusNotFound)
+	return "rejects unknown peers", err
+}
+
+func (t *Test) blobs(ctx context.Context) (string, error) {
+	data := []byte("p2p_test selftest " + t.c.RunID)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	resp, _, err := t.do(ctx, http.MethodPut, "/blobs", data, nil, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	if loc := resp.Header.Get("Location"); loc != "/blobs/"+hash {
+		return "", fmt.Errorf("stored at %s, want /blobs/%s", loc, hash)
+	}
+	_, got, err := t.do(ctx, http.MethodGet, "/blobs/"+hash+"?local=1", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(got, data) {
+		return "", errors.New("fetched blob differs from the stored one")
+	}
+	_, list, err := t.do(ctx, http.MethodGet, "/blobs", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Contains(list, []byte(hash)) {
+		return "", errors.New("stored blob is not listed")
+	}
+	return "", nil
+}
+
+func (t *Test) results(ctx context.Context) (string, error) {
+	now := time.Now()
+	res := results.New("bench", t.PeerID, loadgen.Window{
+		RunID:    t.c.RunID,
+		Start:    now.Add(-time.Second),
+		Duration: 1,
+		Total:    loadgen.Summary{Target: t.Addr, Requests: 1, RPS: 1},
+	})
+	if err := t.c.ReportResult(ctx, res); err != nil {
+		return "", err
+	}
+	_, body, err := t.do(ctx, http.MethodGet, "/results?run="+t.c.RunID, nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var sum results.Aggregate
+	if err := json.Unmarshal(body, &sum); err != nil {
+		return "", err
+	}
+	if sum.Reports != 1 {
+		return "", fmt.Errorf("summary counts %d results, want 1", sum.Reports)
+	}
+	return "", nil
+}
+
+func (t *Test) report(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodPost, "/v1/admin/report?run="+t.c.RunID, nil, nil, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return "", err
+	}
+	if _, _, err := t.do(ctx, http.MethodGet, created.URL, nil, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	if _, _, err := t.do(ctx, http.MethodGet, "/reports/", nil, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	return created.URL, nil
+}
+
+func (t *Test) peers(ctx context.Context) (string, error) {
+	peers, err := t.c.ListPeers(ctx)
+	return fmt.Sprintf("%d peers", len(peers)), err
+}
+
+func (t *Test) topology(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/v1/topology", nil, nil, http.StatusOK)
+	if err == nil && !json.Valid(body) {
+		err = errors.New("not JSON")
+	}
+	return "", err
+}
+
+func (t *Test) throttle(ctx context.Context) (string, error) {
+	if err := t.c.InjectFault(ctx, client.Fault{Peer: t.faultPeer, Send: "1Mbps", Recv: "1Mbps"}); err != nil {
+		return "", err
+	}
+	limits, err := t.c.Faults(ctx)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, l := range limits {
+		found = found || l.Peer == t.faultPeer
+	}
+	if !found {
+		return "", errors.New("limit not listed")
+	}
+	return "", t.c.ClearFault(ctx, t.faultPeer)
+}
+
+func (t *Test) faults(ctx context.Context) (string, error) {
+	faults, err := t.c.FaultEvents(ctx, time.Time{}, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	for _, f := range faults {
+		if f.RunID == t.c.RunID && f.Kind == "unthrottle" {
+			return "", nil
+		}
+	}
+	return "", errors.New("throttle changes were not logged")
+}
+
+func (t *Test) gossip(ctx context.Context) (string, error) {
+	_, _, err := t.do(ctx, http.MethodPost, "/v1/admin/gossip?topic=selftest", []byte("selftest"), nil, http.StatusOK)
+	return "", err
+}
+
+// soak passes without soak mode too, the node then says so
+func (t *Test) soak(ctx context.Context) (string, error) {
+	resp, body, err := t.do(ctx, http.MethodGet, "/v1/soak", nil, nil, http.StatusOK)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		if p, ok := apierror.Parse(body); ok {
+			return p.Message, nil
+		}
+	}
+	return "", err
+}
+
+// recent passes with --stats-window 0 too, as skipped
+func (t *Test) recent(ctx context.Context) (string, error) {
+	resp, body, err := t.do(ctx, http.MethodGet, "/stats/recent?route=/ping", nil, nil, http.StatusOK)
+	if resp != nil && resp.StatusCode == http.StatusNotFound && recentDisabled(body) {
+		return "", skipped("recent stats are disabled")
+	}
+	if err != nil {
+		return "", err
+	}
+	var snap stats.Snapshot
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return "", err
+	}
+	if snap.Summary.Requests == 0 {
+		return "", errors.New("pings are not counted")
+	}
+	return fmt.Sprintf("%d pings", snap.Summary.Requests), nil
+}
+
+// check holds the pings to a budget they meet, and one they can't
+func (t *Test) check(ctx context.Context) (string, error) {
+	resp, body, err := t.do(ctx, http.MethodGet, "/v1/check?handler=/ping&min_requests=1", nil, nil, http.StatusOK)
+	if resp != nil && resp.StatusCode == http.StatusNotFound && recentDisabled(body) {
+		return "", skipped("recent stats are disabled")
+	}
+	if err != nil {
+		return "", err
+	}
+	_, _, err = t.do(ctx, http.MethodGet, "/v1/check?handler=/ping&min_requests=1000000000", nil, nil, http.StatusServiceUnavailable)
+	return "", err
+}
+
+func recentDisabled(body []byte) bool {
+	p, ok := apierror.Parse(body)
+	return ok && p.Message == "recent stats are disabled"
+}
+
+// delay sets a profile and puts the one the node had back
+func (t *Test) delay(ctx context.Context) (string, error) {
+	before, err := t.delayProfile(ctx)
+	if err != nil {
+		return "", err
+	}
+	p, err := delay.Parse("fixed:base=1ms")
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := t.do(ctx, http.MethodPut, "/v1/admin/delay", []byte(`{"profile":"`+p.String()+`"}`), nil, http.StatusNoContent); err != nil {
+		return "", err
+	}
+	got, err := t.delayProfile(ctx)
+	if err == nil && got != p.String() {
+		err = fmt.Errorf("profile is %q, want %q", got, p.String())
+	}
+	if before == "" {
+		_, _, rerr := t.do(ctx, http.MethodDelete, "/v1/admin/delay", nil, nil, http.StatusNoContent)
+		return "", firstErr(err, rerr)
+	}
+	_, _, rerr := t.do(ctx, http.MethodPut, "/v1/admin/delay", []byte(`{"profile":"`+before+`"}`), nil, http.StatusNoContent)
+	return "", firstErr(err, rerr)
+}
+
+func (t *Test) delayProfile(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/v1/admin/delay", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var d struct {
+		Profile string `json:"profile"`
+	}
+	err = json.Unmarshal(body, &d)
+	return d.Profile, err
+}
+
+// chaos loads a local schedule due in an hour and cancels it, so none of
+// its steps is carried out
+func (t *Test) chaos(ctx context.Context) (string, error) {
+	s := chaos.Schedule{
+		ID:    t.c.RunID,
+		Run:   t.c.RunID,
+		Start: time.Now().Add(time.Hour),
+		Steps: []chaos.Step{{Action: chaos.Throttle, Peer: t.faultPeer, Send: "1Mbps"}},
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := t.do(ctx, http.MethodPost, "/v1/admin/chaos?scope=local", data, nil, http.StatusNoContent); err != nil {
+		return "", err
+	}
+	_, body, err := t.do(ctx, http.MethodGet, "/v1/admin/chaos", nil, nil, http.StatusOK)
+	if err == nil {
+		var st chaos.Status
+		if err = json.Unmarshal(body, &st); err == nil && (st.Schedule == nil || st.Schedule.ID != s.ID || len(st.Timeline) != 1) {
+			err = errors.New("schedule not loaded")
+		}
+	}
+	_, _, cerr := t.do(ctx, http.MethodDelete, "/v1/admin/chaos?scope=local", nil, nil, http.StatusNoContent)
+	return "", firstErr(err, cerr)
+}
+
+func (t *Test) inspect(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/v1/admin/metrics/inspect", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var in observability.Inspection
+	if err := json.Unmarshal(body, &in); err != nil {
+		return "", err
+	}
+	for _, f := range in.Families {
+		if f.Name == "http_requests_total" {
+			return fmt.Sprintf("%d series in %d families", in.Series, len(in.Families)), nil
+		}
+	}
+	return "", errors.New("http_requests_total not listed")
+}
+
+// firstErr returns the first of errs that isn't nil
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Test) legacy(ctx context.Context) (string, error) {
+	resp, _, err := t.do(ctx, http.MethodGet, "/peers", nil, nil, http.StatusOK)
+	if err == nil && resp.Header.Get("Deprecation") == "" {
+		err = errors.New("missing Deprecation header")
+	}
+	return "", err
+}
+
+func (t *Test) openapi(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/openapi.json", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	var spec struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(body, &spec); err != nil {
+		return "", err
+	}
+	if len(spec.Paths) == 0 {
+		return "", errors.New("no paths defined")
+	}
+	_, _, err = t.do(ctx, http.MethodGet, "/docs", nil, nil, http.StatusOK)
+	return fmt.Sprintf("%d paths", len(spec.Paths)), err
+}
+
+// errors checks that failing requests are answered with structured
+// errors carrying the caller's request ID
+func (t *Test) errors(ctx context.Context) (string, error) {
+	h := http.Header{apierror.RequestIDHeader: {t.c.RunID}}
+	_, body, err := t.do(ctx, http.MethodGet, "/payload?size=-1", nil, h, http.StatusBadRequest)
+	if err != nil {
+		return "", err
+	}
+	p, ok := apierror.Parse(body)
+	switch {
+	case !ok:
+		return "", errors.New("error response is not structured")
+	case p.RequestID != t.c.RunID:
+		return "", fmt.Errorf("error has request ID %q, want %q", p.RequestID, t.c.RunID)
+	}
+	_, _, err = t.do(ctx, http.MethodGet, "/v1/admin/transfer", nil, nil, http.StatusMethodNotAllowed)
+	return "", err
+}
+
+// metrics checks /metrics for Metrics
+func (t *Test) metrics(ctx context.Context) (string, error) {
+	_, body, err := t.do(ctx, http.MethodGet, "/metrics", nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	have := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			have[strings.Fields(line)[2]] = true
+		}
+	}
+	var missing []string
+	for _, m := range Metrics {
+		if !have[m] {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return fmt.Sprintf("%d metrics", len(have)), nil
+}
+
+// bootstrapPeers waits up to PeerWait for the node to discover peers
+func (t *Test) bootstrapPeers(ctx context.Context) ([]discovery.Peer, error) {
+	deadline := time.Now().Add(t.PeerWait)
+	for {
+		peers, err := t.c.ListPeers(ctx)
+		if err != nil || len(peers) > 0 || time.Now().After(deadline) {
+			return peers, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// reach connects to a peer and pings it
+func (t *Test) reach(ctx context.Context, p discovery.Peer) (string, error) {
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return "", err
+	}
+	connect := time.Since(start)
+	conn.Close()
+	rtt, err := client.New(p.Addr, t.PeerID).Ping(ctx)
+	if err != nil {
+		return "", fmt.Errorf("connects, but ping fails: %w", err)
+	}
+	return fmt.Sprintf("connect %s, ping rtt %s", connect.Round(time.Microsecond), rtt.Round(time.Microsecond)), nil
+}
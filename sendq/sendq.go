@@ -0,0 +1,202 @@
+package sendq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "peer_send_queue_depth",
+			Help: "Number of outbound messages waiting per peer",
+		},
+		[]string{"peer"},
+	)
+	queueDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_send_queue_dropped_total",
+			Help: "Total number of outbound messages dropped because a peer's queue was full",
+		},
+		[]string{"peer", "policy"},
+	)
+	queueBlocked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_send_queue_blocked_seconds_total",
+			Help: "Total time producers spent blocked on a full peer queue",
+		},
+		[]string{"peer"},
+	)
+	sendErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_send_errors_total",
+			Help: "Total number of queued messages that failed to send",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueDropped)
+	prometheus.MustRegister(queueBlocked)
+	prometheus.MustRegister(sendErrors)
+}
+
+// Policy decides what happens when a peer's queue is full.
+type Policy string
+
+const (
+	// Block makes the producer wait for room.
+	Block Policy = "block"
+	// DropNewest discards the message being enqueued.
+	DropNewest Policy = "drop-newest"
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest Policy = "drop-oldest"
+)
+
+// ParsePolicy validates a policy name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Block, DropNewest, DropOldest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown send queue policy %q (block, drop-newest, drop-oldest)", s)
+}
+
+var (
+	// ErrDropped is returned by Enqueue when the message was discarded.
+	ErrDropped = errors.New("send queue full, message dropped")
+	// ErrRemoved is returned by Enqueue when the peer's queue went away.
+	ErrRemoved = errors.New("send queue removed")
+)
+
+// Message is whatever a subsystem queues; the SendFunc knows how to encode it.
+type Message interface{}
+
+// SendFunc delivers one message to peer.
+type SendFunc func(ctx context.Context, peer string, msg Message) error
+
+// Queues owns one bounded queue and sender goroutine per peer.
+type Queues struct {
+	Size   int
+	Policy Policy
+	Send   SendFunc
+
+	mu     sync.Mutex
+	queues map[string]*queue
+}
+
+type queue struct {
+	ch   chan Message
+	done chan struct{}
+}
+
+func New(size int, policy Policy, send SendFunc) *Queues {
+	return &Queues{Size: size, Policy: policy, Send: send, queues: make(map[string]*queue)}
+}
+
+func (q *Queues) queue(peer string) *queue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pq, ok := q.queues[peer]
+	if !ok {
+		pq = &queue{ch: make(chan Message, q.Size), done: make(chan struct{})}
+		q.queues[peer] = pq
+		go q.drain(peer, pq)
+	}
+	return pq
+}
+
+// Enqueue queues msg for peer, applying the policy if the queue is full.
+func (q *Queues) Enqueue(ctx context.Context, peer string, msg Message) error {
+	return q.EnqueueWith(ctx, peer, msg, q.Policy)
+}
+
+// EnqueueWith is Enqueue applying policy instead of the queues' own, for
+// producers that must not block whatever the configuration.
+func (q *Queues) EnqueueWith(ctx context.Context, peer string, msg Message, policy Policy) error {
+	pq := q.queue(peer)
+	ch := pq.ch
+	select {
+	case ch <- msg:
+		queueDepth.WithLabelValues(peer).Set(float64(len(ch)))
+		return nil
+	default:
+	}
+
+	switch policy {
+	case DropNewest:
+		queueDropped.WithLabelValues(peer, string(policy)).Inc()
+		return ErrDropped
+	case DropOldest:
+		for {
+			select {
+			case <-ch:
+				queueDropped.WithLabelValues(peer, string(policy)).Inc()
+			default:
+			}
+			select {
+			case ch <- msg:
+				queueDepth.WithLabelValues(peer).Set(float64(len(ch)))
+				return nil
+			default:
+			}
+		}
+	default:
+		start := time.Now()
+		defer func() { queueBlocked.WithLabelValues(peer).Add(time.Since(start).Seconds()) }()
+		select {
+		case ch <- msg:
+			queueDepth.WithLabelValues(peer).Set(float64(len(ch)))
+			return nil
+		case <-pq.done:
+			return ErrRemoved
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Depth returns the number of messages waiting for peer.
+func (q *Queues) Depth(peer string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pq, ok := q.queues[peer]; ok {
+		return len(pq.ch)
+	}
+	return 0
+}
+
+// Remove stops the sender for peer and discards its pending messages.
+func (q *Queues) Remove(peer string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pq, ok := q.queues[peer]; ok {
+		close(pq.done)
+		delete(q.queues, peer)
+		queueDepth.DeleteLabelValues(peer)
+	}
+}
+
+func (q *Queues) drain(peer string, pq *queue) {
+	for {
+		var msg Message
+		select {
+		case <-pq.done:
+			return
+		case msg = <-pq.ch:
+		}
+		queueDepth.WithLabelValues(peer).Set(float64(len(pq.ch)))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := q.Send(ctx, peer, msg); err != nil {
+			sendErrors.WithLabelValues(peer).Inc()
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,190 @@
+package soak
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"TestProject/client"
+	"TestProject/loadgen"
+	"TestProject/results"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keep bounds the reports held in memory; the file has all of them
+const keep = 1000
+
+var leakSuspected = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "soak_leak_suspected",
+		Help: "1 if a resource grew in every one of the recent soak reports",
+	},
+	[]string{"resource"},
+)
+
+func init() {
+	prometheus.MustRegister(leakSuspected)
+}
+
+// Report is one periodic self-report of a soak run.
+type Report struct {
+	Time       time.Time      `json:"time"`
+	Uptime     float64        `json:"uptime_seconds"`
+	Traffic    loadgen.Window `json:"traffic"`
+	Goroutines int            `json:"goroutines"`
+	HeapAlloc  uint64         `json:"heap_alloc_bytes"`
+	HeapInuse  uint64         `json:"heap_inuse_bytes"`
+	Sys        uint64         `json:"sys_bytes"`
+	NumGC      uint32         `json:"num_gc"`
+	Leaks      []string       `json:"leaks,omitempty"`
+}
+
+// Soak runs a traffic generator indefinitely and writes a report every
+// Interval, appending it as a JSON line to File when set. A resource that
+// grew in each of the last LeakWindow reports is flagged as leaking. The
+// traffic of each interval is also appended to the ResultsCSV and
+// ResultsJSON artifacts when set, and sent to the Collector node
+// (host:port) when set.
+type Soak struct {
+	Gen         *loadgen.Generator
+	Node        string
+	Interval    time.Duration
+	File        string
+	LeakWindow  int
+	ResultsCSV  string
+	ResultsJSON string
+	Collector   string
+
+	start   time.Time
+	mu      sync.Mutex
+	reports []Report
+}
+
+// Run generates traffic and reports until ctx is cancelled.
+func (s *Soak) Run(ctx context.Context) {
+	s.start = time.Now()
+	if s.Gen.RunID != "" {
+		log.Printf("soak: run %s started", s.Gen.RunID)
+	}
+	s.Gen.Snapshot()
+	go s.Gen.Run(ctx)
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r := s.report()
+		if s.File != "" {
+			if err := appendJSON(s.File, r); err != nil {
+				log.Printf("soak: writing report: %v", err)
+			}
+		}
+		res := results.New("soak", s.Node, r.Traffic)
+		if s.ResultsCSV != "" {
+			if err := results.AppendCSV(s.ResultsCSV, res); err != nil {
+				log.Printf("soak: writing results: %v", err)
+			}
+		}
+		if s.ResultsJSON != "" {
+			if err := results.AppendJSONLine(s.ResultsJSON, res); err != nil {
+				log.Printf("soak: writing results: %v", err)
+			}
+		}
+		if s.Collector != "" {
+			c := client.New(s.Collector, s.Node)
+			c.RunID = s.Gen.RunID
+			if err := c.ReportResult(ctx, res); err != nil {
+				log.Printf("soak: reporting results to %s: %v", s.Collector, err)
+			}
+		}
+		for _, l := range r.Leaks {
+			log.Printf("soak: possible %s leak, grew over the last %d reports", l, s.LeakWindow)
+		}
+	}
+}
+
+func (s *Soak) report() Report {
+	// Collect first so heap numbers show live memory rather than garbage
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r := Report{
+		Time:       time.Now(),
+		Uptime:     time.Since(s.start).Seconds(),
+		Traffic:    s.Gen.Snapshot(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		HeapInuse:  ms.HeapInuse,
+		Sys:        ms.Sys,
+		NumGC:      ms.NumGC,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, r)
+	if len(s.reports) > keep {
+		s.reports = s.reports[len(s.reports)-keep:]
+	}
+	for _, res := range resources {
+		if s.grows(res.value) {
+			r.Leaks = append(r.Leaks, res.name)
+			leakSuspected.WithLabelValues(res.name).Set(1)
+		} else {
+			leakSuspected.WithLabelValues(res.name).Set(0)
+		}
+	}
+	s.reports[len(s.reports)-1].Leaks = r.Leaks
+	return r
+}
+
+// resources are the report values watched for leaks
+var resources = []struct {
+	name  string
+	value func(Report) uint64
+}{
+	{"goroutines", func(r Report) uint64 { return uint64(r.Goroutines) }},
+	{"heap", func(r Report) uint64 { return r.HeapAlloc }},
+}
+
+// grows reports whether value strictly increased across the last
+// LeakWindow reports; s.mu must be held
+func (s *Soak) grows(value func(Report) uint64) bool {
+	n := len(s.reports)
+	if s.LeakWindow < 2 || n < s.LeakWindow {
+		return false
+	}
+	for i := n - s.LeakWindow + 1; i < n; i++ {
+		if value(s.reports[i]) <= value(s.reports[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports returns the reports held in memory, oldest first.
+func (s *Soak) Reports() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Report(nil), s.reports...)
+}
+
+func appendJSON(path string, v interface{}) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+package sse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"TestProject/apierror"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxData is the largest event data /admin/broadcast publishes. Data
+// without newlines goes out as a single data: line this long.
+const MaxData = 64 << 10
+
+var (
+	subscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sse_subscribers",
+			Help: "Number of open server-sent event subscriptions",
+		},
+	)
+	eventsSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sse_events_sent_total",
+			Help: "Total number of events queued to subscribers",
+		},
+	)
+	eventsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sse_events_dropped_total",
+			Help: "Total number of events dropped because a subscriber fell behind",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(subscribers)
+	prometheus.MustRegister(eventsSent)
+	prometheus.MustRegister(eventsDropped)
+}
+
+// Event is one server-sent event.
+type Event struct {
+	ID   string
+	Data string
+}
+
+// Broker fans events out to every subscribed client. Each subscriber has
+// a buffer of Buffer events; a subscriber that falls further behind misses
+// events rather than slowing everybody down.
+type Broker struct {
+	Buffer int
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewBroker(buffer int) *Broker {
+	return &Broker{Buffer: buffer, subs: make(map[chan Event]struct{})}
+}
+
+// Publish queues ev to all subscribers and returns how many got it.
+func (b *Broker) Publish(ev Event) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+			n++
+		default:
+			eventsDropped.Inc()
+		}
+	}
+	eventsSent.Add(float64(n))
+	return n
+}
+
+// Subscribers returns the number of open subscriptions.
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// ServeHTTP streams events to the client until it disconnects.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror.Error(w, r, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan Event, b.Buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	subscribers.Inc()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+		subscribers.Dec()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// A comment line tells the client the subscription is live
+	fmt.Fprint(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			fmt.Fprintf(w, "id: %s\n", ev.ID)
+			for _, line := range strings.Split(ev.Data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"TestProject/acl"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// Stress opens Subscribers event streams to a node, then triggers
+// Broadcasts events Interval apart and measures how long each takes to
+// reach every subscriber.
+type Stress struct {
+	Target      string // host:port
+	PeerID      string
+	Subscribers int
+	Broadcasts  int
+	Interval    time.Duration
+	// SetupRate bounds how many subscriptions are opened per second, so
+	// the connection storm itself can be dialed up or down
+	SetupRate float64
+}
+
+// StressReport summarizes a stress run; latencies are in milliseconds.
+type StressReport struct {
+	Subscribers    int            `json:"subscribers"`
+	Connected      int            `json:"connected"`
+	SetupFailures  map[string]int `json:"setup_failures,omitempty"`
+	SetupP50       float64        `json:"setup_p50_ms"`
+	SetupP99       float64        `json:"setup_p99_ms"`
+	SetupMax       float64        `json:"setup_max_ms"`
+	Broadcasts     int            `json:"broadcasts"`
+	Deliveries     int64          `json:"deliveries"`
+	Missed         int64          `json:"missed"`
+	Disconnects    int64          `json:"disconnects"`
+	FanoutP50      float64        `json:"fanout_p50_ms"`
+	FanoutP99      float64        `json:"fanout_p99_ms"`
+	FanoutP999     float64        `json:"fanout_p99_9_ms"`
+	FanoutMax      float64        `json:"fanout_max_ms"`
+	CompletionP50  float64        `json:"completion_p50_ms"`
+	CompletionMax  float64        `json:"completion_max_ms"`
+	BroadcastFails int            `json:"broadcast_failures"`
+}
+
+type broadcast struct {
+	sent      time.Time
+	delivered int64
+	last      int64 // unix nanos of the latest delivery
+}
+
+// Run performs the stress test.
+func (s *Stress) Run(ctx context.Context) StressReport {
+	rep := StressReport{Subscribers: s.Subscribers, Broadcasts: s.Broadcasts}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		MaxIdleConnsPerHost: -1,
+	}}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		setup     = hdrhistogram.New(1, int64(time.Minute/time.Microsecond), 3)
+		fanout    = hdrhistogram.New(1, int64(time.Minute/time.Microsecond), 3)
+		failures  = make(map[string]int)
+		sent      sync.Map // event ID -> *broadcast
+		connected int
+		wg        sync.WaitGroup
+		ready     sync.WaitGroup
+	)
+	var disconnects int64
+
+	interval := time.Duration(0)
+	if s.SetupRate > 0 {
+		interval = time.Duration(float64(time.Second) / s.SetupRate)
+	}
+	for i := 0; i < s.Subscribers; i++ {
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			body, err := s.subscribe(ctx, client)
+			mu.Lock()
+			if err != nil {
+				failures[failure(err)]++
+				mu.Unlock()
+				ready.Done()
+				return
+			}
+			connected++
+			setup.RecordValue(time.Since(start).Microseconds())
+			mu.Unlock()
+			ready.Done()
+			defer body.Close()
+
+			err = readEvents(body, func(id string) {
+				v, ok := sent.Load(id)
+				if !ok {
+					return
+				}
+				b := v.(*broadcast)
+				now := time.Now()
+				atomic.AddInt64(&b.delivered, 1)
+				atomic.StoreInt64(&b.last, now.UnixNano())
+				mu.Lock()
+				fanout.RecordValue(now.Sub(b.sent).Microseconds())
+				mu.Unlock()
+			})
+			if err != nil && ctx.Err() == nil {
+				atomic.AddInt64(&disconnects, 1)
+			}
+		}()
+	}
+	ready.Wait()
+
+	var order []*broadcast
+	for i := 0; i < s.Broadcasts && ctx.Err() == nil; i++ {
+		id := fmt.Sprintf("stress-%d-%d", time.Now().UnixNano(), i)
+		b := &broadcast{sent: time.Now()}
+		sent.Store(id, b)
+		if err := s.trigger(ctx, client, id); err != nil {
+			rep.BroadcastFails++
+			continue
+		}
+		order = append(order, b)
+		time.Sleep(s.Interval)
+	}
+	// Let stragglers arrive before tearing the streams down
+	time.Sleep(time.Second)
+	cancel()
+	wg.Wait()
+
+	completion := hdrhistogram.New(1, int64(time.Minute/time.Microsecond), 3)
+	for _, b := range order {
+		n := atomic.LoadInt64(&b.delivered)
+		rep.Deliveries += n
+		rep.Missed += int64(connected) - n
+		if n > 0 {
+			completion.RecordValue(time.Unix(0, atomic.LoadInt64(&b.last)).Sub(b.sent).Microseconds())
+		}
+	}
+	rep.Connected = connected
+	rep.Disconnects = disconnects
+	if len(failures) > 0 {
+		rep.SetupFailures = failures
+	}
+	ms := func(v int64) float64 { return float64(v) / 1000 }
+	rep.SetupP50, rep.SetupP99, rep.SetupMax = ms(setup.ValueAtQuantile(50)), ms(setup.ValueAtQuantile(99)), ms(setup.Max())
+	rep.FanoutP50, rep.FanoutP99 = ms(fanout.ValueAtQuantile(50)), ms(fanout.ValueAtQuantile(99))
+	rep.FanoutP999, rep.FanoutMax = ms(fanout.ValueAtQuantile(99.9)), ms(fanout.Max())
+	rep.CompletionP50, rep.CompletionMax = ms(completion.ValueAtQuantile(50)), ms(completion.Max())
+	return rep
+}
+
+// subscribe opens a stream; the server registers the subscriber before it
+// sends the response headers, so once they arrive events will be delivered
+func (s *Stress) subscribe(ctx context.Context, client *http.Client) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.Target+"/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	acl.Identify(req, s.PeerID)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (s *Stress) trigger(ctx context.Context, client *http.Client, id string) error {
+	u := "http://" + s.Target + "/v1/admin/broadcast?id=" + id
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader("stress"))
+	if err != nil {
+		return err
+	}
+	acl.Identify(req, s.PeerID)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// failure classifies a subscription error for the report
+func failure(err error) string {
+	var ne net.Error
+	switch {
+	case strings.HasPrefix(err.Error(), "status "):
+		return err.Error()
+	case strings.Contains(err.Error(), "too many open files"):
+		return "fd_limit"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "refused"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "reset"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// readEvents calls fn with the ID of every complete event on r
+func readEvents(r io.Reader, fn func(id string)) error {
+	sc := bufio.NewScanner(r)
+	id := ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if id != "" {
+				fn(id)
+			}
+			id = ""
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
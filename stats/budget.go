@@ -0,0 +1,96 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Budget is what a route may spend over a window: latency quantiles, an
+// error ratio and, to tell an idle route from a healthy one, a minimum of
+// requests. Zero values aren't checked.
+type Budget struct {
+	MaxP50        time.Duration
+	MaxP90        time.Duration
+	MaxP99        time.Duration
+	MaxMean       time.Duration
+	MaxErrorRatio float64
+	MinRequests   int64
+
+	errorRatioSet bool
+}
+
+// ParseBudget reads a budget from the query parameters max_p50, max_p90,
+// max_p99, max_mean (durations), max_error_rate (a ratio, 0 allowing no
+// errors) and min_requests.
+func ParseBudget(q url.Values) (Budget, error) {
+	var b Budget
+	for name, d := range map[string]*time.Duration{"max_p50": &b.MaxP50, "max_p90": &b.MaxP90, "max_p99": &b.MaxP99, "max_mean": &b.MaxMean} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return Budget{}, fmt.Errorf("invalid %s %q, want a positive duration", name, v)
+			}
+			*d = parsed
+		}
+	}
+	if v := q.Get("max_error_rate"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 || r > 1 {
+			return Budget{}, fmt.Errorf("invalid max_error_rate %q, want a ratio between 0 and 1", v)
+		}
+		b.MaxErrorRatio, b.errorRatioSet = r, true
+	}
+	if v := q.Get("min_requests"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return Budget{}, fmt.Errorf("invalid min_requests %q", v)
+		}
+		b.MinRequests = n
+	}
+	if b == (Budget{}) {
+		return Budget{}, errors.New("no thresholds, want max_p50, max_p90, max_p99, max_mean, max_error_rate or min_requests")
+	}
+	return b, nil
+}
+
+// Check is the verdict on one threshold of a budget.
+type Check struct {
+	Name      string  `json:"name"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	Pass      bool    `json:"pass"`
+}
+
+// Check holds p, the summary of a window, to the budget. A window without
+// requests spends no latency or errors.
+func (b Budget) Check(p Point) (checks []Check, pass bool) {
+	pass = true
+	add := func(name string, threshold, value float64, ok bool) {
+		checks = append(checks, Check{Name: name, Threshold: threshold, Value: value, Pass: ok})
+		pass = pass && ok
+	}
+	if b.MinRequests > 0 {
+		add("min_requests", float64(b.MinRequests), float64(p.Requests), p.Requests >= b.MinRequests)
+	}
+	for _, c := range []struct {
+		name  string
+		max   time.Duration
+		value float64
+	}{
+		{"max_p50_ms", b.MaxP50, p.P50Millis},
+		{"max_p90_ms", b.MaxP90, p.P90Millis},
+		{"max_p99_ms", b.MaxP99, p.P99Millis},
+		{"max_mean_ms", b.MaxMean, p.MeanMillis},
+	} {
+		if c.max > 0 {
+			add(c.name, millis(c.max), c.value, c.value <= millis(c.max))
+		}
+	}
+	if b.errorRatioSet {
+		add("max_error_rate", b.MaxErrorRatio, p.ErrorRatio, p.ErrorRatio <= b.MaxErrorRatio)
+	}
+	return checks, pass
+}
@@ -0,0 +1,266 @@
+package stats
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latencies are counted in logarithmic bins: bin i holds latencies up to
+// minLatency * 2^((i+1)/binsPerDoubling), so quantiles are known to
+// within 10%. The first bin holds everything faster, the last everything
+// slower.
+const (
+	minLatency      = 100 * time.Microsecond
+	binsPerDoubling = 4
+	bins            = 21 * binsPerDoubling // up to 3.5 minutes
+)
+
+// bucket counts the requests of one route in one interval
+type bucket struct {
+	start    int64 // interval number, or -1 while unused
+	requests int64
+	errors   int64
+	sum      time.Duration
+	max      time.Duration
+	latency  [bins]uint32
+}
+
+func (b *bucket) add(o *bucket) {
+	b.requests += o.requests
+	b.errors += o.errors
+	b.sum += o.sum
+	if o.max > b.max {
+		b.max = o.max
+	}
+	for i, n := range o.latency {
+		b.latency[i] += n
+	}
+}
+
+// quantile estimates the latency below which q of the requests finished
+func (b *bucket) quantile(q float64) time.Duration {
+	if b.requests == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(b.requests)))
+	var seen uint64
+	for i, n := range b.latency {
+		seen += uint64(n)
+		if seen >= rank {
+			// The geometric middle of the bin, but never above the slowest
+			d := time.Duration(float64(minLatency) * math.Exp2((float64(i)+0.5)/binsPerDoubling))
+			if d > b.max {
+				d = b.max
+			}
+			return d
+		}
+	}
+	return b.max
+}
+
+func bin(d time.Duration) int {
+	if d <= minLatency {
+		return 0
+	}
+	i := int(math.Log2(float64(d)/float64(minLatency)) * binsPerDoubling)
+	if i >= bins {
+		return bins - 1
+	}
+	return i
+}
+
+// Recent keeps the request counts and latencies of the last Window in
+// buckets of Resolution, per route.
+type Recent struct {
+	Resolution time.Duration
+	Window     time.Duration
+
+	mu     sync.Mutex
+	routes map[string][]bucket
+}
+
+// NewRecent keeps window of requests at resolution.
+func NewRecent(resolution, window time.Duration) (*Recent, error) {
+	if resolution <= 0 || window < resolution {
+		return nil, errors.New("the resolution must be positive and at most the window")
+	}
+	return &Recent{Resolution: resolution, Window: window, routes: make(map[string][]bucket)}, nil
+}
+
+func (s *Recent) size() int {
+	return int(s.Window / s.Resolution)
+}
+
+// Record counts a request to route that answered status after d.
+// Statuses of 500 and above count as errors.
+func (s *Recent) Record(route string, status int, d time.Duration, now time.Time) {
+	n := now.UnixNano() / int64(s.Resolution)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ring, ok := s.routes[route]
+	if !ok {
+		ring = make([]bucket, s.size())
+		for i := range ring {
+			ring[i].start = -1
+		}
+		s.routes[route] = ring
+	}
+	b := &ring[n%int64(len(ring))]
+	if b.start != n {
+		*b = bucket{start: n}
+	}
+	b.requests++
+	if status >= 500 {
+		b.errors++
+	}
+	b.sum += d
+	if d > b.max {
+		b.max = d
+	}
+	b.latency[bin(d)]++
+}
+
+// Point sums the requests from Time until the next point.
+type Point struct {
+	Time       time.Time `json:"time"`
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	RatePerSec float64   `json:"rate_per_second"`
+	ErrorRatio float64   `json:"error_ratio"`
+	MeanMillis float64   `json:"mean_ms"`
+	P50Millis  float64   `json:"p50_ms"`
+	P90Millis  float64   `json:"p90_ms"`
+	P99Millis  float64   `json:"p99_ms"`
+	MaxMillis  float64   `json:"max_ms"`
+}
+
+// Snapshot is the recent window of one route or all of them.
+type Snapshot struct {
+	Route      string    `json:"route,omitempty"`
+	Routes     []string  `json:"routes"`
+	Resolution float64   `json:"resolution_seconds"`
+	Step       float64   `json:"step_seconds"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Summary    Point     `json:"summary"`
+	Points     []Point   `json:"points"`
+}
+
+// Query returns the last window before now of route, or of every route if
+// empty, in points of step. window is capped to s.Window and step is
+// rounded up to a multiple of s.Resolution.
+func (s *Recent) Query(route string, now time.Time, window, step time.Duration) (Snapshot, error) {
+	if window <= 0 || window > s.Window {
+		window = s.Window
+	}
+	if step < s.Resolution {
+		step = s.Resolution
+	}
+	per := int64((step + s.Resolution - 1) / s.Resolution)
+	step = time.Duration(per) * s.Resolution
+	last := now.UnixNano() / int64(s.Resolution)
+	first := last - int64(window/s.Resolution) + 1
+	// Points start on multiples of step, so that successive queries line up
+	first -= first % per
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := Snapshot{Route: route, Resolution: s.Resolution.Seconds(), Step: step.Seconds(), Routes: []string{}}
+	var rings [][]bucket
+	for name, ring := range s.routes {
+		snap.Routes = append(snap.Routes, name)
+		if route == "" || name == route {
+			rings = append(rings, ring)
+		}
+	}
+	sort.Strings(snap.Routes)
+	if route != "" && len(rings) == 0 {
+		return Snapshot{}, ErrNoRoute
+	}
+
+	snap.From = time.Unix(0, first*int64(s.Resolution)).UTC()
+	snap.To = time.Unix(0, (last+1)*int64(s.Resolution)).UTC()
+	snap.Points = []Point{}
+	var total bucket
+	for start := first; start <= last; start += per {
+		var agg bucket
+		for n := start; n < start+per && n <= last; n++ {
+			for _, ring := range rings {
+				if b := &ring[n%int64(len(ring))]; b.start == n {
+					agg.add(b)
+				}
+			}
+		}
+		end := start + per
+		if end > last+1 {
+			end = last + 1
+		}
+		seconds := float64(end-start) * s.Resolution.Seconds()
+		snap.Points = append(snap.Points, point(time.Unix(0, start*int64(s.Resolution)).UTC(), &agg, seconds))
+		total.add(&agg)
+	}
+	snap.Summary = point(snap.From, &total, snap.To.Sub(snap.From).Seconds())
+	return snap, nil
+}
+
+// ErrNoRoute is returned by Query for routes without requests.
+var ErrNoRoute = errors.New("no requests to this route in the window")
+
+func point(t time.Time, b *bucket, seconds float64) Point {
+	p := Point{Time: t, Requests: b.requests, Errors: b.errors}
+	if seconds > 0 {
+		p.RatePerSec = float64(b.requests) / seconds
+	}
+	if b.requests > 0 {
+		p.ErrorRatio = float64(b.errors) / float64(b.requests)
+		p.MeanMillis = millis(b.sum / time.Duration(b.requests))
+		p.P50Millis = millis(b.quantile(0.5))
+		p.P90Millis = millis(b.quantile(0.9))
+		p.P99Millis = millis(b.quantile(0.99))
+		p.MaxMillis = millis(b.max)
+	}
+	return p
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Middleware records every request passing through next under the route
+// pattern returned by route.
+func (s *Recent) Middleware(route func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		s.Record(route(r), sw.status, time.Since(start), time.Now())
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,275 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	throttleRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "peer_throttle_rate_bytes",
+			Help: "Configured bandwidth limit per peer and direction in bytes per second",
+		},
+		[]string{"peer", "direction"},
+	)
+	throttleDelay = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_throttle_delay_seconds_total",
+			Help: "Total time spent waiting on per-peer bandwidth limits",
+		},
+		[]string{"peer", "direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(throttleRate)
+	prometheus.MustRegister(throttleDelay)
+}
+
+// Bucket is a token bucket metering bytes at a fixed rate.
+type Bucket struct {
+	peer, direction string
+
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(peer, direction string, rate int64) *Bucket {
+	// A 50ms burst keeps the shaping smooth without tiny writes
+	burst := float64(rate) / 20
+	if burst < 1024 {
+		burst = 1024
+	}
+	return &Bucket{peer: peer, direction: direction, rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Rate returns the configured limit in bytes per second.
+func (b *Bucket) Rate() int64 { return int64(b.rate) }
+
+// wait blocks until n bytes may pass; n must not exceed the burst
+func (b *Bucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		throttleDelay.WithLabelValues(b.peer, b.direction).Add(delay.Seconds())
+		time.Sleep(delay)
+	}
+}
+
+func (b *Bucket) chunk() int { return int(b.burst) }
+
+// Writer returns w limited by b. A nil bucket means no limit.
+func Writer(w io.Writer, b *Bucket) io.Writer {
+	if b == nil {
+		return w
+	}
+	return &writer{w: w, b: b}
+}
+
+type writer struct {
+	w io.Writer
+	b *Bucket
+}
+
+func (t *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if c := t.b.chunk(); n > c {
+			n = c
+		}
+		t.b.wait(n)
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Reader returns r limited by b. A nil bucket means no limit.
+func Reader(r io.Reader, b *Bucket) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &reader{r: r, b: b}
+}
+
+type reader struct {
+	r io.Reader
+	b *Bucket
+}
+
+func (t *reader) Read(p []byte) (int, error) {
+	if c := t.b.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.b.wait(n)
+	}
+	return n, err
+}
+
+// Limit is the bandwidth configured for one peer, 0 meaning unlimited.
+type Limit struct {
+	Peer string `json:"peer"`
+	Send int64  `json:"send_bytes_per_second"`
+	Recv int64  `json:"recv_bytes_per_second"`
+}
+
+// Table holds the per-peer limits. Send is traffic from this node to the
+// peer, Recv is traffic from the peer to this node.
+type Table struct {
+	mu    sync.RWMutex
+	send  map[string]*Bucket
+	recv  map[string]*Bucket
+	limit map[string]Limit
+}
+
+func NewTable() *Table {
+	return &Table{send: make(map[string]*Bucket), recv: make(map[string]*Bucket), limit: make(map[string]Limit)}
+}
+
+// Set replaces the limits for l.Peer. Zero rates in both directions remove it.
+func (t *Table) Set(l Limit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.send, l.Peer)
+	delete(t.recv, l.Peer)
+	delete(t.limit, l.Peer)
+	throttleRate.DeleteLabelValues(l.Peer, "send")
+	throttleRate.DeleteLabelValues(l.Peer, "recv")
+	if l.Send > 0 {
+		t.send[l.Peer] = newBucket(l.Peer, "send", l.Send)
+		throttleRate.WithLabelValues(l.Peer, "send").Set(float64(l.Send))
+	}
+	if l.Recv > 0 {
+		t.recv[l.Peer] = newBucket(l.Peer, "recv", l.Recv)
+		throttleRate.WithLabelValues(l.Peer, "recv").Set(float64(l.Recv))
+	}
+	if l.Send > 0 || l.Recv > 0 {
+		t.limit[l.Peer] = l
+	}
+}
+
+// List returns the configured limits.
+func (t *Table) List() []Limit {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	limits := make([]Limit, 0, len(t.limit))
+	for _, l := range t.limit {
+		limits = append(limits, l)
+	}
+	return limits
+}
+
+// Send returns the bucket for traffic to peer, or nil when unlimited.
+func (t *Table) Send(peer string) *Bucket {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.send[peer]
+}
+
+// Recv returns the bucket for traffic from peer, or nil when unlimited.
+func (t *Table) Recv(peer string) *Bucket {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.recv[peer]
+}
+
+// Middleware limits request bodies and responses of calls from the peer
+// that peer returns for a request.
+func (t *Table) Middleware(peer func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := peer(r)
+		if peer == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if b := t.Recv(peer); b != nil && r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{Reader(r.Body, b), r.Body}
+		}
+		if b := t.Send(peer); b != nil {
+			w = &responseWriter{ResponseWriter: w, out: Writer(w, b)}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	out io.Writer
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) { return w.out.Write(p) }
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ParseRate parses a bit rate such as "1Mbps", "512kbps" or "2000000bps"
+// and returns it in bytes per second, rounded up. "" and "0" mean
+// unlimited.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	lower := strings.ToLower(s)
+	if !strings.HasSuffix(lower, "bps") {
+		return 0, fmt.Errorf("rate %q: expected a unit like kbps, Mbps or Gbps", s)
+	}
+	num := strings.TrimSuffix(lower, "bps")
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(num, "k"):
+		mult, num = 1e3, strings.TrimSuffix(num, "k")
+	case strings.HasSuffix(num, "m"):
+		mult, num = 1e6, strings.TrimSuffix(num, "m")
+	case strings.HasSuffix(num, "g"):
+		mult, num = 1e9, strings.TrimSuffix(num, "g")
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("rate %q: invalid number", s)
+	}
+	bytes := math.Ceil(v * mult / 8)
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("rate %q: too large", s)
+	}
+	// A rate above 0 but under a byte per second means 1, not unlimited
+	return int64(bytes), nil
+}
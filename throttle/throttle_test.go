@@ -0,0 +1,35 @@
+package throttle
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"8bps", 1, true},
+		{"1Mbps", 125000, true},
+		{" 512kbps ", 64000, true},
+		{"2Gbps", 250000000, true},
+		{"1.5kbps", 188, true},
+		// Under a byte per second rounds up instead of becoming unlimited
+		{"1bps", 1, true},
+		{"0.001kbps", 1, true},
+		{"0bps", 0, true},
+		{"1MB", 0, false},
+		{"fastbps", 0, false},
+		{"-1Mbps", 0, false},
+		{"NaNbps", 0, false},
+		{"Infbps", 0, false},
+		{"+Infkbps", 0, false},
+		{"1e30Gbps", 0, false},
+	} {
+		got, err := ParseRate(tc.in)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tc.in, got, err, tc.want)
+		}
+	}
+}
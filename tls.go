@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	tlsCert     = flag.String("tls-cert", "", "certificate file for TLS peer connections")
+	tlsKey      = flag.String("tls-key", "", "private key file for TLS peer connections")
+	tlsCA       = flag.String("tls-ca", "", "CA bundle used to verify peers (default: system roots)")
+	tlsInsecure = flag.Bool("tls-insecure", false, "skip verification of peer certificates")
+)
+
+// peerTLS returns the server and client TLS configs for peer connections,
+// both nil when no certificate is configured
+func peerTLS() (*tls.Config, *tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		return nil, nil, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading TLS key pair: %w", err)
+	}
+
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: *tlsInsecure}
+	if *tlsCA != "" {
+		pem, err := os.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading TLS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", *tlsCA)
+		}
+		client.RootCAs = pool
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return server, client, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/dial"
+)
+
+// Topology is a node's view of the mesh: the nodes it knows and the edges
+// it measured, weighted by the latest ping RTT
+type Topology struct {
+	Leader string         `json:"leader"`
+	Scope  string         `json:"scope"`
+	Nodes  []TopologyNode `json:"nodes"`
+	Edges  []TopologyEdge `json:"edges"`
+}
+
+type TopologyNode struct {
+	ID     string `json:"id"`
+	Addr   string `json:"addr,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+type TopologyEdge struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Transport string  `json:"transport"`
+	RTTMillis float64 `json:"rtt_ms"`
+}
+
+// alivePeers returns the IDs of peers the failure detector doesn't
+// suspect, or of all registered peers when pinging is disabled
+func alivePeers() []string {
+	var ids []string
+	for _, p := range registry.List() {
+		if *pingInterval > 0 && peerPinger.Suspected(p.ID) {
+			continue
+		}
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// currentLeader is the lowest node ID among this node and the live peers,
+// so every node with the same view agrees without an election round
+func currentLeader() string {
+	leader := *nodeID
+	for _, id := range alivePeers() {
+		if id < leader {
+			leader = id
+		}
+	}
+	return leader
+}
+
+func localTopology() Topology {
+	t := Topology{Leader: currentLeader(), Scope: "local"}
+	t.Nodes = append(t.Nodes, TopologyNode{ID: *nodeID, Addr: advertiseAddr(), Source: "self"})
+	for _, p := range registry.List() {
+		t.Nodes = append(t.Nodes, TopologyNode{ID: p.ID, Addr: p.Addr, Source: p.Source})
+	}
+	for peer, byTransport := range peerPinger.Last() {
+		for transport, s := range byTransport {
+			t.Edges = append(t.Edges, TopologyEdge{
+				From:      *nodeID,
+				To:        peer,
+				Transport: transport,
+				RTTMillis: float64(s.RTT.Microseconds()) / 1000,
+			})
+		}
+	}
+	sort.Slice(t.Edges, func(i, j int) bool {
+		if t.Edges[i].To != t.Edges[j].To {
+			return t.Edges[i].To < t.Edges[j].To
+		}
+		return t.Edges[i].Transport < t.Edges[j].Transport
+	})
+	return t
+}
+
+// meshTopology merges the local views of this node and every peer
+func meshTopology(ctx context.Context) Topology {
+	views := []Topology{localTopology()}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	client := &http.Client{Timeout: 3 * time.Second, Transport: dial.Transport}
+	for _, p := range registry.List() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/v1/topology?scope=local", nil)
+			if err != nil {
+				return
+			}
+			acl.Identify(req, *nodeID)
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			var t Topology
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&t) != nil {
+				return
+			}
+			mu.Lock()
+			views = append(views, t)
+			mu.Unlock()
+		}(p.Addr)
+	}
+	wg.Wait()
+
+	mesh := Topology{Leader: views[0].Leader, Scope: "mesh"}
+	nodes := make(map[string]TopologyNode)
+	for _, v := range views {
+		for _, n := range v.Nodes {
+			// A node's own entry is the authoritative one
+			if cur, ok := nodes[n.ID]; !ok || n.Source == "self" || cur.Addr == "" {
+				nodes[n.ID] = n
+			}
+		}
+		mesh.Edges = append(mesh.Edges, v.Edges...)
+	}
+	for _, n := range nodes {
+		n.Source = ""
+		mesh.Nodes = append(mesh.Nodes, n)
+	}
+	sort.Slice(mesh.Nodes, func(i, j int) bool { return mesh.Nodes[i].ID < mesh.Nodes[j].ID })
+	return mesh
+}
+
+// DOT renders the topology for Graphviz
+func (t Topology) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph mesh {\n")
+	for _, n := range t.Nodes {
+		attrs := ""
+		if n.ID == t.Leader {
+			attrs = " [shape=doublecircle]"
+		}
+		fmt.Fprintf(&b, "  %q%s;\n", n.ID, attrs)
+	}
+	// len makes neato lay out high-RTT edges longer
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=\"%.2fms %s\", len=%.3f];\n", e.From, e.To, e.RTTMillis, e.Transport, e.RTTMillis)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// topologyHandler serves the mesh view as JSON or, with ?format=dot, as
+// Graphviz. The leader aggregates the views of all peers unless asked for
+// ?scope=local; other nodes return their own view.
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	var t Topology
+	if scope == "mesh" || (scope == "" && currentLeader() == *nodeID) {
+		t = meshTopology(r.Context())
+	} else {
+		t = localTopology()
+	}
+
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		io.WriteString(w, t.DOT())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,344 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/discovery"
+	"TestProject/throttle"
+)
+
+// Source is the content of a transfer.
+type Source interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// File opens the file name in dir as a transfer source; the caller
+// closes it. Only relative names staying within dir, also after following
+// symlinks, are accepted, so a caller can't send arbitrary files.
+func File(dir, name string) (*FileSource, error) {
+	if name == "" || filepath.IsAbs(name) {
+		return nil, fmt.Errorf("%q is not a file name relative to the source directory", name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return nil, fmt.Errorf("%q leaves the source directory", name)
+		}
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%q leaves the source directory", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return &FileSource{File: f, size: fi.Size()}, nil
+}
+
+// FileSource is a transfer source backed by a file.
+type FileSource struct {
+	*os.File
+	size int64
+}
+
+func (f *FileSource) Size() int64 { return f.size }
+
+// Generated is Length bytes of pseudo-random data derived from Seed. Any
+// range can be produced on its own, so a resumed transfer sends the same
+// bytes as the interrupted one.
+type Generated struct {
+	Seed   string
+	Length int64
+}
+
+func (g Generated) Size() int64 { return g.Length }
+
+// generatedBlock is the unit Generated data is derived in
+const generatedBlock = 64 << 10
+
+func (g Generated) ReadAt(p []byte, off int64) (int, error) {
+	if off >= g.Length {
+		return 0, io.EOF
+	}
+	seed := sha256.Sum256([]byte(g.Seed))
+	base := int64(binary.BigEndian.Uint64(seed[:]))
+	block := make([]byte, generatedBlock)
+	n := 0
+	for n < len(p) && off < g.Length {
+		index := off / generatedBlock
+		rand.New(rand.NewSource(base ^ index)).Read(block)
+		c := copy(p[n:], block[off%generatedBlock:])
+		if rest := g.Length - off; int64(c) > rest {
+			c = int(rest)
+		}
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+var errTooLarge = errors.New("peer refuses the size")
+
+// Transfer uploads Source to Peer in chunks of ChunkSize with tus PATCH
+// requests. It first asks the peer with HEAD how much of upload ID it
+// already holds and resumes from there, and after a failed chunk it asks
+// again before retrying.
+type Transfer struct {
+	ID        string
+	Self      string
+	Peer      discovery.Peer
+	Source    Source
+	ChunkSize int64
+	// Retries is how often a single chunk may fail before giving up
+	Retries int
+	// Corrupt is the probability of flipping a byte in a chunk after its
+	// digest was computed, to exercise verification and retries
+	Corrupt  float64
+	Client   *http.Client
+	Throttle *throttle.Table
+}
+
+// Result describes a finished transfer.
+type Result struct {
+	ID            string  `json:"id"`
+	Peer          string  `json:"peer"`
+	Size          int64   `json:"size"`
+	SHA256        string  `json:"sha256"`
+	ResumedFrom   int64   `json:"resumed_from"`
+	Sent          int64   `json:"sent"`
+	Chunks        int     `json:"chunks"`
+	Retries       int     `json:"retries"`
+	CorruptedSent int     `json:"corrupted_sent,omitempty"`
+	Seconds       float64 `json:"seconds"`
+	BytesPerSec   float64 `json:"bytes_per_second"`
+	Complete      bool    `json:"complete"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// Run performs the transfer. The result is filled in as far as the
+// transfer got, also when an error is returned.
+func (t *Transfer) Run(ctx context.Context) (Result, error) {
+	res, err := t.run(ctx)
+	start := "fresh"
+	if res.ResumedFrom > 0 {
+		start = "resumed"
+	}
+	if err != nil {
+		res.Error = err.Error()
+		transfers.WithLabelValues(t.Peer.ID, "failed", start).Inc()
+		return res, err
+	}
+	transfers.WithLabelValues(t.Peer.ID, "ok", start).Inc()
+	if res.Seconds > 0 {
+		throughput.WithLabelValues(t.Peer.ID).Set(res.BytesPerSec)
+	}
+	return res, nil
+}
+
+func (t *Transfer) run(ctx context.Context) (res Result, err error) {
+	size := t.Source.Size()
+	res = Result{ID: t.ID, Peer: t.Peer.ID, Size: size}
+	if !ValidID(t.ID) {
+		return res, fmt.Errorf("invalid upload ID %q", t.ID)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(t.Source, 0, size)); err != nil {
+		return res, fmt.Errorf("hashing source: %w", err)
+	}
+	res.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	st, err := t.status(ctx, size, res.SHA256)
+	if err != nil {
+		return res, err
+	}
+	res.ResumedFrom = st.Offset
+	resumedBytes.WithLabelValues(t.Peer.ID).Add(float64(st.Offset))
+	if st.Complete {
+		res.Complete = true
+		return res, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		res.Seconds = time.Since(start).Seconds()
+		if res.Seconds > 0 {
+			res.BytesPerSec = float64(res.Sent) / res.Seconds
+		}
+	}()
+
+	offset := st.Offset
+	buf := make([]byte, t.ChunkSize)
+	failures := 0
+	for {
+		n := t.ChunkSize
+		if rest := size - offset; rest < n {
+			n = rest
+		}
+		chunk := buf[:n]
+		if _, err := t.Source.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return res, err
+		}
+		next, err := t.patch(ctx, offset, size, res.SHA256, chunk, &res)
+		if err == nil {
+			res.Chunks++
+			res.Sent += n
+			transferBytes.WithLabelValues(t.Peer.ID, "sent").Add(float64(n))
+			failures = 0
+			offset = next
+			if offset == size {
+				res.Complete = true
+				return res, nil
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		if errors.Is(err, errTooLarge) {
+			return res, err
+		}
+
+		failures++
+		res.Retries++
+		retries.WithLabelValues(t.Peer.ID).Inc()
+		if failures > t.Retries {
+			return res, fmt.Errorf("chunk at offset %d: %w", offset, err)
+		}
+		time.Sleep(time.Duration(failures) * 100 * time.Millisecond)
+		// Continue from wherever the peer got to: the chunk may have
+		// arrived even though its response didn't, or the peer may have
+		// lost the upload and it starts over
+		if st, err := t.status(ctx, size, res.SHA256); err == nil {
+			if st.Complete {
+				res.Complete = true
+				return res, nil
+			}
+			offset = st.Offset
+		}
+	}
+}
+
+func (t *Transfer) url() string {
+	return "http://" + t.Peer.Addr + "/transfer/" + url.PathEscape(t.ID)
+}
+
+// status asks the peer how much of the upload it holds. An upload of
+// different content under the same ID counts as nothing held.
+func (t *Transfer) status(ctx context.Context, size int64, digest string) (Status, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.url(), nil)
+	if err != nil {
+		return Status{}, err
+	}
+	t.setHeaders(req)
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return Status{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return Status{}, nil
+	default:
+		return Status{}, fmt.Errorf("HEAD: %s", resp.Status)
+	}
+	st := Status{Digest: digest}
+	st.Offset, _ = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	st.Length, _ = strconv.ParseInt(resp.Header.Get("Upload-Length"), 10, 64)
+	if st.Length != size || resp.Header.Get("Upload-Metadata") != Metadata(digest) {
+		return Status{}, nil
+	}
+	st.Complete = st.Offset == size
+	return st, nil
+}
+
+// patch appends chunk at offset and returns the new offset
+func (t *Transfer) patch(ctx context.Context, offset, size int64, digest string, chunk []byte, res *Result) (int64, error) {
+	sum := sha256.Sum256(chunk)
+	body := chunk
+	if t.Corrupt > 0 && len(chunk) > 0 && rand.Float64() < t.Corrupt {
+		body = append([]byte(nil), chunk...)
+		body[rand.Intn(len(body))] ^= 0xff
+		res.CorruptedSent++
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if t.Throttle != nil {
+		r = throttle.Reader(r, t.Throttle.Send(t.Peer.ID))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, t.url(), r)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = int64(len(body))
+	t.setHeaders(req)
+	req.Header.Set("Content-Type", OffsetStream)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if offset == 0 {
+		req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+		req.Header.Set("Upload-Metadata", Metadata(digest))
+	}
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if p, ok := apierror.Parse(msg); ok {
+			msg = []byte(p.Message)
+		}
+		err := fmt.Errorf("PATCH: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			// Sending it again won't make it fit
+			err = fmt.Errorf("%w: %v", errTooLarge, err)
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func (t *Transfer) setHeaders(req *http.Request) {
+	acl.Identify(req, t.Self)
+	req.Header.Set("Tus-Resumable", TusVersion)
+}
@@ -0,0 +1,491 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"TestProject/acl"
+	"TestProject/apierror"
+	"TestProject/cardinality"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The receiver speaks the core tus 1.0 protocol (https://tus.io) with the
+// checksum and termination extensions. Uploads are not created with a
+// POST; the sender picks the ID and the first PATCH announces the length.
+const (
+	TusVersion   = "1.0.0"
+	OffsetStream = "application/offset+octet-stream"
+	// StatusChecksumMismatch is what tus answers a chunk whose
+	// Upload-Checksum doesn't match its body with
+	StatusChecksumMismatch = 460
+)
+
+// MaxChunk is the largest chunk a receiver accepts.
+const MaxChunk = 64 << 20
+
+var (
+	transferBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_bytes_total",
+			Help: "Total number of verified transfer chunk bytes by peer and direction",
+		},
+		[]string{"peer", "direction"},
+	)
+	corrupt = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_corrupt_total",
+			Help: "Total number of received chunks or files that failed SHA-256 verification",
+		},
+		[]string{"peer", "scope"},
+	)
+	retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_chunk_retries_total",
+			Help: "Total number of chunks sent again after a failure",
+		},
+		[]string{"peer"},
+	)
+	transfers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfers_total",
+			Help: "Total number of outgoing transfers by peer, result and whether they started fresh or resumed",
+		},
+		[]string{"peer", "result", "start"},
+	)
+	resumedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_resumed_bytes_total",
+			Help: "Total number of bytes not sent again because the peer already held them",
+		},
+		[]string{"peer"},
+	)
+	throughput = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "transfer_throughput_bytes_per_second",
+			Help: "Throughput of the latest completed outgoing transfer to a peer",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(transferBytes)
+	prometheus.MustRegister(corrupt)
+	prometheus.MustRegister(retries)
+	prometheus.MustRegister(transfers)
+	prometheus.MustRegister(resumedBytes)
+	prometheus.MustRegister(throughput)
+}
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// ValidID reports whether receivers accept id as an upload ID.
+func ValidID(id string) bool { return validID.MatchString(id) }
+
+// senders bounds the peer label of the received-side series: senders pick
+// their IDs, and unauthenticated ones share the Other value
+var senders = &cardinality.Limiter{
+	Max:  64,
+	Idle: time.Hour,
+	OnEvict: func(peer string) {
+		transferBytes.DeleteLabelValues(peer, "received")
+		corrupt.DeletePartialMatch(prometheus.Labels{"peer": peer})
+	},
+}
+
+// Status is the receiver's view of an upload.
+type Status struct {
+	Offset   int64
+	Length   int64
+	Digest   string // hex SHA-256 of the whole file
+	Complete bool
+}
+
+type upload struct {
+	length int64
+	digest string // hex SHA-256 of the whole file
+	done   time.Time
+}
+
+// KeepDone is how long a receiver remembers a completed upload, so a
+// sender repeating it is told it already arrived.
+const KeepDone = time.Hour
+
+// Receiver accepts uploads at /transfer/<id>. Partial data is kept in Dir
+// as <id>.part, with the length and digest in <id>.info, so a sender can
+// resume after a failure of either side; completed and verified files are
+// removed again, only their length and digest are remembered for
+// KeepDone. Uploads announcing more than MaxLength bytes are refused.
+type Receiver struct {
+	Dir       string
+	MaxLength int64
+
+	mu     sync.Mutex // guards done and active, not the uploads
+	done   map[string]upload
+	active map[string]*active
+}
+
+// active is an upload being received. Its lock serializes the chunks of
+// one upload, and the running digest saves reading the part again when
+// the last one arrives.
+type active struct {
+	mu     sync.Mutex
+	id     string
+	refs   int // guarded by Receiver.mu
+	seen   time.Time
+	hash   hash.Hash
+	hashed int64 // bytes of the part hash has seen
+}
+
+func NewReceiver(dir string, maxLength int64) (*Receiver, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Receiver{Dir: dir, MaxLength: maxLength, done: make(map[string]upload), active: make(map[string]*active)}, nil
+}
+
+// ServeHTTP answers HEAD with the offset of an upload, appends a chunk on
+// PATCH and discards an upload on DELETE.
+func (rc *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != TusVersion && r.Method != http.MethodOptions {
+		w.Header().Set("Tus-Version", TusVersion)
+		apierror.Error(w, r, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", "checksum,termination")
+		w.Header().Set("Tus-Checksum-Algorithm", "sha256")
+		w.Header().Set("Tus-Max-Chunk", strconv.Itoa(MaxChunk))
+		if rc.MaxLength > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(rc.MaxLength, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/transfer/")
+	if !validID.MatchString(id) {
+		apierror.Error(w, r, "missing or invalid upload ID", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		a := rc.lock(id)
+		st, ok := rc.status(id)
+		rc.unlock(a)
+		w.Header().Set("Cache-Control", "no-store")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		setStatus(w, st)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		rc.patch(w, r, id)
+	case http.MethodDelete:
+		a := rc.lock(id)
+		rc.remove(id)
+		rc.setDone(id, nil)
+		a.hash = nil
+		rc.unlock(a)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Error(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rc *Receiver) patch(w http.ResponseWriter, r *http.Request, id string) {
+	peer := senders.Value(acl.Peer(r))
+	if r.Header.Get("Content-Type") != OffsetStream {
+		apierror.Error(w, r, "expected Content-Type "+OffsetStream, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		apierror.Error(w, r, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	checksum, ok := parseChecksum(r.Header.Get("Upload-Checksum"))
+	if !ok {
+		apierror.Error(w, r, "expected Upload-Checksum: sha256 <base64>", http.StatusBadRequest)
+		return
+	}
+
+	// Chunks are verified before they touch the file, so the part on disk
+	// only ever holds good data to resume from
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, MaxChunk+1))
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(chunk) > MaxChunk {
+		apierror.Error(w, r, fmt.Sprintf("chunks are limited to %d bytes", MaxChunk), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if sum := sha256.Sum256(chunk); string(sum[:]) != string(checksum) {
+		corrupt.WithLabelValues(peer, "chunk").Inc()
+		apierror.Error(w, r, "checksum mismatch", StatusChecksumMismatch)
+		return
+	}
+
+	a := rc.lock(id)
+	defer rc.unlock(a)
+	up, known := rc.info(id)
+	if offset == 0 {
+		// A PATCH at offset 0 starts the upload (again) and announces it
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		digest, ok := parseDigest(r.Header.Get("Upload-Metadata"))
+		if err != nil || length < 0 || !ok {
+			apierror.Error(w, r, "the first chunk needs Upload-Length and Upload-Metadata with sha256", http.StatusBadRequest)
+			return
+		}
+		if rc.MaxLength > 0 && length > rc.MaxLength {
+			apierror.Write(w, r, http.StatusRequestEntityTooLarge, apierror.Problem{
+				Message: fmt.Sprintf("uploads are limited to %d bytes", rc.MaxLength),
+				Details: map[string]interface{}{"max_size": rc.MaxLength},
+			})
+			return
+		}
+		up, known = upload{length: length, digest: digest}, true
+		rc.setDone(id, nil)
+		rc.remove(id)
+		a.hash, a.hashed = sha256.New(), 0
+		info := fmt.Sprintf("%d %s\n", length, digest)
+		if err := os.WriteFile(rc.path(id, ".info"), []byte(info), 0o644); err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	st, _ := rc.status(id)
+	if !known || st.Complete || offset != st.Offset {
+		setStatus(w, st)
+		apierror.Write(w, r, http.StatusConflict, apierror.Problem{
+			Message: "Upload-Offset doesn't match",
+			Details: map[string]interface{}{"offset": st.Offset},
+		})
+		return
+	}
+	if offset+int64(len(chunk)) > up.length {
+		apierror.Error(w, r, "chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if a.hash == nil || a.hashed != offset {
+		// After a restart or a failed write the digest of the part is
+		// built again, once
+		h, n, err := partDigest(rc.path(id, ".part"))
+		if err != nil {
+			apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.hash, a.hashed = h, n
+	}
+	f, err := openPart(rc.path(id, ".part"))
+	if err != nil {
+		apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = f.Write(chunk)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Drop whatever part of the chunk made it, the sender resumes
+		// from the last complete one
+		os.Truncate(rc.path(id, ".part"), offset)
+		a.hash = nil
+		apierror.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.hash.Write(chunk)
+	a.hashed += int64(len(chunk))
+	transferBytes.WithLabelValues(peer, "received").Add(float64(len(chunk)))
+	st.Offset += int64(len(chunk))
+
+	if st.Offset == up.length {
+		ok := hex.EncodeToString(a.hash.Sum(nil)) == up.digest
+		rc.remove(id)
+		a.hash = nil
+		if !ok {
+			corrupt.WithLabelValues(peer, "file").Inc()
+			apierror.Error(w, r, "file checksum mismatch", StatusChecksumMismatch)
+			return
+		}
+		up.done = time.Now()
+		rc.setDone(id, &up)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openPart opens the part of an upload to append a chunk to; tests
+// replace it to make writes fail
+var openPart = func(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+// lock waits for other requests to upload id, and prunes what was
+// completed or left alone longer than KeepDone
+func (rc *Receiver) lock(id string) *active {
+	rc.mu.Lock()
+	now := time.Now()
+	for k, up := range rc.done {
+		if now.Sub(up.done) > KeepDone {
+			delete(rc.done, k)
+		}
+	}
+	for k, a := range rc.active {
+		if a.refs == 0 && now.Sub(a.seen) > KeepDone {
+			delete(rc.active, k)
+		}
+	}
+	a := rc.active[id]
+	if a == nil {
+		a = &active{id: id}
+		rc.active[id] = a
+	}
+	a.refs++
+	a.seen = now
+	rc.mu.Unlock()
+	a.mu.Lock()
+	return a
+}
+
+func (rc *Receiver) unlock(a *active) {
+	// Without a digest to keep there's no reason to remember the upload
+	drop := a.hash == nil
+	a.mu.Unlock()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	a.refs--
+	if a.refs == 0 && drop && rc.active[a.id] == a {
+		delete(rc.active, a.id)
+	}
+}
+
+// setDone remembers a completed upload, or forgets it if up is nil
+func (rc *Receiver) setDone(id string, up *upload) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if up == nil {
+		delete(rc.done, id)
+		return
+	}
+	rc.done[id] = *up
+}
+
+// status must be called with the upload locked
+func (rc *Receiver) status(id string) (Status, bool) {
+	rc.mu.Lock()
+	up, ok := rc.done[id]
+	rc.mu.Unlock()
+	if ok {
+		return Status{Offset: up.length, Length: up.length, Digest: up.digest, Complete: true}, true
+	}
+	up, ok = rc.info(id)
+	if !ok {
+		return Status{}, false
+	}
+	st := Status{Length: up.length, Digest: up.digest}
+	if fi, err := os.Stat(rc.path(id, ".part")); err == nil {
+		st.Offset = fi.Size()
+	}
+	return st, true
+}
+
+// info reads what the first chunk of an unfinished upload announced
+func (rc *Receiver) info(id string) (upload, bool) {
+	data, err := os.ReadFile(rc.path(id, ".info"))
+	if err != nil {
+		return upload{}, false
+	}
+	var up upload
+	if _, err := fmt.Sscanf(string(data), "%d %s", &up.length, &up.digest); err != nil {
+		return upload{}, false
+	}
+	return up, true
+}
+
+func (rc *Receiver) remove(id string) {
+	os.Remove(rc.path(id, ".part"))
+	os.Remove(rc.path(id, ".info"))
+}
+
+func (rc *Receiver) path(id, ext string) string {
+	return filepath.Join(rc.Dir, id+ext)
+}
+
+func setStatus(w http.ResponseWriter, st Status) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(st.Length, 10))
+	if st.Digest != "" {
+		w.Header().Set("Upload-Metadata", Metadata(st.Digest))
+	}
+}
+
+// Metadata is the Upload-Metadata header announcing the hex SHA-256 of
+// the whole file.
+func Metadata(digest string) string {
+	return "sha256 " + base64.StdEncoding.EncodeToString([]byte(digest))
+}
+
+// parseChecksum decodes an Upload-Checksum header such as
+// "sha256 <base64 digest>"
+func parseChecksum(h string) ([]byte, bool) {
+	algo, value, ok := strings.Cut(h, " ")
+	if !ok || algo != "sha256" {
+		return nil, false
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	return sum, err == nil && len(sum) == sha256.Size
+}
+
+// parseDigest finds the hex SHA-256 of the whole file in Upload-Metadata,
+// a comma-separated list of keys and base64 values
+func parseDigest(h string) (string, bool) {
+	for _, pair := range strings.Split(h, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key != "sha256" {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(digest) != sha256.Size*2 {
+			return "", false
+		}
+		return string(digest), true
+	}
+	return "", false
+}
+
+// partDigest hashes what was received of an upload so far
+func partDigest(path string) (hash.Hash, int64, error) {
+	h := sha256.New()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, n, nil
+}
@@ -0,0 +1,266 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+var file = bytes.Repeat([]byte("0123456789abcdef"), 1024)
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newReceiver(t *testing.T) *Receiver {
+	t.Helper()
+	rc, err := NewReceiver(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+// patch sends chunk at offset; the chunk at offset 0 announces a file of
+// length with the given digest
+func patch(rc *Receiver, id string, offset int64, chunk []byte, length int64, fileDigest string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/transfer/"+id, bytes.NewReader(chunk))
+	r.Header.Set("Tus-Resumable", TusVersion)
+	r.Header.Set("Content-Type", OffsetStream)
+	r.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	sum := sha256.Sum256(chunk)
+	r.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	if offset == 0 {
+		r.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+		r.Header.Set("Upload-Metadata", Metadata(fileDigest))
+	}
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, r)
+	return w
+}
+
+// head returns the status of the HEAD request for id and its offset
+func head(rc *Receiver, id string) (int, int64) {
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/transfer/"+id, nil))
+	offset, _ := strconv.ParseInt(w.Header().Get("Upload-Offset"), 10, 64)
+	return w.Code, offset
+}
+
+// send uploads file[from:to] in chunks of size
+func send(t *testing.T, rc *Receiver, id string, from, to, size int) {
+	t.Helper()
+	for off := from; off < to; off += size {
+		end := off + size
+		if end > to {
+			end = to
+		}
+		if w := patch(rc, id, int64(off), file[off:end], int64(len(file)), digest(file)); w.Code != http.StatusNoContent {
+			t.Fatalf("chunk at %d: %d %s", off, w.Code, w.Body)
+		}
+	}
+}
+
+func partSize(t *testing.T, rc *Receiver, id string) int64 {
+	t.Helper()
+	fi, err := os.Stat(rc.path(id, ".part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestReceiverUpload(t *testing.T) {
+	rc := newReceiver(t)
+	if code, _ := head(rc, "up"); code != http.StatusNotFound {
+		t.Errorf("HEAD of an unknown upload: %d", code)
+	}
+	send(t, rc, "up", 0, 5000, 1000)
+	if code, offset := head(rc, "up"); code != http.StatusOK || offset != 5000 {
+		t.Errorf("HEAD after 5000 bytes: %d at %d", code, offset)
+	}
+	send(t, rc, "up", 5000, len(file), 1000)
+	if code, offset := head(rc, "up"); code != http.StatusOK || offset != int64(len(file)) {
+		t.Errorf("HEAD of the completed upload: %d at %d", code, offset)
+	}
+	if _, err := os.Stat(rc.path("up", ".part")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the verified part is kept: %v", err)
+	}
+	// A completed upload takes no more chunks
+	if w := patch(rc, "up", int64(len(file)), []byte("x"), 0, ""); w.Code != http.StatusConflict {
+		t.Errorf("chunk after completion: %d", w.Code)
+	}
+}
+
+func TestReceiverOffsetConflict(t *testing.T) {
+	rc := newReceiver(t)
+	if w := patch(rc, "up", 100, file[100:200], 0, ""); w.Code != http.StatusConflict {
+		t.Errorf("chunk of an upload never started: %d", w.Code)
+	}
+	send(t, rc, "up", 0, 1000, 1000)
+	for _, offset := range []int64{500, 999, 1001, 2000} {
+		w := patch(rc, "up", offset, file[offset:offset+100], 0, "")
+		if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "1000" {
+			t.Errorf("chunk at %d after 1000 bytes: %d, offset %q", offset, w.Code, w.Header().Get("Upload-Offset"))
+		}
+		if !bytes.Contains(w.Body.Bytes(), []byte(`"offset":1000`)) {
+			t.Errorf("chunk at %d: the conflict doesn't report the offset: %s", offset, w.Body)
+		}
+	}
+	if n := partSize(t, rc, "up"); n != 1000 {
+		t.Errorf("conflicting chunks changed the part to %d bytes", n)
+	}
+	// The upload continues from where it is
+	send(t, rc, "up", 1000, len(file), 4096)
+}
+
+func TestReceiverRejectsBadChunks(t *testing.T) {
+	rc := newReceiver(t)
+	send(t, rc, "up", 0, 1000, 1000)
+
+	r := httptest.NewRequest(http.MethodPatch, "/transfer/up", bytes.NewReader(file[1000:2000]))
+	r.Header.Set("Content-Type", OffsetStream)
+	r.Header.Set("Upload-Offset", "1000")
+	sum := sha256.Sum256(file[1001:2001])
+	r.Header.Set("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:]))
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, r)
+	if w.Code != StatusChecksumMismatch {
+		t.Errorf("chunk with a wrong checksum: %d", w.Code)
+	}
+	if w := patch(rc, "up", 1000, make([]byte, len(file)), 0, ""); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk beyond Upload-Length: %d", w.Code)
+	}
+	if n := partSize(t, rc, "up"); n != 1000 {
+		t.Errorf("refused chunks changed the part to %d bytes", n)
+	}
+}
+
+// A chunk at offset 0 starts the upload over, also with other content
+func TestReceiverRestartAtZero(t *testing.T) {
+	rc := newReceiver(t)
+	send(t, rc, "up", 0, 3000, 1000)
+
+	other := bytes.Repeat([]byte("z"), 2500)
+	if w := patch(rc, "up", 0, other[:2000], int64(len(other)), digest(other)); w.Code != http.StatusNoContent {
+		t.Fatalf("restart at offset 0: %d %s", w.Code, w.Body)
+	}
+	if code, offset := head(rc, "up"); code != http.StatusOK || offset != 2000 {
+		t.Errorf("HEAD after the restart: %d at %d", code, offset)
+	}
+	if w := patch(rc, "up", 2000, other[2000:], 0, ""); w.Code != http.StatusNoContent {
+		t.Errorf("last chunk after the restart: %d %s", w.Code, w.Body)
+	}
+
+	// Also a completed upload starts over
+	if w := patch(rc, "up", 0, file[:1000], int64(len(file)), digest(file)); w.Code != http.StatusNoContent {
+		t.Fatalf("restart of a completed upload: %d %s", w.Code, w.Body)
+	}
+	send(t, rc, "up", 1000, len(file), 5000)
+}
+
+// A receiver started on the directory of a previous one resumes its
+// uploads and checks the whole file, including the part it didn't see
+func TestReceiverResumesAfterRestart(t *testing.T) {
+	rc := newReceiver(t)
+	send(t, rc, "up", 0, 6000, 2000)
+	send(t, rc, "bad", 0, 6000, 2000)
+
+	restarted, err := NewReceiver(rc.Dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, offset := head(restarted, "up"); code != http.StatusOK || offset != 6000 {
+		t.Fatalf("HEAD after the restart: %d at %d", code, offset)
+	}
+	send(t, restarted, "up", 6000, len(file), 2000)
+
+	// The digest is built from the part on disk, so damage to it while
+	// the receiver was down is found
+	f, err := os.OpenFile(rc.path("bad", ".part"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), 10)
+	f.Close()
+	w := patch(restarted, "bad", 6000, file[6000:], int64(len(file)), digest(file))
+	if w.Code != StatusChecksumMismatch {
+		t.Errorf("completing a damaged part: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReceiverFileMismatch(t *testing.T) {
+	rc := newReceiver(t)
+	other := digest([]byte("something else"))
+	if w := patch(rc, "up", 0, file[:8000], int64(len(file)), other); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: %d %s", w.Code, w.Body)
+	}
+	w := patch(rc, "up", 8000, file[8000:], 0, "")
+	if w.Code != StatusChecksumMismatch {
+		t.Errorf("last chunk of a file with another digest: %d %s", w.Code, w.Body)
+	}
+	// The upload is dropped, so the sender starts over
+	if code, _ := head(rc, "up"); code != http.StatusNotFound {
+		t.Errorf("HEAD after the mismatch: %d", code)
+	}
+}
+
+// failingWriter writes part of what it is given and fails
+type failingWriter struct {
+	io.WriteCloser
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	n, _ := w.WriteCloser.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+func TestReceiverFailedWrite(t *testing.T) {
+	rc := newReceiver(t)
+	send(t, rc, "up", 0, 4000, 2000)
+
+	open := openPart
+	openPart = func(path string) (io.WriteCloser, error) {
+		f, err := open(path)
+		return failingWriter{f}, err
+	}
+	w := patch(rc, "up", 4000, file[4000:6000], 0, "")
+	openPart = open
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed write: %d", w.Code)
+	}
+	// What made it of the chunk is cut off again
+	if n := partSize(t, rc, "up"); n != 4000 {
+		t.Errorf("part of %d bytes after a failed write at 4000", n)
+	}
+	if code, offset := head(rc, "up"); code != http.StatusOK || offset != 4000 {
+		t.Errorf("HEAD after the failed write: %d at %d", code, offset)
+	}
+	// The retried chunk goes on from there and the digest still matches
+	send(t, rc, "up", 4000, len(file), 2000)
+}
+
+func TestReceiverDelete(t *testing.T) {
+	rc := newReceiver(t)
+	send(t, rc, "up", 0, 1000, 1000)
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/transfer/up", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: %d", w.Code)
+	}
+	if code, _ := head(rc, "up"); code != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: %d", code)
+	}
+	if w := patch(rc, "up", 1000, file[1000:2000], 0, ""); w.Code != http.StatusConflict {
+		t.Errorf("chunk after DELETE: %d", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	usage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "watchdog_usage",
+			Help: "Latest watchdog sample of goroutines, open file descriptors and heap bytes",
+		},
+		[]string{"resource"},
+	)
+	limit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "watchdog_threshold",
+			Help: "Configured watchdog threshold per resource, 0 meaning none",
+		},
+		[]string{"resource"},
+	)
+	exceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "watchdog_threshold_exceeded_total",
+			Help: "Total number of times a resource went over its watchdog threshold",
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(usage)
+	prometheus.MustRegister(limit)
+	prometheus.MustRegister(exceeded)
+}
+
+// Watchdog samples resource usage every Interval. When a threshold is
+// crossed it logs a warning and, with DumpDir set, writes a goroutine
+// profile; it warns again only after usage has dropped back below.
+type Watchdog struct {
+	Interval      time.Duration
+	MaxGoroutines int
+	MaxFDs        int
+	MaxHeap       uint64
+	DumpDir       string
+
+	over map[string]bool
+}
+
+// Run samples until ctx is cancelled.
+func (w *Watchdog) Run(ctx context.Context) {
+	w.over = make(map[string]bool)
+	limit.WithLabelValues("goroutines").Set(float64(w.MaxGoroutines))
+	limit.WithLabelValues("fds").Set(float64(w.MaxFDs))
+	limit.WithLabelValues("heap_bytes").Set(float64(w.MaxHeap))
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		w.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watchdog) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	w.check("goroutines", float64(runtime.NumGoroutine()), float64(w.MaxGoroutines))
+	w.check("heap_bytes", float64(ms.HeapAlloc), float64(w.MaxHeap))
+	if n, err := openFDs(); err == nil {
+		w.check("fds", float64(n), float64(w.MaxFDs))
+	}
+}
+
+func (w *Watchdog) check(resource string, value, max float64) {
+	usage.WithLabelValues(resource).Set(value)
+	if max <= 0 || value <= max {
+		w.over[resource] = false
+		return
+	}
+	if w.over[resource] {
+		return
+	}
+	w.over[resource] = true
+	exceeded.WithLabelValues(resource).Inc()
+	log.Printf("watchdog: %s at %.0f, over the threshold of %.0f", resource, value, max)
+	if w.DumpDir != "" {
+		path, err := w.dump(resource)
+		if err != nil {
+			log.Printf("watchdog: dumping goroutines: %v", err)
+		} else {
+			log.Printf("watchdog: goroutine profile written to %s", path)
+		}
+	}
+}
+
+// dump writes the stacks of all goroutines in the text format of
+// /debug/pprof/goroutine?debug=2
+func (w *Watchdog) dump(resource string) (string, error) {
+	if err := os.MkdirAll(w.DumpDir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("watchdog-%s-%s.txt", resource, time.Now().UTC().Format("20060102T150405Z"))
+	path := filepath.Join(w.DumpDir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// openFDs counts this process's file descriptors; it needs /proc, so it
+// fails outside Linux
+func openFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,207 @@
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	register(jsonCodec{})
+	register(protobufCodec{})
+	register(cborCodec{})
+}
+
+// Names lists the supported codecs, most debuggable first.
+func Names() []string { return []string{"json", "protobuf", "cbor"} }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Marshal(m *Message) ([]byte, error) { return json.Marshal(m) }
+
+// Unmarshal replaces m, like the protobuf codec, instead of merging into it
+func (jsonCodec) Unmarshal(data []byte, m *Message) error {
+	*m = Message{}
+	return json.Unmarshal(data, m)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string                       { return "cbor" }
+func (cborCodec) Marshal(m *Message) ([]byte, error) { return cbor.Marshal(m) }
+
+func (cborCodec) Unmarshal(data []byte, m *Message) error {
+	*m = Message{}
+	return cbor.Unmarshal(data, m)
+}
+
+// protobufCodec hand-encodes the layout in message.proto with protowire,
+// so no generated code is needed for a single message type
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) Marshal(m *Message) ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Kind))
+	if m.ID != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.ID)
+	}
+	if m.From != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, m.From)
+	}
+	if m.Seq != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Seq)
+	}
+	if m.Sent != 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Sent))
+	}
+	for _, p := range m.Peers {
+		var pb []byte
+		pb = protowire.AppendTag(pb, 1, protowire.BytesType)
+		pb = protowire.AppendString(pb, p.ID)
+		pb = protowire.AppendTag(pb, 2, protowire.BytesType)
+		pb = protowire.AppendString(pb, p.Addr)
+		if p.AgeMillis != 0 {
+			pb = protowire.AppendTag(pb, 3, protowire.VarintType)
+			pb = protowire.AppendVarint(pb, p.AgeMillis)
+		}
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, pb)
+	}
+	if m.Topic != "" {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendString(b, m.Topic)
+	}
+	if len(m.Payload) > 0 {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Payload)
+	}
+	if len(m.Digests) > 0 {
+		var packed []byte
+		for _, d := range m.Digests {
+			packed = protowire.AppendVarint(packed, d)
+		}
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	return b, nil
+}
+
+var errMalformed = errors.New("protobuf: malformed message")
+
+func (protobufCodec) Unmarshal(b []byte, m *Message) error {
+	*m = Message{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return errMalformed
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				m.Kind = Kind(v)
+			case 4:
+				m.Seq = v
+			case 5:
+				m.Sent = int64(v)
+			case 9:
+				m.Digests = append(m.Digests, v)
+			}
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return errMalformed
+			}
+			b = b[n:]
+			switch num {
+			case 2:
+				m.ID = string(v)
+			case 3:
+				m.From = string(v)
+			case 6:
+				p, err := unmarshalPeer(v)
+				if err != nil {
+					return err
+				}
+				m.Peers = append(m.Peers, p)
+			case 7:
+				m.Topic = string(v)
+			case 8:
+				m.Payload = append([]byte(nil), v...)
+			case 9:
+				for len(v) > 0 {
+					d, n := protowire.ConsumeVarint(v)
+					if n < 0 {
+						return errMalformed
+					}
+					m.Digests = append(m.Digests, d)
+					v = v[n:]
+				}
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return errMalformed
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func unmarshalPeer(b []byte) (PeerInfo, error) {
+	var p PeerInfo
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return p, errMalformed
+		}
+		b = b[n:]
+		if num == 3 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return p, errMalformed
+			}
+			b = b[n:]
+			p.AgeMillis = v
+			continue
+		}
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return p, errMalformed
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return p, errMalformed
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			p.ID = string(v)
+		case 2:
+			p.Addr = string(v)
+		}
+	}
+	return p, nil
+}
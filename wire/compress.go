@@ -0,0 +1,63 @@
+package wire
+
+import (
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression compresses encoded messages.
+type Compression interface {
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var compressions = map[string]Compression{}
+
+func init() {
+	zenc, _ := zstd.NewWriter(nil)
+	zdec, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+	for _, c := range []Compression{none{}, snappyCompression{}, zstdCompression{zenc, zdec}} {
+		compressions[c.Name()] = c
+	}
+}
+
+// CompressionNames lists the supported compressions.
+func CompressionNames() []string { return []string{"zstd", "snappy", "none"} }
+
+// LookupCompression returns the compression with the given name.
+func LookupCompression(name string) (Compression, bool) {
+	c, ok := compressions[name]
+	return c, ok
+}
+
+type none struct{}
+
+func (none) Name() string                          { return "none" }
+func (none) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (none) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+type snappyCompression struct{}
+
+func (snappyCompression) Name() string                        { return "snappy" }
+func (snappyCompression) Compress(src []byte) ([]byte, error) { return snappy.Encode(nil, src), nil }
+
+func (snappyCompression) Decompress(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+type zstdCompression struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (zstdCompression) Name() string                            { return "zstd" }
+func (z zstdCompression) Compress(src []byte) ([]byte, error)   { return z.enc.EncodeAll(src, nil), nil }
+func (z zstdCompression) Decompress(src []byte) ([]byte, error) { return z.dec.DecodeAll(src, nil) }
@@ -0,0 +1,204 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxFrameSize bounds a single encoded message.
+const MaxFrameSize = 16 << 20
+
+var (
+	encodeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wire_encode_duration_seconds",
+			Help:    "Histogram of time spent serializing peer messages",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"codec"},
+	)
+	decodeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wire_decode_duration_seconds",
+			Help:    "Histogram of time spent deserializing peer messages",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"codec"},
+	)
+	messageSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wire_message_size_bytes",
+			Help:    "Histogram of serialized peer message sizes",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 10),
+		},
+		[]string{"codec", "kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(encodeDuration)
+	prometheus.MustRegister(decodeDuration)
+	prometheus.MustRegister(messageSize)
+}
+
+// Kind identifies the type of a peer message.
+type Kind uint8
+
+const (
+	KindPing Kind = iota + 1
+	KindPong
+	KindPeerList
+	KindGossip
+	KindSyncDigest
+	KindSyncEntries
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindPing:
+		return "ping"
+	case KindPong:
+		return "pong"
+	case KindPeerList:
+		return "peer_list"
+	case KindGossip:
+		return "gossip"
+	case KindSyncDigest:
+		return "sync_digest"
+	case KindSyncEntries:
+		return "sync_entries"
+	}
+	return fmt.Sprintf("kind_%d", uint8(k))
+}
+
+// PeerInfo describes a node inside a message.
+type PeerInfo struct {
+	ID   string `json:"id" cbor:"1,keyasint"`
+	Addr string `json:"addr" cbor:"2,keyasint"`
+	// AgeMillis is how long ago the sender, or the node it learned of the
+	// peer from, last had first-hand word of it
+	AgeMillis uint64 `json:"age_ms,omitempty" cbor:"3,keyasint,omitempty"`
+}
+
+// Message is the one definition of every peer message; which fields are
+// set depends on Kind. message.proto documents the protobuf layout.
+type Message struct {
+	Kind    Kind       `json:"kind" cbor:"1,keyasint"`
+	ID      string     `json:"id,omitempty" cbor:"2,keyasint,omitempty"`
+	From    string     `json:"from,omitempty" cbor:"3,keyasint,omitempty"`
+	Seq     uint64     `json:"seq,omitempty" cbor:"4,keyasint,omitempty"`
+	Sent    int64      `json:"sent,omitempty" cbor:"5,keyasint,omitempty"` // unix nanoseconds
+	Peers   []PeerInfo `json:"peers,omitempty" cbor:"6,keyasint,omitempty"`
+	Topic   string     `json:"topic,omitempty" cbor:"7,keyasint,omitempty"`
+	Payload []byte     `json:"payload,omitempty" cbor:"8,keyasint,omitempty"`
+	Digests []uint64   `json:"digests,omitempty" cbor:"9,keyasint,omitempty"`
+}
+
+// Codec serializes messages.
+type Codec interface {
+	Name() string
+	Marshal(m *Message) ([]byte, error)
+	Unmarshal(data []byte, m *Message) error
+}
+
+var codecs = map[string]Codec{}
+
+func register(c Codec) { codecs[c.Name()] = c }
+
+// Lookup returns the codec with the given name.
+func Lookup(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Negotiate returns the first entry of offered that is also supported
+// locally, or an error if there is none.
+func Negotiate(offered, supported []string) (string, error) {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return o, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("nothing in common between %v and %v", offered, supported)
+}
+
+// Encode marshals m with c, recording latency and size.
+func Encode(c Codec, m *Message) ([]byte, error) {
+	start := time.Now()
+	data, err := c.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	encodeDuration.WithLabelValues(c.Name()).Observe(time.Since(start).Seconds())
+	messageSize.WithLabelValues(c.Name(), m.Kind.String()).Observe(float64(len(data)))
+	return data, nil
+}
+
+// Decode unmarshals data with c, recording latency.
+func Decode(c Codec, data []byte, m *Message) error {
+	start := time.Now()
+	if err := c.Unmarshal(data, m); err != nil {
+		return err
+	}
+	decodeDuration.WithLabelValues(c.Name()).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// Format is the codec and compression negotiated for a connection.
+type Format struct {
+	Codec       Codec
+	Compression Compression
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes m as a length-prefixed frame and returns the encoded
+// and the compressed size of the message.
+func WriteFrame(w io.Writer, f Format, m *Message) (int, int, error) {
+	data, err := Encode(f.Codec, m)
+	if err != nil {
+		return 0, 0, err
+	}
+	raw := len(data)
+	if f.Compression != nil {
+		if data, err = f.Compression.Compress(data); err != nil {
+			return 0, 0, err
+		}
+	}
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(data)))
+	if _, err := w.Write(append(hdr[:n], data...)); err != nil {
+		return 0, 0, err
+	}
+	return raw, len(data), nil
+}
+
+// ReadFrame reads one length-prefixed frame into m and returns the encoded
+// and the compressed size of the message.
+func ReadFrame(r *bufio.Reader, f Format, m *Message) (int, int, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size > MaxFrameSize {
+		return 0, 0, errFrameTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, 0, err
+	}
+	if f.Compression != nil {
+		if data, err = f.Compression.Decompress(data); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(data), int(size), Decode(f.Codec, data, m)
+}
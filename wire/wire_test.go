@@ -0,0 +1,276 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var testMessages = map[string]*Message{
+	"kind only":     {Kind: KindPing},
+	"ping":          {Kind: KindPing, ID: "42", From: "node-a", Seq: 7, Sent: 1700000000123456789},
+	"negative sent": {Kind: KindPong, Sent: -1},
+	"peer list": {Kind: KindPeerList, From: "node-a", Peers: []PeerInfo{
+		{ID: "node-b", Addr: "10.0.0.2:8080", AgeMillis: 1500},
+		{ID: "node-c", Addr: "[::1]:8080"},
+		{ID: "", Addr: ""},
+	}},
+	"gossip":       {Kind: KindGossip, ID: "g1", Topic: "tōpic/ü", Payload: []byte{0, 1, 0xff, '\n'}},
+	"large":        {Kind: KindGossip, Payload: bytes.Repeat([]byte("p2p"), 100000)},
+	"sync digest":  {Kind: KindSyncDigest, Digests: []uint64{0, 1, 1<<63 + 5, ^uint64(0)}},
+	"unknown kind": {Kind: 200, Seq: ^uint64(0)},
+}
+
+func messageNames() []string {
+	var names []string
+	for name := range testMessages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func codecsUnderTest(t *testing.T) []Codec {
+	t.Helper()
+	var cs []Codec
+	for _, name := range Names() {
+		c, ok := Lookup(name)
+		if !ok {
+			t.Fatalf("codec %s is listed but not registered", name)
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range codecsUnderTest(t) {
+		for name, m := range testMessages {
+			data, err := Encode(c, m)
+			if err != nil {
+				t.Fatalf("%s: encoding %s: %v", c.Name(), name, err)
+			}
+			var got Message
+			if err := Decode(c, data, &got); err != nil {
+				t.Fatalf("%s: decoding %s: %v", c.Name(), name, err)
+			}
+			if !reflect.DeepEqual(&got, m) {
+				t.Errorf("%s: %s decoded to %+v, want %+v", c.Name(), name, got, *m)
+			}
+		}
+	}
+}
+
+// Unmarshal resets the message, so fields of an earlier one don't leak
+func TestUnmarshalResets(t *testing.T) {
+	for _, c := range codecsUnderTest(t) {
+		data, err := c.Marshal(&Message{Kind: KindPing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := *testMessages["peer list"]
+		m.Peers = append([]PeerInfo(nil), m.Peers...)
+		if err := c.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, Message{Kind: KindPing}) {
+			t.Errorf("%s: got %+v", c.Name(), m)
+		}
+	}
+}
+
+// Every prefix of a message is either decoded or rejected, never panics
+func TestTruncated(t *testing.T) {
+	for _, c := range codecsUnderTest(t) {
+		data, err := c.Marshal(testMessages["peer list"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			var m Message
+			c.Unmarshal(data[:n], &m)
+		}
+	}
+}
+
+func TestProtobufCompatibility(t *testing.T) {
+	var c protobufCodec
+	tag := func(b []byte, num protowire.Number, typ protowire.Type) []byte {
+		return protowire.AppendTag(b, num, typ)
+	}
+
+	// Fields of later versions are skipped
+	var b []byte
+	b = protowire.AppendVarint(tag(b, 1, protowire.VarintType), uint64(KindSyncDigest))
+	b = protowire.AppendFixed32(tag(b, 15, protowire.Fixed32Type), 1)
+	b = protowire.AppendFixed64(tag(b, 16, protowire.Fixed64Type), 2)
+	b = protowire.AppendString(tag(b, 17, protowire.BytesType), "later")
+	b = protowire.AppendVarint(tag(b, 18, protowire.VarintType), 3)
+	// Digests can be packed or not, and repeated
+	b = protowire.AppendVarint(tag(b, 9, protowire.VarintType), 10)
+	b = protowire.AppendBytes(tag(b, 9, protowire.BytesType), protowire.AppendVarint(protowire.AppendVarint(nil, 11), 12))
+	// A peer with a field of a later version
+	var pb []byte
+	pb = protowire.AppendString(tag(pb, 1, protowire.BytesType), "node-b")
+	pb = protowire.AppendFixed32(tag(pb, 4, protowire.Fixed32Type), 9)
+	pb = protowire.AppendString(tag(pb, 2, protowire.BytesType), "10.0.0.2:8080")
+	b = protowire.AppendBytes(tag(b, 6, protowire.BytesType), pb)
+	// The last of a repeated scalar wins
+	b = protowire.AppendString(tag(b, 2, protowire.BytesType), "first")
+	b = protowire.AppendString(tag(b, 2, protowire.BytesType), "second")
+
+	var m Message
+	if err := c.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	want := Message{Kind: KindSyncDigest, ID: "second", Digests: []uint64{10, 11, 12}, Peers: []PeerInfo{{ID: "node-b", Addr: "10.0.0.2:8080"}}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+}
+
+func TestProtobufMalformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"field number 0":        {0x00, 0x01},
+		"truncated tag":         {0x80},
+		"truncated varint":      {0x08, 0x80},
+		"bytes beyond the end":  {0x12, 0x05, 'a'},
+		"truncated fixed64":     {0x79, 1, 2, 3},
+		"end group":             {0x0c},
+		"truncated packed list": {0x4a, 0x01, 0x80},
+		"truncated peer":        {0x32, 0x02, 0x0a, 0x05},
+		"peer with bad varint":  {0x32, 0x02, 0x18, 0x80},
+	} {
+		var m Message
+		if err := (protobufCodec{}).Unmarshal(data, &m); !errors.Is(err, errMalformed) {
+			t.Errorf("%s: err = %v, want %v", name, err, errMalformed)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		offered, supported []string
+		want               string
+	}{
+		{[]string{"protobuf", "json"}, []string{"json", "protobuf"}, "protobuf"},
+		{[]string{"cbor"}, Names(), "cbor"},
+		{[]string{"msgpack", "json"}, Names(), "json"},
+		{[]string{"msgpack"}, Names(), ""},
+		{nil, Names(), ""},
+		{Names(), nil, ""},
+	} {
+		got, err := Negotiate(tc.offered, tc.supported)
+		if got != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("Negotiate(%v, %v) = %q, %v, want %q", tc.offered, tc.supported, got, err, tc.want)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	for _, c := range codecsUnderTest(t) {
+		for _, name := range CompressionNames() {
+			comp, ok := LookupCompression(name)
+			if !ok {
+				t.Fatalf("compression %s is listed but not registered", name)
+			}
+			f := Format{Codec: c, Compression: comp}
+			var buf bytes.Buffer
+			var sizes [][2]int
+			for _, msg := range messageNames() {
+				raw, wire, err := WriteFrame(&buf, f, testMessages[msg])
+				if err != nil {
+					t.Fatalf("%s/%s: writing %s: %v", c.Name(), name, msg, err)
+				}
+				sizes = append(sizes, [2]int{raw, wire})
+			}
+			r := bufio.NewReader(&buf)
+			for i, msg := range messageNames() {
+				var m Message
+				raw, wire, err := ReadFrame(r, f, &m)
+				if err != nil {
+					t.Fatalf("%s/%s: frame %d: %v", c.Name(), name, i, err)
+				}
+				if !reflect.DeepEqual(&m, testMessages[msg]) {
+					t.Errorf("%s/%s: %s read as %+v", c.Name(), name, msg, m)
+				}
+				if [2]int{raw, wire} != sizes[i] {
+					t.Errorf("%s/%s: frame %d read as %d/%d bytes, written as %d/%d", c.Name(), name, i, raw, wire, sizes[i][0], sizes[i][1])
+				}
+			}
+			var m Message
+			if _, _, err := ReadFrame(r, f, &m); err != io.EOF {
+				t.Errorf("%s/%s: err = %v at the end, want EOF", c.Name(), name, err)
+			}
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	jsonOnly := Format{Codec: jsonCodec{}}
+	snappyFormat := Format{Codec: jsonCodec{}, Compression: snappyCompression{}}
+	zstdFormat := Format{Codec: jsonCodec{}}
+	zstdFormat.Compression, _ = LookupCompression("zstd")
+	frame := func(body []byte) []byte {
+		return append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		f    Format
+		data []byte
+		want error
+	}{
+		{"too large", jsonOnly, binary.AppendUvarint(nil, MaxFrameSize+1), errFrameTooLarge},
+		{"truncated length", jsonOnly, []byte{0x80}, io.ErrUnexpectedEOF},
+		{"truncated body", jsonOnly, append(binary.AppendUvarint(nil, 10), "{}"...), io.ErrUnexpectedEOF},
+		{"snappy bomb", snappyFormat, frame(binary.AppendUvarint(nil, MaxFrameSize+1)), errFrameTooLarge},
+		{"corrupt snappy", snappyFormat, frame([]byte{0x05, 0xff, 0xff}), nil},
+		{"corrupt zstd", zstdFormat, frame([]byte("not zstd")), nil},
+		{"malformed JSON", jsonOnly, frame([]byte(`{"kind":`)), nil},
+	} {
+		var m Message
+		_, _, err := ReadFrame(bufio.NewReader(bytes.NewReader(tc.data)), tc.f, &m)
+		switch {
+		case err == nil:
+			t.Errorf("%s: no error", tc.name)
+		case tc.want != nil && !errors.Is(err, tc.want):
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestKindString(t *testing.T) {
+	for k, want := range map[Kind]string{KindPing: "ping", KindSyncEntries: "sync_entries", 0: "kind_0", 99: "kind_99"} {
+		if got := k.String(); got != want {
+			t.Errorf("Kind(%d) = %q, want %q", uint8(k), got, want)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, name := range CompressionNames() {
+		c, _ := LookupCompression(name)
+		for _, src := range [][]byte{{}, []byte("x"), []byte(strings.Repeat("compressible ", 10000))} {
+			packed, err := c.Compress(src)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := c.Decompress(packed)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, src) {
+				t.Errorf("%s: %d bytes came back as %d", name, len(src), len(got))
+			}
+		}
+	}
+}